@@ -7,15 +7,24 @@ import (
 	"net"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strings"
 	"syscall"
 	"time"
 
 	"jabberwocky238/jw238dns/dns"
 	jwhttp "jabberwocky238/jw238dns/http"
+	"jabberwocky238/jw238dns/metrics"
+	"jabberwocky238/jw238dns/querylog"
 	"jabberwocky238/jw238dns/storage"
+	"jabberwocky238/jw238dns/tracing"
+	"jabberwocky238/jw238dns/tsig"
 
 	mdns "github.com/miekg/dns"
+	"go.etcd.io/etcd/client/pkg/v3/transport"
+	clientv3 "go.etcd.io/etcd/client/v3"
 	"gopkg.in/yaml.v3"
+	"k8s.io/client-go/dynamic"
 )
 
 func main() {
@@ -26,12 +35,30 @@ func main() {
 			os.Exit(0)
 		case "serve":
 			// Continue to serve
+		case "migrate":
+			if err := runMigrate(); err != nil {
+				fmt.Fprintf(os.Stderr, "migrate: %v\n", err)
+				os.Exit(1)
+			}
+			return
+		case "snapshot":
+			if err := runSnapshot(os.Args[2:]); err != nil {
+				fmt.Fprintf(os.Stderr, "snapshot: %v\n", err)
+				os.Exit(1)
+			}
+			return
+		case "restore":
+			if err := runRestore(os.Args[2:]); err != nil {
+				fmt.Fprintf(os.Stderr, "restore: %v\n", err)
+				os.Exit(1)
+			}
+			return
 		case "version":
 			fmt.Println("jw238dns v1.0.0")
 			return
 		default:
 			fmt.Printf("Unknown command: %s\n", os.Args[1])
-			fmt.Println("Available commands: serve, healthcheck, version")
+			fmt.Println("Available commands: serve, migrate, snapshot, restore, healthcheck, version")
 			os.Exit(1)
 		}
 	}
@@ -45,12 +72,7 @@ func main() {
 	slog.Info("Starting jw238dns server")
 
 	// Load configuration
-	configPath := os.Getenv("CONFIG_PATH")
-	if configPath == "" {
-		configPath = "/app/config/app.yaml"
-	}
-
-	config, err := loadConfig(configPath)
+	config, err := loadConfig(configPath())
 	if err != nil {
 		slog.Error("Failed to load configuration", "error", err)
 		os.Exit(1)
@@ -62,55 +84,302 @@ func main() {
 		os.Exit(1)
 	}
 
+	// Initialize tracing (no-op unless an exporter is configured)
+	shutdownTracing, err := tracing.Setup(context.Background(), tracing.Config{
+		Exporter:    config.Tracing.Exporter,
+		Endpoint:    config.Tracing.Endpoint,
+		Insecure:    config.Tracing.Insecure,
+		SampleRatio: config.Tracing.SampleRatio,
+		ServiceName: config.Tracing.ServiceName,
+	})
+	if err != nil {
+		slog.Error("Failed to initialize tracing", "error", err)
+		os.Exit(1)
+	}
+	defer func() {
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := shutdownTracing(shutdownCtx); err != nil {
+			slog.Error("Tracing shutdown error", "error", err)
+		}
+	}()
+
 	// Initialize storage
 	store := storage.NewMemoryStorage()
+	metrics.Registry.MustRegister(metrics.NewStorageCollector(store))
+
+	// writeStore receives changes made through the HTTP API and dynamic
+	// updates. It is the in-memory store unless the storage backend is the
+	// source of truth shared with other replicas.
+	var writeStore storage.CoreStorage = store
+
+	// Record every change to the records, before they are loaded so a
+	// restart records only what changed while the process was down.
+	var history *storage.History
+	if config.Storage.History.Enabled {
+		h, err := config.Storage.History.open()
+		if err != nil {
+			slog.Error("Failed to open history", "error", err)
+			os.Exit(1)
+		}
+		defer h.Close()
+		store.SetHistory(h)
+		history = h
+		slog.Info("Change history enabled", "backend", config.Storage.History.Backend, "version", h.Version())
+	}
 
 	// Create context for background tasks
 	ctx, cancel := context.WithCancel(context.Background())
 
+	// Closed once file or bolt storage has flushed its last write; nil
+	// otherwise.
+	var persisted chan struct{}
+
 	// Load initial records based on storage type
 	if config.Storage.Type == "file" {
 		loader := storage.NewJSONFileLoader(config.Storage.File.Path, store)
-		records, err := loader.Load()
-		if err != nil {
-			slog.Warn("Failed to load initial records", "error", err)
-		} else {
-			for _, record := range records {
-				if err := store.Create(ctx, record); err != nil {
-					slog.Warn("Failed to create record", "name", record.Name, "error", err)
-				}
-			}
-			slog.Info("Loaded initial records", "count", len(records))
+		if err := loader.LoadAndApply(ctx); err != nil {
+			slog.Error("Failed to load records file", "path", config.Storage.File.Path, "error", err)
+			os.Exit(1)
 		}
+
+		// Apply file edits to the store and persist API changes back to
+		// the file; the final write happens after ctx is cancelled.
+		persisted = make(chan struct{})
+		go func() {
+			defer close(persisted)
+			if err := loader.WatchAndSync(ctx); err != nil && ctx.Err() == nil {
+				slog.Error("Records file sync failed", "error", err)
+			}
+		}()
+
+		slog.Info("File storage initialized", "path", config.Storage.File.Path)
 	} else if config.Storage.Type == "configmap" {
 		// Initialize Kubernetes client for ConfigMap storage
-		k8sClient, err := storage.NewK8sClient()
+		k8sClient, err := storage.NewK8sClient(config.Storage.ConfigMap.clientConfig())
 		if err != nil {
 			slog.Error("Failed to create Kubernetes client", "error", err)
 			os.Exit(1)
 		}
 
-		// Create ConfigMap watcher
-		watcher := storage.NewConfigMapWatcher(
-			k8sClient,
-			config.Storage.ConfigMap.Namespace,
-			config.Storage.ConfigMap.Name,
-			config.Storage.ConfigMap.DataKey,
-			store,
-		)
+		// Create ConfigMap watcher: one ConfigMap, or every ConfigMap
+		// matching the shard selector.
+		cmConfig := config.Storage.ConfigMap
+		var watcher configMapSyncer
+		leaseBase := cmConfig.Name
+		if cmConfig.ShardSelector != "" {
+			watcher = storage.NewShardedConfigMapWatcher(k8sClient, cmConfig.Namespace, cmConfig.ShardSelector, cmConfig.DataKey, store)
+			if leaseBase == "" {
+				leaseBase = "jw238dns-records"
+			}
+		} else {
+			watcher = storage.NewConfigMapWatcher(k8sClient, cmConfig.Namespace, cmConfig.Name, cmConfig.DataKey, store)
+		}
+
+		// With leader election only the leader writes the ConfigMap, so
+		// followers reject API writes rather than lose them.
+		if le := cmConfig.LeaderElection; le.Enabled {
+			electionConfig, err := le.electionConfig(leaseBase)
+			if err != nil {
+				slog.Error("Invalid configmap leader election configuration", "error", err)
+				os.Exit(1)
+			}
+			watcher.EnableLeaderElection(electionConfig)
+			writeStore = storage.NewLeaderOnlyStorage(store, watcher.CheckLeader)
+			slog.Info("ConfigMap leader election enabled", "lease", electionConfig.LeaseName, "identity", electionConfig.Identity)
+		}
 
 		// Start watching ConfigMap in background
 		go func() {
 			slog.Info("Starting ConfigMap watcher",
-				"namespace", config.Storage.ConfigMap.Namespace,
-				"name", config.Storage.ConfigMap.Name,
-				"key", config.Storage.ConfigMap.DataKey)
+				"namespace", cmConfig.Namespace,
+				"name", cmConfig.Name,
+				"shard_selector", cmConfig.ShardSelector,
+				"key", cmConfig.DataKey)
 			if err := watcher.WatchAndSync(ctx); err != nil {
 				slog.Error("ConfigMap watcher failed", "error", err)
 			}
 		}()
 
 		slog.Info("ConfigMap storage initialized")
+	} else if config.Storage.Type == "crd" {
+		client, err := storage.NewK8sDynamicClient(config.Storage.ConfigMap.clientConfig())
+		if err != nil {
+			slog.Error("Failed to create Kubernetes client", "error", err)
+			os.Exit(1)
+		}
+		crdStore := storage.NewCRDStorage(client, config.Storage.CRD.Namespace, config.Storage.CRD.WriteNamespace, store)
+		if err := crdStore.Start(ctx); err != nil {
+			slog.Error("Failed to load DNSRecord objects", "error", err)
+			os.Exit(1)
+		}
+
+		// Writes create, update or delete DNSRecord objects, which reach
+		// the store through the informer like kubectl changes.
+		writeStore = crdStore
+
+		slog.Info("CRD storage initialized", "namespace", config.Storage.CRD.Namespace)
+	} else if config.Storage.Type == "zonefile" {
+		var zones []dns.ZoneFile
+		for _, z := range config.Storage.ZoneFile.Zones {
+			zones = append(zones, dns.ZoneFile{Path: z.Path, Origin: z.Origin})
+		}
+		loader := dns.NewZoneFileLoader(zones, store)
+		if err := loader.LoadAndApply(ctx); err != nil {
+			slog.Error("Failed to load zone files", "error", err)
+			os.Exit(1)
+		}
+
+		// Reload zone files in background whenever they change.
+		go func() {
+			if err := loader.Watch(ctx); err != nil && ctx.Err() == nil {
+				slog.Error("Zone file watcher failed", "error", err)
+			}
+		}()
+
+		slog.Info("Zone file storage initialized", "zones", len(zones))
+	} else if config.Storage.Type == "bolt" {
+		db, err := storage.OpenBoltStorage(config.Storage.Bolt.Path, config.Storage.Bolt.JournalSize)
+		if err != nil {
+			slog.Error("Failed to open bolt database", "error", err)
+			os.Exit(1)
+		}
+		records, err := db.List(ctx)
+		if err == nil {
+			err = store.HotReload(ctx, records)
+		}
+		if err != nil {
+			slog.Error("Failed to load records from bolt database", "error", err)
+			os.Exit(1)
+		}
+
+		// Write every change to the database; the database is closed
+		// after the final write on shutdown.
+		persisted = make(chan struct{})
+		go func() {
+			defer close(persisted)
+			defer db.Close()
+			if err := db.SyncFrom(ctx, store); err != nil {
+				slog.Error("Bolt database sync failed", "error", err)
+			}
+		}()
+
+		slog.Info("Bolt storage initialized", "path", config.Storage.Bolt.Path, "records", len(records))
+	} else if config.Storage.Type == "sql" {
+		sqlConfig, err := config.Storage.SQL.storageConfig()
+		if err != nil {
+			slog.Error("Invalid sql storage configuration", "error", err)
+			os.Exit(1)
+		}
+		db, err := storage.OpenSQLStorage(ctx, sqlConfig)
+		if err != nil {
+			slog.Error("Failed to open sql database", "error", err)
+			os.Exit(1)
+		}
+		defer db.Close()
+		version, err := db.LoadInto(ctx, store)
+		if err != nil {
+			slog.Error("Failed to load records from sql database", "error", err)
+			os.Exit(1)
+		}
+
+		// Writes go to the database; every replica, this one included,
+		// picks them up from the change log.
+		writeStore = db
+		go db.SyncTo(ctx, store, version)
+
+		slog.Info("SQL storage initialized", "driver", sqlConfig.Driver, "version", version)
+	} else if config.Storage.Type == "etcd" {
+		client, err := newEtcdClient(config.Storage.Etcd)
+		if err != nil {
+			slog.Error("Failed to create etcd client", "error", err)
+			os.Exit(1)
+		}
+		defer client.Close()
+		etcdStore := storage.NewEtcdStorage(client, config.Storage.Etcd.Prefix, config.Storage.Etcd.MaxTxnOps)
+		revision, err := etcdStore.LoadInto(ctx, store)
+		if err != nil {
+			slog.Error("Failed to load records from etcd", "error", err)
+			os.Exit(1)
+		}
+
+		// Writes go to etcd; every replica, this one included, picks them
+		// up from its watch.
+		writeStore = etcdStore
+		go etcdStore.SyncTo(ctx, store, revision)
+
+		slog.Info("Etcd storage initialized", "endpoints", config.Storage.Etcd.Endpoints, "revision", revision)
+	}
+
+	// Writes through a backend reach the store later, without the actor
+	// of the request; carry it over to the history entries.
+	if history != nil {
+		writeStore = history.Attributed(writeStore)
+	}
+
+	// Delete records whose expiry has passed. Deletions go through
+	// writeStore, so only the leader deletes and the removal is persisted.
+	expiryInterval := storage.DefaultExpiryInterval
+	if v := config.Storage.ExpiryInterval; v != "" {
+		if d, err := time.ParseDuration(v); err != nil {
+			slog.Warn("Invalid expiry interval, using default", "value", v, "error", err)
+		} else {
+			expiryInterval = d
+		}
+	}
+	go func() {
+		if err := storage.NewExpiryJanitor(writeStore, expiryInterval).Run(ctx); err != nil && ctx.Err() == nil {
+			slog.Error("Expiry janitor failed", "error", err)
+		}
+	}()
+
+	// Publish records for annotated Services, Ingresses and Gateways.
+	if config.Storage.Discovery.Enabled {
+		if err := startDiscovery(ctx, config.Storage.Discovery, config.Storage.ConfigMap.clientConfig(), store); err != nil {
+			slog.Error("Failed to start Kubernetes discovery", "error", err)
+			os.Exit(1)
+		}
+		slog.Info("Kubernetes discovery enabled", "namespace", config.Storage.Discovery.Namespace, "gateways", config.Storage.Discovery.Gateways)
+	}
+
+	// TSIG keys authenticate zone transfers, NOTIFY, dynamic updates and
+	// signed upstream queries. The keyring is always installed on the
+	// servers so that signed requests are verified even with no keys.
+	keyring, err := newKeyring(ctx, config.DNS.TSIG, config.Storage.ConfigMap.clientConfig())
+	if err != nil {
+		slog.Error("Failed to load TSIG keys", "error", err)
+		os.Exit(1)
+	}
+
+	// Pull secondary zones from external primaries if configured.
+	var secondary *dns.Secondary
+	if len(config.Storage.Secondary.Zones) > 0 {
+		secondaryConfig := dns.DefaultSecondaryConfig()
+		secondaryConfig.Keyring = keyring
+		for _, z := range config.Storage.Secondary.Zones {
+			secondaryConfig.Zones = append(secondaryConfig.Zones, dns.SecondaryZone{
+				Name:      z.Name,
+				Primaries: z.Primaries,
+				TSIGKey:   z.TSIGKey,
+			})
+		}
+		if v := config.Storage.Secondary.Refresh; v != "" {
+			if d, err := time.ParseDuration(v); err != nil {
+				slog.Warn("Invalid secondary refresh interval, using SOA refresh", "value", v, "error", err)
+			} else {
+				secondaryConfig.Refresh = d
+			}
+		}
+		if v := config.Storage.Secondary.Timeout; v != "" {
+			if d, err := time.ParseDuration(v); err != nil {
+				slog.Warn("Invalid secondary timeout, using default", "value", v, "error", err)
+			} else {
+				secondaryConfig.Timeout = d
+			}
+		}
+		secondary = dns.NewSecondary(store, secondaryConfig)
+		go secondary.Run(ctx)
+		slog.Info("Secondary zones enabled", "zones", len(secondaryConfig.Zones))
 	}
 
 	// Initialize DNS backend with config
@@ -137,9 +406,12 @@ func main() {
 				backendConfig.Forwarder.Timeout = d
 			}
 		}
+		backendConfig.Forwarder.TSIGKey = config.DNS.Upstream.TSIGKey
+		backendConfig.Forwarder.Keyring = keyring
 		slog.Info("Upstream DNS forwarding enabled",
 			"servers", backendConfig.Forwarder.Servers,
 			"timeout", backendConfig.Forwarder.Timeout,
+			"tsig_key", backendConfig.Forwarder.TSIGKey,
 		)
 	}
 
@@ -147,17 +419,128 @@ func main() {
 	defer backend.Close()
 	frontend := dns.NewFrontend(backend)
 
+	// Enable per-query logging if configured.
+	if config.DNS.QueryLog.Enabled {
+		qlCfg := querylog.DefaultConfig()
+		qlCfg.Output = config.DNS.QueryLog.Output
+		if config.DNS.QueryLog.Format != "" {
+			qlCfg.Format = config.DNS.QueryLog.Format
+		}
+		if config.DNS.QueryLog.SampleRate > 0 {
+			qlCfg.SampleRate = config.DNS.QueryLog.SampleRate
+		}
+		if config.DNS.QueryLog.BufferSize > 0 {
+			qlCfg.BufferSize = config.DNS.QueryLog.BufferSize
+		}
+		queryLog, err := querylog.New(qlCfg)
+		if err != nil {
+			slog.Error("Failed to open query log", "error", err)
+			os.Exit(1)
+		}
+		defer queryLog.Close()
+		frontend.SetQueryLogger(queryLog)
+		slog.Info("Query logging enabled",
+			"format", qlCfg.Format,
+			"output", qlCfg.Output,
+			"sample_rate", qlCfg.SampleRate,
+		)
+	}
+
 	// Create DNS handler
-	dnsHandler := &DNSHandler{frontend: frontend}
+	dnsHandler := &DNSHandler{frontend: frontend, secondary: secondary}
+
+	// Enable outgoing zone transfers if configured. The journal tracks zone
+	// serials and history; SOA answers use the same serials.
+	if config.DNS.Transfer.Enabled {
+		journal := storage.NewJournal(store, config.DNS.Transfer.JournalSize)
+		if path := config.DNS.Transfer.SerialFile; path != "" {
+			if err := journal.SetSerialFile(path); err != nil {
+				slog.Error("Failed to open zone serial file", "error", err)
+				os.Exit(1)
+			}
+		}
+		go func() {
+			if err := journal.Run(ctx); err != nil && ctx.Err() == nil {
+				slog.Error("Zone journal failed", "error", err)
+			}
+		}()
+		transferer, err := dns.NewTransferer(journal, dns.TransferConfig{
+			Enabled:     true,
+			AllowFrom:   config.DNS.Transfer.AllowFrom,
+			RequireTSIG: config.DNS.Transfer.RequireTSIG,
+		})
+		if err != nil {
+			slog.Error("Invalid zone transfer configuration", "error", err)
+			os.Exit(1)
+		}
+		frontend.SetZoneSerials(journal)
+		dnsHandler.transfer = transferer
 
-	// Start DNS servers
+		if len(config.DNS.Transfer.Notify.Secondaries) > 0 {
+			notifyConfig := dns.DefaultNotifyConfig()
+			notifyConfig.Secondaries = config.DNS.Transfer.Notify.Secondaries
+			notifyConfig.TSIGKey = config.DNS.Transfer.Notify.TSIGKey
+			notifyConfig.Keyring = keyring
+			if config.DNS.Transfer.Notify.Retries > 0 {
+				notifyConfig.Retries = config.DNS.Transfer.Notify.Retries
+			}
+			if v := config.DNS.Transfer.Notify.Timeout; v != "" {
+				if d, err := time.ParseDuration(v); err != nil {
+					slog.Warn("Invalid NOTIFY timeout, using default", "value", v, "error", err)
+				} else {
+					notifyConfig.Timeout = d
+				}
+			}
+			if v := config.DNS.Transfer.Notify.RetryInterval; v != "" {
+				if d, err := time.ParseDuration(v); err != nil {
+					slog.Warn("Invalid NOTIFY retry interval, using default", "value", v, "error", err)
+				} else {
+					notifyConfig.RetryInterval = d
+				}
+			}
+			go dns.NewNotifier(journal, notifyConfig).Run(ctx)
+			slog.Info("NOTIFY enabled",
+				"secondaries", notifyConfig.Secondaries,
+				"retries", notifyConfig.Retries,
+				"retry_interval", notifyConfig.RetryInterval,
+			)
+		}
+
+		slog.Info("Zone transfers enabled",
+			"allow_from", config.DNS.Transfer.AllowFrom,
+			"require_tsig", config.DNS.Transfer.RequireTSIG,
+		)
+	}
+
+	// Accept RFC 2136 dynamic updates if configured. Updates must be
+	// TSIG-signed with one of the configured keys.
+	var acceptMsg mdns.MsgAcceptFunc
+	if config.DNS.Update.Enabled {
+		updater, err := dns.NewUpdater(writeStore, dns.UpdateConfig{
+			Enabled:   true,
+			AllowFrom: config.DNS.Update.AllowFrom,
+		})
+		if err != nil {
+			slog.Error("Invalid dynamic update configuration", "error", err)
+			os.Exit(1)
+		}
+		dnsHandler.update = updater
+		acceptMsg = dns.AcceptMsg
+		slog.Info("Dynamic updates enabled", "allow_from", config.DNS.Update.AllowFrom)
+	}
+
+	// Start DNS servers. The servers taking writes are stopped with
+	// shutdown before the storage is written for the last time.
 	defer cancel()
+	var shutdown []func()
 
 	if config.DNS.UDPEnabled {
 		udpServer := &mdns.Server{
-			Addr:    config.DNS.Listen,
-			Net:     "udp",
-			Handler: dnsHandler,
+			Addr:          config.DNS.Listen,
+			Net:           "udp",
+			Handler:       dnsHandler,
+			TsigProvider:  keyring,
+			MsgAcceptFunc: acceptMsg,
 		}
 		go func() {
 			slog.Info("DNS UDP server starting", "address", config.DNS.Listen)
@@ -165,14 +548,16 @@ func main() {
 				slog.Error("DNS UDP server failed", "error", err)
 			}
 		}()
-		defer udpServer.Shutdown()
+		shutdown = append(shutdown, func() { udpServer.Shutdown() })
 	}
 
 	if config.DNS.TCPEnabled {
 		tcpServer := &mdns.Server{
-			Addr:    config.DNS.Listen,
-			Net:     "tcp",
-			Handler: dnsHandler,
+			Addr:          config.DNS.Listen,
+			Net:           "tcp",
+			Handler:       dnsHandler,
+			TsigProvider:  keyring,
+			MsgAcceptFunc: acceptMsg,
 		}
 		go func() {
 			slog.Info("DNS TCP server starting", "address", config.DNS.Listen)
@@ -180,7 +565,7 @@ func main() {
 				slog.Error("DNS TCP server failed", "error", err)
 			}
 		}()
-		defer tcpServer.Shutdown()
+		shutdown = append(shutdown, func() { tcpServer.Shutdown() })
 	}
 
 	// Start HTTP management server if enabled.
@@ -192,13 +577,15 @@ func main() {
 		httpSrv := jwhttp.NewServer(jwhttp.ServerConfig{
 			Listen:    config.HTTP.Listen,
 			AuthToken: authToken,
-		}, store)
+			History:   history,
+			Events:    store,
+		}, writeStore)
 		go func() {
 			if err := httpSrv.Start(); err != nil {
 				slog.Error("HTTP management server failed", "error", err)
 			}
 		}()
-		defer httpSrv.Shutdown()
+		shutdown = append(shutdown, httpSrv.Shutdown)
 	}
 
 	// Wait for interrupt signal
@@ -208,26 +595,61 @@ func main() {
 	<-sigCh
 	slog.Info("Shutting down server...")
 
+	// Stop taking writes before the final flush, so none is lost.
+	for _, stop := range shutdown {
+		stop()
+	}
 	cancel()
+	if persisted != nil {
+		select {
+		case <-persisted:
+		case <-time.After(5 * time.Second):
+			slog.Warn("Timed out waiting for storage to be written")
+		}
+	}
 	slog.Info("Server stopped")
 }
 
 // DNSHandler implements dns.Handler interface
 type DNSHandler struct {
-	frontend *dns.Frontend
+	frontend  *dns.Frontend
+	transfer  *dns.Transferer // nil when zone transfers are disabled
+	secondary *dns.Secondary  // nil when no secondary zones are configured
+	update    *dns.Updater    // nil when dynamic updates are disabled
 }
 
 func (h *DNSHandler) ServeDNS(w mdns.ResponseWriter, r *mdns.Msg) {
-	// Extract client IP
+	// Zone transfers stream multiple messages and bypass the frontend.
+	if h.transfer != nil && dns.IsTransfer(r) {
+		h.transfer.ServeTransfer(w, r)
+		return
+	}
+	// Dynamic updates modify storage directly.
+	if h.update != nil && dns.IsUpdate(r) {
+		h.update.ServeUpdate(w, r)
+		return
+	}
+
+	// NOTIFY from a primary triggers a refresh of the secondary zone.
+	if h.secondary != nil && dns.IsNotify(r) {
+		h.secondary.HandleNotify(w, r)
+		return
+	}
+
+	// Extract client IP and transport
 	var clientIP net.IP
+	transport := "unknown"
 	if addr, ok := w.RemoteAddr().(*net.UDPAddr); ok {
 		clientIP = addr.IP
+		transport = "udp"
 	} else if addr, ok := w.RemoteAddr().(*net.TCPAddr); ok {
 		clientIP = addr.IP
+		transport = "tcp"
 	}
 
-	// Create context with client IP
+	// Create context with client IP and transport
 	ctx := dns.ContextWithClientIP(context.Background(), clientIP)
+	ctx = dns.ContextWithTransport(ctx, transport)
 
 	// Process query
 	resp, err := h.frontend.ReceiveQuery(ctx, r)
@@ -243,6 +665,90 @@ func (h *DNSHandler) ServeDNS(w mdns.ResponseWriter, r *mdns.Msg) {
 	}
 }
 
+// startDiscovery starts publishing records for the Kubernetes objects
+// selected by cfg into store.
+func startDiscovery(ctx context.Context, cfg DiscoveryConfig, clientConfig storage.K8sClientConfig, store *storage.MemoryStorage) error {
+	client, err := storage.NewK8sClient(clientConfig)
+	if err != nil {
+		return err
+	}
+	var dyn dynamic.Interface
+	if cfg.Gateways {
+		if dyn, err = storage.NewK8sDynamicClient(clientConfig); err != nil {
+			return err
+		}
+	}
+	return storage.NewKubernetesDiscovery(client, dyn, cfg.Namespace, cfg.TTL, store).Start(ctx)
+}
+
+// newEtcdClient connects to the etcd cluster described by cfg.
+func newEtcdClient(cfg EtcdStorageConfig) (*clientv3.Client, error) {
+	if len(cfg.Endpoints) == 0 {
+		return nil, fmt.Errorf("no etcd endpoints configured")
+	}
+	clientConfig := clientv3.Config{
+		Endpoints:   cfg.Endpoints,
+		DialTimeout: 5 * time.Second,
+		Username:    cfg.Username,
+	}
+	if cfg.DialTimeout != "" {
+		d, err := time.ParseDuration(cfg.DialTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("invalid dial_timeout: %w", err)
+		}
+		clientConfig.DialTimeout = d
+	}
+	if cfg.PasswordEnv != "" {
+		clientConfig.Password = os.Getenv(cfg.PasswordEnv)
+		if clientConfig.Password == "" {
+			return nil, fmt.Errorf("environment variable %s is not set or empty", cfg.PasswordEnv)
+		}
+	}
+	if cfg.CAFile != "" || cfg.CertFile != "" {
+		tlsInfo := transport.TLSInfo{TrustedCAFile: cfg.CAFile, CertFile: cfg.CertFile, KeyFile: cfg.KeyFile}
+		tlsConfig, err := tlsInfo.ClientConfig()
+		if err != nil {
+			return nil, fmt.Errorf("etcd TLS: %w", err)
+		}
+		clientConfig.TLS = tlsConfig
+	}
+	return clientv3.New(clientConfig)
+}
+
+// configPath returns the configuration file path, from CONFIG_PATH if set.
+func configPath() string {
+	if path := os.Getenv("CONFIG_PATH"); path != "" {
+		return path
+	}
+	return "/app/config/app.yaml"
+}
+
+// runMigrate applies pending schema migrations to the configured SQL
+// database.
+func runMigrate() error {
+	config, err := loadConfig(configPath())
+	if err != nil {
+		return err
+	}
+	if config.Storage.Type != "sql" {
+		return fmt.Errorf("storage type is %q; migrations only apply to sql storage", config.Storage.Type)
+	}
+	sqlConfig, err := config.Storage.SQL.storageConfig()
+	if err != nil {
+		return err
+	}
+	from, to, err := storage.MigrateSQL(context.Background(), sqlConfig.Driver, sqlConfig.DSN)
+	if err != nil {
+		return err
+	}
+	if from == to {
+		fmt.Printf("Schema is up to date (version %d)\n", to)
+	} else {
+		fmt.Printf("Migrated schema from version %d to %d\n", from, to)
+	}
+	return nil
+}
+
 func loadConfig(path string) (*Config, error) {
 	data, err := os.ReadFile(path)
 	if err != nil {
@@ -257,6 +763,48 @@ func loadConfig(path string) (*Config, error) {
 	return &config, nil
 }
 
+// newKeyring builds the TSIG keyring from the configured keys and, when
+// configured, a Kubernetes Secret that is watched for key rotation.
+func newKeyring(ctx context.Context, cfg TSIGConfig, clientConfig storage.K8sClientConfig) (*tsig.Keyring, error) {
+	keyring := tsig.NewKeyring(cfg.Fudge)
+
+	keys := make([]tsig.Key, 0, len(cfg.Keys))
+	for _, k := range cfg.Keys {
+		secret := k.Secret
+		if k.SecretEnv != "" {
+			secret = os.Getenv(k.SecretEnv)
+			if secret == "" {
+				return nil, fmt.Errorf("TSIG key %s: environment variable %s is not set or empty", k.Name, k.SecretEnv)
+			}
+		}
+		keys = append(keys, tsig.Key{Name: k.Name, Algorithm: k.Algorithm, Secret: secret})
+	}
+	if err := keyring.Set("config", keys); err != nil {
+		return nil, err
+	}
+
+	if ks := cfg.KubernetesSecret; ks.Name != "" {
+		client, err := storage.NewK8sClient(clientConfig)
+		if err != nil {
+			return nil, fmt.Errorf("create kubernetes client: %w", err)
+		}
+		watcher := tsig.NewSecretWatcher(client, ks.Namespace, ks.Name, ks.DataKey, keyring)
+		if err := watcher.Load(ctx); err != nil {
+			return nil, err
+		}
+		go func() {
+			if err := watcher.Watch(ctx); err != nil && ctx.Err() == nil {
+				slog.Error("TSIG secret watcher failed", "error", err)
+			}
+		}()
+	}
+
+	if names := keyring.Names(); len(names) > 0 {
+		slog.Info("TSIG keys loaded", "keys", names)
+	}
+	return keyring, nil
+}
+
 // validateConfig validates the configuration and checks required environment variables
 func validateConfig(config *Config) error {
 	// Validate HTTP authentication
@@ -271,6 +819,10 @@ func validateConfig(config *Config) error {
 		slog.Info("HTTP authentication validated", "token_env", config.HTTP.Auth.TokenEnv)
 	}
 
+	if h := config.Storage.History; h.Enabled && h.Backend == "file" && h.Path == "" {
+		return fmt.Errorf("file history is enabled but path is not configured")
+	}
+
 	return nil
 }
 
@@ -280,6 +832,7 @@ type Config struct {
 	GeoIP   GeoIPConfig   `yaml:"geoip"`
 	Storage StorageConfig `yaml:"storage"`
 	HTTP    HTTPConfig    `yaml:"http"`
+	Tracing TracingConfig `yaml:"tracing"`
 }
 
 type DNSConfig struct {
@@ -287,6 +840,59 @@ type DNSConfig struct {
 	TCPEnabled bool           `yaml:"tcp_enabled"`
 	UDPEnabled bool           `yaml:"udp_enabled"`
 	Upstream   UpstreamConfig `yaml:"upstream"`
+	QueryLog   QueryLogConfig `yaml:"query_log"`
+	Transfer   TransferConfig `yaml:"transfer"`
+	Update     UpdateConfig   `yaml:"update"`
+	TSIG       TSIGConfig     `yaml:"tsig"`
+}
+
+// UpdateConfig controls RFC 2136 dynamic updates.
+type UpdateConfig struct {
+	Enabled   bool     `yaml:"enabled"`
+	AllowFrom []string `yaml:"allow_from"` // IPs/CIDRs allowed to update; empty allows any
+}
+
+// TransferConfig controls outgoing zone transfers (AXFR/IXFR) to secondaries.
+type TransferConfig struct {
+	Enabled     bool         `yaml:"enabled"`
+	AllowFrom   []string     `yaml:"allow_from"`   // IPs/CIDRs allowed to transfer
+	RequireTSIG bool         `yaml:"require_tsig"` // Reject unsigned transfer requests
+	JournalSize int          `yaml:"journal_size"` // IXFR history entries kept per zone
+	SerialFile  string       `yaml:"serial_file"`  // Keeps serials increasing across restarts
+	Notify      NotifyConfig `yaml:"notify"`
+}
+
+// NotifyConfig controls NOTIFY messages sent to secondaries on zone changes.
+type NotifyConfig struct {
+	Secondaries   []string `yaml:"secondaries"`    // host:port of each secondary
+	TSIGKey       string   `yaml:"tsig_key"`       // Key signing NOTIFY messages
+	Timeout       string   `yaml:"timeout"`        // Wait for a response, default 5s
+	Retries       int      `yaml:"retries"`        // Retransmissions, default 5
+	RetryInterval string   `yaml:"retry_interval"` // First retransmission delay, default 60s
+}
+
+// TSIGConfig holds the TSIG keyring: keys from the config file or the
+// environment, plus an optional Kubernetes Secret watched for rotation.
+type TSIGConfig struct {
+	Fudge            uint16           `yaml:"fudge"` // Allowed clock skew in seconds, default 300
+	Keys             []TSIGKeyConfig  `yaml:"keys"`
+	KubernetesSecret TSIGSecretConfig `yaml:"kubernetes_secret"`
+}
+
+// TSIGKeyConfig is a named TSIG shared secret. The base64 secret is given
+// inline or read from the environment variable named by SecretEnv.
+type TSIGKeyConfig struct {
+	Name      string `yaml:"name"`
+	Algorithm string `yaml:"algorithm"` // "hmac-sha256" (default) or "hmac-sha512"
+	Secret    string `yaml:"secret"`
+	SecretEnv string `yaml:"secret_env"` // Env var holding the secret
+}
+
+// TSIGSecretConfig names a Kubernetes Secret holding TSIG keys.
+type TSIGSecretConfig struct {
+	Namespace string `yaml:"namespace"`
+	Name      string `yaml:"name"`
+	DataKey   string `yaml:"data_key"` // Default "keys.yaml"
 }
 
 // UpstreamConfig controls forwarding of unresolved queries to upstream DNS servers.
@@ -294,6 +900,16 @@ type UpstreamConfig struct {
 	Enabled bool     `yaml:"enabled"`
 	Servers []string `yaml:"servers"`
 	Timeout string   `yaml:"timeout"`
+	TSIGKey string   `yaml:"tsig_key"` // Key signing upstream queries
+}
+
+// QueryLogConfig controls sampled per-query logging.
+type QueryLogConfig struct {
+	Enabled    bool    `yaml:"enabled"`
+	Format     string  `yaml:"format"`      // "json" or "dnstap"
+	Output     string  `yaml:"output"`      // File path or "unix:/path/to.sock"
+	SampleRate float64 `yaml:"sample_rate"` // Fraction of queries logged, default 1
+	BufferSize int     `yaml:"buffer_size"` // Queue size before entries are dropped
 }
 
 type GeoIPConfig struct {
@@ -304,19 +920,287 @@ type GeoIPConfig struct {
 type StorageConfig struct {
 	Type      string                 `yaml:"type"`
 	ConfigMap ConfigMapStorageConfig `yaml:"configmap"`
+	CRD       CRDStorageConfig       `yaml:"crd"`
 	File      FileStorageConfig      `yaml:"file"`
+	ZoneFile  ZoneFileStorageConfig  `yaml:"zonefile"`
+	Bolt      BoltStorageConfig      `yaml:"bolt"`
+	SQL       SQLStorageConfig       `yaml:"sql"`
+	Etcd      EtcdStorageConfig      `yaml:"etcd"`
+	Secondary SecondaryStorageConfig `yaml:"secondary"`
+	Discovery DiscoveryConfig        `yaml:"discovery"`
+
+	// ExpiryInterval bounds how long an expired record may outlive its
+	// expiry if nothing wakes the janitor sooner. Default: 1m.
+	ExpiryInterval string `yaml:"expiry_interval"`
+
+	History HistoryConfig `yaml:"history"`
+}
+
+// HistoryConfig keeps a journal of every change to the records, served
+// by /dns/history and used by /dns/rollback.
+type HistoryConfig struct {
+	Enabled    bool   `yaml:"enabled"`
+	Backend    string `yaml:"backend"`     // "memory" (default) or "file"
+	Path       string `yaml:"path"`        // File of the file backend
+	MaxEntries int    `yaml:"max_entries"` // Entries kept, default 10000
+	MaxAge     string `yaml:"max_age"`     // File backend: age after which entries are dropped; empty keeps them
+}
+
+// open opens the configured history.
+func (c HistoryConfig) open() (*storage.History, error) {
+	var backend storage.HistoryBackend
+	switch c.Backend {
+	case "", "memory":
+		backend = storage.NewMemoryHistory(c.MaxEntries)
+	case "file":
+		var maxAge time.Duration
+		if c.MaxAge != "" {
+			d, err := time.ParseDuration(c.MaxAge)
+			if err != nil {
+				return nil, fmt.Errorf("invalid history.max_age: %w", err)
+			}
+			maxAge = d
+		}
+		f, err := storage.OpenFileHistory(expandHome(c.Path), c.MaxEntries, maxAge)
+		if err != nil {
+			return nil, err
+		}
+		backend = f
+	default:
+		return nil, fmt.Errorf("unknown history backend %q", c.Backend)
+	}
+	h, err := storage.NewHistory(backend)
+	if err != nil {
+		backend.Close()
+		return nil, err
+	}
+	return h, nil
+}
+
+// DiscoveryConfig publishes records for annotated Kubernetes Services,
+// Ingresses and Gateways, in addition to the records of the main storage
+// type. Discovered records are never persisted.
+type DiscoveryConfig struct {
+	Enabled   bool   `yaml:"enabled"`
+	Namespace string `yaml:"namespace"` // Watched namespace; empty watches all
+	TTL       uint32 `yaml:"ttl"`       // Default TTL, 300 if zero
+	Gateways  bool   `yaml:"gateways"`  // Also watch Gateway API gateways
+}
+
+// SecondaryStorageConfig lists zones pulled from external primaries by
+// AXFR/IXFR, in addition to the records of the main storage type.
+type SecondaryStorageConfig struct {
+	Zones   []SecondaryZoneConfig `yaml:"zones"`
+	Refresh string                `yaml:"refresh"` // Overrides the SOA refresh interval
+	Timeout string                `yaml:"timeout"` // Transfer timeout, default 10s
+}
+
+// SecondaryZoneConfig names a zone and the primaries it is pulled from.
+type SecondaryZoneConfig struct {
+	Name      string   `yaml:"name"`
+	Primaries []string `yaml:"primaries"` // host:port, tried in order
+	TSIGKey   string   `yaml:"tsig_key"`  // Key signing transfers and expected on NOTIFY
 }
 
 type ConfigMapStorageConfig struct {
-	Namespace string `yaml:"namespace"`
-	Name      string `yaml:"name"`
-	DataKey   string `yaml:"data_key"`
+	Namespace      string               `yaml:"namespace"`
+	Name           string               `yaml:"name"`
+	DataKey        string               `yaml:"data_key"`
+	LeaderElection LeaderElectionConfig `yaml:"leader_election"`
+
+	// ShardSelector spreads records across every ConfigMap in Namespace
+	// matching this label selector instead of the one named Name. A
+	// shard's jw238dns/zone annotation sets the zone whose records it
+	// holds; a shard without it holds the rest.
+	ShardSelector string `yaml:"shard_selector"`
+
+	// Kubernetes API connection, shared by every Kubernetes client (crd
+	// storage, discovery and TSIG secrets included). By default the
+	// in-cluster configuration is used, then the default kubeconfig.
+	Kubeconfig  string            `yaml:"kubeconfig"` // Kubeconfig path
+	Context     string            `yaml:"context"`    // Kubeconfig context
+	Impersonate ImpersonateConfig `yaml:"impersonate"`
+	QPS         float32           `yaml:"qps"`   // Client rate limit; 0 uses the client-go default (5)
+	Burst       int               `yaml:"burst"` // Client burst; 0 uses the client-go default (10)
+}
+
+// configMapSyncer is a single or sharded ConfigMap watcher.
+type configMapSyncer interface {
+	EnableLeaderElection(storage.LeaderElectionConfig)
+	CheckLeader() error
+	WatchAndSync(ctx context.Context) error
+}
+
+// ImpersonateConfig makes Kubernetes requests as another user or group.
+type ImpersonateConfig struct {
+	User   string   `yaml:"user"`
+	Groups []string `yaml:"groups"`
+}
+
+// clientConfig returns the Kubernetes client settings.
+func (c ConfigMapStorageConfig) clientConfig() storage.K8sClientConfig {
+	return storage.K8sClientConfig{
+		Kubeconfig:        expandHome(c.Kubeconfig),
+		Context:           c.Context,
+		ImpersonateUser:   c.Impersonate.User,
+		ImpersonateGroups: c.Impersonate.Groups,
+		QPS:               c.QPS,
+		Burst:             c.Burst,
+	}
+}
+
+// expandHome replaces a leading "~/" in path with the home directory.
+func expandHome(path string) string {
+	if rest, ok := strings.CutPrefix(path, "~/"); ok {
+		if home, err := os.UserHomeDir(); err == nil {
+			return filepath.Join(home, rest)
+		}
+	}
+	return path
+}
+
+// LeaderElectionConfig elects one replica to write the ConfigMap through a
+// coordination.k8s.io Lease; the others reject API writes.
+type LeaderElectionConfig struct {
+	Enabled       bool   `yaml:"enabled"`
+	LeaseName     string `yaml:"lease_name"`     // Default: "<configmap name>-leader"
+	Identity      string `yaml:"identity"`       // Default: $POD_NAME, then the hostname
+	LeaseDuration string `yaml:"lease_duration"` // Default: 15s
+	RenewDeadline string `yaml:"renew_deadline"` // Default: 10s
+	RetryPeriod   string `yaml:"retry_period"`   // Default: 2s
+}
+
+// electionConfig converts the leader election configuration for the
+// ConfigMap named cmName, applying defaults.
+func (c LeaderElectionConfig) electionConfig(cmName string) (storage.LeaderElectionConfig, error) {
+	leaseName := c.LeaseName
+	if leaseName == "" {
+		leaseName = cmName + "-leader"
+	}
+	identity := c.Identity
+	if identity == "" {
+		identity = os.Getenv("POD_NAME")
+	}
+	if identity == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return storage.LeaderElectionConfig{}, fmt.Errorf("leader election identity: %w", err)
+		}
+		identity = hostname
+	}
+
+	cfg := storage.DefaultLeaderElectionConfig(leaseName, identity)
+	for _, d := range []struct {
+		name  string
+		value string
+		dst   *time.Duration
+	}{
+		{"lease_duration", c.LeaseDuration, &cfg.LeaseDuration},
+		{"renew_deadline", c.RenewDeadline, &cfg.RenewDeadline},
+		{"retry_period", c.RetryPeriod, &cfg.RetryPeriod},
+	} {
+		if d.value == "" {
+			continue
+		}
+		v, err := time.ParseDuration(d.value)
+		if err != nil {
+			return storage.LeaderElectionConfig{}, fmt.Errorf("leader_election.%s: %w", d.name, err)
+		}
+		*d.dst = v
+	}
+	if cfg.RenewDeadline >= cfg.LeaseDuration || cfg.RetryPeriod >= cfg.RenewDeadline {
+		return storage.LeaderElectionConfig{}, fmt.Errorf("leader_election: need retry_period < renew_deadline < lease_duration")
+	}
+	return cfg, nil
+}
+
+// CRDStorageConfig selects the DNSRecord objects served.
+type CRDStorageConfig struct {
+	Namespace      string `yaml:"namespace"`       // Watched namespace; empty watches all
+	WriteNamespace string `yaml:"write_namespace"` // Namespace of records created through the API
 }
 
 type FileStorageConfig struct {
 	Path string `yaml:"path"`
 }
 
+// ZoneFileStorageConfig lists RFC 1035 zone files loaded as the record
+// source and reloaded when they change.
+type ZoneFileStorageConfig struct {
+	Zones []ZoneFileConfig `yaml:"zones"`
+}
+
+// ZoneFileConfig names a zone file and the origin of its relative names.
+type ZoneFileConfig struct {
+	Path   string `yaml:"path"`
+	Origin string `yaml:"origin"` // Initial $ORIGIN, e.g. "example.com."
+}
+
+// BoltStorageConfig locates the embedded bbolt database used as the
+// record store.
+type BoltStorageConfig struct {
+	Path        string `yaml:"path"`
+	JournalSize int    `yaml:"journal_size"` // Changes kept in the database journal, default 10000
+}
+
+// SQLStorageConfig connects to the SQL database shared by all replicas.
+type SQLStorageConfig struct {
+	Driver       string `yaml:"driver"`        // "postgres", "mysql" or "sqlite"
+	DSN          string `yaml:"dsn"`           // Data source name
+	DSNEnv       string `yaml:"dsn_env"`       // Environment variable holding the DSN; overrides dsn
+	PollInterval string `yaml:"poll_interval"` // How often to check for changes, default 2s
+	Listen       bool   `yaml:"listen"`        // PostgreSQL: use LISTEN/NOTIFY
+	JournalSize  int    `yaml:"journal_size"`  // Changes kept in the change log, default 10000
+	AutoMigrate  bool   `yaml:"auto_migrate"`  // Apply schema migrations on startup
+}
+
+// EtcdStorageConfig connects to the etcd cluster shared by all replicas.
+type EtcdStorageConfig struct {
+	Endpoints   []string `yaml:"endpoints"`
+	Prefix      string   `yaml:"prefix"` // Key prefix, default /jw238dns/records/
+	Username    string   `yaml:"username"`
+	PasswordEnv string   `yaml:"password_env"` // Environment variable holding the password
+	DialTimeout string   `yaml:"dial_timeout"` // Default 5s
+	MaxTxnOps   int      `yaml:"max_txn_ops"`  // Operations per transaction, default 128
+	CAFile      string   `yaml:"ca_file"`
+	CertFile    string   `yaml:"cert_file"`
+	KeyFile     string   `yaml:"key_file"`
+}
+
+// storageConfig converts c to the storage package's form.
+func (c SQLStorageConfig) storageConfig() (storage.SQLConfig, error) {
+	cfg := storage.SQLConfig{
+		Driver:      c.Driver,
+		DSN:         c.DSN,
+		Listen:      c.Listen,
+		JournalSize: c.JournalSize,
+		AutoMigrate: c.AutoMigrate,
+	}
+	if c.DSNEnv != "" {
+		cfg.DSN = os.Getenv(c.DSNEnv)
+		if cfg.DSN == "" {
+			return cfg, fmt.Errorf("environment variable %s is not set or empty", c.DSNEnv)
+		}
+	}
+	if c.PollInterval != "" {
+		d, err := time.ParseDuration(c.PollInterval)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid poll_interval: %w", err)
+		}
+		cfg.PollInterval = d
+	}
+	return cfg, nil
+}
+
+// TracingConfig controls OpenTelemetry trace export.
+type TracingConfig struct {
+	Exporter    string  `yaml:"exporter"`     // "none", "otlp-grpc" or "otlp-http"
+	Endpoint    string  `yaml:"endpoint"`     // Collector host:port
+	Insecure    bool    `yaml:"insecure"`     // Disable TLS to the collector
+	SampleRatio float64 `yaml:"sample_ratio"` // Fraction of traces sampled, default 1
+	ServiceName string  `yaml:"service_name"` // Reported service.name, default "jw238dns"
+}
+
 type HTTPConfig struct {
 	Enabled bool       `yaml:"enabled"`
 	Listen  string     `yaml:"listen"`
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"jabberwocky238/jw238dns/dns"
+	"jabberwocky238/jw238dns/storage"
+	"jabberwocky238/jw238dns/types"
+)
+
+// recordBackend reads and replaces the persistent records of the
+// configured storage directly, for the snapshot and restore commands.
+type recordBackend struct {
+	list    func(ctx context.Context) ([]*types.DNSRecord, error)
+	replace func(ctx context.Context, records []*types.DNSRecord) error // nil if read-only
+	close   func()
+}
+
+// openRecordBackend opens the storage configured in cfg. The backend must
+// be closed; ctx bounds its background work.
+func openRecordBackend(ctx context.Context, cfg StorageConfig) (*recordBackend, error) {
+	store := storage.NewMemoryStorage()
+	b := &recordBackend{close: func() {}}
+
+	switch cfg.Type {
+	case "file":
+		loader := storage.NewJSONFileLoader(cfg.File.Path, store)
+		b.list = func(context.Context) ([]*types.DNSRecord, error) { return loader.Load() }
+		b.replace = func(ctx context.Context, records []*types.DNSRecord) error {
+			if err := store.HotReload(ctx, records); err != nil {
+				return err
+			}
+			return loader.Save(ctx)
+		}
+	case "configmap":
+		if cfg.ConfigMap.ShardSelector != "" {
+			return nil, fmt.Errorf("sharded configmap storage is not supported")
+		}
+		client, err := storage.NewK8sClient(cfg.ConfigMap.clientConfig())
+		if err != nil {
+			return nil, err
+		}
+		watcher := storage.NewConfigMapWatcher(client, cfg.ConfigMap.Namespace, cfg.ConfigMap.Name, cfg.ConfigMap.DataKey, store)
+		b.list = watcher.Load
+		b.replace = func(ctx context.Context, records []*types.DNSRecord) error {
+			if err := store.HotReload(ctx, records); err != nil {
+				return err
+			}
+			return watcher.PersistToConfigMap(ctx)
+		}
+	case "crd":
+		client, err := storage.NewK8sDynamicClient(cfg.ConfigMap.clientConfig())
+		if err != nil {
+			return nil, err
+		}
+		crdStore := storage.NewCRDStorage(client, cfg.CRD.Namespace, cfg.CRD.WriteNamespace, store)
+		if err := crdStore.Start(ctx); err != nil {
+			return nil, err
+		}
+		b.list = store.ListPersistent
+		b.replace = crdStore.HotReload
+	case "zonefile":
+		var zones []dns.ZoneFile
+		for _, z := range cfg.ZoneFile.Zones {
+			zones = append(zones, dns.ZoneFile{Path: z.Path, Origin: z.Origin})
+		}
+		loader := dns.NewZoneFileLoader(zones, store)
+		b.list = func(context.Context) ([]*types.DNSRecord, error) { return loader.Load() }
+	case "bolt":
+		db, err := storage.OpenBoltStorage(cfg.Bolt.Path, cfg.Bolt.JournalSize)
+		if err != nil {
+			return nil, err
+		}
+		b.list, b.replace, b.close = db.List, db.HotReload, func() { db.Close() }
+	case "sql":
+		sqlConfig, err := cfg.SQL.storageConfig()
+		if err != nil {
+			return nil, err
+		}
+		db, err := storage.OpenSQLStorage(ctx, sqlConfig)
+		if err != nil {
+			return nil, err
+		}
+		b.list, b.replace, b.close = db.List, db.HotReload, func() { db.Close() }
+	case "etcd":
+		client, err := newEtcdClient(cfg.Etcd)
+		if err != nil {
+			return nil, err
+		}
+		etcdStore := storage.NewEtcdStorage(client, cfg.Etcd.Prefix, cfg.Etcd.MaxTxnOps)
+		b.list, b.replace, b.close = etcdStore.List, etcdStore.HotReload, func() { client.Close() }
+	default:
+		return nil, fmt.Errorf("unknown storage type %q", cfg.Type)
+	}
+	return b, nil
+}
+
+// runSnapshot writes a snapshot of the records of the configured storage
+// to the file given by -o, or to stdout. A file name ending in ".gz" is
+// compressed.
+func runSnapshot(args []string) error {
+	fs := flag.NewFlagSet("snapshot", flag.ContinueOnError)
+	out := fs.String("o", "-", "snapshot file, or - for stdout")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	config, err := loadConfig(configPath())
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	backend, err := openRecordBackend(ctx, config.Storage)
+	if err != nil {
+		return err
+	}
+	defer backend.close()
+
+	records, err := backend.list(ctx)
+	if err != nil {
+		return fmt.Errorf("list records: %w", err)
+	}
+	snap := storage.NewSnapshot(config.Storage.Type, records)
+
+	if *out == "-" {
+		return storage.WriteSnapshot(os.Stdout, snap, false)
+	}
+	f, err := os.Create(*out)
+	if err != nil {
+		return err
+	}
+	if err := storage.WriteSnapshot(f, snap, strings.HasSuffix(*out, ".gz")); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Wrote %d records in %d zones to %s\n", len(snap.Records), len(snap.Zones), *out)
+	return nil
+}
+
+// runRestore replaces the records of the configured storage with those
+// of a snapshot file, or of stdin for "-". With -dry-run it only reports
+// the changes.
+func runRestore(args []string) error {
+	fs := flag.NewFlagSet("restore", flag.ContinueOnError)
+	dryRun := fs.Bool("dry-run", false, "report the changes without applying them")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: jw238dns restore [-dry-run] <snapshot file|->")
+	}
+
+	var in io.Reader = os.Stdin
+	if path := fs.Arg(0); path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+	snap, err := storage.ReadSnapshot(in)
+	if err != nil {
+		return err
+	}
+
+	config, err := loadConfig(configPath())
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	backend, err := openRecordBackend(ctx, config.Storage)
+	if err != nil {
+		return err
+	}
+	defer backend.close()
+	if backend.replace == nil {
+		return fmt.Errorf("%s storage is read-only", config.Storage.Type)
+	}
+
+	current, err := backend.list(ctx)
+	if err != nil {
+		return fmt.Errorf("list records: %w", err)
+	}
+	changes := storage.DiffRecords(current, snap.Records)
+	fmt.Fprintf(os.Stderr, "Snapshot of %s storage taken %s: %d records; %d to add, %d to update, %d to delete\n",
+		snap.Source, snap.CreatedAt.Format(time.RFC3339), len(snap.Records),
+		len(changes.Added), len(changes.Updated), len(changes.Deleted))
+	if *dryRun {
+		return nil
+	}
+	if err := backend.replace(ctx, snap.Records); err != nil {
+		return fmt.Errorf("restore records: %w", err)
+	}
+	fmt.Fprintf(os.Stderr, "Restored %d records into %s storage\n", len(snap.Records), config.Storage.Type)
+	return nil
+}
@@ -5,10 +5,12 @@ import (
 	"log/slog"
 
 	"jabberwocky238/jw238dns/geoip"
+	"jabberwocky238/jw238dns/querylog"
 	"jabberwocky238/jw238dns/storage"
 	"jabberwocky238/jw238dns/types"
 
 	"github.com/miekg/dns"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 // DNSBackend resolves DNS queries from storage and applies rules.
@@ -92,6 +94,13 @@ func (b *Backend) Close() error {
 // CNAME chains when configured. If no records are found it returns
 // ErrRecordNotFound.
 func (b *Backend) Resolve(ctx context.Context, query *types.QueryInfo) ([]*types.DNSRecord, error) {
+	ctx, span := tracer.Start(ctx, "Backend.Resolve")
+	defer span.End()
+	span.SetAttributes(
+		attribute.String("dns.qname", query.Domain),
+		attribute.String("dns.qtype", dns.Type(query.Type).String()),
+	)
+
 	rt := uint16ToRecordType(query.Type)
 
 	// ANY query: return all record types for the domain.
@@ -101,6 +110,7 @@ func (b *Backend) Resolve(ctx context.Context, query *types.QueryInfo) ([]*types
 			return nil, err
 		}
 		b.applyGeoSort(recs, query)
+		markSource(ctx, querylog.SourceLocal)
 		return recs, nil
 	}
 
@@ -109,6 +119,7 @@ func (b *Backend) Resolve(ctx context.Context, query *types.QueryInfo) ([]*types
 	if err == nil {
 		recs, _ = b.ApplyRules(ctx, recs)
 		b.applyGeoSort(recs, query)
+		markSource(ctx, querylog.SourceLocal)
 		return recs, nil
 	}
 
@@ -119,6 +130,7 @@ func (b *Backend) Resolve(ctx context.Context, query *types.QueryInfo) ([]*types
 		if chainErr == nil && len(chainRecs) > 0 {
 			chainRecs, _ = b.ApplyRules(ctx, chainRecs)
 			b.applyGeoSort(chainRecs, query)
+			markSource(ctx, querylog.SourceLocal)
 			return chainRecs, nil
 		}
 	}
@@ -127,6 +139,7 @@ func (b *Backend) Resolve(ctx context.Context, query *types.QueryInfo) ([]*types
 	if b.forwarder != nil {
 		upstreamRecs, upstreamErr := b.forwarder.Forward(ctx, query.Domain, query.Type)
 		if upstreamErr == nil && len(upstreamRecs) > 0 {
+			markSource(ctx, querylog.SourceForwarded)
 			return upstreamRecs, nil
 		}
 	}
@@ -167,6 +180,13 @@ func (b *Backend) applyGeoSort(records []*types.DNSRecord, query *types.QueryInf
 // resolveCNAMEChain follows CNAME records up to MaxCNAMEDepth, collecting
 // the CNAME records and the final target records of the requested type.
 func (b *Backend) resolveCNAMEChain(ctx context.Context, domain string, targetType types.RecordType, depth int) ([]*types.DNSRecord, error) {
+	ctx, span := tracer.Start(ctx, "Backend.resolveCNAMEChain")
+	defer span.End()
+	span.SetAttributes(
+		attribute.String("dns.qname", domain),
+		attribute.Int("dns.cname_depth", depth),
+	)
+
 	if depth >= b.config.MaxCNAMEDepth {
 		slog.Warn("CNAME chain depth exceeded", "domain", domain, "depth", depth)
 		return nil, types.ErrRecordNotFound
@@ -6,9 +6,14 @@ import (
 	"log/slog"
 	"time"
 
+	"jabberwocky238/jw238dns/metrics"
+	"jabberwocky238/jw238dns/tsig"
 	"jabberwocky238/jw238dns/types"
 
 	"github.com/miekg/dns"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // ForwarderConfig holds configuration for upstream DNS forwarding.
@@ -16,6 +21,8 @@ type ForwarderConfig struct {
 	Enabled bool          // Enable upstream forwarding
 	Servers []string      // Upstream DNS server addresses (e.g. "1.1.1.1:53")
 	Timeout time.Duration // Timeout for upstream queries
+	TSIGKey string        // Key signing upstream queries; empty sends them unsigned
+	Keyring *tsig.Keyring // Keys for TSIGKey
 }
 
 // DefaultForwarderConfig returns a ForwarderConfig with sensible defaults.
@@ -38,8 +45,9 @@ func NewForwarder(cfg ForwarderConfig) *Forwarder {
 	return &Forwarder{
 		config: cfg,
 		client: &dns.Client{
-			Net:     "udp",
-			Timeout: cfg.Timeout,
+			Net:          "udp",
+			Timeout:      cfg.Timeout,
+			TsigProvider: tsigProvider(cfg.Keyring),
 		},
 	}
 }
@@ -57,13 +65,27 @@ func (f *Forwarder) Forward(ctx context.Context, domain string, qtype uint16) ([
 		return nil, types.ErrRecordNotFound
 	}
 
+	ctx, span := tracer.Start(ctx, "Forwarder.Forward", trace.WithSpanKind(trace.SpanKindClient))
+	defer span.End()
+	span.SetAttributes(
+		attribute.String("dns.qname", domain),
+		attribute.String("dns.qtype", dns.Type(qtype).String()),
+	)
+
 	query := new(dns.Msg)
 	query.SetQuestion(domain, qtype)
 	query.RecursionDesired = true
+	if err := signMsg(f.config.Keyring, f.config.TSIGKey, query); err != nil {
+		span.SetStatus(codes.Error, err.Error())
+		return nil, fmt.Errorf("sign upstream query: %w", err)
+	}
 
 	for _, server := range f.config.Servers {
-		resp, _, err := f.client.ExchangeContext(ctx, query, server)
+		span.AddEvent("upstream exchange", trace.WithAttributes(attribute.String("dns.upstream", server)))
+		resp, rtt, err := f.client.ExchangeContext(ctx, query, server)
 		if err != nil {
+			metrics.UpstreamErrorsTotal.WithLabelValues(server, "exchange").Inc()
+			span.RecordError(err, trace.WithAttributes(attribute.String("dns.upstream", server)))
 			slog.Debug("upstream query failed, trying next server",
 				"server", server,
 				"domain", domain,
@@ -71,15 +93,24 @@ func (f *Forwarder) Forward(ctx context.Context, domain string, qtype uint16) ([
 			)
 			continue
 		}
+		metrics.UpstreamDuration.WithLabelValues(server).Observe(rtt.Seconds())
+		rcode := dns.RcodeToString[resp.Rcode]
+		metrics.UpstreamResponsesTotal.WithLabelValues(server, rcode).Inc()
+		// NXDOMAIN is an answer, not an upstream failure.
+		if resp.Rcode == dns.RcodeServerFailure || resp.Rcode == dns.RcodeRefused {
+			metrics.UpstreamErrorsTotal.WithLabelValues(server, rcode).Inc()
+		}
 
 		// Authoritative negative responses are final; don't retry.
 		if resp.Rcode == dns.RcodeNameError || resp.Rcode == dns.RcodeServerFailure {
 			slog.Debug("upstream returned negative response",
 				"server", server,
 				"domain", domain,
-				"rcode", dns.RcodeToString[resp.Rcode],
+				"rcode", rcode,
 			)
-			return nil, fmt.Errorf("upstream %s: %s", server, dns.RcodeToString[resp.Rcode])
+			err := fmt.Errorf("upstream %s: %s", server, rcode)
+			span.SetStatus(codes.Error, err.Error())
+			return nil, err
 		}
 
 		records := f.rrToRecords(resp.Answer)
@@ -89,6 +120,7 @@ func (f *Forwarder) Forward(ctx context.Context, domain string, qtype uint16) ([
 				"domain", domain,
 				"records", len(records),
 			)
+			span.SetAttributes(attribute.String("dns.upstream", server))
 			return records, nil
 		}
 	}
@@ -101,46 +133,54 @@ func (f *Forwarder) Forward(ctx context.Context, domain string, qtype uint16) ([
 func (f *Forwarder) rrToRecords(rrs []dns.RR) []*types.DNSRecord {
 	var records []*types.DNSRecord
 	for _, rr := range rrs {
-		hdr := rr.Header()
-		rt := uint16ToRecordType(hdr.Rrtype)
-		if rt == "" {
-			continue
+		if rec, ok := rrToRecord(rr); ok {
+			records = append(records, rec)
 		}
+	}
+	return records
+}
 
-		rec := &types.DNSRecord{
-			Name: hdr.Name,
-			Type: rt,
-			TTL:  hdr.Ttl,
-		}
+// rrToRecord converts a single RR into a DNSRecord. It returns false for
+// unsupported RR types.
+func rrToRecord(rr dns.RR) (*types.DNSRecord, bool) {
+	hdr := rr.Header()
+	rt := uint16ToRecordType(hdr.Rrtype)
+	if rt == "" {
+		return nil, false
+	}
 
-		switch v := rr.(type) {
-		case *dns.A:
-			rec.Value = []string{v.A.String()}
-		case *dns.AAAA:
-			rec.Value = []string{v.AAAA.String()}
-		case *dns.CNAME:
-			rec.Value = []string{v.Target}
-		case *dns.MX:
-			rec.Value = []string{fmt.Sprintf("%d %s", v.Preference, v.Mx)}
-		case *dns.TXT:
-			rec.Value = v.Txt
-		case *dns.NS:
-			rec.Value = []string{v.Ns}
-		case *dns.PTR:
-			rec.Value = []string{v.Ptr}
-		case *dns.SOA:
-			rec.Value = []string{fmt.Sprintf("%s %s %d %d %d %d %d",
-				v.Ns, v.Mbox, v.Serial, v.Refresh, v.Retry, v.Expire, v.Minttl)}
-		case *dns.SRV:
-			rec.Value = []string{fmt.Sprintf("%d %d %d %s",
-				v.Priority, v.Weight, v.Port, v.Target)}
-		case *dns.CAA:
-			rec.Value = []string{fmt.Sprintf("%d %s %s", v.Flag, v.Tag, v.Value)}
-		default:
-			continue
-		}
+	rec := &types.DNSRecord{
+		Name: hdr.Name,
+		Type: rt,
+		TTL:  hdr.Ttl,
+	}
 
-		records = append(records, rec)
+	switch v := rr.(type) {
+	case *dns.A:
+		rec.Value = []string{v.A.String()}
+	case *dns.AAAA:
+		rec.Value = []string{v.AAAA.String()}
+	case *dns.CNAME:
+		rec.Value = []string{v.Target}
+	case *dns.MX:
+		rec.Value = []string{fmt.Sprintf("%d %s", v.Preference, v.Mx)}
+	case *dns.TXT:
+		rec.Value = v.Txt
+	case *dns.NS:
+		rec.Value = []string{v.Ns}
+	case *dns.PTR:
+		rec.Value = []string{v.Ptr}
+	case *dns.SOA:
+		rec.Value = []string{fmt.Sprintf("%s %s %d %d %d %d %d",
+			v.Ns, v.Mbox, v.Serial, v.Refresh, v.Retry, v.Expire, v.Minttl)}
+	case *dns.SRV:
+		rec.Value = []string{fmt.Sprintf("%d %d %d %s",
+			v.Priority, v.Weight, v.Port, v.Target)}
+	case *dns.CAA:
+		rec.Value = []string{fmt.Sprintf("%d %s %s", v.Flag, v.Tag, v.Value)}
+	default:
+		return nil, false
 	}
-	return records
+
+	return rec, true
 }
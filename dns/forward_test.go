@@ -6,9 +6,11 @@ import (
 	"testing"
 	"time"
 
+	"jabberwocky238/jw238dns/metrics"
 	"jabberwocky238/jw238dns/types"
 
 	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 func TestNewForwarder(t *testing.T) {
@@ -87,6 +89,61 @@ func TestForwarder_Forward_NoServers(t *testing.T) {
 	}
 }
 
+func TestForwarder_Forward_UpstreamMetrics(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	rcodes := map[string]int{
+		"missing.example.com.": dns.RcodeNameError,
+		"broken.example.com.":  dns.RcodeServerFailure,
+		"refused.example.com.": dns.RcodeRefused,
+	}
+	server := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetRcode(r, rcodes[r.Question[0].Name])
+		_ = w.WriteMsg(m)
+	})}
+	started := make(chan struct{})
+	server.NotifyStartedFunc = func() { close(started) }
+	go func() { _ = server.ActivateAndServe() }()
+	<-started
+	t.Cleanup(func() { _ = server.Shutdown() })
+
+	addr := pc.LocalAddr().String()
+	f := NewForwarder(ForwarderConfig{Enabled: true, Servers: []string{addr}, Timeout: 2 * time.Second})
+
+	tests := []struct {
+		domain string
+		rcode  string
+		failed bool
+	}{
+		{domain: "missing.example.com.", rcode: "NXDOMAIN", failed: false},
+		{domain: "broken.example.com.", rcode: "SERVFAIL", failed: true},
+		{domain: "refused.example.com.", rcode: "REFUSED", failed: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.rcode, func(t *testing.T) {
+			responses := metrics.UpstreamResponsesTotal.WithLabelValues(addr, tt.rcode)
+			errs := metrics.UpstreamErrorsTotal.WithLabelValues(addr, tt.rcode)
+			beforeResponses, beforeErrs := testutil.ToFloat64(responses), testutil.ToFloat64(errs)
+
+			_, _ = f.Forward(context.Background(), tt.domain, dns.TypeA)
+
+			if got := testutil.ToFloat64(responses) - beforeResponses; got != 1 {
+				t.Errorf("upstream_responses_total{%s} increased by %v, want 1", tt.rcode, got)
+			}
+			want := 0.0
+			if tt.failed {
+				want = 1
+			}
+			if got := testutil.ToFloat64(errs) - beforeErrs; got != want {
+				t.Errorf("upstream_errors_total{%s} increased by %v, want %v", tt.rcode, got, want)
+			}
+		})
+	}
+}
+
 func TestForwarder_rrToRecords_A(t *testing.T) {
 	f := NewForwarder(DefaultForwarderConfig())
 
@@ -8,12 +8,22 @@ import (
 	"log/slog"
 	"net"
 	"strings"
+	"time"
 
+	"jabberwocky238/jw238dns/metrics"
+	"jabberwocky238/jw238dns/querylog"
+	"jabberwocky238/jw238dns/tracing"
 	"jabberwocky238/jw238dns/types"
 
 	"github.com/miekg/dns"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
+// tracer traces query handling in the frontend, backend and forwarder.
+var tracer = tracing.Tracer()
+
 // clientIPKey is the context key for storing the client IP address.
 type clientIPKey struct{}
 
@@ -28,6 +38,45 @@ func ClientIPFromContext(ctx context.Context) net.IP {
 	return ip
 }
 
+// transportKey is the context key for storing the query transport.
+type transportKey struct{}
+
+// ContextWithTransport returns a new context carrying the transport ("udp"
+// or "tcp") the query arrived on.
+func ContextWithTransport(ctx context.Context, transport string) context.Context {
+	return context.WithValue(ctx, transportKey{}, transport)
+}
+
+// TransportFromContext extracts the query transport from the context. It
+// returns "unknown" if none was set.
+func TransportFromContext(ctx context.Context) string {
+	if t, ok := ctx.Value(transportKey{}).(string); ok && t != "" {
+		return t
+	}
+	return "unknown"
+}
+
+// resolutionKey is the context key for the resolution outcome of a query.
+type resolutionKey struct{}
+
+// resolution records where the answer to a query came from. Backend.Resolve
+// fills it in when the context carries one.
+type resolution struct {
+	source string
+}
+
+// contextWithResolution returns a new context carrying res.
+func contextWithResolution(ctx context.Context, res *resolution) context.Context {
+	return context.WithValue(ctx, resolutionKey{}, res)
+}
+
+// markSource records the answer source on the context's resolution, if any.
+func markSource(ctx context.Context, source string) {
+	if res, ok := ctx.Value(resolutionKey{}).(*resolution); ok {
+		res.source = source
+	}
+}
+
 // DNSFrontend receives and parses DNS queries.
 type DNSFrontend interface {
 	// ReceiveQuery accepts a DNS query and returns a response.
@@ -40,7 +89,16 @@ type DNSFrontend interface {
 // Frontend implements DNSFrontend by parsing incoming queries and delegating
 // resolution to a DNSBackend.
 type Frontend struct {
-	backend DNSBackend
+	backend  DNSBackend
+	queryLog *querylog.Logger
+	serials  ZoneSerials
+}
+
+// ZoneSerials reports the current serial of a zone. When set on a Frontend,
+// it replaces the serial of every SOA record in responses so that SOA
+// queries agree with the serials served by zone transfers.
+type ZoneSerials interface {
+	Serial(zone string) (uint32, bool)
 }
 
 // NewFrontend creates a Frontend that delegates resolution to the given backend.
@@ -48,10 +106,110 @@ func NewFrontend(backend DNSBackend) *Frontend {
 	return &Frontend{backend: backend}
 }
 
+// SetQueryLogger enables per-query logging to the given logger. A nil
+// logger disables it.
+func (f *Frontend) SetQueryLogger(l *querylog.Logger) {
+	f.queryLog = l
+}
+
+// SetZoneSerials makes SOA records in responses carry the serial reported
+// by s. A nil value serves stored SOA values unchanged.
+func (f *Frontend) SetZoneSerials(s ZoneSerials) {
+	f.serials = s
+}
+
 // ReceiveQuery parses the incoming DNS message, resolves it via the backend,
 // and builds a wire-format response. If the context carries a client IP
 // (via ContextWithClientIP), it is attached to the QueryInfo for GeoIP sorting.
+// Every query is recorded in the query counters and latency histogram, and
+// in the query log when one is configured.
 func (f *Frontend) ReceiveQuery(ctx context.Context, query *dns.Msg) (*dns.Msg, error) {
+	ctx, span := tracer.Start(ctx, "Frontend.ReceiveQuery", trace.WithSpanKind(trace.SpanKindServer))
+	defer span.End()
+
+	start := time.Now()
+	res := &resolution{source: querylog.SourceNone}
+	resp, err := f.receiveQuery(ctx, query, res)
+	if resp != nil && f.serials != nil {
+		f.applySerials(resp)
+	}
+	elapsed := time.Since(start)
+
+	var qname string
+	qtype := "NONE"
+	if query != nil && len(query.Question) > 0 {
+		qname = query.Question[0].Name
+		qtype = dns.Type(query.Question[0].Qtype).String()
+	}
+	rcode := dns.RcodeToString[dns.RcodeServerFailure]
+	if resp != nil {
+		rcode = dns.RcodeToString[resp.Rcode]
+	}
+	transport := TransportFromContext(ctx)
+	metrics.ObserveQuery(qtype, rcode, transport, elapsed)
+
+	span.SetAttributes(
+		attribute.String("dns.qname", qname),
+		attribute.String("dns.qtype", qtype),
+		attribute.String("dns.rcode", rcode),
+		attribute.String("dns.transport", transport),
+		attribute.String("dns.source", res.source),
+	)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+
+	if f.queryLog != nil && f.queryLog.Sampled() {
+		clientIP := ClientIPFromContext(ctx)
+		entry := &querylog.Entry{
+			Time:      start,
+			Transport: transport,
+			Name:      qname,
+			Type:      qtype,
+			Rcode:     rcode,
+			LatencyMs: float64(elapsed) / float64(time.Millisecond),
+			Source:    res.source,
+			ClientIP:  clientIP,
+		}
+		if f.queryLog.Wire() {
+			// Pack now: the caller packs resp again to write it once we
+			// return, and Pack modifies the message.
+			if query != nil {
+				entry.QueryWire, _ = query.Pack()
+			}
+			if resp != nil {
+				entry.ResponseWire, _ = resp.Pack()
+			}
+		}
+		if clientIP != nil {
+			entry.Client = clientIP.String()
+		}
+		if resp != nil {
+			entry.Answers = len(resp.Answer)
+		}
+		f.queryLog.Log(entry)
+	}
+
+	return resp, err
+}
+
+// applySerials rewrites the serial of every SOA record in the response.
+func (f *Frontend) applySerials(resp *dns.Msg) {
+	for _, section := range [][]dns.RR{resp.Answer, resp.Ns} {
+		for _, rr := range section {
+			if soa, ok := rr.(*dns.SOA); ok {
+				if serial, ok := f.serials.Serial(soa.Hdr.Name); ok {
+					soa.Serial = serial
+				}
+			}
+		}
+	}
+}
+
+// receiveQuery implements ReceiveQuery without instrumentation. The
+// outcome of the main lookup is recorded in res.
+func (f *Frontend) receiveQuery(ctx context.Context, query *dns.Msg, res *resolution) (*dns.Msg, error) {
 	info, err := f.ParseQuery(query)
 	if err != nil {
 		resp := new(dns.Msg)
@@ -68,7 +226,7 @@ func (f *Frontend) ReceiveQuery(ctx context.Context, query *dns.Msg) (*dns.Msg,
 		"class", info.Class,
 	)
 
-	records, err := f.backend.Resolve(ctx, info)
+	records, err := f.backend.Resolve(contextWithResolution(ctx, res), info)
 
 	resp := new(dns.Msg)
 	resp.SetReply(query)
@@ -98,28 +256,7 @@ func (f *Frontend) ReceiveQuery(ctx context.Context, query *dns.Msg) (*dns.Msg,
 	}
 
 	for _, r := range records {
-		// For record types with multiple values, create one RR per value
-		// This applies to: A, AAAA, NS, MX, and other multi-value types
-		if len(r.Value) > 1 && (r.Type == types.RecordTypeA || r.Type == types.RecordTypeAAAA ||
-			r.Type == types.RecordTypeNS || r.Type == types.RecordTypeMX) {
-			for _, val := range r.Value {
-				singleRec := &types.DNSRecord{
-					Name:  r.Name,
-					Type:  r.Type,
-					TTL:   r.TTL,
-					Value: []string{val},
-				}
-				rr := buildRR(singleRec)
-				if rr != nil {
-					resp.Answer = append(resp.Answer, rr)
-				}
-			}
-		} else {
-			rr := buildRR(r)
-			if rr != nil {
-				resp.Answer = append(resp.Answer, rr)
-			}
-		}
+		resp.Answer = append(resp.Answer, buildRRs(r)...)
 	}
 
 	// Add NS records to Authority section for better DNS compliance
@@ -189,6 +326,31 @@ func (f *Frontend) ParseQuery(query *dns.Msg) (*types.QueryInfo, error) {
 	}, nil
 }
 
+// buildRRs converts a DNSRecord into one or more dns.RRs. Each value
+// becomes its own RR, so a record with several values is an RRset; SOA
+// records always produce a single RR.
+func buildRRs(r *types.DNSRecord) []dns.RR {
+	var rrs []dns.RR
+	if len(r.Value) > 1 && r.Type != types.RecordTypeSOA {
+		for _, val := range r.Value {
+			singleRec := &types.DNSRecord{
+				Name:  r.Name,
+				Type:  r.Type,
+				TTL:   r.TTL,
+				Value: []string{val},
+			}
+			if rr := buildRR(singleRec); rr != nil {
+				rrs = append(rrs, rr)
+			}
+		}
+		return rrs
+	}
+	if rr := buildRR(r); rr != nil {
+		rrs = append(rrs, rr)
+	}
+	return rrs
+}
+
 // buildRR converts a DNSRecord into a dns.RR suitable for a response message.
 // Returns nil if the record type is unsupported or the value is empty.
 func buildRR(record *types.DNSRecord) dns.RR {
@@ -215,7 +377,7 @@ func buildRR(record *types.DNSRecord) dns.RR {
 	case types.RecordTypeMX:
 		return &dns.MX{Hdr: hdr, Preference: 10, Mx: val}
 	case types.RecordTypeTXT:
-		return &dns.TXT{Hdr: hdr, Txt: record.Value}
+		return &dns.TXT{Hdr: hdr, Txt: txtStrings(record.Value)}
 	case types.RecordTypeNS:
 		return &dns.NS{Hdr: hdr, Ns: val}
 	case types.RecordTypePTR:
@@ -2,12 +2,23 @@ package dns
 
 import (
 	"context"
+	"net"
+	"path/filepath"
 	"testing"
+	"time"
 
+	"jabberwocky238/jw238dns/metrics"
+	"jabberwocky238/jw238dns/querylog"
 	"jabberwocky238/jw238dns/storage"
 	"jabberwocky238/jw238dns/types"
 
+	dnstap "github.com/dnstap/golang-dnstap"
 	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"google.golang.org/protobuf/proto"
 )
 
 func setupFrontend(t *testing.T) (*Frontend, *storage.MemoryStorage) {
@@ -273,3 +284,176 @@ func TestFrontend_ReceiveQuery_FormatError(t *testing.T) {
 		t.Errorf("Rcode = %d, want %d (FORMERR)", resp.Rcode, dns.RcodeFormatError)
 	}
 }
+
+func TestFrontend_ReceiveQuery_RecordsMetrics(t *testing.T) {
+	fe, _ := setupFrontend(t)
+	ctx := ContextWithTransport(context.Background(), "udp")
+
+	counter := metrics.QueriesTotal.WithLabelValues("A", "NXDOMAIN", "udp")
+	before := testutil.ToFloat64(counter)
+
+	query := new(dns.Msg)
+	query.SetQuestion("metrics-notfound.com.", dns.TypeA)
+	if _, err := fe.ReceiveQuery(ctx, query); err != nil {
+		t.Fatalf("ReceiveQuery() error = %v", err)
+	}
+
+	if got := testutil.ToFloat64(counter) - before; got != 1 {
+		t.Errorf("queries_total{A,NXDOMAIN,udp} increased by %v, want 1", got)
+	}
+}
+
+func TestTransportFromContext(t *testing.T) {
+	if got := TransportFromContext(context.Background()); got != "unknown" {
+		t.Errorf("TransportFromContext(empty) = %q, want %q", got, "unknown")
+	}
+	ctx := ContextWithTransport(context.Background(), "tcp")
+	if got := TransportFromContext(ctx); got != "tcp" {
+		t.Errorf("TransportFromContext() = %q, want %q", got, "tcp")
+	}
+}
+
+// recordingSink captures query log entries written by the frontend.
+type recordingSink struct {
+	entries chan *querylog.Entry
+}
+
+func (s *recordingSink) Write(entry *querylog.Entry) error {
+	s.entries <- entry
+	return nil
+}
+
+func (s *recordingSink) Close() error { return nil }
+
+func TestFrontend_ReceiveQuery_QueryLog(t *testing.T) {
+	tests := []struct {
+		name       string
+		domain     string
+		wantRcode  string
+		wantSource string
+		wantCount  int
+	}{
+		{name: "local answer", domain: "example.com.", wantRcode: "NOERROR", wantSource: querylog.SourceLocal, wantCount: 1},
+		{name: "nxdomain", domain: "querylog-missing.com.", wantRcode: "NXDOMAIN", wantSource: querylog.SourceNone},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fe, _ := setupFrontend(t)
+			sink := &recordingSink{entries: make(chan *querylog.Entry, 1)}
+			ql := querylog.NewLogger(sink, 1, 8)
+			defer ql.Close()
+			fe.SetQueryLogger(ql)
+
+			ctx := ContextWithClientIP(context.Background(), net.ParseIP("10.1.2.3"))
+			query := new(dns.Msg)
+			query.SetQuestion(tt.domain, dns.TypeA)
+			if _, err := fe.ReceiveQuery(ctx, query); err != nil {
+				t.Fatalf("ReceiveQuery() error = %v", err)
+			}
+
+			select {
+			case e := <-sink.entries:
+				if e.Rcode != tt.wantRcode {
+					t.Errorf("Rcode = %q, want %q", e.Rcode, tt.wantRcode)
+				}
+				if e.Source != tt.wantSource {
+					t.Errorf("Source = %q, want %q", e.Source, tt.wantSource)
+				}
+				if e.Answers != tt.wantCount {
+					t.Errorf("Answers = %d, want %d", e.Answers, tt.wantCount)
+				}
+				if e.Client != "10.1.2.3" || e.Name != tt.domain || e.Type != "A" {
+					t.Errorf("unexpected entry: %+v", e)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("timed out waiting for query log entry")
+			}
+		})
+	}
+}
+
+func TestFrontend_ReceiveQuery_QueryLogDNSTap(t *testing.T) {
+	fe, _ := setupFrontend(t)
+	path := filepath.Join(t.TempDir(), "queries.dnstap")
+	ql, err := querylog.New(querylog.Config{Format: querylog.FormatDNSTap, Output: path})
+	if err != nil {
+		t.Fatalf("querylog.New() error = %v", err)
+	}
+	fe.SetQueryLogger(ql)
+
+	query := new(dns.Msg)
+	query.SetQuestion("example.com.", dns.TypeA)
+	resp, err := fe.ReceiveQuery(context.Background(), query)
+	if err != nil {
+		t.Fatalf("ReceiveQuery() error = %v", err)
+	}
+	// Write the response as the server does while the entry is logged.
+	if _, err := resp.Pack(); err != nil {
+		t.Fatalf("Pack() error = %v", err)
+	}
+	if err := ql.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	input, err := dnstap.NewFrameStreamInputFromFilename(path)
+	if err != nil {
+		t.Fatalf("open dnstap input: %v", err)
+	}
+	frames := make(chan []byte, 1)
+	go func() {
+		input.ReadInto(frames)
+		close(frames)
+	}()
+	frame, ok := <-frames
+	if !ok {
+		t.Fatal("no dnstap frame written")
+	}
+	var dt dnstap.Dnstap
+	if err := proto.Unmarshal(frame, &dt); err != nil {
+		t.Fatalf("unmarshal frame: %v", err)
+	}
+	var logged dns.Msg
+	if err := logged.Unpack(dt.GetMessage().GetResponseMessage()); err != nil {
+		t.Fatalf("unpack response message: %v", err)
+	}
+	if logged.Id != query.Id || len(logged.Answer) != 1 {
+		t.Errorf("logged response id = %d with %d answers, want %d with 1", logged.Id, len(logged.Answer), query.Id)
+	}
+}
+
+func TestFrontend_ReceiveQuery_Spans(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	prev := otel.GetTracerProvider()
+	otel.SetTracerProvider(provider)
+	defer otel.SetTracerProvider(prev)
+
+	fe, _ := setupFrontend(t)
+	query := new(dns.Msg)
+	query.SetQuestion("example.com.", dns.TypeA)
+	if _, err := fe.ReceiveQuery(context.Background(), query); err != nil {
+		t.Fatalf("ReceiveQuery() error = %v", err)
+	}
+
+	spans := exporter.GetSpans()
+	byName := make(map[string]tracetest.SpanStub)
+	for _, s := range spans {
+		byName[s.Name] = s
+	}
+
+	root, ok := byName["Frontend.ReceiveQuery"]
+	if !ok {
+		t.Fatalf("missing Frontend.ReceiveQuery span, got %d spans", len(spans))
+	}
+	for _, name := range []string{"Backend.Resolve", "MemoryStorage.Get"} {
+		s, ok := byName[name]
+		if !ok {
+			t.Errorf("missing %s span", name)
+			continue
+		}
+		if s.SpanContext.TraceID() != root.SpanContext.TraceID() {
+			t.Errorf("%s span is not in the query trace", name)
+		}
+	}
+}
@@ -116,3 +116,71 @@ func extractZone(domain string) string {
 	}
 	return strings.Join(parts[len(parts)-2:], ".") + "."
 }
+
+// storedValue converts an RR into a single value in the format buildRR
+// expects, the inverse of buildRR. It returns false for RR types the store
+// cannot hold. MX preference and CAA flag/tag are not part of the stored
+// value and are dropped.
+func storedValue(rr dns.RR) (string, bool) {
+	switch v := rr.(type) {
+	case *dns.A:
+		return v.A.String(), true
+	case *dns.AAAA:
+		return v.AAAA.String(), true
+	case *dns.CNAME:
+		return v.Target, true
+	case *dns.MX:
+		return v.Mx, true
+	case *dns.TXT:
+		return strings.Join(v.Txt, ""), true
+	case *dns.NS:
+		return v.Ns, true
+	case *dns.PTR:
+		return v.Ptr, true
+	case *dns.SOA:
+		return fmt.Sprintf("%s %s %d %d %d %d %d",
+			v.Ns, v.Mbox, v.Serial, v.Refresh, v.Retry, v.Expire, v.Minttl), true
+	case *dns.SRV:
+		return fmt.Sprintf("%d %d %d %s", v.Priority, v.Weight, v.Port, v.Target), true
+	case *dns.CAA:
+		return v.Value, true
+	default:
+		return "", false
+	}
+}
+
+// maxTXTString is the longest character-string a TXT RR can carry
+// (RFC 1035 section 3.3).
+const maxTXTString = 255
+
+// txtStrings splits each value into character-strings of at most 255
+// bytes, so long values such as DKIM keys can be packed. Escape sequences
+// (\X and \DDD) count as the single byte they encode and are never split.
+func txtStrings(values []string) []string {
+	var out []string
+	for _, v := range values {
+		start, n := 0, 0
+		for i := 0; i < len(v); {
+			width := 1
+			if v[i] == '\\' && i+1 < len(v) {
+				width = 2
+				if i+3 < len(v) && isDigit(v[i+1]) && isDigit(v[i+2]) && isDigit(v[i+3]) {
+					width = 4
+				}
+			}
+			if n == maxTXTString {
+				out = append(out, v[start:i])
+				start, n = i, 0
+			}
+			i += width
+			n++
+		}
+		out = append(out, v[start:])
+	}
+	return out
+}
+
+// isDigit reports whether b is an ASCII digit.
+func isDigit(b byte) bool {
+	return b >= '0' && b <= '9'
+}
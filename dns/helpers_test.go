@@ -1,6 +1,7 @@
 package dns
 
 import (
+	"strings"
 	"testing"
 
 	"jabberwocky238/jw238dns/types"
@@ -322,3 +323,83 @@ func TestParseIP(t *testing.T) {
 		})
 	}
 }
+
+func TestStoredValue_RoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		rr   string
+		want string
+	}{
+		{name: "A", rr: "a.com. 300 IN A 192.168.1.1", want: "192.168.1.1"},
+		{name: "AAAA", rr: "a.com. 300 IN AAAA 2001:db8::1", want: "2001:db8::1"},
+		{name: "CNAME", rr: "www.a.com. 300 IN CNAME a.com.", want: "a.com."},
+		{name: "MX", rr: "a.com. 300 IN MX 10 mail.a.com.", want: "mail.a.com."},
+		{name: "TXT", rr: `a.com. 300 IN TXT "v=spf1 " "~all"`, want: "v=spf1 ~all"},
+		{name: "SRV", rr: "_sip._tcp.a.com. 300 IN SRV 10 60 5060 sip.a.com.", want: "10 60 5060 sip.a.com."},
+		{name: "SOA", rr: "a.com. 300 IN SOA ns1.a.com. admin.a.com. 7 3600 900 604800 86400", want: "ns1.a.com. admin.a.com. 7 3600 900 604800 86400"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr, err := dns.NewRR(tt.rr)
+			if err != nil {
+				t.Fatalf("NewRR() error = %v", err)
+			}
+			got, ok := storedValue(rr)
+			if !ok || got != tt.want {
+				t.Fatalf("storedValue() = %q, %v, want %q", got, ok, tt.want)
+			}
+			rec := &types.DNSRecord{Name: rr.Header().Name, Type: uint16ToRecordType(rr.Header().Rrtype), TTL: 300, Value: []string{got}}
+			if back := buildRR(rec); back == nil || back.Header().Rrtype != rr.Header().Rrtype {
+				t.Errorf("buildRR(storedValue()) = %v, want %s", back, tt.name)
+			}
+		})
+	}
+}
+
+func TestBuildRRs_OneRRPerValue(t *testing.T) {
+	tests := []struct {
+		name   string
+		record *types.DNSRecord
+		want   int
+	}{
+		{name: "TXT", record: &types.DNSRecord{Name: "a.com.", Type: types.RecordTypeTXT, TTL: 60, Value: []string{"token-1", "token-2"}}, want: 2},
+		{name: "A", record: &types.DNSRecord{Name: "a.com.", Type: types.RecordTypeA, TTL: 60, Value: []string{"10.0.0.1", "10.0.0.2"}}, want: 2},
+		{name: "SOA", record: &types.DNSRecord{Name: "a.com.", Type: types.RecordTypeSOA, TTL: 60, Value: []string{"ns1.a.com.", "admin.a.com."}}, want: 1},
+	}
+	for _, tt := range tests {
+		if got := buildRRs(tt.record); len(got) != tt.want {
+			t.Errorf("buildRRs(%s) returned %d RRs, want %d", tt.name, len(got), tt.want)
+		}
+	}
+}
+
+func TestTxtStrings(t *testing.T) {
+	tests := []struct {
+		name  string
+		in    []string
+		wantN []int // length of each resulting string
+	}{
+		{name: "short", in: []string{"v=spf1 -all"}, wantN: []int{11}},
+		{name: "exactly 255", in: []string{strings.Repeat("a", 255)}, wantN: []int{255}},
+		{name: "long", in: []string{strings.Repeat("a", 600)}, wantN: []int{255, 255, 90}},
+		{name: "escape not split", in: []string{strings.Repeat("a", 254) + `\"b`}, wantN: []int{256, 1}},
+		{name: "decimal escape not split", in: []string{strings.Repeat("a", 254) + `\065b`}, wantN: []int{258, 1}},
+		{name: "several values", in: []string{"a", "b"}, wantN: []int{1, 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := txtStrings(tt.in)
+			if len(got) != len(tt.wantN) {
+				t.Fatalf("txtStrings() = %d strings, want %d", len(got), len(tt.wantN))
+			}
+			for i, s := range got {
+				if len(s) != tt.wantN[i] {
+					t.Errorf("string %d length = %d, want %d", i, len(s), tt.wantN[i])
+				}
+			}
+			if strings.Join(got, "") != strings.Join(tt.in, "") {
+				t.Error("joined strings differ from input")
+			}
+		})
+	}
+}
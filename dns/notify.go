@@ -0,0 +1,207 @@
+package dns
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"jabberwocky238/jw238dns/metrics"
+	"jabberwocky238/jw238dns/storage"
+	"jabberwocky238/jw238dns/tsig"
+
+	"github.com/miekg/dns"
+)
+
+// NotifyConfig holds configuration for outgoing NOTIFY messages.
+type NotifyConfig struct {
+	Secondaries   []string      // Secondary server addresses (e.g. "10.0.0.2:53")
+	Timeout       time.Duration // Time to wait for a NOTIFY response
+	Retries       int           // Retransmissions after the first attempt
+	RetryInterval time.Duration // Delay before the first retransmission; doubled each time
+	TSIGKey       string        // Key signing NOTIFY messages; empty sends them unsigned
+	Keyring       *tsig.Keyring // Keys for TSIGKey
+}
+
+// DefaultNotifyConfig returns a NotifyConfig with the retransmission
+// defaults suggested by RFC 1996 section 3.6: a 60 second interval and at
+// most 5 retransmissions.
+func DefaultNotifyConfig() NotifyConfig {
+	return NotifyConfig{
+		Timeout:       5 * time.Second,
+		Retries:       5,
+		RetryInterval: 60 * time.Second,
+	}
+}
+
+// Notifier sends DNS NOTIFY messages (RFC 1996) to secondaries whenever a
+// zone tracked by the journal changes, so they refresh immediately instead
+// of waiting for the SOA refresh interval.
+type Notifier struct {
+	journal *storage.Journal
+	config  NotifyConfig
+	client  *dns.Client
+
+	mu      sync.Mutex
+	pending map[string]context.CancelFunc // zone -> cancels in-flight retries
+	wg      sync.WaitGroup
+}
+
+// NewNotifier creates a Notifier for the journal's zones.
+func NewNotifier(journal *storage.Journal, cfg NotifyConfig) *Notifier {
+	return &Notifier{
+		journal: journal,
+		config:  cfg,
+		client: &dns.Client{
+			Net:          "udp",
+			Timeout:      cfg.Timeout,
+			TsigProvider: tsigProvider(cfg.Keyring),
+		},
+		pending: make(map[string]context.CancelFunc),
+	}
+}
+
+// Run subscribes to zone changes and notifies secondaries of each one. It
+// blocks until ctx is cancelled, then waits for in-flight notifications to
+// stop.
+func (n *Notifier) Run(ctx context.Context) {
+	changed := make(chan string, 64)
+	n.journal.Subscribe(changed)
+
+	for {
+		select {
+		case <-ctx.Done():
+			n.wg.Wait()
+			return
+		case zone := <-changed:
+			n.Notify(ctx, zone)
+		}
+	}
+}
+
+// Notify sends a NOTIFY for zone to every secondary in the background. A
+// newer change to the same zone supersedes retries still pending for an
+// older serial.
+func (n *Notifier) Notify(ctx context.Context, zone string) {
+	if len(n.config.Secondaries) == 0 {
+		return
+	}
+	soa, _, serial, ok := n.journal.Zone(zone)
+	if !ok {
+		return
+	}
+	msg := new(dns.Msg)
+	msg.SetNotify(soa.Name)
+	msg.Authoritative = true
+	msg.Answer = []dns.RR{zoneSOA(soa, serial)}
+
+	n.mu.Lock()
+	if cancel, ok := n.pending[zone]; ok {
+		cancel()
+	}
+	zoneCtx, cancel := context.WithCancel(ctx)
+	n.pending[zone] = cancel
+	n.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, secondary := range n.config.Secondaries {
+		wg.Add(1)
+		n.wg.Add(1)
+		go func() {
+			defer n.wg.Done()
+			defer wg.Done()
+			n.send(zoneCtx, zone, serial, secondary, msg.Copy())
+		}()
+	}
+
+	// Release the zone's slot once every secondary is done, unless a newer
+	// notification has already taken it.
+	n.wg.Add(1)
+	go func() {
+		defer n.wg.Done()
+		wg.Wait()
+		n.mu.Lock()
+		if zoneCtx.Err() == nil {
+			delete(n.pending, zone)
+		}
+		n.mu.Unlock()
+		cancel()
+	}()
+}
+
+// send delivers msg to one secondary, retransmitting with doubling delays
+// until the secondary responds, the retries run out or ctx is cancelled.
+// Any response ends retransmission (RFC 1996 section 3.6); a non-NOERROR
+// response is logged as a rejection.
+func (n *Notifier) send(ctx context.Context, zone string, serial uint32, secondary string, msg *dns.Msg) {
+	delay := n.config.RetryInterval
+	for attempt := 0; ; attempt++ {
+		msg.Id = dns.Id()
+		// Re-sign every attempt: the signature covers the ID and the time.
+		if err := signMsg(n.config.Keyring, n.config.TSIGKey, msg); err != nil {
+			metrics.NotifiesTotal.WithLabelValues("failed").Inc()
+			slog.Error("failed to sign NOTIFY", "zone", zone, "error", err)
+			return
+		}
+		resp, _, err := n.client.ExchangeContext(ctx, msg, secondary)
+		if err != nil && resp != nil {
+			if t := resp.IsTsig(); t != nil && t.Error != dns.RcodeSuccess {
+				// An unsigned BADKEY/BADSIG answer cannot be trusted, so
+				// keep retrying, but say why.
+				slog.Warn("secondary rejected NOTIFY signature",
+					"zone", zone,
+					"secondary", secondary,
+					"tsig_error", dns.RcodeToString[int(t.Error)],
+				)
+			}
+		}
+		if err == nil {
+			if resp.Rcode != dns.RcodeSuccess {
+				metrics.NotifiesTotal.WithLabelValues("rejected").Inc()
+				slog.Warn("secondary rejected NOTIFY",
+					"zone", zone,
+					"serial", serial,
+					"secondary", secondary,
+					"rcode", dns.RcodeToString[resp.Rcode],
+				)
+				return
+			}
+			metrics.NotifiesTotal.WithLabelValues("acked").Inc()
+			slog.Info("secondary acknowledged NOTIFY",
+				"zone", zone,
+				"serial", serial,
+				"secondary", secondary,
+			)
+			return
+		}
+		if ctx.Err() != nil {
+			metrics.NotifiesTotal.WithLabelValues("superseded").Inc()
+			return
+		}
+		if attempt >= n.config.Retries {
+			metrics.NotifiesTotal.WithLabelValues("failed").Inc()
+			slog.Warn("giving up on NOTIFY",
+				"zone", zone,
+				"serial", serial,
+				"secondary", secondary,
+				"attempts", attempt+1,
+				"error", err,
+			)
+			return
+		}
+		slog.Debug("NOTIFY not answered, retrying",
+			"zone", zone,
+			"secondary", secondary,
+			"retry_in", delay,
+			"error", err,
+		)
+
+		select {
+		case <-ctx.Done():
+			metrics.NotifiesTotal.WithLabelValues("superseded").Inc()
+			return
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
@@ -0,0 +1,157 @@
+package dns
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"jabberwocky238/jw238dns/storage"
+	"jabberwocky238/jw238dns/types"
+
+	"github.com/miekg/dns"
+)
+
+// fakeSecondary records NOTIFY messages. It ignores the first drop
+// messages and answers the rest with rcode.
+type fakeSecondary struct {
+	mu       sync.Mutex
+	received []*dns.Msg
+	drop     int
+	rcode    int
+	got      chan *dns.Msg
+}
+
+func (s *fakeSecondary) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	s.mu.Lock()
+	s.received = append(s.received, r)
+	drop := len(s.received) <= s.drop
+	s.mu.Unlock()
+	if drop {
+		return
+	}
+	resp := new(dns.Msg)
+	resp.SetRcode(r, s.rcode)
+	_ = w.WriteMsg(resp)
+	s.got <- r
+}
+
+func (s *fakeSecondary) attempts() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.received)
+}
+
+func startSecondary(t *testing.T, sec *fakeSecondary) string {
+	t.Helper()
+	sec.got = make(chan *dns.Msg, 16)
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	server := &dns.Server{PacketConn: pc, Handler: sec}
+	started := make(chan struct{})
+	server.NotifyStartedFunc = func() { close(started) }
+	go func() { _ = server.ActivateAndServe() }()
+	<-started
+	t.Cleanup(func() { _ = server.Shutdown() })
+	return pc.LocalAddr().String()
+}
+
+func setupNotifier(t *testing.T, secondaries ...string) (*Notifier, *storage.MemoryStorage, *storage.Journal) {
+	t.Helper()
+	store := storage.NewMemoryStorage()
+	_ = store.Create(context.Background(), &types.DNSRecord{
+		Name: "example.com.", Type: types.RecordTypeSOA, TTL: 300,
+		Value: []string{"ns1.example.com. admin.example.com. 1 3600 900 604800 86400"},
+	})
+	journal := storage.NewJournal(store, 0)
+	notifier := NewNotifier(journal, NotifyConfig{
+		Secondaries:   secondaries,
+		Timeout:       100 * time.Millisecond,
+		Retries:       2,
+		RetryInterval: 10 * time.Millisecond,
+	})
+	return notifier, store, journal
+}
+
+func TestDefaultNotifyConfig(t *testing.T) {
+	cfg := DefaultNotifyConfig()
+	if cfg.Retries != 5 || cfg.RetryInterval != 60*time.Second {
+		t.Errorf("DefaultNotifyConfig() = %+v, want RFC 1996 defaults", cfg)
+	}
+}
+
+func TestNotifier_RunNotifiesOnChange(t *testing.T) {
+	sec := &fakeSecondary{rcode: dns.RcodeSuccess}
+	notifier, store, journal := setupNotifier(t, startSecondary(t, sec))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go notifier.Run(ctx)
+	time.Sleep(20 * time.Millisecond)
+
+	_ = store.Create(ctx, &types.DNSRecord{
+		Name: "_acme-challenge.example.com.", Type: types.RecordTypeTXT, TTL: 60, Value: []string{"token"},
+	})
+	journal.Sync()
+	serial, _ := journal.Serial("example.com.")
+
+	select {
+	case msg := <-sec.got:
+		if msg.Opcode != dns.OpcodeNotify || !msg.Authoritative {
+			t.Errorf("opcode = %s, aa = %v, want NOTIFY with AA", dns.OpcodeToString[msg.Opcode], msg.Authoritative)
+		}
+		if q := msg.Question[0]; q.Name != "example.com." || q.Qtype != dns.TypeSOA {
+			t.Errorf("question = %v, want example.com. SOA", q)
+		}
+		if len(msg.Answer) != 1 || msg.Answer[0].(*dns.SOA).Serial != serial {
+			t.Errorf("answer = %v, want SOA with serial %d", msg.Answer, serial)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("secondary did not receive NOTIFY")
+	}
+}
+
+func TestNotifier_Retries(t *testing.T) {
+	tests := []struct {
+		name         string
+		drop         int
+		rcode        int
+		wantAttempts int
+	}{
+		{name: "answered first time", drop: 0, rcode: dns.RcodeSuccess, wantAttempts: 1},
+		{name: "retransmits until answered", drop: 2, rcode: dns.RcodeSuccess, wantAttempts: 3},
+		{name: "gives up after retries", drop: 10, rcode: dns.RcodeSuccess, wantAttempts: 3},
+		{name: "rejection is not retried", drop: 0, rcode: dns.RcodeNotImplemented, wantAttempts: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sec := &fakeSecondary{drop: tt.drop, rcode: tt.rcode}
+			notifier, _, _ := setupNotifier(t, startSecondary(t, sec))
+
+			ctx, cancel := context.WithCancel(context.Background())
+			notifier.Notify(ctx, "example.com.")
+			// Retries are 10ms then 20ms apart, each attempt times out at 100ms.
+			time.Sleep(500 * time.Millisecond)
+			cancel()
+			notifier.wg.Wait()
+
+			if got := sec.attempts(); got != tt.wantAttempts {
+				t.Errorf("attempts = %d, want %d", got, tt.wantAttempts)
+			}
+		})
+	}
+}
+
+func TestNotifier_UnknownZone(t *testing.T) {
+	sec := &fakeSecondary{rcode: dns.RcodeSuccess}
+	notifier, _, _ := setupNotifier(t, startSecondary(t, sec))
+
+	notifier.Notify(context.Background(), "example.org.")
+	notifier.wg.Wait()
+	if got := sec.attempts(); got != 0 {
+		t.Errorf("attempts = %d, want 0 for a zone without SOA", got)
+	}
+}
@@ -0,0 +1,502 @@
+package dns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"jabberwocky238/jw238dns/metrics"
+	"jabberwocky238/jw238dns/storage"
+	"jabberwocky238/jw238dns/tsig"
+	"jabberwocky238/jw238dns/types"
+
+	"github.com/miekg/dns"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+)
+
+// defaultSecondaryRetry is the delay before retrying a failed refresh when
+// the zone's SOA (and thus its retry interval) is not yet known.
+const defaultSecondaryRetry = 30 * time.Second
+
+// errNoSerialHistory is returned when an IXFR response does not start at
+// the serial we hold, so a full transfer is needed.
+var errNoSerialHistory = errors.New("IXFR does not start at the local serial")
+
+// SecondaryZone names a zone to pull and the primaries to pull it from.
+type SecondaryZone struct {
+	Name      string   // Zone apex (e.g. "example.com.")
+	Primaries []string // Primary server addresses (e.g. "10.0.0.1:53"), tried in order
+	TSIGKey   string   // Key signing transfer requests; NOTIFY must be signed with it too
+}
+
+// SecondaryConfig holds configuration for secondary zones.
+type SecondaryConfig struct {
+	Zones   []SecondaryZone
+	Refresh time.Duration // Overrides the SOA refresh interval when non-zero
+	Timeout time.Duration // Dial and read timeout for transfers
+	Keyring *tsig.Keyring // Keys for SecondaryZone.TSIGKey
+}
+
+// DefaultSecondaryConfig returns a SecondaryConfig with sensible defaults.
+func DefaultSecondaryConfig() SecondaryConfig {
+	return SecondaryConfig{
+		Timeout: 10 * time.Second,
+	}
+}
+
+// Secondary keeps zones in sync with external primaries. Each zone is
+// transferred (IXFR when possible, AXFR otherwise) on the SOA refresh
+// schedule and whenever a primary sends NOTIFY, then published with
+// MemoryStorage.ApplySource under the source "secondary:<zone>".
+//
+// Pulled records are served but never persisted or recorded in the
+// history, and reloads of the storage backend leave them alone. Local
+// records win over the primary's where both define the same name and
+// type.
+type Secondary struct {
+	store  *storage.MemoryStorage
+	config SecondaryConfig
+	zones  map[string]*secondaryZone
+}
+
+// secondaryZone is the transfer state of one zone.
+type secondaryZone struct {
+	name      string
+	primaries []string
+	tsigKey   string
+	notify    chan struct{}
+
+	mu          sync.Mutex
+	soa         *dns.SOA          // nil until the first successful transfer
+	full        bool              // The primary cannot serve soa's serial incrementally
+	rrs         map[string]dns.RR // current zone contents keyed by rrKey
+	lastSuccess time.Time
+}
+
+// NewSecondary creates a Secondary for the configured zones.
+func NewSecondary(store *storage.MemoryStorage, cfg SecondaryConfig) *Secondary {
+	s := &Secondary{
+		store:  store,
+		config: cfg,
+		zones:  make(map[string]*secondaryZone),
+	}
+	for _, z := range cfg.Zones {
+		name := strings.ToLower(dns.Fqdn(z.Name))
+		s.zones[name] = &secondaryZone{
+			name:      name,
+			primaries: z.Primaries,
+			tsigKey:   z.TSIGKey,
+			notify:    make(chan struct{}, 1),
+		}
+	}
+	return s
+}
+
+// IsNotify reports whether msg is a NOTIFY request.
+func IsNotify(msg *dns.Msg) bool {
+	return msg != nil && msg.Opcode == dns.OpcodeNotify && !msg.Response && len(msg.Question) == 1
+}
+
+// Run refreshes every zone on its schedule until ctx is cancelled.
+func (s *Secondary) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, z := range s.zones {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.runZone(ctx, z)
+		}()
+	}
+	wg.Wait()
+}
+
+// runZone refreshes z immediately and then after each refresh or retry
+// interval, or as soon as a NOTIFY arrives.
+func (s *Secondary) runZone(ctx context.Context, z *secondaryZone) {
+	for {
+		var wait time.Duration
+		if err := s.refresh(ctx, z); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			wait = s.retryInterval(z)
+			slog.Warn("secondary zone refresh failed",
+				"zone", z.name,
+				"retry_in", wait,
+				"error", err,
+			)
+			s.expire(ctx, z)
+		} else {
+			wait = s.refreshInterval(z)
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-z.notify:
+			timer.Stop()
+		case <-timer.C:
+		}
+	}
+}
+
+// HandleNotify answers a NOTIFY from a primary and schedules an immediate
+// refresh of the zone. NOTIFY for zones we do not pull is answered with
+// NOTAUTH; NOTIFY from hosts that are not a configured primary, or not
+// signed with the zone's TSIG key when it has one, is refused.
+func (s *Secondary) HandleNotify(w dns.ResponseWriter, r *dns.Msg) {
+	zone := strings.ToLower(dns.Fqdn(r.Question[0].Name))
+	client := remoteIP(w.RemoteAddr())
+
+	z, ok := s.zones[zone]
+	if !ok {
+		writeRcode(w, r, dns.RcodeNotAuth)
+		return
+	}
+	if !isPrimary(z.primaries, client) {
+		slog.Warn("NOTIFY from unknown host refused", "zone", zone, "client", client)
+		writeRcode(w, r, dns.RcodeRefused)
+		return
+	}
+	if rejectBadTSIG(w, r) {
+		return
+	}
+	if z.tsigKey != "" {
+		if t := r.IsTsig(); t == nil || dns.CanonicalName(t.Hdr.Name) != dns.CanonicalName(z.tsigKey) {
+			slog.Warn("NOTIFY without the zone's TSIG key refused", "zone", zone, "client", client)
+			writeRcode(w, r, dns.RcodeRefused)
+			return
+		}
+	}
+
+	resp := new(dns.Msg)
+	resp.SetReply(r)
+	resp.Authoritative = true
+	signReply(w, r, resp)
+	if err := w.WriteMsg(resp); err != nil {
+		slog.Error("failed to write response", "error", err)
+	}
+
+	slog.Info("received NOTIFY", "zone", zone, "primary", client)
+	select {
+	case z.notify <- struct{}{}:
+	default: // a refresh is already pending
+	}
+}
+
+// refresh transfers z from the first primary that answers and applies the
+// result to the store.
+func (s *Secondary) refresh(ctx context.Context, z *secondaryZone) error {
+	ctx, span := tracer.Start(ctx, "Secondary.refresh")
+	defer span.End()
+	span.SetAttributes(attribute.String("dns.zone", z.name))
+
+	z.mu.Lock()
+	defer z.mu.Unlock()
+
+	var errs []error
+	for _, primary := range z.primaries {
+		rrs, err := s.transfer(z, primary)
+		if err == nil {
+			err = s.apply(ctx, z, rrs)
+		}
+		if errors.Is(err, errNoSerialHistory) {
+			// The primary cannot serve our serial incrementally; start
+			// over with a full transfer. The SOA is kept, so the zone
+			// still expires if that fails too.
+			z.full = true
+			if rrs, err = s.transfer(z, primary); err == nil {
+				err = s.apply(ctx, z, rrs)
+			}
+		}
+		if err == nil {
+			z.lastSuccess = time.Now()
+			return nil
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", primary, err))
+	}
+
+	err := errors.Join(errs...)
+	if err == nil {
+		err = errors.New("no primaries configured")
+	}
+	metrics.ObserveReload("secondary", err)
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+	return err
+}
+
+// transfer requests the zone from primary: IXFR from the current serial
+// once the zone is loaded, AXFR before that or when the primary cannot
+// serve the serial incrementally.
+func (s *Secondary) transfer(z *secondaryZone, primary string) ([]dns.RR, error) {
+	m := new(dns.Msg)
+	if z.soa != nil && !z.full {
+		m.SetIxfr(z.name, z.soa.Serial, z.soa.Ns, z.soa.Mbox)
+	} else {
+		m.SetAxfr(z.name)
+	}
+	if err := signMsg(s.config.Keyring, z.tsigKey, m); err != nil {
+		return nil, err
+	}
+
+	tr := &dns.Transfer{
+		DialTimeout:  s.config.Timeout,
+		ReadTimeout:  s.config.Timeout,
+		TsigProvider: tsigProvider(s.config.Keyring),
+	}
+	env, err := tr.In(m, primary)
+	if err != nil {
+		return nil, err
+	}
+	var rrs []dns.RR
+	for e := range env {
+		if e.Error != nil {
+			return nil, e.Error
+		}
+		rrs = append(rrs, e.RR...)
+	}
+	if len(rrs) == 0 {
+		return nil, errors.New("empty transfer")
+	}
+	if _, ok := rrs[0].(*dns.SOA); !ok {
+		return nil, errors.New("transfer does not start with SOA")
+	}
+	return rrs, nil
+}
+
+// apply interprets a transfer response (up to date, incremental or full)
+// and loads the resulting zone contents into the store.
+func (s *Secondary) apply(ctx context.Context, z *secondaryZone, rrs []dns.RR) error {
+	soa := rrs[0].(*dns.SOA)
+
+	var contents map[string]dns.RR
+	switch {
+	case len(rrs) == 1:
+		// Single SOA: the zone has not changed since our serial.
+		if z.soa == nil || soa.Serial != z.soa.Serial {
+			return errNoSerialHistory
+		}
+		return nil
+	case isIncremental(rrs):
+		var err error
+		if contents, err = applyIncremental(z, rrs); err != nil {
+			return err
+		}
+	default:
+		contents = make(map[string]dns.RR, len(rrs))
+		for _, rr := range rrs[:len(rrs)-1] {
+			contents[rrKey(rr)] = rr
+		}
+	}
+
+	s.load(ctx, z.name, contents)
+	slog.Info("secondary zone refreshed",
+		"zone", z.name,
+		"serial", soa.Serial,
+		"rrs", len(contents),
+	)
+	z.soa = soa
+	z.full = false
+	z.rrs = contents
+	return nil
+}
+
+// load replaces the records published for zone with contents.
+func (s *Secondary) load(ctx context.Context, zone string, contents map[string]dns.RR) {
+	for _, rr := range contents {
+		if loss := approximation(rr); loss != "" {
+			hdr := rr.Header()
+			slog.Warn("secondary zone record stored approximately", "zone", zone, "name", hdr.Name, "type", dns.Type(hdr.Rrtype), "detail", loss)
+		}
+	}
+	conflicts := s.store.ApplySource(ctx, secondarySource(zone), rrsToRecords(contents))
+	metrics.ObserveReload("secondary", nil)
+	for _, key := range conflicts {
+		slog.Warn("secondary zone record shadowed by a local record", "zone", zone, "name", key.Name, "type", key.Type)
+	}
+}
+
+// secondarySource names the records pulled for zone.
+func secondarySource(zone string) string {
+	return "secondary:" + zone
+}
+
+// expire removes a zone whose primaries have been unreachable for longer
+// than the SOA expire interval (RFC 1035 section 3.3.13).
+func (s *Secondary) expire(ctx context.Context, z *secondaryZone) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+
+	if z.soa == nil || time.Since(z.lastSuccess) < time.Duration(z.soa.Expire)*time.Second {
+		return
+	}
+	slog.Warn("secondary zone expired", "zone", z.name, "last_refresh", z.lastSuccess)
+	s.load(ctx, z.name, nil)
+	z.soa = nil
+	z.full = false
+	z.rrs = nil
+}
+
+// refreshInterval returns the delay before the next scheduled refresh.
+func (s *Secondary) refreshInterval(z *secondaryZone) time.Duration {
+	if s.config.Refresh > 0 {
+		return s.config.Refresh
+	}
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	if z.soa == nil || z.soa.Refresh == 0 {
+		return defaultSecondaryRetry
+	}
+	return time.Duration(z.soa.Refresh) * time.Second
+}
+
+// retryInterval returns the delay before retrying a failed refresh.
+func (s *Secondary) retryInterval(z *secondaryZone) time.Duration {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	if z.soa == nil || z.soa.Retry == 0 {
+		return defaultSecondaryRetry
+	}
+	return time.Duration(z.soa.Retry) * time.Second
+}
+
+// isIncremental reports whether a transfer response is an incremental
+// (RFC 1995) one: the current SOA followed by an older SOA.
+func isIncremental(rrs []dns.RR) bool {
+	if len(rrs) < 3 {
+		return false
+	}
+	second, ok := rrs[1].(*dns.SOA)
+	return ok && second.Serial != rrs[0].(*dns.SOA).Serial
+}
+
+// applyIncremental replays the difference sequences of an IXFR response
+// onto a copy of the zone's current contents.
+func applyIncremental(z *secondaryZone, rrs []dns.RR) (map[string]dns.RR, error) {
+	if z.soa == nil || rrs[1].(*dns.SOA).Serial != z.soa.Serial {
+		return nil, errNoSerialHistory
+	}
+
+	contents := make(map[string]dns.RR, len(z.rrs))
+	for k, rr := range z.rrs {
+		contents[k] = rr
+	}
+
+	last := len(rrs) - 1
+	i := 1
+	for i < last {
+		// Old SOA, then the RRs it deletes.
+		i++
+		for i < last && rrs[i].Header().Rrtype != dns.TypeSOA {
+			delete(contents, rrKey(rrs[i]))
+			i++
+		}
+		if i >= last {
+			return nil, errors.New("truncated IXFR sequence")
+		}
+		// New SOA, then the RRs it adds.
+		newSOA := rrs[i]
+		i++
+		for i < last && rrs[i].Header().Rrtype != dns.TypeSOA {
+			contents[rrKey(rrs[i])] = rrs[i]
+			i++
+		}
+		contents[rrKey(newSOA)] = newSOA
+	}
+
+	// Keep exactly one SOA: the current one.
+	for k, rr := range contents {
+		if rr.Header().Rrtype == dns.TypeSOA {
+			delete(contents, k)
+		}
+	}
+	contents[rrKey(rrs[0])] = rrs[0]
+	return contents, nil
+}
+
+// rrKey identifies an RR by owner, type and rdata, ignoring TTL and case of
+// the owner name, so IXFR deletions match regardless of TTL.
+func rrKey(rr dns.RR) string {
+	c := dns.Copy(rr)
+	c.Header().Ttl = 0
+	c.Header().Name = strings.ToLower(c.Header().Name)
+	if soa, ok := c.(*dns.SOA); ok {
+		// A zone has a single SOA, whatever its serial.
+		return soa.Header().Name + " SOA"
+	}
+	return c.String()
+}
+
+// rrsToRecords merges RRs sharing an owner and type into one DNSRecord
+// with multiple values, using the smallest TTL of the set. Values are
+// sorted so repeated transfers of the same data compare equal.
+func rrsToRecords(rrs map[string]dns.RR) []*types.DNSRecord {
+	keys := make([]string, 0, len(rrs))
+	for k := range rrs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	byKey := make(map[types.RecordKey]*types.DNSRecord)
+	var records []*types.DNSRecord
+	for _, k := range keys {
+		rr := rrs[k]
+		hdr := rr.Header()
+		value, ok := storedValue(rr)
+		rt := uint16ToRecordType(hdr.Rrtype)
+		if !ok || rt == "" {
+			continue
+		}
+		key := types.RecordKey{Name: hdr.Name, Type: rt}
+		existing, ok := byKey[key]
+		if !ok {
+			rec := &types.DNSRecord{Name: hdr.Name, Type: rt, TTL: hdr.Ttl, Value: []string{value}}
+			byKey[key] = rec
+			records = append(records, rec)
+			continue
+		}
+		existing.Value = append(existing.Value, value)
+		existing.TTL = min(existing.TTL, hdr.Ttl)
+	}
+	return records
+}
+
+// isPrimary reports whether ip belongs to one of the primaries. Primaries
+// given by host name are resolved on each call.
+func isPrimary(primaries []string, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, primary := range primaries {
+		host, _, err := net.SplitHostPort(primary)
+		if err != nil {
+			host = primary
+		}
+		if addr := net.ParseIP(host); addr != nil {
+			if addr.Equal(ip) {
+				return true
+			}
+			continue
+		}
+		addrs, err := net.LookupIP(host)
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if addr.Equal(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,318 @@
+package dns
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"jabberwocky238/jw238dns/storage"
+	"jabberwocky238/jw238dns/types"
+
+	"github.com/miekg/dns"
+)
+
+// setupPrimary starts a primary serving example.com over TCP from its own
+// store and journal.
+func setupPrimary(t *testing.T) (string, *storage.MemoryStorage, *storage.Journal) {
+	t.Helper()
+	return setupTransfer(t, TransferConfig{AllowFrom: []string{"127.0.0.1"}})
+}
+
+func setupSecondary(t *testing.T, primary string) (*Secondary, *storage.MemoryStorage) {
+	t.Helper()
+	store := storage.NewMemoryStorage()
+	cfg := DefaultSecondaryConfig()
+	cfg.Timeout = 2 * time.Second
+	cfg.Zones = []SecondaryZone{{Name: "Example.com", Primaries: []string{primary}}}
+	return NewSecondary(store, cfg), store
+}
+
+func getValues(t *testing.T, store *storage.MemoryStorage, name string, rt types.RecordType) []string {
+	t.Helper()
+	recs, err := store.Get(context.Background(), name, rt)
+	if err != nil {
+		return nil
+	}
+	return recs[0].Value
+}
+
+func TestSecondary_Refresh(t *testing.T) {
+	primary, primaryStore, journal := setupPrimary(t)
+	sec, store := setupSecondary(t, primary)
+	ctx := context.Background()
+	z := sec.zones["example.com."]
+
+	// Local records survive, inside the zone or not.
+	_ = store.Create(ctx, &types.DNSRecord{Name: "local.test.", Type: types.RecordTypeA, TTL: 300, Value: []string{"10.1.1.1"}})
+	_ = store.Create(ctx, &types.DNSRecord{Name: "local.example.com.", Type: types.RecordTypeA, TTL: 300, Value: []string{"10.2.2.2"}})
+
+	if err := sec.refresh(ctx, z); err != nil {
+		t.Fatalf("initial refresh error = %v", err)
+	}
+	if got := getValues(t, store, "www.example.com.", types.RecordTypeA); len(got) != 2 || got[0] != "192.168.1.1" || got[1] != "192.168.1.2" {
+		t.Errorf("www A after AXFR = %v, want both addresses", got)
+	}
+	for _, name := range []string{"local.test.", "local.example.com."} {
+		if got := getValues(t, store, name, types.RecordTypeA); len(got) != 1 {
+			t.Errorf("local record %s was removed", name)
+		}
+	}
+	serial, _ := journal.Serial("example.com.")
+	if z.soa.Serial != serial {
+		t.Errorf("secondary serial = %d, want %d", z.soa.Serial, serial)
+	}
+
+	// Change the primary and pull the difference with IXFR.
+	_ = primaryStore.Update(ctx, &types.DNSRecord{Name: "www.example.com.", Type: types.RecordTypeA, TTL: 300, Value: []string{"192.168.1.9"}})
+	_ = primaryStore.Create(ctx, &types.DNSRecord{Name: "_acme-challenge.example.com.", Type: types.RecordTypeTXT, TTL: 60, Value: []string{"token"}})
+	_ = primaryStore.Delete(ctx, "ns1.example.com.", types.RecordTypeA)
+	journal.Sync()
+
+	if err := sec.refresh(ctx, z); err != nil {
+		t.Fatalf("incremental refresh error = %v", err)
+	}
+	if got := getValues(t, store, "www.example.com.", types.RecordTypeA); len(got) != 1 || got[0] != "192.168.1.9" {
+		t.Errorf("www A after IXFR = %v, want [192.168.1.9]", got)
+	}
+	if got := getValues(t, store, "_acme-challenge.example.com.", types.RecordTypeTXT); len(got) != 1 {
+		t.Errorf("TXT after IXFR = %v, want token", got)
+	}
+	if got := getValues(t, store, "ns1.example.com.", types.RecordTypeA); got != nil {
+		t.Errorf("deleted record after IXFR = %v, want removed", got)
+	}
+	if newSerial, _ := journal.Serial("example.com."); z.soa.Serial != newSerial {
+		t.Errorf("secondary serial = %d, want %d", z.soa.Serial, newSerial)
+	}
+
+	// Nothing changed: a refresh is a no-op.
+	version := store.Version()
+	if err := sec.refresh(ctx, z); err != nil {
+		t.Fatalf("up-to-date refresh error = %v", err)
+	}
+	if store.Version() != version {
+		t.Error("up-to-date refresh modified the store")
+	}
+}
+
+func TestSecondary_Refresh_UnknownSerialFallsBack(t *testing.T) {
+	primary, _, _ := setupPrimary(t)
+	sec, store := setupSecondary(t, primary)
+	ctx := context.Background()
+	z := sec.zones["example.com."]
+
+	if err := sec.refresh(ctx, z); err != nil {
+		t.Fatalf("initial refresh error = %v", err)
+	}
+	// Pretend we hold a serial the primary has no history for.
+	z.soa.Serial -= 10
+	if err := sec.refresh(ctx, z); err != nil {
+		t.Fatalf("fallback refresh error = %v", err)
+	}
+	if got := getValues(t, store, "www.example.com.", types.RecordTypeA); len(got) != 2 {
+		t.Errorf("www A after fallback = %v, want 2 values", got)
+	}
+}
+
+func TestSecondary_FailedFallbackStillExpires(t *testing.T) {
+	primary, _, _ := setupPrimary(t)
+	sec, store := setupSecondary(t, primary)
+	ctx := context.Background()
+	z := sec.zones["example.com."]
+
+	if err := sec.refresh(ctx, z); err != nil {
+		t.Fatalf("initial refresh error = %v", err)
+	}
+
+	// A primary that has lost our serial's history and refuses AXFR.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	server := &dns.Server{Listener: ln, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		if r.Question[0].Qtype == dns.TypeIXFR {
+			// Changes that start after the serial we hold.
+			from, to := *z.soa, *z.soa
+			from.Serial += 5
+			to.Serial += 10
+			m.Answer = []dns.RR{&to, &from, &to, &to}
+		} else {
+			m.Rcode = dns.RcodeRefused
+		}
+		_ = w.WriteMsg(m)
+	})}
+	started := make(chan struct{})
+	server.NotifyStartedFunc = func() { close(started) }
+	go func() { _ = server.ActivateAndServe() }()
+	<-started
+	t.Cleanup(func() { _ = server.Shutdown() })
+
+	z.primaries = []string{ln.Addr().String()}
+	if err := sec.refresh(ctx, z); err == nil {
+		t.Fatal("refresh() with AXFR refused should fail")
+	}
+	if z.soa == nil {
+		t.Fatal("failed fallback dropped the SOA")
+	}
+
+	z.lastSuccess = time.Now().Add(-time.Duration(z.soa.Expire+1) * time.Second)
+	sec.expire(ctx, z)
+	if got := getValues(t, store, "www.example.com.", types.RecordTypeA); got != nil {
+		t.Errorf("www A after expiry = %v, want none", got)
+	}
+}
+
+func TestSecondary_FileBackedStore(t *testing.T) {
+	primary, _, _ := setupPrimary(t)
+	sec, store := setupSecondary(t, primary)
+	ctx := context.Background()
+
+	path := filepath.Join(t.TempDir(), "records.json")
+	if err := os.WriteFile(path, []byte(`[{"name":"local.test.","type":"A","ttl":300,"value":["10.1.1.1"]}]`), 0o644); err != nil {
+		t.Fatalf("write records file: %v", err)
+	}
+	loader := storage.NewJSONFileLoader(path, store)
+	if err := loader.LoadAndApply(ctx); err != nil {
+		t.Fatalf("LoadAndApply() error = %v", err)
+	}
+	if err := sec.refresh(ctx, sec.zones["example.com."]); err != nil {
+		t.Fatalf("refresh error = %v", err)
+	}
+
+	// The pulled zone is not persisted...
+	if err := loader.Save(ctx); err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+	saved, err := loader.Load()
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if len(saved) != 1 || saved[0].Name != "local.test." {
+		t.Errorf("saved records = %v, want only local.test.", saved)
+	}
+
+	// ...and reloading the file does not delete it.
+	if err := loader.LoadAndApply(ctx); err != nil {
+		t.Fatalf("LoadAndApply() after refresh error = %v", err)
+	}
+	if got := getValues(t, store, "www.example.com.", types.RecordTypeA); len(got) != 2 {
+		t.Errorf("www A after file reload = %v, want 2 values", got)
+	}
+}
+
+func TestSecondary_Refresh_PrimaryDown(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	sec, _ := setupSecondary(t, addr)
+	if err := sec.refresh(context.Background(), sec.zones["example.com."]); err == nil {
+		t.Error("refresh() with unreachable primary should fail")
+	}
+}
+
+func TestSecondary_HandleNotify(t *testing.T) {
+	tests := []struct {
+		name      string
+		primary   string
+		zone      string
+		wantRcode int
+	}{
+		{name: "from primary", primary: "127.0.0.1:53", zone: "example.com.", wantRcode: dns.RcodeSuccess},
+		{name: "from unknown host", primary: "10.0.0.1:53", zone: "example.com.", wantRcode: dns.RcodeRefused},
+		{name: "unknown zone", primary: "127.0.0.1:53", zone: "example.org.", wantRcode: dns.RcodeNotAuth},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sec, _ := setupSecondary(t, tt.primary)
+
+			pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatalf("listen: %v", err)
+			}
+			server := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(sec.HandleNotify)}
+			started := make(chan struct{})
+			server.NotifyStartedFunc = func() { close(started) }
+			go func() { _ = server.ActivateAndServe() }()
+			<-started
+			defer server.Shutdown()
+
+			m := new(dns.Msg)
+			m.SetNotify(tt.zone)
+			resp, _, err := new(dns.Client).Exchange(m, pc.LocalAddr().String())
+			if err != nil {
+				t.Fatalf("Exchange() error = %v", err)
+			}
+			if resp.Rcode != tt.wantRcode {
+				t.Errorf("Rcode = %s, want %s", dns.RcodeToString[resp.Rcode], dns.RcodeToString[tt.wantRcode])
+			}
+			if tt.wantRcode == dns.RcodeSuccess && len(sec.zones["example.com."].notify) != 1 {
+				t.Error("NOTIFY did not schedule a refresh")
+			}
+		})
+	}
+}
+
+func TestSecondary_RunRefreshesOnNotify(t *testing.T) {
+	primary, primaryStore, journal := setupPrimary(t)
+	sec, store := setupSecondary(t, primary)
+	sec.config.Refresh = time.Hour
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go sec.Run(ctx)
+
+	waitFor := func(name string) bool {
+		deadline := time.Now().Add(2 * time.Second)
+		for time.Now().Before(deadline) {
+			if getValues(t, store, name, types.RecordTypeA) != nil {
+				return true
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		return false
+	}
+	if !waitFor("www.example.com.") {
+		t.Fatal("initial transfer did not load the zone")
+	}
+
+	_ = primaryStore.Create(ctx, &types.DNSRecord{Name: "new.example.com.", Type: types.RecordTypeA, TTL: 300, Value: []string{"192.168.1.77"}})
+	journal.Sync()
+	sec.zones["example.com."].notify <- struct{}{}
+
+	if !waitFor("new.example.com.") {
+		t.Error("NOTIFY did not trigger a refresh")
+	}
+}
+
+func TestIsNotify(t *testing.T) {
+	notify := new(dns.Msg)
+	notify.SetNotify("example.com.")
+	query := new(dns.Msg)
+	query.SetQuestion("example.com.", dns.TypeSOA)
+	reply := new(dns.Msg)
+	reply.SetReply(notify)
+
+	tests := []struct {
+		name string
+		msg  *dns.Msg
+		want bool
+	}{
+		{name: "notify", msg: notify, want: true},
+		{name: "query", msg: query, want: false},
+		{name: "notify response", msg: reply, want: false},
+		{name: "nil", msg: nil, want: false},
+	}
+	for _, tt := range tests {
+		if got := IsNotify(tt.msg); got != tt.want {
+			t.Errorf("IsNotify(%s) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,281 @@
+package dns
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+	"time"
+
+	"jabberwocky238/jw238dns/storage"
+	"jabberwocky238/jw238dns/types"
+
+	"github.com/miekg/dns"
+)
+
+// transferChunkSize is the number of RRs sent per message in a transfer.
+const transferChunkSize = 100
+
+// TransferConfig controls outgoing zone transfers (AXFR/IXFR).
+type TransferConfig struct {
+	Enabled     bool     // Serve AXFR/IXFR requests
+	AllowFrom   []string // CIDRs or IPs allowed to transfer; empty denies everyone
+	RequireTSIG bool     // Reject transfer requests that are not TSIG-signed
+}
+
+// Transferer serves AXFR and IXFR requests from a storage Journal.
+type Transferer struct {
+	journal     *storage.Journal
+	allow       []*net.IPNet
+	requireTSIG bool
+}
+
+// NewTransferer creates a Transferer for the given journal. It returns an
+// error if an AllowFrom entry is not a valid IP or CIDR.
+func NewTransferer(journal *storage.Journal, cfg TransferConfig) (*Transferer, error) {
+	allow, err := parseACL(cfg.AllowFrom)
+	if err != nil {
+		return nil, err
+	}
+	return &Transferer{
+		journal:     journal,
+		allow:       allow,
+		requireTSIG: cfg.RequireTSIG,
+	}, nil
+}
+
+// IsTransfer reports whether msg is an AXFR or IXFR request.
+func IsTransfer(msg *dns.Msg) bool {
+	if msg == nil || len(msg.Question) != 1 {
+		return false
+	}
+	qt := msg.Question[0].Qtype
+	return qt == dns.TypeAXFR || qt == dns.TypeIXFR
+}
+
+// ServeTransfer answers an AXFR or IXFR request on w. Requests from
+// clients outside the ACL, or without a required TSIG signature, are
+// refused.
+func (t *Transferer) ServeTransfer(w dns.ResponseWriter, r *dns.Msg) {
+	q := r.Question[0]
+	zone := strings.ToLower(dns.Fqdn(q.Name))
+	client := remoteIP(w.RemoteAddr())
+
+	if rcode, ok := t.authorize(w, r, client); !ok {
+		slog.Warn("zone transfer refused",
+			"zone", zone,
+			"client", client,
+			"rcode", dns.RcodeToString[rcode],
+		)
+		writeAuthRcode(w, r, rcode)
+		return
+	}
+
+	soa, records, serial, ok := t.journal.Zone(zone)
+	if !ok {
+		writeRcode(w, r, dns.RcodeNotAuth)
+		return
+	}
+	soaRR := zoneSOA(soa, serial)
+
+	_, isUDP := w.RemoteAddr().(*net.UDPAddr)
+	if q.Qtype == dns.TypeIXFR {
+		clientSerial, hasSerial := ixfrSerial(r)
+		if isUDP || (hasSerial && clientSerial == serial) {
+			// Up to date, or too large for UDP: a single SOA tells the
+			// client to compare serials and retry over TCP if needed.
+			t.writeSingle(w, r, soaRR)
+			return
+		}
+		if hasSerial {
+			if entries, ok := t.journal.Since(zone, clientSerial); ok {
+				t.send(w, r, ixfrRRs(soa, soaRR, entries))
+				slog.Info("served IXFR", "zone", zone, "client", client, "from", clientSerial, "to", serial)
+				return
+			}
+		}
+		// History unavailable: fall back to a full, AXFR-style response.
+	} else if isUDP {
+		writeRcode(w, r, dns.RcodeRefused)
+		return
+	}
+
+	rrs := []dns.RR{soaRR}
+	for _, rec := range records {
+		rrs = append(rrs, buildRRs(rec)...)
+	}
+	rrs = append(rrs, soaRR)
+	t.send(w, r, rrs)
+	slog.Info("served AXFR", "zone", zone, "client", client, "serial", serial, "records", len(rrs))
+}
+
+// authorize checks the client against the ACL and the TSIG requirements.
+// It returns the rcode to answer with when the request is not allowed.
+func (t *Transferer) authorize(w dns.ResponseWriter, r *dns.Msg, client net.IP) (int, bool) {
+	if !aclAllows(t.allow, client) {
+		return dns.RcodeRefused, false
+	}
+	if r.IsTsig() != nil {
+		if err := w.TsigStatus(); err != nil {
+			return dns.RcodeNotAuth, false
+		}
+		return dns.RcodeSuccess, true
+	}
+	if t.requireTSIG {
+		return dns.RcodeRefused, false
+	}
+	return dns.RcodeSuccess, true
+}
+
+// send streams rrs to the client in chunks of transferChunkSize and
+// closes the connection.
+func (t *Transferer) send(w dns.ResponseWriter, r *dns.Msg, rrs []dns.RR) {
+	defer w.Close()
+
+	ch := make(chan *dns.Envelope)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- new(dns.Transfer).Out(w, r, ch)
+	}()
+
+	for len(rrs) > 0 {
+		n := min(transferChunkSize, len(rrs))
+		select {
+		case ch <- &dns.Envelope{RR: rrs[:n]}:
+			rrs = rrs[n:]
+		case err := <-errCh:
+			slog.Error("zone transfer write failed", "error", err)
+			return
+		}
+	}
+	close(ch)
+
+	if err := <-errCh; err != nil {
+		slog.Error("zone transfer write failed", "error", err)
+	}
+}
+
+// writeSingle answers with a single message carrying rr.
+func (t *Transferer) writeSingle(w dns.ResponseWriter, r *dns.Msg, rr dns.RR) {
+	resp := new(dns.Msg)
+	resp.SetReply(r)
+	resp.Authoritative = true
+	resp.Answer = []dns.RR{rr}
+	signReply(w, r, resp)
+	if err := w.WriteMsg(resp); err != nil {
+		slog.Error("failed to write response", "error", err)
+	}
+}
+
+// ixfrRRs builds an incremental transfer: the current SOA, then for each
+// journal entry the old SOA with removed RRs and the new SOA with added
+// RRs, and finally the current SOA again (RFC 1995 section 4).
+func ixfrRRs(soa *types.DNSRecord, current *dns.SOA, entries []storage.JournalEntry) []dns.RR {
+	rrs := []dns.RR{current}
+	for _, e := range entries {
+		rrs = append(rrs, zoneSOA(soa, e.From))
+		for _, rec := range e.Deleted {
+			if rec.Type != types.RecordTypeSOA {
+				rrs = append(rrs, buildRRs(rec)...)
+			}
+		}
+		rrs = append(rrs, zoneSOA(soa, e.Serial))
+		for _, rec := range e.Added {
+			if rec.Type != types.RecordTypeSOA {
+				rrs = append(rrs, buildRRs(rec)...)
+			}
+		}
+	}
+	return append(rrs, current)
+}
+
+// ixfrSerial returns the client's serial from the SOA in the authority
+// section of an IXFR request.
+func ixfrSerial(r *dns.Msg) (uint32, bool) {
+	for _, rr := range r.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			return soa.Serial, true
+		}
+	}
+	return 0, false
+}
+
+// zoneSOA builds the zone's SOA RR with the given serial.
+func zoneSOA(soa *types.DNSRecord, serial uint32) *dns.SOA {
+	rr := buildSOA(dns.RR_Header{
+		Name:   dns.Fqdn(soa.Name),
+		Rrtype: dns.TypeSOA,
+		Class:  dns.ClassINET,
+		Ttl:    soa.TTL,
+	}, soa.Value)
+	rr.Serial = serial
+	return rr
+}
+
+// writeRcode answers r with an empty response carrying rcode.
+func writeRcode(w dns.ResponseWriter, r *dns.Msg, rcode int) {
+	resp := new(dns.Msg)
+	resp.SetRcode(r, rcode)
+	signReply(w, r, resp)
+	if err := w.WriteMsg(resp); err != nil {
+		slog.Error("failed to write response", "error", err)
+	}
+}
+
+// signReply adds a TSIG record to resp when the request was validly
+// signed, so the server signs the reply with the same key.
+func signReply(w dns.ResponseWriter, r, resp *dns.Msg) {
+	if tsig := r.IsTsig(); tsig != nil && w.TsigStatus() == nil {
+		resp.SetTsig(tsig.Hdr.Name, tsig.Algorithm, tsig.Fudge, time.Now().Unix())
+	}
+}
+
+// parseACL parses a list of IPs and CIDRs into networks.
+func parseACL(entries []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, entry := range entries {
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid ACL entry %q", entry)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ACL entry %q: %w", entry, err)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// aclAllows reports whether ip falls in one of the networks.
+func aclAllows(nets []*net.IPNet, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// remoteIP extracts the IP from a UDP or TCP address.
+func remoteIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP
+	case *net.TCPAddr:
+		return a.IP
+	}
+	return nil
+}
@@ -0,0 +1,271 @@
+package dns
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"jabberwocky238/jw238dns/storage"
+	"jabberwocky238/jw238dns/types"
+
+	"github.com/miekg/dns"
+)
+
+const testTSIGKey = "xfr.example.com."
+const testTSIGSecret = "c2VjcmV0LXNlY3JldC1zZWNyZXQ="
+
+func setupTransfer(t *testing.T, cfg TransferConfig) (string, *storage.MemoryStorage, *storage.Journal) {
+	t.Helper()
+	store := storage.NewMemoryStorage()
+	ctx := context.Background()
+	for _, r := range []*types.DNSRecord{
+		{Name: "example.com.", Type: types.RecordTypeSOA, TTL: 300, Value: []string{"ns1.example.com. admin.example.com. 1 3600 900 604800 86400"}},
+		{Name: "example.com.", Type: types.RecordTypeNS, TTL: 300, Value: []string{"ns1.example.com."}},
+		{Name: "ns1.example.com.", Type: types.RecordTypeA, TTL: 300, Value: []string{"192.168.1.53"}},
+		{Name: "www.example.com.", Type: types.RecordTypeA, TTL: 300, Value: []string{"192.168.1.1", "192.168.1.2"}},
+	} {
+		if err := store.Create(ctx, r); err != nil {
+			t.Fatalf("setup: %v", err)
+		}
+	}
+	journal := storage.NewJournal(store, 0)
+	xfr, err := NewTransferer(journal, cfg)
+	if err != nil {
+		t.Fatalf("NewTransferer() error = %v", err)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	server := &dns.Server{
+		Listener:     ln,
+		Handler:      dns.HandlerFunc(xfr.ServeTransfer),
+		TsigProvider: newTestKeyring(t),
+	}
+	started := make(chan struct{})
+	server.NotifyStartedFunc = func() { close(started) }
+	go func() { _ = server.ActivateAndServe() }()
+	<-started
+	t.Cleanup(func() { _ = server.Shutdown() })
+
+	return ln.Addr().String(), store, journal
+}
+
+func transferIn(t *testing.T, addr string, m *dns.Msg, tsig bool) []dns.RR {
+	t.Helper()
+	tr := &dns.Transfer{ReadTimeout: 2 * time.Second}
+	if tsig {
+		tr.TsigSecret = map[string]string{testTSIGKey: testTSIGSecret}
+		m.SetTsig(testTSIGKey, dns.HmacSHA256, 300, time.Now().Unix())
+	}
+	env, err := tr.In(m, addr)
+	if err != nil {
+		t.Fatalf("Transfer.In() error = %v", err)
+	}
+	var rrs []dns.RR
+	for e := range env {
+		if e.Error != nil {
+			t.Fatalf("transfer envelope error = %v", e.Error)
+		}
+		rrs = append(rrs, e.RR...)
+	}
+	return rrs
+}
+
+func exchangeTCP(t *testing.T, addr string, m *dns.Msg) *dns.Msg {
+	t.Helper()
+	c := &dns.Client{Net: "tcp", Timeout: 2 * time.Second}
+	resp, _, err := c.Exchange(m, addr)
+	if err != nil {
+		t.Fatalf("Exchange() error = %v", err)
+	}
+	return resp
+}
+
+func TestNewTransferer_InvalidACL(t *testing.T) {
+	tests := []struct {
+		name    string
+		allow   []string
+		wantErr bool
+	}{
+		{name: "ip", allow: []string{"10.0.0.1"}, wantErr: false},
+		{name: "cidr", allow: []string{"10.0.0.0/8", "2001:db8::/32"}, wantErr: false},
+		{name: "garbage", allow: []string{"not-an-ip"}, wantErr: true},
+		{name: "bad cidr", allow: []string{"10.0.0.0/99"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewTransferer(nil, TransferConfig{AllowFrom: tt.allow})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("NewTransferer() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestIsTransfer(t *testing.T) {
+	tests := []struct {
+		qtype uint16
+		want  bool
+	}{
+		{dns.TypeAXFR, true},
+		{dns.TypeIXFR, true},
+		{dns.TypeA, false},
+		{dns.TypeSOA, false},
+	}
+	for _, tt := range tests {
+		m := new(dns.Msg)
+		m.SetQuestion("example.com.", tt.qtype)
+		if got := IsTransfer(m); got != tt.want {
+			t.Errorf("IsTransfer(%s) = %v, want %v", dns.TypeToString[tt.qtype], got, tt.want)
+		}
+	}
+	if IsTransfer(new(dns.Msg)) {
+		t.Error("IsTransfer(empty) = true, want false")
+	}
+}
+
+func TestTransferer_AXFR(t *testing.T) {
+	addr, _, journal := setupTransfer(t, TransferConfig{AllowFrom: []string{"127.0.0.0/8"}})
+	serial, _ := journal.Serial("example.com.")
+
+	m := new(dns.Msg)
+	m.SetAxfr("example.com.")
+	rrs := transferIn(t, addr, m, false)
+
+	// SOA, NS, ns1 A, two www A records, SOA.
+	if len(rrs) != 6 {
+		t.Fatalf("AXFR returned %d RRs, want 6: %v", len(rrs), rrs)
+	}
+	first, ok1 := rrs[0].(*dns.SOA)
+	last, ok2 := rrs[len(rrs)-1].(*dns.SOA)
+	if !ok1 || !ok2 {
+		t.Fatalf("AXFR must start and end with SOA, got %v ... %v", rrs[0], rrs[len(rrs)-1])
+	}
+	if first.Serial != serial || last.Serial != serial {
+		t.Errorf("SOA serial = %d/%d, want %d", first.Serial, last.Serial, serial)
+	}
+}
+
+func TestTransferer_Refused(t *testing.T) {
+	tests := []struct {
+		name      string
+		cfg       TransferConfig
+		zone      string
+		tsig      bool
+		wantRcode int
+	}{
+		{
+			name:      "client outside ACL",
+			cfg:       TransferConfig{AllowFrom: []string{"10.0.0.0/8"}},
+			zone:      "example.com.",
+			wantRcode: dns.RcodeRefused,
+		},
+		{
+			name:      "TSIG required but missing",
+			cfg:       TransferConfig{AllowFrom: []string{"127.0.0.1"}, RequireTSIG: true},
+			zone:      "example.com.",
+			wantRcode: dns.RcodeRefused,
+		},
+		{
+			name:      "unknown zone",
+			cfg:       TransferConfig{AllowFrom: []string{"127.0.0.1"}},
+			zone:      "example.org.",
+			wantRcode: dns.RcodeNotAuth,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr, _, _ := setupTransfer(t, tt.cfg)
+			m := new(dns.Msg)
+			m.SetAxfr(tt.zone)
+			resp := exchangeTCP(t, addr, m)
+			if resp.Rcode != tt.wantRcode {
+				t.Errorf("Rcode = %s, want %s", dns.RcodeToString[resp.Rcode], dns.RcodeToString[tt.wantRcode])
+			}
+		})
+	}
+}
+
+func TestTransferer_AXFR_TSIG(t *testing.T) {
+	addr, _, _ := setupTransfer(t, TransferConfig{AllowFrom: []string{"127.0.0.1"}, RequireTSIG: true})
+
+	m := new(dns.Msg)
+	m.SetAxfr("example.com.")
+	rrs := transferIn(t, addr, m, true)
+	if len(rrs) != 6 {
+		t.Errorf("signed AXFR returned %d RRs, want 6", len(rrs))
+	}
+}
+
+func TestTransferer_IXFR(t *testing.T) {
+	addr, store, journal := setupTransfer(t, TransferConfig{AllowFrom: []string{"127.0.0.1"}})
+	start, _ := journal.Serial("example.com.")
+
+	_ = store.Create(context.Background(), &types.DNSRecord{
+		Name: "mail.example.com.", Type: types.RecordTypeA, TTL: 300, Value: []string{"192.168.1.25"},
+	})
+	journal.Sync()
+	current, _ := journal.Serial("example.com.")
+
+	t.Run("incremental", func(t *testing.T) {
+		m := new(dns.Msg)
+		m.SetIxfr("example.com.", start, "ns1.example.com.", "admin.example.com.")
+		rrs := transferIn(t, addr, m, false)
+
+		// current SOA, old SOA, new SOA, added A, current SOA.
+		if len(rrs) != 5 {
+			t.Fatalf("IXFR returned %d RRs, want 5: %v", len(rrs), rrs)
+		}
+		if rrs[1].(*dns.SOA).Serial != start || rrs[2].(*dns.SOA).Serial != current {
+			t.Errorf("IXFR serial chain = %v -> %v, want %d -> %d", rrs[1], rrs[2], start, current)
+		}
+		if a, ok := rrs[3].(*dns.A); !ok || a.A.String() != "192.168.1.25" {
+			t.Errorf("IXFR added RR = %v, want mail A record", rrs[3])
+		}
+	})
+
+	t.Run("up to date", func(t *testing.T) {
+		m := new(dns.Msg)
+		m.SetIxfr("example.com.", current, "ns1.example.com.", "admin.example.com.")
+		resp := exchangeTCP(t, addr, m)
+		if len(resp.Answer) != 1 || resp.Answer[0].(*dns.SOA).Serial != current {
+			t.Errorf("IXFR at current serial = %v, want single SOA", resp.Answer)
+		}
+	})
+
+	t.Run("unknown serial falls back to full transfer", func(t *testing.T) {
+		m := new(dns.Msg)
+		m.SetIxfr("example.com.", start-10, "ns1.example.com.", "admin.example.com.")
+		rrs := transferIn(t, addr, m, false)
+		if len(rrs) != 7 {
+			t.Errorf("IXFR fallback returned %d RRs, want 7", len(rrs))
+		}
+	})
+}
+
+func TestFrontend_ZoneSerials(t *testing.T) {
+	fe, store := setupFrontend(t)
+	_ = store.Create(context.Background(), &types.DNSRecord{
+		Name: "example.com.", Type: types.RecordTypeSOA, TTL: 300,
+		Value: []string{"ns1.example.com. admin.example.com. 1 3600 900 604800 86400"},
+	})
+	journal := storage.NewJournal(store, 0)
+	fe.SetZoneSerials(journal)
+	serial, _ := journal.Serial("example.com.")
+
+	m := new(dns.Msg)
+	m.SetQuestion("example.com.", dns.TypeSOA)
+	resp, err := fe.ReceiveQuery(context.Background(), m)
+	if err != nil {
+		t.Fatalf("ReceiveQuery() error = %v", err)
+	}
+	if len(resp.Answer) != 1 {
+		t.Fatalf("ReceiveQuery() answers = %v, want one SOA", resp.Answer)
+	}
+	if soa := resp.Answer[0].(*dns.SOA); soa.Serial != serial {
+		t.Errorf("SOA serial = %d, want journal serial %d", soa.Serial, serial)
+	}
+}
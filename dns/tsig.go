@@ -0,0 +1,101 @@
+package dns
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"jabberwocky238/jw238dns/metrics"
+	"jabberwocky238/jw238dns/tsig"
+
+	"github.com/miekg/dns"
+)
+
+// tsigErrorCode maps a TSIG verification failure to the TSIG error sent
+// back to the client (RFC 8945 section 5.2).
+func tsigErrorCode(err error) uint16 {
+	switch {
+	case errors.Is(err, dns.ErrSecret), errors.Is(err, dns.ErrKeyAlg):
+		return dns.RcodeBadKey
+	case errors.Is(err, dns.ErrTime):
+		return dns.RcodeBadTime
+	default:
+		return dns.RcodeBadSig
+	}
+}
+
+// rejectBadTSIG answers r with NOTAUTH and a TSIG record carrying the
+// error when r is signed but failed verification, and reports whether it
+// did so. BADKEY and BADSIG errors are sent unsigned; BADTIME is signed and
+// carries the server's clock so the client can see the skew.
+func rejectBadTSIG(w dns.ResponseWriter, r *dns.Msg) bool {
+	req := r.IsTsig()
+	if req == nil {
+		return false
+	}
+	err := w.TsigStatus()
+	if err == nil {
+		return false
+	}
+
+	code := tsigErrorCode(err)
+	metrics.TSIGErrorsTotal.WithLabelValues(dns.RcodeToString[int(code)]).Inc()
+	slog.Warn("TSIG verification failed",
+		"key", req.Hdr.Name,
+		"client", remoteIP(w.RemoteAddr()),
+		"opcode", dns.OpcodeToString[r.Opcode],
+		"tsig_error", dns.RcodeToString[int(code)],
+		"error", err,
+	)
+
+	resp := new(dns.Msg)
+	resp.SetRcode(r, dns.RcodeNotAuth)
+	t := &dns.TSIG{
+		Hdr:        dns.RR_Header{Name: req.Hdr.Name, Rrtype: dns.TypeTSIG, Class: dns.ClassANY},
+		Algorithm:  req.Algorithm,
+		Fudge:      req.Fudge,
+		TimeSigned: req.TimeSigned,
+		OrigId:     r.Id,
+		Error:      code,
+	}
+	if code == dns.RcodeBadTime {
+		t.OtherLen = 6
+		t.OtherData = fmt.Sprintf("%012x", time.Now().Unix())
+	}
+	resp.Extra = append(resp.Extra, t)
+	if err := w.WriteMsg(resp); err != nil {
+		slog.Error("failed to write response", "error", err)
+	}
+	return true
+}
+
+// tsigProvider returns keyring as a dns.TsigProvider, or nil when there
+// is no keyring, so callers never hold a typed nil interface.
+func tsigProvider(keyring *tsig.Keyring) dns.TsigProvider {
+	if keyring == nil {
+		return nil
+	}
+	return keyring
+}
+
+// signMsg signs m with the named key from keyring. It does nothing when
+// key is empty.
+func signMsg(keyring *tsig.Keyring, key string, m *dns.Msg) error {
+	if key == "" {
+		return nil
+	}
+	if keyring == nil {
+		return fmt.Errorf("TSIG key %q configured without a keyring", key)
+	}
+	return keyring.Sign(m, key)
+}
+
+// writeAuthRcode answers r with rcode, or with a TSIG error response when
+// the rcode is NOTAUTH because r failed TSIG verification.
+func writeAuthRcode(w dns.ResponseWriter, r *dns.Msg, rcode int) {
+	if rcode == dns.RcodeNotAuth && rejectBadTSIG(w, r) {
+		return
+	}
+	writeRcode(w, r, rcode)
+}
@@ -0,0 +1,271 @@
+package dns
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"jabberwocky238/jw238dns/storage"
+	"jabberwocky238/jw238dns/tsig"
+
+	"github.com/miekg/dns"
+)
+
+// newTestKeyring returns a keyring holding testTSIGKey.
+func newTestKeyring(t *testing.T) *tsig.Keyring {
+	t.Helper()
+	keyring := tsig.NewKeyring(0)
+	if err := keyring.Set("test", []tsig.Key{{Name: testTSIGKey, Secret: testTSIGSecret}}); err != nil {
+		t.Fatalf("Set() error = %v", err)
+	}
+	return keyring
+}
+
+func TestTSIGErrorCode(t *testing.T) {
+	tests := []struct {
+		err  error
+		want uint16
+	}{
+		{dns.ErrSecret, dns.RcodeBadKey},
+		{dns.ErrKeyAlg, dns.RcodeBadKey},
+		{dns.ErrSig, dns.RcodeBadSig},
+		{dns.ErrTime, dns.RcodeBadTime},
+		{fmt.Errorf("wrapped: %w", dns.ErrTime), dns.RcodeBadTime},
+		{errors.New("other"), dns.RcodeBadSig},
+	}
+	for _, tt := range tests {
+		if got := tsigErrorCode(tt.err); got != tt.want {
+			t.Errorf("tsigErrorCode(%v) = %s, want %s", tt.err, dns.RcodeToString[int(got)], dns.RcodeToString[int(tt.want)])
+		}
+	}
+}
+
+func TestTransferer_TSIGErrors(t *testing.T) {
+	addr, _, _ := setupTransfer(t, TransferConfig{AllowFrom: []string{"127.0.0.1"}, RequireTSIG: true})
+
+	tests := []struct {
+		name      string
+		key       string
+		secret    string
+		signed    time.Time
+		wantError uint16
+		wantMAC   bool
+	}{
+		{name: "unknown key", key: "other.example.com.", secret: testTSIGSecret, signed: time.Now(), wantError: dns.RcodeBadKey},
+		{name: "wrong secret", key: testTSIGKey, secret: "b3RoZXItb3RoZXItb3RoZXI=", signed: time.Now(), wantError: dns.RcodeBadSig},
+		{name: "clock skew", key: testTSIGKey, secret: testTSIGSecret, signed: time.Now().Add(-time.Hour), wantError: dns.RcodeBadTime, wantMAC: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := new(dns.Msg)
+			m.SetAxfr("example.com.")
+			m.SetTsig(tt.key, dns.HmacSHA256, 300, tt.signed.Unix())
+
+			// The client cannot verify these responses, so it reports an
+			// error alongside the message; only the message matters here.
+			c := &dns.Client{Net: "tcp", Timeout: 2 * time.Second, TsigSecret: map[string]string{tt.key: tt.secret}}
+			resp, _, err := c.Exchange(m, addr)
+			if resp == nil {
+				t.Fatalf("Exchange() error = %v", err)
+			}
+			if resp.Rcode != dns.RcodeNotAuth {
+				t.Errorf("Rcode = %s, want NOTAUTH", dns.RcodeToString[resp.Rcode])
+			}
+			rr := resp.IsTsig()
+			if rr == nil {
+				t.Fatal("response has no TSIG record")
+			}
+			if rr.Error != tt.wantError {
+				t.Errorf("TSIG error = %s, want %s", dns.RcodeToString[int(rr.Error)], dns.RcodeToString[int(tt.wantError)])
+			}
+			if (rr.MAC != "") != tt.wantMAC {
+				t.Errorf("MAC = %q, want signed = %v", rr.MAC, tt.wantMAC)
+			}
+			if tt.wantError == dns.RcodeBadTime {
+				if rr.OtherLen != 6 || rr.TimeSigned != uint64(tt.signed.Unix()) {
+					t.Errorf("BADTIME TSIG = %v, want request time and 6 bytes of server time", rr)
+				}
+			}
+		})
+	}
+}
+
+func TestSecondary_SignedTransferAndNotify(t *testing.T) {
+	primary, _, _ := setupTransfer(t, TransferConfig{AllowFrom: []string{"127.0.0.1"}, RequireTSIG: true})
+
+	keyring := newTestKeyring(t)
+	store, cfg := newSecondaryConfig(primary)
+	cfg.Zones[0].TSIGKey = testTSIGKey
+	cfg.Keyring = keyring
+	secondary := NewSecondary(store, cfg)
+	z := secondary.zones["example.com."]
+	if err := secondary.refresh(t.Context(), z); err != nil {
+		t.Fatalf("signed refresh error = %v", err)
+	}
+	if got := getValues(t, store, "www.example.com.", "A"); len(got) != 2 {
+		t.Errorf("www.example.com. A = %v, want 2 values", got)
+	}
+
+	// Without the key the primary refuses the transfer.
+	store, cfg = newSecondaryConfig(primary)
+	unsigned := NewSecondary(store, cfg)
+	if err := unsigned.refresh(t.Context(), unsigned.zones["example.com."]); err == nil {
+		t.Error("unsigned refresh succeeded against a primary requiring TSIG")
+	}
+
+	// NOTIFY for the zone must carry its key.
+	addr := startNotifyServer(t, secondary)
+	tests := []struct {
+		name      string
+		sign      bool
+		wantRcode int
+	}{
+		{name: "signed", sign: true, wantRcode: dns.RcodeSuccess},
+		{name: "unsigned", sign: false, wantRcode: dns.RcodeRefused},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := new(dns.Msg)
+			m.SetNotify("example.com.")
+			c := &dns.Client{Timeout: 2 * time.Second}
+			if tt.sign {
+				c.TsigProvider = keyring
+				m.SetTsig(testTSIGKey, dns.HmacSHA256, 300, time.Now().Unix())
+			}
+			resp, _, err := c.Exchange(m, addr)
+			if err != nil {
+				t.Fatalf("Exchange() error = %v", err)
+			}
+			if resp.Rcode != tt.wantRcode {
+				t.Errorf("Rcode = %s, want %s", dns.RcodeToString[resp.Rcode], dns.RcodeToString[tt.wantRcode])
+			}
+		})
+	}
+}
+
+func newSecondaryConfig(primary string) (*storage.MemoryStorage, SecondaryConfig) {
+	cfg := DefaultSecondaryConfig()
+	cfg.Timeout = 2 * time.Second
+	cfg.Zones = []SecondaryZone{{Name: "example.com.", Primaries: []string{primary}}}
+	return storage.NewMemoryStorage(), cfg
+}
+
+// startNotifyServer serves s.HandleNotify over UDP with the test keyring.
+func startNotifyServer(t *testing.T, s *Secondary) string {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	server := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(s.HandleNotify), TsigProvider: newTestKeyring(t)}
+	started := make(chan struct{})
+	server.NotifyStartedFunc = func() { close(started) }
+	go func() { _ = server.ActivateAndServe() }()
+	<-started
+	t.Cleanup(func() { _ = server.Shutdown() })
+	return pc.LocalAddr().String()
+}
+
+func TestNotifier_Signed(t *testing.T) {
+	keyring := newTestKeyring(t)
+	got := make(chan error, 1)
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	server := &dns.Server{
+		PacketConn:   pc,
+		TsigProvider: keyring,
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+			err := w.TsigStatus()
+			if r.IsTsig() == nil {
+				err = errors.New("NOTIFY not signed")
+			}
+			got <- err
+			resp := new(dns.Msg)
+			resp.SetReply(r)
+			signReply(w, r, resp)
+			_ = w.WriteMsg(resp)
+		}),
+	}
+	started := make(chan struct{})
+	server.NotifyStartedFunc = func() { close(started) }
+	go func() { _ = server.ActivateAndServe() }()
+	<-started
+	t.Cleanup(func() { _ = server.Shutdown() })
+
+	notifier, _, _ := setupNotifier(t, pc.LocalAddr().String())
+	notifier.config.TSIGKey = testTSIGKey
+	notifier.config.Keyring = keyring
+	notifier.client.TsigProvider = keyring
+
+	notifier.Notify(t.Context(), "example.com.")
+	select {
+	case err := <-got:
+		if err != nil {
+			t.Errorf("secondary TSIG status = %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("secondary did not receive NOTIFY")
+	}
+}
+
+func TestForwarder_SignedQuery(t *testing.T) {
+	keyring := newTestKeyring(t)
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	// The upstream only answers validly signed queries.
+	server := &dns.Server{
+		PacketConn:   pc,
+		TsigProvider: keyring,
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+			resp := new(dns.Msg)
+			if r.IsTsig() == nil || w.TsigStatus() != nil {
+				resp.SetRcode(r, dns.RcodeRefused)
+				_ = w.WriteMsg(resp)
+				return
+			}
+			resp.SetReply(r)
+			resp.Answer = append(resp.Answer, mustRR(t, "signed.example.com. 60 IN A 192.0.2.1"))
+			signReply(w, r, resp)
+			_ = w.WriteMsg(resp)
+		}),
+	}
+	started := make(chan struct{})
+	server.NotifyStartedFunc = func() { close(started) }
+	go func() { _ = server.ActivateAndServe() }()
+	<-started
+	t.Cleanup(func() { _ = server.Shutdown() })
+
+	tests := []struct {
+		name    string
+		key     string
+		wantErr bool
+	}{
+		{name: "signed", key: testTSIGKey},
+		{name: "unsigned", wantErr: true},
+		{name: "unknown key", key: "missing.example.com.", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := NewForwarder(ForwarderConfig{
+				Enabled: true,
+				Servers: []string{pc.LocalAddr().String()},
+				Timeout: 2 * time.Second,
+				TSIGKey: tt.key,
+				Keyring: keyring,
+			})
+			records, err := f.Forward(t.Context(), "signed.example.com.", dns.TypeA)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Forward() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && (len(records) != 1 || records[0].Value[0] != "192.0.2.1") {
+				t.Errorf("Forward() = %v, want signed.example.com. A 192.0.2.1", records)
+			}
+		})
+	}
+}
@@ -0,0 +1,551 @@
+package dns
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"slices"
+	"strings"
+	"time"
+
+	"jabberwocky238/jw238dns/metrics"
+	"jabberwocky238/jw238dns/storage"
+	"jabberwocky238/jw238dns/types"
+
+	"github.com/miekg/dns"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// UpdateConfig controls RFC 2136 dynamic updates.
+type UpdateConfig struct {
+	Enabled   bool     // Accept UPDATE messages
+	AllowFrom []string // CIDRs or IPs allowed to send updates; empty allows any address
+}
+
+// Updater applies RFC 2136 dynamic updates to a CoreStorage. Every update
+// must be TSIG-signed. The prerequisites are checked and the update
+// section applied inside a CoreStorage.Transaction, against the RRsets at
+// every name the update touches, so an update is applied in full or not
+// at all, and never after another writer invalidated its prerequisites
+// (RFC 2136 section 3.2).
+//
+// A zone is a name with an SOA record in the store.
+type Updater struct {
+	store storage.CoreStorage
+	allow []*net.IPNet
+}
+
+// updateTypes are the types read for every name an update touches.
+var updateTypes = []types.RecordType{
+	types.RecordTypeA, types.RecordTypeAAAA, types.RecordTypeCNAME, types.RecordTypeMX,
+	types.RecordTypeTXT, types.RecordTypeNS, types.RecordTypeSRV, types.RecordTypePTR,
+	types.RecordTypeSOA, types.RecordTypeCAA,
+}
+
+// rcodeError aborts an update transaction with a response code.
+type rcodeError int
+
+func (e rcodeError) Error() string {
+	return dns.RcodeToString[int(e)]
+}
+
+// NewUpdater creates an Updater for the given store. It returns an error
+// if an AllowFrom entry is not a valid IP or CIDR.
+func NewUpdater(store storage.CoreStorage, cfg UpdateConfig) (*Updater, error) {
+	allow, err := parseACL(cfg.AllowFrom)
+	if err != nil {
+		return nil, err
+	}
+	return &Updater{store: store, allow: allow}, nil
+}
+
+// IsUpdate reports whether msg is an UPDATE request.
+func IsUpdate(msg *dns.Msg) bool {
+	return msg != nil && msg.Opcode == dns.OpcodeUpdate && !msg.Response
+}
+
+// AcceptMsg is a dns.MsgAcceptFunc that accepts UPDATE messages, which
+// dns.DefaultMsgAcceptFunc rejects because their prerequisite and update
+// sections may hold any number of RRs. Everything else is left to the
+// default.
+func AcceptMsg(dh dns.Header) dns.MsgAcceptAction {
+	const qr = 1 << 15
+	opcode := int(dh.Bits>>11) & 0xF
+	if opcode == dns.OpcodeUpdate && dh.Bits&qr == 0 {
+		if dh.Qdcount != 1 {
+			return dns.MsgReject
+		}
+		return dns.MsgAccept
+	}
+	return dns.DefaultMsgAcceptFunc(dh)
+}
+
+// ServeUpdate authenticates an UPDATE request, applies it and answers
+// with the resulting rcode.
+func (u *Updater) ServeUpdate(w dns.ResponseWriter, r *dns.Msg) {
+	ctx, span := tracer.Start(context.Background(), "Updater.ServeUpdate", trace.WithSpanKind(trace.SpanKindServer))
+	defer span.End()
+
+	client := remoteIP(w.RemoteAddr())
+	rcode := u.authorize(w, r, client)
+	if rcode == dns.RcodeSuccess {
+		// authorize requires TSIG, so the key names the client.
+		ctx = storage.WithActor(ctx, storage.Actor{Name: r.IsTsig().Hdr.Name, Source: types.SourceUpdate})
+		rcode = u.Apply(ctx, r)
+	}
+
+	zone := ""
+	if len(r.Question) > 0 {
+		zone = r.Question[0].Name
+	}
+	span.SetAttributes(
+		attribute.String("dns.zone", zone),
+		attribute.String("dns.rcode", dns.RcodeToString[rcode]),
+	)
+	metrics.UpdatesTotal.WithLabelValues(dns.RcodeToString[rcode]).Inc()
+	slog.Info("dynamic update",
+		"zone", zone,
+		"client", client,
+		"prerequisites", len(r.Answer),
+		"updates", len(r.Ns),
+		"rcode", dns.RcodeToString[rcode],
+	)
+	writeAuthRcode(w, r, rcode)
+}
+
+// authorize checks the client against the ACL and requires a valid TSIG
+// signature.
+func (u *Updater) authorize(w dns.ResponseWriter, r *dns.Msg, client net.IP) int {
+	if len(u.allow) > 0 && !aclAllows(u.allow, client) {
+		return dns.RcodeRefused
+	}
+	if r.IsTsig() == nil {
+		return dns.RcodeRefused
+	}
+	if err := w.TsigStatus(); err != nil {
+		return dns.RcodeNotAuth
+	}
+	return dns.RcodeSuccess
+}
+
+// Apply processes the zone, prerequisite and update sections of r as
+// described in RFC 2136 section 3 and returns the response rcode.
+// Authentication is the caller's responsibility.
+func (u *Updater) Apply(ctx context.Context, r *dns.Msg) int {
+	if len(r.Question) != 1 || r.Question[0].Qtype != dns.TypeSOA {
+		return dns.RcodeFormatError
+	}
+	zone := strings.ToLower(dns.Fqdn(r.Question[0].Name))
+
+	// Names are matched without regard to case, but stored records are
+	// read by exact name: list the store to learn the stored spelling.
+	records, err := u.store.List(ctx)
+	if err != nil {
+		slog.Error("dynamic update: list records", "error", err)
+		return dns.RcodeServerFailure
+	}
+	names := updateNames(zone, r, records)
+	now := time.Now().UTC().Truncate(time.Second)
+
+	err = u.store.Transaction(ctx, func(tx *storage.Tx) error {
+		var current []*types.DNSRecord
+		for _, name := range names {
+			for _, rt := range updateTypes {
+				rec, err := tx.Get(name, rt)
+				if err == nil {
+					current = append(current, rec)
+				} else if !errors.Is(err, types.ErrRecordNotFound) {
+					return err
+				}
+			}
+		}
+		z := newUpdateZone(zone, current)
+		if !z.exists(zone, types.RecordTypeSOA) {
+			return rcodeError(dns.RcodeNotAuth)
+		}
+
+		if rcode := z.checkPrerequisites(r.Answer); rcode != dns.RcodeSuccess {
+			return rcodeError(rcode)
+		}
+		if rcode := z.prescan(r.Ns); rcode != dns.RcodeSuccess {
+			return rcodeError(rcode)
+		}
+		for _, rr := range r.Ns {
+			z.apply(rr)
+		}
+		return z.write(tx, now)
+	})
+
+	var rcode rcodeError
+	switch {
+	case errors.As(err, &rcode):
+		return int(rcode)
+	case err != nil:
+		slog.Error("dynamic update: apply changes", "zone", zone, "error", err)
+		return dns.RcodeServerFailure
+	}
+	return dns.RcodeSuccess
+}
+
+// updateNames returns the names in zone that the prerequisite and update
+// sections of r touch, and the zone apex, spelled as stored in records or,
+// for names not stored yet, lower-cased.
+func updateNames(zone string, r *dns.Msg, records []*types.DNSRecord) []string {
+	wanted := map[string]bool{zone: true}
+	for _, rr := range slices.Concat(r.Answer, r.Ns) {
+		if name := rr.Header().Name; dns.IsSubDomain(zone, name) {
+			wanted[strings.ToLower(dns.Fqdn(name))] = true
+		}
+	}
+
+	var names []string
+	for _, rec := range records {
+		if lower := strings.ToLower(rec.Name); wanted[lower] && !slices.Contains(names, rec.Name) {
+			names = append(names, rec.Name)
+		}
+	}
+	for name := range wanted {
+		if !slices.ContainsFunc(names, func(n string) bool { return strings.EqualFold(n, name) }) {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+	return names
+}
+
+// updateZone is a working copy of one zone's records. Keys use lower-cased
+// names; records keep the name they were stored under.
+type updateZone struct {
+	zone string
+	orig map[types.RecordKey]*types.DNSRecord
+	cur  map[types.RecordKey]*types.DNSRecord
+}
+
+func newUpdateZone(zone string, records []*types.DNSRecord) *updateZone {
+	z := &updateZone{
+		zone: zone,
+		orig: make(map[types.RecordKey]*types.DNSRecord),
+		cur:  make(map[types.RecordKey]*types.DNSRecord),
+	}
+	for _, rec := range records {
+		if !dns.IsSubDomain(zone, rec.Name) {
+			continue
+		}
+		key := updateKey(rec.Name, rec.Type)
+		z.orig[key] = rec
+		z.cur[key] = &types.DNSRecord{
+			Name:  rec.Name,
+			Type:  rec.Type,
+			TTL:   rec.TTL,
+			Value: slices.Clone(rec.Value),
+			Meta:  rec.Meta.Clone(),
+		}
+	}
+	return z
+}
+
+// updateKey builds the working map key for name and type.
+func updateKey(name string, rt types.RecordType) types.RecordKey {
+	return types.RecordKey{Name: strings.ToLower(dns.Fqdn(name)), Type: rt}
+}
+
+func (z *updateZone) exists(name string, rt types.RecordType) bool {
+	_, ok := z.cur[updateKey(name, rt)]
+	return ok
+}
+
+// nameInUse reports whether any RRset exists at name.
+func (z *updateZone) nameInUse(name string) bool {
+	name = strings.ToLower(dns.Fqdn(name))
+	for key := range z.cur {
+		if key.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// checkPrerequisites evaluates the prerequisite section (RFC 2136 section
+// 3.2) against the zone before any update is applied.
+func (z *updateZone) checkPrerequisites(prereqs []dns.RR) int {
+	// Value-dependent prerequisites are compared per RRset as a whole.
+	want := make(map[types.RecordKey][]string)
+	var order []types.RecordKey
+
+	for _, rr := range prereqs {
+		hdr := rr.Header()
+		if hdr.Ttl != 0 {
+			return dns.RcodeFormatError
+		}
+		if !dns.IsSubDomain(z.zone, hdr.Name) {
+			return dns.RcodeNotZone
+		}
+		rt := uint16ToRecordType(hdr.Rrtype)
+
+		switch hdr.Class {
+		case dns.ClassANY:
+			if hdr.Rdlength != 0 {
+				return dns.RcodeFormatError
+			}
+			if hdr.Rrtype == dns.TypeANY {
+				if !z.nameInUse(hdr.Name) {
+					return dns.RcodeNameError
+				}
+			} else if rt == "" || !z.exists(hdr.Name, rt) {
+				return dns.RcodeNXRrset
+			}
+		case dns.ClassNONE:
+			if hdr.Rdlength != 0 {
+				return dns.RcodeFormatError
+			}
+			if hdr.Rrtype == dns.TypeANY {
+				if z.nameInUse(hdr.Name) {
+					return dns.RcodeYXDomain
+				}
+			} else if rt != "" && z.exists(hdr.Name, rt) {
+				return dns.RcodeYXRrset
+			}
+		case dns.ClassINET:
+			value, ok := storedValue(rr)
+			if !ok || rt == "" {
+				return dns.RcodeNXRrset
+			}
+			key := updateKey(hdr.Name, rt)
+			if _, seen := want[key]; !seen {
+				order = append(order, key)
+			}
+			want[key] = append(want[key], value)
+		default:
+			return dns.RcodeFormatError
+		}
+	}
+
+	for _, key := range order {
+		rec, ok := z.cur[key]
+		if !ok || !sameValues(key.Type, rec.Value, want[key]) {
+			return dns.RcodeNXRrset
+		}
+	}
+	return dns.RcodeSuccess
+}
+
+// prescan validates the update section (RFC 2136 section 3.4.1) before
+// anything is applied.
+func (z *updateZone) prescan(updates []dns.RR) int {
+	for _, rr := range updates {
+		hdr := rr.Header()
+		if !dns.IsSubDomain(z.zone, hdr.Name) {
+			return dns.RcodeNotZone
+		}
+		meta := hdr.Rrtype == dns.TypeAXFR || hdr.Rrtype == dns.TypeIXFR ||
+			hdr.Rrtype == dns.TypeMAILA || hdr.Rrtype == dns.TypeMAILB
+
+		switch hdr.Class {
+		case dns.ClassINET:
+			if meta || hdr.Rrtype == dns.TypeANY {
+				return dns.RcodeFormatError
+			}
+			if _, ok := storedValue(rr); !ok {
+				return dns.RcodeNotImplemented
+			}
+		case dns.ClassANY:
+			if hdr.Ttl != 0 || hdr.Rdlength != 0 || meta {
+				return dns.RcodeFormatError
+			}
+		case dns.ClassNONE:
+			if hdr.Ttl != 0 || meta || hdr.Rrtype == dns.TypeANY {
+				return dns.RcodeFormatError
+			}
+		default:
+			return dns.RcodeFormatError
+		}
+	}
+	return dns.RcodeSuccess
+}
+
+// apply applies one update RR to the working copy (RFC 2136 section
+// 3.4.2). The prescan has already validated it.
+func (z *updateZone) apply(rr dns.RR) {
+	hdr := rr.Header()
+	name := dns.Fqdn(hdr.Name)
+	apex := strings.EqualFold(name, z.zone)
+	rt := uint16ToRecordType(hdr.Rrtype)
+
+	switch hdr.Class {
+	case dns.ClassINET:
+		value, _ := storedValue(rr)
+		key := updateKey(name, rt)
+
+		switch {
+		case rt == types.RecordTypeCNAME:
+			// A CNAME cannot coexist with other data at the same name.
+			for k := range z.cur {
+				if k.Name == key.Name && k.Type != types.RecordTypeCNAME {
+					return
+				}
+			}
+			z.set(key, name, rt, hdr.Ttl, []string{value})
+		case z.exists(name, types.RecordTypeCNAME):
+			return
+		case rt == types.RecordTypeSOA:
+			if apex {
+				z.set(key, name, rt, hdr.Ttl, []string{value})
+			}
+		default:
+			rec, ok := z.cur[key]
+			if !ok {
+				z.set(key, name, rt, hdr.Ttl, []string{value})
+				return
+			}
+			// All RRs in an RRset share a TTL (RFC 2181 section 5.2).
+			rec.TTL = hdr.Ttl
+			if !slices.ContainsFunc(rec.Value, func(v string) bool { return valueEqual(rt, v, value) }) {
+				rec.Value = append(rec.Value, value)
+			}
+		}
+
+	case dns.ClassANY:
+		if hdr.Rrtype == dns.TypeANY {
+			for key := range z.cur {
+				if key.Name != strings.ToLower(name) {
+					continue
+				}
+				if apex && (key.Type == types.RecordTypeSOA || key.Type == types.RecordTypeNS) {
+					continue
+				}
+				delete(z.cur, key)
+			}
+			return
+		}
+		if rt == "" || (apex && (rt == types.RecordTypeSOA || rt == types.RecordTypeNS)) {
+			return
+		}
+		delete(z.cur, updateKey(name, rt))
+
+	case dns.ClassNONE:
+		if rt == "" || (apex && rt == types.RecordTypeSOA) {
+			return
+		}
+		key := updateKey(name, rt)
+		rec, ok := z.cur[key]
+		if !ok {
+			return
+		}
+		value, ok := storedValue(rr)
+		if !ok {
+			return
+		}
+		remaining := slices.DeleteFunc(slices.Clone(rec.Value), func(v string) bool { return valueEqual(rt, v, value) })
+		if len(remaining) == 0 {
+			// The zone must keep at least one apex NS.
+			if apex && rt == types.RecordTypeNS {
+				return
+			}
+			delete(z.cur, key)
+			return
+		}
+		rec.Value = remaining
+	}
+}
+
+// set replaces the RRset at key, keeping the stored name of an existing
+// record.
+func (z *updateZone) set(key types.RecordKey, name string, rt types.RecordType, ttl uint32, values []string) {
+	var meta *types.RecordMeta
+	if rec, ok := z.orig[key]; ok {
+		name, meta = rec.Name, rec.Meta.Clone()
+	}
+	z.cur[key] = &types.DNSRecord{Name: name, Type: rt, TTL: ttl, Value: values, Meta: meta}
+}
+
+// changes returns the difference between the original and working copies,
+// stamping the metadata of added and updated records with now.
+func (z *updateZone) changes(now time.Time) *types.RecordChanges {
+	changes := &types.RecordChanges{}
+	for key, rec := range z.cur {
+		old, ok := z.orig[key]
+		switch {
+		case !ok:
+			rec.Meta = &types.RecordMeta{Source: types.SourceUpdate, CreatedAt: now, UpdatedAt: now}
+			changes.Added = append(changes.Added, rec)
+		case old.TTL != rec.TTL || !slices.Equal(old.Value, rec.Value):
+			if rec.Meta == nil {
+				rec.Meta = &types.RecordMeta{Source: types.SourceUpdate}
+			}
+			rec.Meta.UpdatedAt = now
+			changes.Updated = append(changes.Updated, rec)
+		}
+	}
+	for key, old := range z.orig {
+		if _, ok := z.cur[key]; !ok {
+			changes.Deleted = append(changes.Deleted, types.RecordKey{Name: old.Name, Type: old.Type})
+		}
+	}
+	return changes
+}
+
+// write applies the difference between the original and working copies
+// to tx. Updates carry no owner, so changing or deleting a record with an
+// owner (types.RecordMeta.Owner) is refused, as it is over the HTTP API
+// for any other owner.
+func (z *updateZone) write(tx *storage.Tx, now time.Time) error {
+	changes := z.changes(now)
+	for _, rec := range changes.Updated {
+		if rec.Owner() != "" {
+			return rcodeError(dns.RcodeRefused)
+		}
+	}
+	for _, key := range changes.Deleted {
+		if old, err := tx.Get(key.Name, key.Type); err == nil && old.Owner() != "" {
+			return rcodeError(dns.RcodeRefused)
+		}
+	}
+	for _, rec := range changes.Added {
+		if err := tx.Create(rec); err != nil {
+			return err
+		}
+	}
+	for _, rec := range changes.Updated {
+		if err := tx.Update(rec); err != nil {
+			return err
+		}
+	}
+	for _, key := range changes.Deleted {
+		if err := tx.Delete(key.Name, key.Type); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sameValues reports whether two value lists of type rt hold the same set
+// of values.
+func sameValues(rt types.RecordType, a, b []string) bool {
+	for _, v := range a {
+		if !slices.ContainsFunc(b, func(w string) bool { return valueEqual(rt, v, w) }) {
+			return false
+		}
+	}
+	for _, v := range b {
+		if !slices.ContainsFunc(a, func(w string) bool { return valueEqual(rt, v, w) }) {
+			return false
+		}
+	}
+	return true
+}
+
+// valueEqual compares two stored values of type rt. Domain names are
+// case-insensitive, so values whose only letters are in domain names are
+// compared without regard to case; everything else, such as TXT and CAA
+// values, must match exactly.
+func valueEqual(rt types.RecordType, a, b string) bool {
+	switch rt {
+	case types.RecordTypeNS, types.RecordTypeCNAME, types.RecordTypePTR,
+		types.RecordTypeMX, types.RecordTypeSRV, types.RecordTypeSOA:
+		return strings.EqualFold(a, b)
+	default:
+		return a == b
+	}
+}
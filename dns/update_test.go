@@ -0,0 +1,444 @@
+package dns
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"jabberwocky238/jw238dns/storage"
+	"jabberwocky238/jw238dns/types"
+
+	"github.com/miekg/dns"
+)
+
+func setupUpdateStore(t *testing.T) *storage.MemoryStorage {
+	t.Helper()
+	store := storage.NewMemoryStorage()
+	ctx := context.Background()
+	for _, r := range []*types.DNSRecord{
+		{Name: "example.com.", Type: types.RecordTypeSOA, TTL: 300, Value: []string{"ns1.example.com. admin.example.com. 1 3600 900 604800 86400"}},
+		{Name: "example.com.", Type: types.RecordTypeNS, TTL: 300, Value: []string{"ns1.example.com."}},
+		{Name: "www.example.com.", Type: types.RecordTypeA, TTL: 300, Value: []string{"192.168.1.1", "192.168.1.2"}, Meta: &types.RecordMeta{Comment: "web"}},
+		{Name: "owned.example.com.", Type: types.RecordTypeA, TTL: 300, Value: []string{"192.168.2.1"}, Meta: &types.RecordMeta{Owner: "ops"}},
+		{Name: "alias.example.com.", Type: types.RecordTypeCNAME, TTL: 300, Value: []string{"www.example.com."}},
+		{Name: "other.org.", Type: types.RecordTypeA, TTL: 300, Value: []string{"10.0.0.1"}},
+	} {
+		if err := store.Create(ctx, r); err != nil {
+			t.Fatalf("setup: %v", err)
+		}
+	}
+	return store
+}
+
+func mustRR(t *testing.T, s string) dns.RR {
+	t.Helper()
+	rr, err := dns.NewRR(s)
+	if err != nil {
+		t.Fatalf("NewRR(%q) error = %v", s, err)
+	}
+	return rr
+}
+
+func TestUpdater_Apply(t *testing.T) {
+	tests := []struct {
+		name      string
+		zone      string
+		build     func(t *testing.T, m *dns.Msg)
+		wantRcode int
+		check     func(t *testing.T, store *storage.MemoryStorage)
+	}{
+		{
+			name: "add TXT records",
+			zone: "example.com.",
+			build: func(t *testing.T, m *dns.Msg) {
+				m.Insert([]dns.RR{
+					mustRR(t, `_acme-challenge.example.com. 60 IN TXT "token-1"`),
+					mustRR(t, `_acme-challenge.example.com. 60 IN TXT "token-2"`),
+				})
+			},
+			wantRcode: dns.RcodeSuccess,
+			check: func(t *testing.T, store *storage.MemoryStorage) {
+				got := getValues(t, store, "_acme-challenge.example.com.", types.RecordTypeTXT)
+				if len(got) != 2 || got[0] != "token-1" || got[1] != "token-2" {
+					t.Errorf("TXT = %v, want [token-1 token-2]", got)
+				}
+				recs, _ := store.Get(context.Background(), "_acme-challenge.example.com.", types.RecordTypeTXT)
+				if meta := recs[0].Meta; meta == nil || meta.Source != types.SourceUpdate || meta.CreatedAt.IsZero() {
+					t.Errorf("Meta = %+v, want source rfc2136 and a creation time", meta)
+				}
+			},
+		},
+		{
+			name: "add to existing RRset updates TTL and skips duplicates",
+			zone: "example.com.",
+			build: func(t *testing.T, m *dns.Msg) {
+				m.Insert([]dns.RR{
+					mustRR(t, "www.example.com. 120 IN A 192.168.1.2"),
+					mustRR(t, "www.example.com. 120 IN A 192.168.1.3"),
+				})
+			},
+			wantRcode: dns.RcodeSuccess,
+			check: func(t *testing.T, store *storage.MemoryStorage) {
+				recs, _ := store.Get(context.Background(), "www.example.com.", types.RecordTypeA)
+				if len(recs[0].Value) != 3 || recs[0].TTL != 120 {
+					t.Errorf("www A = %+v, want 3 values with TTL 120", recs[0])
+				}
+				if meta := recs[0].Meta; meta.Comment != "web" || meta.UpdatedAt.IsZero() {
+					t.Errorf("Meta = %+v, want the comment kept and the update time set", meta)
+				}
+			},
+		},
+		{
+			name: "delete single RR",
+			zone: "example.com.",
+			build: func(t *testing.T, m *dns.Msg) {
+				m.Remove([]dns.RR{mustRR(t, "www.example.com. 0 IN A 192.168.1.1")})
+			},
+			wantRcode: dns.RcodeSuccess,
+			check: func(t *testing.T, store *storage.MemoryStorage) {
+				if got := getValues(t, store, "www.example.com.", types.RecordTypeA); len(got) != 1 || got[0] != "192.168.1.2" {
+					t.Errorf("www A = %v, want [192.168.1.2]", got)
+				}
+			},
+		},
+		{
+			name: "changing an owned record is refused",
+			zone: "example.com.",
+			build: func(t *testing.T, m *dns.Msg) {
+				m.Insert([]dns.RR{
+					mustRR(t, "owned.example.com. 300 IN A 192.168.2.2"),
+					mustRR(t, `owned.example.com. 300 IN TXT "new"`),
+				})
+			},
+			wantRcode: dns.RcodeRefused,
+			check: func(t *testing.T, store *storage.MemoryStorage) {
+				if got := getValues(t, store, "owned.example.com.", types.RecordTypeA); len(got) != 1 {
+					t.Errorf("owned A = %v, want unchanged", got)
+				}
+				if got := getValues(t, store, "owned.example.com.", types.RecordTypeTXT); got != nil {
+					t.Errorf("owned TXT = %v, want not written", got)
+				}
+			},
+		},
+		{
+			name: "deleting an owned record is refused",
+			zone: "example.com.",
+			build: func(t *testing.T, m *dns.Msg) {
+				m.RemoveName([]dns.RR{mustRR(t, "owned.example.com. 0 IN A 0.0.0.0")})
+			},
+			wantRcode: dns.RcodeRefused,
+			check: func(t *testing.T, store *storage.MemoryStorage) {
+				if got := getValues(t, store, "owned.example.com.", types.RecordTypeA); len(got) != 1 {
+					t.Errorf("owned A = %v, want kept", got)
+				}
+			},
+		},
+		{
+			name: "TXT values are case-sensitive",
+			zone: "example.com.",
+			build: func(t *testing.T, m *dns.Msg) {
+				m.Insert([]dns.RR{
+					mustRR(t, `_acme-challenge.example.com. 60 IN TXT "abc"`),
+					mustRR(t, `_acme-challenge.example.com. 60 IN TXT "ABC"`),
+				})
+				m.Remove([]dns.RR{mustRR(t, `_acme-challenge.example.com. 0 IN TXT "abc"`)})
+			},
+			wantRcode: dns.RcodeSuccess,
+			check: func(t *testing.T, store *storage.MemoryStorage) {
+				if got := getValues(t, store, "_acme-challenge.example.com.", types.RecordTypeTXT); len(got) != 1 || got[0] != "ABC" {
+					t.Errorf("TXT = %v, want [ABC]", got)
+				}
+			},
+		},
+		{
+			name: "domain name values are case-insensitive",
+			zone: "example.com.",
+			build: func(t *testing.T, m *dns.Msg) {
+				m.Used([]dns.RR{mustRR(t, "alias.example.com. 0 IN CNAME WWW.Example.COM.")})
+				m.Insert([]dns.RR{mustRR(t, "example.com. 300 IN NS ns2.example.com.")})
+				m.Remove([]dns.RR{mustRR(t, "example.com. 0 IN NS NS1.EXAMPLE.COM.")})
+			},
+			wantRcode: dns.RcodeSuccess,
+			check: func(t *testing.T, store *storage.MemoryStorage) {
+				if got := getValues(t, store, "example.com.", types.RecordTypeNS); len(got) != 1 || got[0] != "ns2.example.com." {
+					t.Errorf("NS = %v, want [ns2.example.com.]", got)
+				}
+			},
+		},
+		{
+			name: "delete RRset",
+			zone: "example.com.",
+			build: func(t *testing.T, m *dns.Msg) {
+				m.RemoveRRset([]dns.RR{mustRR(t, "www.example.com. 0 IN A 0.0.0.0")})
+			},
+			wantRcode: dns.RcodeSuccess,
+			check: func(t *testing.T, store *storage.MemoryStorage) {
+				if got := getValues(t, store, "www.example.com.", types.RecordTypeA); got != nil {
+					t.Errorf("www A = %v, want deleted", got)
+				}
+			},
+		},
+		{
+			name: "delete name keeps apex SOA and NS",
+			zone: "example.com.",
+			build: func(t *testing.T, m *dns.Msg) {
+				m.RemoveName([]dns.RR{mustRR(t, "example.com. 0 IN A 0.0.0.0")})
+				m.Remove([]dns.RR{mustRR(t, "example.com. 0 IN NS ns1.example.com.")})
+			},
+			wantRcode: dns.RcodeSuccess,
+			check: func(t *testing.T, store *storage.MemoryStorage) {
+				if getValues(t, store, "example.com.", types.RecordTypeSOA) == nil || getValues(t, store, "example.com.", types.RecordTypeNS) == nil {
+					t.Error("apex SOA/NS must not be deleted")
+				}
+			},
+		},
+		{
+			name: "CNAME conflicts are ignored",
+			zone: "example.com.",
+			build: func(t *testing.T, m *dns.Msg) {
+				m.Insert([]dns.RR{
+					mustRR(t, "alias.example.com. 300 IN A 192.168.1.5"),
+					mustRR(t, "www.example.com. 300 IN CNAME example.com."),
+				})
+			},
+			wantRcode: dns.RcodeSuccess,
+			check: func(t *testing.T, store *storage.MemoryStorage) {
+				if got := getValues(t, store, "alias.example.com.", types.RecordTypeA); got != nil {
+					t.Errorf("A next to CNAME = %v, want ignored", got)
+				}
+				if got := getValues(t, store, "www.example.com.", types.RecordTypeCNAME); got != nil {
+					t.Errorf("CNAME next to A = %v, want ignored", got)
+				}
+			},
+		},
+		{
+			name:      "zone not served",
+			zone:      "example.net.",
+			build:     func(t *testing.T, m *dns.Msg) {},
+			wantRcode: dns.RcodeNotAuth,
+		},
+		{
+			name: "update outside zone",
+			zone: "example.com.",
+			build: func(t *testing.T, m *dns.Msg) {
+				m.Insert([]dns.RR{mustRR(t, "host.other.org. 300 IN A 10.0.0.2")})
+			},
+			wantRcode: dns.RcodeNotZone,
+		},
+		{
+			name: "prerequisite name in use",
+			zone: "example.com.",
+			build: func(t *testing.T, m *dns.Msg) {
+				m.NameUsed([]dns.RR{mustRR(t, "missing.example.com. 0 IN A 0.0.0.0")})
+			},
+			wantRcode: dns.RcodeNameError,
+		},
+		{
+			name: "prerequisite name not in use",
+			zone: "example.com.",
+			build: func(t *testing.T, m *dns.Msg) {
+				m.NameNotUsed([]dns.RR{mustRR(t, "www.example.com. 0 IN A 0.0.0.0")})
+			},
+			wantRcode: dns.RcodeYXDomain,
+		},
+		{
+			name: "prerequisite RRset exists",
+			zone: "example.com.",
+			build: func(t *testing.T, m *dns.Msg) {
+				m.RRsetUsed([]dns.RR{mustRR(t, "www.example.com. 0 IN AAAA ::")})
+			},
+			wantRcode: dns.RcodeNXRrset,
+		},
+		{
+			name: "prerequisite RRset does not exist",
+			zone: "example.com.",
+			build: func(t *testing.T, m *dns.Msg) {
+				m.RRsetNotUsed([]dns.RR{mustRR(t, "www.example.com. 0 IN A 0.0.0.0")})
+			},
+			wantRcode: dns.RcodeYXRrset,
+		},
+		{
+			name: "value-dependent prerequisite must match the whole RRset",
+			zone: "example.com.",
+			build: func(t *testing.T, m *dns.Msg) {
+				m.Used([]dns.RR{mustRR(t, "www.example.com. 0 IN A 192.168.1.1")})
+			},
+			wantRcode: dns.RcodeNXRrset,
+		},
+		{
+			name: "failed prerequisite leaves the zone untouched",
+			zone: "example.com.",
+			build: func(t *testing.T, m *dns.Msg) {
+				m.Used([]dns.RR{
+					mustRR(t, "www.example.com. 0 IN A 192.168.1.1"),
+					mustRR(t, "www.example.com. 0 IN A 192.168.1.2"),
+				})
+				m.NameNotUsed([]dns.RR{mustRR(t, "alias.example.com. 0 IN A 0.0.0.0")})
+				m.RemoveRRset([]dns.RR{mustRR(t, "www.example.com. 0 IN A 0.0.0.0")})
+			},
+			wantRcode: dns.RcodeYXDomain,
+			check: func(t *testing.T, store *storage.MemoryStorage) {
+				if got := getValues(t, store, "www.example.com.", types.RecordTypeA); len(got) != 2 {
+					t.Errorf("www A = %v, want unchanged", got)
+				}
+			},
+		},
+		{
+			name: "unsupported type",
+			zone: "example.com.",
+			build: func(t *testing.T, m *dns.Msg) {
+				m.Insert([]dns.RR{mustRR(t, `host.example.com. 300 IN HINFO "cpu" "os"`)})
+			},
+			wantRcode: dns.RcodeNotImplemented,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := setupUpdateStore(t)
+			u, err := NewUpdater(store, UpdateConfig{Enabled: true})
+			if err != nil {
+				t.Fatalf("NewUpdater() error = %v", err)
+			}
+			m := new(dns.Msg)
+			m.SetUpdate(tt.zone)
+			tt.build(t, m)
+
+			// Round-trip through the wire format, as the server would see it.
+			wire, err := m.Pack()
+			if err != nil {
+				t.Fatalf("Pack() error = %v", err)
+			}
+			in := new(dns.Msg)
+			if err := in.Unpack(wire); err != nil {
+				t.Fatalf("Unpack() error = %v", err)
+			}
+
+			if got := u.Apply(context.Background(), in); got != tt.wantRcode {
+				t.Errorf("Apply() = %s, want %s", dns.RcodeToString[got], dns.RcodeToString[tt.wantRcode])
+			}
+			if tt.check != nil {
+				tt.check(t, store)
+			}
+			if got := getValues(t, store, "other.org.", types.RecordTypeA); len(got) != 1 {
+				t.Error("record outside the zone was modified")
+			}
+		})
+	}
+}
+
+// staleListStorage is a CoreStorage whose List returns records read
+// before another writer changed them.
+type staleListStorage struct {
+	storage.CoreStorage
+	records []*types.DNSRecord
+}
+
+func (s *staleListStorage) List(context.Context) ([]*types.DNSRecord, error) {
+	return s.records, nil
+}
+
+func TestUpdater_ApplyChecksPrerequisitesInTransaction(t *testing.T) {
+	store := setupUpdateStore(t)
+	ctx := context.Background()
+	stale, _ := store.List(ctx)
+	// Another writer removes the RRset after the update listed the store.
+	_ = store.Delete(ctx, "www.example.com.", types.RecordTypeA)
+
+	u, err := NewUpdater(&staleListStorage{CoreStorage: store, records: stale}, UpdateConfig{Enabled: true})
+	if err != nil {
+		t.Fatalf("NewUpdater() error = %v", err)
+	}
+	m := new(dns.Msg)
+	m.SetUpdate("example.com.")
+	m.RRsetUsed([]dns.RR{mustRR(t, "www.example.com. 0 IN A 0.0.0.0")})
+	m.Insert([]dns.RR{mustRR(t, "www.example.com. 300 IN TXT \"present\"")})
+
+	if got := u.Apply(ctx, m); got != dns.RcodeNXRrset {
+		t.Errorf("Apply() = %s, want NXRRSET", dns.RcodeToString[got])
+	}
+	if got := getValues(t, store, "www.example.com.", types.RecordTypeTXT); got != nil {
+		t.Errorf("www TXT = %v, want not written", got)
+	}
+}
+
+func TestUpdater_ServeUpdate(t *testing.T) {
+	store := setupUpdateStore(t)
+	u, err := NewUpdater(store, UpdateConfig{Enabled: true})
+	if err != nil {
+		t.Fatalf("NewUpdater() error = %v", err)
+	}
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	server := &dns.Server{
+		PacketConn:    pc,
+		Handler:       dns.HandlerFunc(u.ServeUpdate),
+		TsigSecret:    map[string]string{testTSIGKey: testTSIGSecret},
+		MsgAcceptFunc: AcceptMsg,
+	}
+	started := make(chan struct{})
+	server.NotifyStartedFunc = func() { close(started) }
+	go func() { _ = server.ActivateAndServe() }()
+	<-started
+	defer server.Shutdown()
+	addr := pc.LocalAddr().String()
+
+	tests := []struct {
+		name      string
+		secret    string
+		sign      bool
+		wantRcode int
+	}{
+		{name: "unsigned", sign: false, wantRcode: dns.RcodeRefused},
+		{name: "bad signature", sign: true, secret: "d3Jvbmctc2VjcmV0", wantRcode: dns.RcodeNotAuth},
+		{name: "signed", sign: true, secret: testTSIGSecret, wantRcode: dns.RcodeSuccess},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := new(dns.Msg)
+			m.SetUpdate("example.com.")
+			m.Insert([]dns.RR{mustRR(t, `_acme-challenge.example.com. 60 IN TXT "`+tt.name+`"`)})
+			c := &dns.Client{Timeout: 2 * time.Second}
+			if tt.sign {
+				c.TsigSecret = map[string]string{testTSIGKey: tt.secret}
+				m.SetTsig(testTSIGKey, dns.HmacSHA256, 300, time.Now().Unix())
+			}
+			resp, _, err := c.Exchange(m, addr)
+			if err != nil && resp == nil {
+				t.Fatalf("Exchange() error = %v", err)
+			}
+			if resp.Rcode != tt.wantRcode {
+				t.Errorf("Rcode = %s, want %s", dns.RcodeToString[resp.Rcode], dns.RcodeToString[tt.wantRcode])
+			}
+		})
+	}
+
+	if got := getValues(t, store, "_acme-challenge.example.com.", types.RecordTypeTXT); len(got) != 1 || got[0] != "signed" {
+		t.Errorf("TXT = %v, want only the signed update applied", got)
+	}
+}
+
+func TestAcceptMsg(t *testing.T) {
+	tests := []struct {
+		name   string
+		opcode int
+		qd     uint16
+		ns     uint16
+		want   dns.MsgAcceptAction
+	}{
+		{name: "update", opcode: dns.OpcodeUpdate, qd: 1, ns: 5, want: dns.MsgAccept},
+		{name: "update without zone", opcode: dns.OpcodeUpdate, qd: 0, want: dns.MsgReject},
+		{name: "query", opcode: dns.OpcodeQuery, qd: 1, want: dns.MsgAccept},
+		{name: "status", opcode: dns.OpcodeStatus, qd: 1, want: dns.MsgRejectNotImplemented},
+	}
+	for _, tt := range tests {
+		dh := dns.Header{Bits: uint16(tt.opcode) << 11, Qdcount: tt.qd, Nscount: tt.ns}
+		if got := AcceptMsg(dh); got != tt.want {
+			t.Errorf("AcceptMsg(%s) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,216 @@
+package dns
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sort"
+	"strings"
+
+	"jabberwocky238/jw238dns/metrics"
+	"jabberwocky238/jw238dns/storage"
+	"jabberwocky238/jw238dns/types"
+
+	"github.com/miekg/dns"
+)
+
+// defaultZoneTTL is the TTL of records in a zone file that have neither
+// an explicit TTL nor a preceding $TTL directive.
+const defaultZoneTTL = 3600
+
+// ZoneFile names an RFC 1035 master file and the origin of its relative
+// names.
+type ZoneFile struct {
+	Path   string // Path to the zone file
+	Origin string // Initial $ORIGIN; empty requires absolute names or an $ORIGIN directive
+}
+
+// ParsedZone is the result of parsing a zone file.
+type ParsedZone struct {
+	Records  []*types.DNSRecord
+	Warnings []string // RRs that were skipped or cannot be stored exactly
+}
+
+// ParseZone parses RFC 1035 master-file syntax ($ORIGIN, $TTL, relative
+// names, parenthesised multi-line records, $INCLUDE) from r. file is used
+// in error messages and to resolve relative $INCLUDE paths; $INCLUDE is
+// only followed when allowInclude is set.
+//
+// RRs sharing an owner and type are merged into one record. RRs the store
+// cannot represent are skipped, and RRs it can only store approximately
+// (MX preference, CAA flag and tag) are kept; both are reported in
+// Warnings.
+func ParseZone(r io.Reader, origin, file string, allowInclude bool) (*ParsedZone, error) {
+	zp := dns.NewZoneParser(r, origin, file)
+	zp.SetDefaultTTL(defaultZoneTTL)
+	zp.SetIncludeAllowed(allowInclude)
+
+	parsed := &ParsedZone{}
+	rrs := make(map[string]dns.RR)
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		hdr := rr.Header()
+		if hdr.Class != dns.ClassINET {
+			parsed.warn(rr, "class %s not supported, skipped", dns.Class(hdr.Class))
+			continue
+		}
+		if _, ok := storedValue(rr); !ok {
+			parsed.warn(rr, "type not supported, skipped")
+			continue
+		}
+		if loss := approximation(rr); loss != "" {
+			parsed.warn(rr, "%s", loss)
+		}
+		rrs[rrKey(rr)] = rr
+	}
+	if err := zp.Err(); err != nil {
+		return nil, err
+	}
+
+	parsed.Records = rrsToRecords(rrs)
+	return parsed, nil
+}
+
+// ParseZoneFile parses the zone file zf, following $INCLUDE directives.
+func ParseZoneFile(zf ZoneFile) (*ParsedZone, error) {
+	f, err := os.Open(zf.Path)
+	if err != nil {
+		return nil, fmt.Errorf("open zone file: %w", err)
+	}
+	defer f.Close()
+	return ParseZone(f, zf.Origin, zf.Path, true)
+}
+
+// approximation describes what of rr the store cannot keep (MX preference,
+// CAA flag and tag), or returns "" if it is stored exactly.
+func approximation(rr dns.RR) string {
+	switch v := rr.(type) {
+	case *dns.MX:
+		if v.Preference != 10 {
+			return fmt.Sprintf("preference %d is served as 10", v.Preference)
+		}
+	case *dns.CAA:
+		if v.Flag != 0 || v.Tag != "issue" {
+			return fmt.Sprintf("flag %d tag %q is served as 0 issue", v.Flag, v.Tag)
+		}
+	}
+	return ""
+}
+
+// warn records a warning about rr.
+func (p *ParsedZone) warn(rr dns.RR, format string, args ...any) {
+	hdr := rr.Header()
+	p.Warnings = append(p.Warnings,
+		fmt.Sprintf("%s %s: %s", hdr.Name, dns.Type(hdr.Rrtype), fmt.Sprintf(format, args...)))
+}
+
+// WriteZone writes records as an RFC 1035 zone file with absolute names.
+// When origin is set only records at or below it are written, preceded by
+// an $ORIGIN directive. SOA records come first, then the rest sorted by
+// name and type.
+func WriteZone(w io.Writer, records []*types.DNSRecord, origin string) error {
+	var selected []*types.DNSRecord
+	for _, rec := range records {
+		if origin == "" || dns.IsSubDomain(dns.Fqdn(origin), dns.Fqdn(rec.Name)) {
+			selected = append(selected, rec)
+		}
+	}
+	sort.Slice(selected, func(i, j int) bool {
+		a, b := selected[i], selected[j]
+		if (a.Type == types.RecordTypeSOA) != (b.Type == types.RecordTypeSOA) {
+			return a.Type == types.RecordTypeSOA
+		}
+		if a.Name != b.Name {
+			return strings.ToLower(a.Name) < strings.ToLower(b.Name)
+		}
+		return a.Type < b.Type
+	})
+
+	bw := bufio.NewWriter(w)
+	if origin != "" {
+		fmt.Fprintf(bw, "$ORIGIN %s\n", dns.Fqdn(origin))
+	}
+	for _, rec := range selected {
+		fqdn := *rec
+		fqdn.Name = dns.Fqdn(rec.Name)
+		for _, rr := range buildRRs(&fqdn) {
+			fmt.Fprintln(bw, rr.String())
+		}
+	}
+	return bw.Flush()
+}
+
+// ZoneFileLoader loads records from zone files into a MemoryStorage and
+// reloads them whenever a file changes. The files are the source of truth:
+// every load replaces the store with their combined contents, and changes
+// made through the API are not written back.
+//
+// Changes to files pulled in with $INCLUDE are picked up the next time one
+// of the configured files changes.
+type ZoneFileLoader struct {
+	zones []ZoneFile
+	store *storage.MemoryStorage
+}
+
+// NewZoneFileLoader creates a ZoneFileLoader for the given zone files.
+func NewZoneFileLoader(zones []ZoneFile, store *storage.MemoryStorage) *ZoneFileLoader {
+	return &ZoneFileLoader{
+		zones: zones,
+		store: store,
+	}
+}
+
+// Load parses every zone file and returns their combined records. Parse
+// warnings are logged. If any file fails to parse, no records are
+// returned.
+func (l *ZoneFileLoader) Load() ([]*types.DNSRecord, error) {
+	var records []*types.DNSRecord
+	for _, zf := range l.zones {
+		// Parse errors already name the file and line.
+		parsed, err := ParseZoneFile(zf)
+		if err != nil {
+			return nil, err
+		}
+		for _, w := range parsed.Warnings {
+			slog.Warn("zone file record", "path", zf.Path, "warning", w)
+		}
+		records = append(records, parsed.Records...)
+	}
+	return records, nil
+}
+
+// LoadAndApply reads the zone files and applies the records to the store
+// using CalculateChanges + PartialReload. The store is left untouched if a
+// file fails to parse.
+func (l *ZoneFileLoader) LoadAndApply(ctx context.Context) error {
+	records, err := l.Load()
+	if err != nil {
+		metrics.ObserveReload("zonefile", err)
+		return err
+	}
+
+	changes := l.store.CalculateChanges(records)
+	if len(changes.Added) == 0 && len(changes.Updated) == 0 && len(changes.Deleted) == 0 {
+		return nil
+	}
+
+	err = l.store.PartialReload(ctx, changes)
+	metrics.ObserveReload("zonefile", err)
+	return err
+}
+
+// Watch reloads the zone files whenever one of them is written. It blocks
+// until ctx is cancelled.
+func (l *ZoneFileLoader) Watch(ctx context.Context) error {
+	paths := make([]string, 0, len(l.zones))
+	for _, zf := range l.zones {
+		paths = append(paths, zf.Path)
+	}
+	return storage.WatchFiles(ctx, paths, func() {
+		if err := l.LoadAndApply(ctx); err != nil {
+			slog.Error("reload zone files", "err", err)
+		}
+	})
+}
@@ -0,0 +1,210 @@
+package dns
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"jabberwocky238/jw238dns/storage"
+	"jabberwocky238/jw238dns/types"
+)
+
+const testZone = `$ORIGIN example.com.
+$TTL 600
+@   IN SOA ns1 admin (
+        2024010101 ; serial
+        3600       ; refresh
+        900        ; retry
+        604800     ; expire
+        86400 )    ; minimum
+    IN NS  ns1
+ns1 IN A   192.0.2.53
+www 300 IN A 192.0.2.1
+www IN A   192.0.2.2
+mail IN MX 10 mx.example.net.
+txt IN TXT "hello " "world"
+_sip._tcp IN SRV 10 20 5060 sip
+`
+
+func findRecord(records []*types.DNSRecord, name string, rt types.RecordType) *types.DNSRecord {
+	for _, r := range records {
+		if r.Name == name && r.Type == rt {
+			return r
+		}
+	}
+	return nil
+}
+
+func TestParseZone(t *testing.T) {
+	parsed, err := ParseZone(strings.NewReader(testZone), "", "test", false)
+	if err != nil {
+		t.Fatalf("ParseZone() error = %v", err)
+	}
+	if len(parsed.Warnings) != 0 {
+		t.Errorf("Warnings = %v, want none", parsed.Warnings)
+	}
+
+	tests := []struct {
+		name  string
+		rt    types.RecordType
+		ttl   uint32
+		value []string
+	}{
+		{"example.com.", types.RecordTypeSOA, 600, []string{"ns1.example.com. admin.example.com. 2024010101 3600 900 604800 86400"}},
+		{"example.com.", types.RecordTypeNS, 600, []string{"ns1.example.com."}},
+		{"ns1.example.com.", types.RecordTypeA, 600, []string{"192.0.2.53"}},
+		{"www.example.com.", types.RecordTypeA, 300, []string{"192.0.2.1", "192.0.2.2"}},
+		{"mail.example.com.", types.RecordTypeMX, 600, []string{"mx.example.net."}},
+		{"txt.example.com.", types.RecordTypeTXT, 600, []string{"hello world"}},
+		{"_sip._tcp.example.com.", types.RecordTypeSRV, 600, []string{"10 20 5060 sip.example.com."}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name+" "+string(tt.rt), func(t *testing.T) {
+			rec := findRecord(parsed.Records, tt.name, tt.rt)
+			if rec == nil {
+				t.Fatalf("record not found in %v", parsed.Records)
+			}
+			if rec.TTL != tt.ttl {
+				t.Errorf("TTL = %d, want %d", rec.TTL, tt.ttl)
+			}
+			if strings.Join(rec.Value, "|") != strings.Join(tt.value, "|") {
+				t.Errorf("Value = %v, want %v", rec.Value, tt.value)
+			}
+		})
+	}
+	if len(parsed.Records) != len(tests) {
+		t.Errorf("got %d records, want %d", len(parsed.Records), len(tests))
+	}
+}
+
+func TestParseZone_Errors(t *testing.T) {
+	tests := []struct {
+		name         string
+		zone         string
+		origin       string
+		wantErr      bool
+		wantWarnings int
+	}{
+		{name: "initial origin", zone: "www 60 IN A 192.0.2.1\n", origin: "example.com"},
+		{name: "syntax error", zone: "www IN A not-an-ip\n", origin: "example.com.", wantErr: true},
+		{name: "include not allowed", zone: "$INCLUDE /etc/passwd\n", origin: "example.com.", wantErr: true},
+		{name: "unsupported type", zone: "@ IN DNSKEY 257 3 13 AAAA\n", origin: "example.com.", wantWarnings: 1},
+		{name: "other class", zone: "@ CH TXT \"x\"\n", origin: "example.com.", wantWarnings: 1},
+		{name: "lossy MX and CAA", zone: "@ IN MX 20 mx\n@ IN CAA 0 iodef \"mailto:a@example.com\"\n", origin: "example.com.", wantWarnings: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parsed, err := ParseZone(strings.NewReader(tt.zone), tt.origin, "test", false)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseZone() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && len(parsed.Warnings) != tt.wantWarnings {
+				t.Errorf("Warnings = %v, want %d", parsed.Warnings, tt.wantWarnings)
+			}
+		})
+	}
+}
+
+func TestParseZoneFile_Include(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "hosts.inc"), "www IN A 192.0.2.1\n")
+	main := filepath.Join(dir, "db.example.com")
+	writeFile(t, main, "$TTL 300\n@ IN NS ns1\n$INCLUDE hosts.inc\n")
+
+	parsed, err := ParseZoneFile(ZoneFile{Path: main, Origin: "example.com."})
+	if err != nil {
+		t.Fatalf("ParseZoneFile() error = %v", err)
+	}
+	if rec := findRecord(parsed.Records, "www.example.com.", types.RecordTypeA); rec == nil || rec.TTL != 300 {
+		t.Errorf("included record = %v, want www.example.com. A with TTL 300", rec)
+	}
+}
+
+func TestWriteZone_RoundTrip(t *testing.T) {
+	parsed, err := ParseZone(strings.NewReader(testZone), "", "test", false)
+	if err != nil {
+		t.Fatalf("ParseZone() error = %v", err)
+	}
+	other := &types.DNSRecord{Name: "example.org.", Type: types.RecordTypeA, TTL: 60, Value: []string{"192.0.2.9"}}
+	long := &types.DNSRecord{Name: "dkim.example.com.", Type: types.RecordTypeTXT, TTL: 60, Value: []string{strings.Repeat("k", 600)}}
+	records := append(parsed.Records, other, long)
+
+	var buf strings.Builder
+	if err := WriteZone(&buf, records, "example.com."); err != nil {
+		t.Fatalf("WriteZone() error = %v", err)
+	}
+	out := buf.String()
+	if !strings.HasPrefix(out, "$ORIGIN example.com.\nexample.com.\t600\tIN\tSOA\t") {
+		t.Errorf("zone does not start with $ORIGIN and SOA:\n%s", out)
+	}
+	if strings.Contains(out, "example.org.") {
+		t.Errorf("zone contains a record outside the origin:\n%s", out)
+	}
+
+	again, err := ParseZone(strings.NewReader(out), "", "export", false)
+	if err != nil {
+		t.Fatalf("re-parse error = %v\n%s", err, out)
+	}
+	want := append(parsed.Records, long)
+	if len(again.Records) != len(want) {
+		t.Fatalf("re-parsed %d records, want %d", len(again.Records), len(want))
+	}
+	for _, w := range want {
+		got := findRecord(again.Records, w.Name, w.Type)
+		if got == nil || got.TTL != w.TTL || strings.Join(got.Value, "|") != strings.Join(w.Value, "|") {
+			t.Errorf("re-parsed %s %s = %v, want %v", w.Name, w.Type, got, w)
+		}
+	}
+}
+
+func TestZoneFileLoader_LoadAndWatch(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "db.example.com")
+	writeFile(t, path, "$TTL 300\nwww IN A 192.0.2.1\n")
+
+	store := storage.NewMemoryStorage()
+	_ = store.Create(context.Background(), &types.DNSRecord{Name: "stale.example.com.", Type: types.RecordTypeA, TTL: 60, Value: []string{"192.0.2.99"}})
+	loader := NewZoneFileLoader([]ZoneFile{{Path: path, Origin: "example.com."}}, store)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := loader.LoadAndApply(ctx); err != nil {
+		t.Fatalf("LoadAndApply() error = %v", err)
+	}
+	if got := getValues(t, store, "www.example.com.", types.RecordTypeA); len(got) != 1 {
+		t.Errorf("www.example.com. A = %v, want 1 value", got)
+	}
+	if got := getValues(t, store, "stale.example.com.", types.RecordTypeA); got != nil {
+		t.Errorf("stale record survived load: %v", got)
+	}
+
+	go func() { _ = loader.Watch(ctx) }()
+	time.Sleep(100 * time.Millisecond)
+
+	// A broken file leaves the store unchanged.
+	writeFile(t, path, "www IN A broken\n")
+	time.Sleep(300 * time.Millisecond)
+	if got := getValues(t, store, "www.example.com.", types.RecordTypeA); len(got) != 1 {
+		t.Errorf("store changed after a bad edit: %v", got)
+	}
+
+	writeFile(t, path, "$TTL 300\nwww IN A 192.0.2.1\nwww IN A 192.0.2.2\n")
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if len(getValues(t, store, "www.example.com.", types.RecordTypeA)) == 2 {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Errorf("www.example.com. A = %v after edit, want 2 values", getValues(t, store, "www.example.com.", types.RecordTypeA))
+}
+
+func writeFile(t *testing.T, path, data string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+		t.Fatalf("write %s: %v", path, err)
+	}
+}
@@ -0,0 +1,191 @@
+package http
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"jabberwocky238/jw238dns/storage"
+	"jabberwocky238/jw238dns/types"
+
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	// errPrecondition fails a batch operation whose precondition does not
+	// hold.
+	errPrecondition = errors.New("precondition failed")
+
+	// errDryRun rolls back a dry-run batch once its changes are known.
+	errDryRun = errors.New("dry run")
+)
+
+// Batch handles POST /dns/batch. The operations are checked and applied
+// in order in a single storage transaction: either all of them are
+// applied or none is. The response has a result per operation; the first
+// failing one fails the batch with 400 if it is invalid, 412 if its
+// precondition does not hold, and 409 on a conflict with the stored
+// records.
+func (h *DNSHandler) Batch(c *gin.Context) {
+	var req BatchRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		Fail(c, 400, err.Error())
+		return
+	}
+
+	resp := BatchResponse{DryRun: req.DryRun, Results: make([]BatchResult, len(req.Operations))}
+	for i, op := range req.Operations {
+		resp.Results[i] = BatchResult{Index: i, Op: op.Op, Domain: op.Domain, Type: op.Type, Status: BatchStatusSkipped}
+	}
+
+	// Every operation is validated before the transaction starts.
+	now := time.Now().UTC().Truncate(time.Second)
+	expires := make([]time.Time, len(req.Operations))
+	for i, op := range req.Operations {
+		var err error
+		if expires[i], err = op.validate(now); err != nil {
+			resp.Results[i].Status, resp.Results[i].Error = BatchStatusFailed, err.Error()
+			failBatch(c, 400, fmt.Sprintf("operation %d: %v", i, err), resp)
+			return
+		}
+	}
+
+	failed := -1
+	err := h.storage.Transaction(c.Request.Context(), func(tx *storage.Tx) error {
+		// The transaction may be retried, so start from a clean slate.
+		failed, resp.Changes = -1, nil
+		for i := range resp.Results {
+			resp.Results[i].Status, resp.Results[i].Error, resp.Results[i].Record = BatchStatusSkipped, "", nil
+		}
+		for i, op := range req.Operations {
+			record, err := op.apply(tx, expires[i], now)
+			if err != nil {
+				failed = i
+				resp.Results[i].Status, resp.Results[i].Error = BatchStatusFailed, err.Error()
+				return err
+			}
+			resp.Results[i].Status, resp.Results[i].Record = BatchStatusOK, record
+		}
+		resp.Changes = batchChanges(tx.Changes())
+		if req.DryRun {
+			return errDryRun
+		}
+		return nil
+	})
+
+	switch {
+	case err == nil:
+		resp.Applied = true
+		OK(c, resp)
+	case errors.Is(err, errDryRun):
+		OK(c, resp)
+	case failed < 0:
+		FailStorage(c, err)
+	case errors.Is(err, errPrecondition):
+		failBatch(c, 412, fmt.Sprintf("operation %d: %v", failed, err), resp)
+	case errors.Is(err, types.ErrRecordExists), errors.Is(err, types.ErrRecordNotFound), errors.Is(err, types.ErrRecordOwned):
+		failBatch(c, 409, fmt.Sprintf("operation %d: %v", failed, err), resp)
+	default:
+		FailStorage(c, err)
+	}
+}
+
+// validate checks op without looking at the stored records and returns
+// its expiry.
+func (op *BatchOperation) validate(now time.Time) (time.Time, error) {
+	if !op.Type.IsValid() {
+		return time.Time{}, errors.New("invalid record type")
+	}
+	if op.Op != "delete" && len(op.Value) == 0 {
+		return time.Time{}, fmt.Errorf("%s requires a value", op.Op)
+	}
+	return expiry(op.ExpiresAt, op.ExpiresIn, now)
+}
+
+// apply checks op's precondition and ownership against tx and applies
+// it, returning the record it writes.
+func (op *BatchOperation) apply(tx *storage.Tx, expires, now time.Time) (*types.DNSRecord, error) {
+	existing, err := tx.Get(op.Domain, op.Type)
+	if err != nil && !errors.Is(err, types.ErrRecordNotFound) {
+		return nil, err
+	}
+	if err := op.If.check(existing); err != nil {
+		return nil, err
+	}
+	if existing != nil && existing.Owner() != "" && existing.Owner() != op.Owner {
+		return nil, fmt.Errorf("%w: %q", types.ErrRecordOwned, existing.Owner())
+	}
+
+	ttl := op.TTL
+	if ttl == 0 {
+		ttl = 300
+	}
+	switch op.Op {
+	case "create":
+		comment := ""
+		if op.Comment != nil {
+			comment = *op.Comment
+		}
+		record := &types.DNSRecord{
+			Name:  op.Domain,
+			Type:  op.Type,
+			TTL:   ttl,
+			Value: op.Value,
+			Meta:  newMeta(op.Owner, op.Labels, comment, expires, now),
+		}
+		return record, tx.Create(record)
+	case "update":
+		record := &types.DNSRecord{
+			Name:  op.Domain,
+			Type:  op.Type,
+			TTL:   ttl,
+			Value: op.Value,
+			Meta:  updatedMeta(existing, op.Owner, op.Labels, op.Comment, expires, now),
+		}
+		return record, tx.Update(record)
+	default:
+		return nil, tx.Delete(op.Domain, op.Type)
+	}
+}
+
+// check returns an error wrapping errPrecondition unless existing, which
+// is nil for a missing record, satisfies p. A nil p always holds.
+func (p *BatchPrecondition) check(existing *types.DNSRecord) error {
+	if p == nil {
+		return nil
+	}
+	if p.Exists != nil && *p.Exists != (existing != nil) {
+		if *p.Exists {
+			return fmt.Errorf("%w: record does not exist", errPrecondition)
+		}
+		return fmt.Errorf("%w: record exists", errPrecondition)
+	}
+	if p.Value == nil && p.TTL == 0 {
+		return nil
+	}
+	if existing == nil {
+		return fmt.Errorf("%w: record does not exist", errPrecondition)
+	}
+	if p.Value != nil && !slices.Equal(slices.Sorted(slices.Values(p.Value)), slices.Sorted(slices.Values(existing.Value))) {
+		return fmt.Errorf("%w: value is %q", errPrecondition, existing.Value)
+	}
+	if p.TTL != 0 && p.TTL != existing.TTL {
+		return fmt.Errorf("%w: ttl is %d", errPrecondition, existing.TTL)
+	}
+	return nil
+}
+
+// batchChanges converts storage changes for a BatchResponse.
+func batchChanges(changes *types.RecordChanges) *BatchChanges {
+	out := &BatchChanges{Added: changes.Added, Updated: changes.Updated, Deleted: []RecordRef{}}
+	for _, key := range changes.Deleted {
+		out.Deleted = append(out.Deleted, RecordRef{Domain: key.Name, Type: key.Type})
+	}
+	return out
+}
+
+// failBatch sends an error response carrying the batch results.
+func failBatch(c *gin.Context, httpStatus int, message string, resp BatchResponse) {
+	c.JSON(httpStatus, Response{Code: httpStatus, Message: message, Data: resp})
+}
@@ -2,6 +2,9 @@ package http
 
 import (
 	"errors"
+	"fmt"
+	"strings"
+	"time"
 
 	"jabberwocky238/jw238dns/storage"
 	"jabberwocky238/jw238dns/types"
@@ -12,6 +15,8 @@ import (
 // DNSHandler handles DNS record management endpoints.
 type DNSHandler struct {
 	storage storage.CoreStorage
+	history *storage.History // nil if history is disabled
+	events  EventSource      // nil if watching is disabled
 }
 
 // NewDNSHandler creates a new DNSHandler with the given storage backend.
@@ -36,11 +41,18 @@ func (h *DNSHandler) AddRecord(c *gin.Context) {
 		req.TTL = 300
 	}
 
+	now := time.Now().UTC().Truncate(time.Second)
+	expires, err := expiry(req.ExpiresAt, req.ExpiresIn, now)
+	if err != nil {
+		Fail(c, 400, err.Error())
+		return
+	}
 	record := &types.DNSRecord{
 		Name:  req.Domain,
 		Type:  req.Type,
 		TTL:   req.TTL,
 		Value: req.Value,
+		Meta:  newMeta(req.Owner, req.Labels, req.Comment, expires, now),
 	}
 
 	if err := h.storage.Create(c.Request.Context(), record); err != nil {
@@ -48,7 +60,7 @@ func (h *DNSHandler) AddRecord(c *gin.Context) {
 			Fail(c, 409, "record already exists")
 			return
 		}
-		Fail(c, 500, err.Error())
+		FailStorage(c, err)
 		return
 	}
 
@@ -68,12 +80,14 @@ func (h *DNSHandler) DeleteRecord(c *gin.Context) {
 		return
 	}
 
-	if err := h.storage.Delete(c.Request.Context(), req.Domain, req.Type); err != nil {
-		if errors.Is(err, types.ErrRecordNotFound) {
-			Fail(c, 404, "record not found")
-			return
+	err := h.storage.Transaction(c.Request.Context(), func(tx *storage.Tx) error {
+		if _, err := checkOwner(tx, req.Domain, req.Type, req.Owner); err != nil {
+			return err
 		}
-		Fail(c, 500, err.Error())
+		return tx.Delete(req.Domain, req.Type)
+	})
+	if err != nil {
+		failWrite(c, err)
 		return
 	}
 
@@ -97,19 +111,30 @@ func (h *DNSHandler) UpdateRecord(c *gin.Context) {
 		req.TTL = 300
 	}
 
-	record := &types.DNSRecord{
-		Name:  req.Domain,
-		Type:  req.Type,
-		TTL:   req.TTL,
-		Value: req.Value,
+	now := time.Now().UTC().Truncate(time.Second)
+	expires, err := expiry(req.ExpiresAt, req.ExpiresIn, now)
+	if err != nil {
+		Fail(c, 400, err.Error())
+		return
 	}
 
-	if err := h.storage.Update(c.Request.Context(), record); err != nil {
-		if errors.Is(err, types.ErrRecordNotFound) {
-			Fail(c, 404, "record not found")
-			return
+	var record *types.DNSRecord
+	err = h.storage.Transaction(c.Request.Context(), func(tx *storage.Tx) error {
+		existing, err := checkOwner(tx, req.Domain, req.Type, req.Owner)
+		if err != nil {
+			return err
 		}
-		Fail(c, 500, err.Error())
+		record = &types.DNSRecord{
+			Name:  req.Domain,
+			Type:  req.Type,
+			TTL:   req.TTL,
+			Value: req.Value,
+			Meta:  updatedMeta(existing, req.Owner, req.Labels, req.Comment, expires, now),
+		}
+		return tx.Update(record)
+	})
+	if err != nil {
+		failWrite(c, err)
 		return
 	}
 
@@ -124,9 +149,13 @@ func (h *DNSHandler) ListRecords(c *gin.Context) {
 		return
 	}
 
-	// Apply optional filters from query params.
+	// Apply optional filters from query params. Each label parameter is
+	// "key=value", or "key" to match any value.
 	domain := c.Query("domain")
 	recordType := c.Query("type")
+	owner := c.Query("owner")
+	source := c.Query("source")
+	labels := c.QueryArray("label")
 
 	var filtered []*types.DNSRecord
 	for _, r := range records {
@@ -136,6 +165,15 @@ func (h *DNSHandler) ListRecords(c *gin.Context) {
 		if recordType != "" && string(r.Type) != recordType {
 			continue
 		}
+		if owner != "" && r.Owner() != owner {
+			continue
+		}
+		if source != "" && (r.Meta == nil || r.Meta.Source != source) {
+			continue
+		}
+		if !hasLabels(r, labels) {
+			continue
+		}
 		filtered = append(filtered, r)
 	}
 
@@ -170,3 +208,111 @@ func (h *DNSHandler) GetRecord(c *gin.Context) {
 
 	OK(c, records)
 }
+
+// checkOwner returns the record stored under domain and type in tx, or
+// nil if there is none. It returns ErrRecordOwned if the record has an
+// owner other than owner. Reading the record through tx makes the write
+// that follows fail over to a retry if the owner changes in between.
+func checkOwner(tx *storage.Tx, domain string, rt types.RecordType, owner string) (*types.DNSRecord, error) {
+	existing, err := tx.Get(domain, rt)
+	if errors.Is(err, types.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if existing.Owner() != "" && existing.Owner() != owner {
+		return nil, fmt.Errorf("%w: %q", types.ErrRecordOwned, existing.Owner())
+	}
+	return existing, nil
+}
+
+// failWrite fails a request whose update or delete returned err.
+func failWrite(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, types.ErrRecordNotFound):
+		Fail(c, 404, "record not found")
+	case errors.Is(err, types.ErrRecordOwned):
+		Fail(c, 409, err.Error())
+	default:
+		FailStorage(c, err)
+	}
+}
+
+// newMeta returns the metadata of a record created through the API.
+func newMeta(owner string, labels map[string]string, comment string, expires, now time.Time) *types.RecordMeta {
+	return &types.RecordMeta{
+		Owner:     owner,
+		Source:    types.SourceHTTP,
+		CreatedAt: now,
+		UpdatedAt: now,
+		Labels:    labels,
+		Comment:   comment,
+		ExpiresAt: expires,
+	}
+}
+
+// updatedMeta returns the metadata of existing, which may be nil, updated
+// through the API. Nil labels, a nil comment and a zero expiry keep the
+// stored ones.
+func updatedMeta(existing *types.DNSRecord, owner string, labels map[string]string, comment *string, expires, now time.Time) *types.RecordMeta {
+	var meta *types.RecordMeta
+	if existing != nil {
+		meta = existing.Meta.Clone()
+	}
+	if meta == nil {
+		meta = &types.RecordMeta{Source: types.SourceHTTP}
+	}
+	meta.Owner = owner
+	meta.UpdatedAt = now
+	if !expires.IsZero() {
+		meta.ExpiresAt = expires
+	}
+	if labels != nil {
+		meta.Labels = labels
+	}
+	if comment != nil {
+		meta.Comment = *comment
+	}
+	return meta
+}
+
+// hasLabels reports whether r has every label in selectors, each
+// "key=value" or "key".
+func hasLabels(r *types.DNSRecord, selectors []string) bool {
+	for _, sel := range selectors {
+		key, value, withValue := strings.Cut(sel, "=")
+		if r.Meta == nil {
+			return false
+		}
+		v, ok := r.Meta.Labels[key]
+		if !ok || (withValue && v != value) {
+			return false
+		}
+	}
+	return true
+}
+
+// expiry returns the expiry requested by expires_at or expires_in, or the
+// zero time if neither is set.
+func expiry(at *time.Time, in string, now time.Time) (time.Time, error) {
+	switch {
+	case at != nil && in != "":
+		return time.Time{}, errors.New("set expires_at or expires_in, not both")
+	case at != nil:
+		if !at.After(now) {
+			return time.Time{}, errors.New("expires_at is in the past")
+		}
+		return at.UTC(), nil
+	case in != "":
+		d, err := time.ParseDuration(in)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("expires_in: %w", err)
+		}
+		if d <= 0 {
+			return time.Time{}, errors.New("expires_in must be positive")
+		}
+		return now.Add(d), nil
+	}
+	return time.Time{}, nil
+}
@@ -0,0 +1,168 @@
+package http
+
+import (
+	"errors"
+	"slices"
+	"strconv"
+	"time"
+
+	"jabberwocky238/jw238dns/storage"
+	"jabberwocky238/jw238dns/types"
+
+	"github.com/gin-gonic/gin"
+)
+
+// defaultHistoryLimit is the number of entries GET /dns/history returns
+// without a limit parameter.
+const defaultHistoryLimit = 100
+
+// History handles GET /dns/history. It returns the change history, newest
+// first, optionally filtered by the "name" and "type" query parameters
+// and the RFC 3339 times "since" and "until". "limit" caps the number of
+// entries (default 100, 0 for all).
+func (h *DNSHandler) History(c *gin.Context) {
+	if h.history == nil {
+		Fail(c, 404, "history is not enabled")
+		return
+	}
+
+	q := storage.HistoryQuery{
+		Name:  c.Query("name"),
+		Type:  types.RecordType(c.Query("type")),
+		Limit: defaultHistoryLimit,
+	}
+	if q.Type != "" && !q.Type.IsValid() {
+		Fail(c, 400, "invalid record type")
+		return
+	}
+	for param, t := range map[string]*time.Time{"since": &q.Since, "until": &q.Until} {
+		if v := c.Query(param); v != "" {
+			parsed, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				Fail(c, 400, param+": "+err.Error())
+				return
+			}
+			*t = parsed
+		}
+	}
+	if v := c.Query("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 0 {
+			Fail(c, 400, "limit must be a non-negative integer")
+			return
+		}
+		q.Limit = limit
+	}
+
+	entries, err := h.history.Entries(q)
+	if err != nil {
+		Fail(c, 500, err.Error())
+		return
+	}
+	if entries == nil {
+		entries = []storage.HistoryEntry{}
+	}
+	OK(c, HistoryResponse{Version: h.history.Version(), Entries: entries})
+}
+
+// Rollback handles POST /dns/rollback. It restores the records as they
+// were at a history version, or at a time, in one storage transaction.
+// Like /dns/update and /dns/delete, it fails if a record it would change
+// or delete has an owner other than the request's. The rollback itself
+// is recorded as a change.
+func (h *DNSHandler) Rollback(c *gin.Context) {
+	if h.history == nil {
+		Fail(c, 404, "history is not enabled")
+		return
+	}
+
+	var req RollbackRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		Fail(c, 400, err.Error())
+		return
+	}
+	version := req.Version
+	switch {
+	case (version == 0) == (req.Time == nil):
+		Fail(c, 400, "exactly one of version and time is required")
+		return
+	case req.Time != nil:
+		v, err := h.history.VersionAt(*req.Time)
+		if err != nil {
+			failHistory(c, err)
+			return
+		}
+		version = v
+	}
+
+	records, err := h.history.RecordsAt(version)
+	if err != nil {
+		failHistory(c, err)
+		return
+	}
+	current, err := h.history.RecordsAt(h.history.Version())
+	if err != nil {
+		Fail(c, 500, err.Error())
+		return
+	}
+	changes := storage.DiffRecords(current, records)
+	resp := RollbackResponse{Version: version}
+
+	ctx := c.Request.Context()
+	actor, _ := storage.ActorFrom(ctx)
+	actor.Source = storage.SourceRollback
+	err = h.storage.Transaction(storage.WithActor(ctx, actor), func(tx *storage.Tx) error {
+		for _, r := range slices.Concat(changes.Added, changes.Updated) {
+			existing, err := checkOwner(tx, r.Name, r.Type, req.Owner)
+			if err != nil {
+				return err
+			}
+			if existing == nil {
+				err = tx.Create(r)
+			} else {
+				err = tx.Update(r)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		for _, key := range changes.Deleted {
+			existing, err := checkOwner(tx, key.Name, key.Type, req.Owner)
+			if err != nil {
+				return err
+			}
+			if existing != nil {
+				if err := tx.Delete(key.Name, key.Type); err != nil {
+					return err
+				}
+			}
+		}
+		applied := tx.Changes()
+		resp.Added, resp.Updated, resp.Deleted = len(applied.Added), len(applied.Updated), len(applied.Deleted)
+		if req.DryRun {
+			return errDryRun
+		}
+		return nil
+	})
+	switch {
+	case err == nil:
+		resp.Applied = true
+		OK(c, resp)
+	case errors.Is(err, errDryRun):
+		OK(c, resp)
+	case errors.Is(err, types.ErrRecordOwned):
+		Fail(c, 409, err.Error())
+	default:
+		FailStorage(c, err)
+	}
+}
+
+// failHistory sends the error response for a rollback target the history
+// cannot restore: 410 if it is no longer kept, 400 otherwise.
+func failHistory(c *gin.Context, err error) {
+	if errors.Is(err, storage.ErrHistoryUnavailable) {
+		Fail(c, 410, err.Error())
+		return
+	}
+	Fail(c, 400, err.Error())
+}
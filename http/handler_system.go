@@ -4,7 +4,10 @@ import (
 	"runtime"
 	"time"
 
+	"jabberwocky238/jw238dns/metrics"
+
 	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 var startTime = time.Now()
@@ -26,3 +29,8 @@ func StatusHandler(c *gin.Context) {
 		"alloc_bytes": mem.Alloc,
 	})
 }
+
+// MetricsHandler handles GET /metrics and serves the Prometheus registry.
+func MetricsHandler() gin.HandlerFunc {
+	return gin.WrapH(promhttp.HandlerFor(metrics.Registry, promhttp.HandlerOpts{}))
+}
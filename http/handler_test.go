@@ -1,12 +1,16 @@
 package http
 
 import (
+	"bufio"
 	"bytes"
 	"context"
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
 	"jabberwocky238/jw238dns/storage"
 	"jabberwocky238/jw238dns/types"
@@ -87,6 +91,18 @@ func TestStatusEndpoint(t *testing.T) {
 	}
 }
 
+func TestMetricsEndpoint(t *testing.T) {
+	router, _ := setupTestRouter(t)
+	w := doRequest(router, http.MethodGet, "/metrics", nil, "")
+
+	if w.Code != 200 {
+		t.Fatalf("GET /metrics status = %d, want 200", w.Code)
+	}
+	if !strings.Contains(w.Body.String(), "go_goroutines") {
+		t.Errorf("GET /metrics body missing go_goroutines, got: %.200s", w.Body.String())
+	}
+}
+
 // --- Auth Middleware ---
 
 func TestAuthMiddleware_NoToken(t *testing.T) {
@@ -295,6 +311,319 @@ func TestListRecords_Filter(t *testing.T) {
 	}
 }
 
+func TestRecordOwnership(t *testing.T) {
+	router, store := setupTestRouter(t)
+
+	add := AddRecordRequest{
+		Domain: "_acme-challenge.example.com.", Type: types.RecordTypeTXT, Value: []string{"token"},
+		Owner: "cert-manager", Labels: map[string]string{"purpose": "acme"}, Comment: "DNS-01 challenge",
+	}
+	if w := doRequest(router, http.MethodPost, "/dns/add", add, "test-token"); w.Code != 200 {
+		t.Fatalf("add status = %d, body = %s", w.Code, w.Body.String())
+	}
+	recs, _ := store.Get(context.Background(), add.Domain, types.RecordTypeTXT)
+	meta := recs[0].Meta
+	if meta == nil || meta.Owner != "cert-manager" || meta.Source != types.SourceHTTP || meta.CreatedAt.IsZero() {
+		t.Fatalf("Meta = %+v, want owner, source and creation time", meta)
+	}
+
+	// Other owners, and requests naming none, cannot touch the record.
+	for _, owner := range []string{"", "external-dns"} {
+		update := UpdateRecordRequest{Domain: add.Domain, Type: types.RecordTypeTXT, Value: []string{"other"}, Owner: owner}
+		if w := doRequest(router, http.MethodPost, "/dns/update", update, "test-token"); w.Code != 409 {
+			t.Errorf("update by %q status = %d, want 409", owner, w.Code)
+		}
+		del := DeleteRecordRequest{Domain: add.Domain, Type: types.RecordTypeTXT, Owner: owner}
+		if w := doRequest(router, http.MethodPost, "/dns/delete", del, "test-token"); w.Code != 409 {
+			t.Errorf("delete by %q status = %d, want 409", owner, w.Code)
+		}
+	}
+
+	// The owner can; omitted metadata is kept.
+	update := UpdateRecordRequest{Domain: add.Domain, Type: types.RecordTypeTXT, Value: []string{"renewed"}, Owner: "cert-manager"}
+	if w := doRequest(router, http.MethodPost, "/dns/update", update, "test-token"); w.Code != 200 {
+		t.Fatalf("update by owner status = %d, body = %s", w.Code, w.Body.String())
+	}
+	recs, _ = store.Get(context.Background(), add.Domain, types.RecordTypeTXT)
+	if got := recs[0].Meta; got.Comment != "DNS-01 challenge" || got.Labels["purpose"] != "acme" || !got.CreatedAt.Equal(meta.CreatedAt) {
+		t.Errorf("Meta after update = %+v, want comment, labels and creation time kept", got)
+	}
+
+	// Unowned records stay open to everyone.
+	del := DeleteRecordRequest{Domain: "example.com.", Type: types.RecordTypeA, Owner: "anyone"}
+	if w := doRequest(router, http.MethodPost, "/dns/delete", del, "test-token"); w.Code != 200 {
+		t.Errorf("delete unowned status = %d, want 200", w.Code)
+	}
+}
+
+// staleGetStorage is a CoreStorage whose Get returns records read before
+// another writer changed them.
+type staleGetStorage struct {
+	storage.CoreStorage
+	records []*types.DNSRecord
+}
+
+func (s *staleGetStorage) Get(context.Context, string, types.RecordType) ([]*types.DNSRecord, error) {
+	return s.records, nil
+}
+
+func TestRecordOwnership_CheckedInTransaction(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	store := storage.NewMemoryStorage()
+	ctx := context.Background()
+	rec := &types.DNSRecord{Name: "www.example.com.", Type: types.RecordTypeA, TTL: 300, Value: []string{"192.0.2.1"}}
+	_ = store.Create(ctx, rec)
+	stale := []*types.DNSRecord{rec}
+	// Another owner takes the record after it was read.
+	_ = store.Update(ctx, &types.DNSRecord{Name: rec.Name, Type: rec.Type, TTL: 300, Value: []string{"192.0.2.2"},
+		Meta: &types.RecordMeta{Owner: "ops"}})
+	router := NewServer(ServerConfig{Listen: ":0", AuthToken: "test-token"}, &staleGetStorage{CoreStorage: store, records: stale}).Engine()
+
+	update := UpdateRecordRequest{Domain: rec.Name, Type: rec.Type, Value: []string{"192.0.2.3"}, Owner: "deploy"}
+	if w := doRequest(router, http.MethodPost, "/dns/update", update, "test-token"); w.Code != 409 {
+		t.Errorf("update status = %d, want 409", w.Code)
+	}
+	del := DeleteRecordRequest{Domain: rec.Name, Type: rec.Type, Owner: "deploy"}
+	if w := doRequest(router, http.MethodPost, "/dns/delete", del, "test-token"); w.Code != 409 {
+		t.Errorf("delete status = %d, want 409", w.Code)
+	}
+	if recs, err := store.Get(ctx, rec.Name, rec.Type); err != nil || recs[0].Owner() != "ops" || recs[0].Value[0] != "192.0.2.2" {
+		t.Errorf("record = %v, %v, want the other owner's record kept", recs, err)
+	}
+}
+
+func TestAddRecord_Expiry(t *testing.T) {
+	router, store := setupTestRouter(t)
+
+	add := AddRecordRequest{Domain: "preview.example.com.", Type: types.RecordTypeA, Value: []string{"192.0.2.1"}, ExpiresIn: "2h"}
+	if w := doRequest(router, http.MethodPost, "/dns/add", add, "test-token"); w.Code != 200 {
+		t.Fatalf("add status = %d, body = %s", w.Code, w.Body.String())
+	}
+	recs, _ := store.Get(context.Background(), add.Domain, types.RecordTypeA)
+	if until := time.Until(recs[0].Expires()); until < time.Hour || until > 2*time.Hour {
+		t.Errorf("expires in %v, want about 2h", until)
+	}
+
+	past := time.Now().Add(-time.Minute)
+	for name, req := range map[string]AddRecordRequest{
+		"both":     {Domain: "a.example.com.", Type: types.RecordTypeA, Value: []string{"192.0.2.1"}, ExpiresIn: "1h", ExpiresAt: &past},
+		"past":     {Domain: "b.example.com.", Type: types.RecordTypeA, Value: []string{"192.0.2.1"}, ExpiresAt: &past},
+		"negative": {Domain: "c.example.com.", Type: types.RecordTypeA, Value: []string{"192.0.2.1"}, ExpiresIn: "-1h"},
+		"garbage":  {Domain: "d.example.com.", Type: types.RecordTypeA, Value: []string{"192.0.2.1"}, ExpiresIn: "soon"},
+	} {
+		if w := doRequest(router, http.MethodPost, "/dns/add", req, "test-token"); w.Code != 400 {
+			t.Errorf("%s: status = %d, want 400", name, w.Code)
+		}
+	}
+
+	// Updates keep the expiry unless they set a new one.
+	update := UpdateRecordRequest{Domain: add.Domain, Type: types.RecordTypeA, Value: []string{"192.0.2.2"}}
+	if w := doRequest(router, http.MethodPost, "/dns/update", update, "test-token"); w.Code != 200 {
+		t.Fatalf("update status = %d, body = %s", w.Code, w.Body.String())
+	}
+	if got, _ := store.Get(context.Background(), add.Domain, types.RecordTypeA); !got[0].Expires().Equal(recs[0].Expires()) {
+		t.Errorf("expiry after update = %v, want %v", got[0].Expires(), recs[0].Expires())
+	}
+}
+
+func TestListRecords_MetadataFilters(t *testing.T) {
+	router, store := setupTestRouter(t)
+	_ = store.Create(context.Background(), &types.DNSRecord{
+		Name: "a.example.com.", Type: types.RecordTypeA, TTL: 60, Value: []string{"192.0.2.1"},
+		Meta: &types.RecordMeta{Owner: "team-a", Source: types.SourceHTTP, Labels: map[string]string{"env": "prod", "tier": "web"}},
+	})
+	_ = store.Create(context.Background(), &types.DNSRecord{
+		Name: "b.example.com.", Type: types.RecordTypeA, TTL: 60, Value: []string{"192.0.2.2"},
+		Meta: &types.RecordMeta{Owner: "team-b", Source: types.SourceUpdate, Labels: map[string]string{"env": "dev"}},
+	})
+
+	for query, want := range map[string]int{
+		"owner=team-a":           1,
+		"source=rfc2136":         1,
+		"label=env":              2,
+		"label=env=prod":         1,
+		"label=env&label=tier":   1,
+		"label=env=prod&owner=x": 0,
+	} {
+		w := doRequest(router, http.MethodGet, "/dns/list?"+query, nil, "test-token")
+		data, _ := parseResponse(t, w).Data.([]any)
+		if len(data) != want {
+			t.Errorf("list?%s returned %d records, want %d", query, len(data), want)
+		}
+	}
+}
+
+// --- Zone import/export ---
+
+func doZoneRequest(router *gin.Engine, path, zone string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(zone))
+	req.Header.Set("Content-Type", "text/dns")
+	req.Header.Set("Authorization", "Bearer test-token")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestImportZone(t *testing.T) {
+	const zone = "$TTL 600\n@ IN A 192.168.1.2\nwww IN A 192.168.1.3\nmail IN MX 20 mx\n"
+	tests := []struct {
+		name        string
+		path        string
+		zone        string
+		wantStatus  int
+		wantAdded   float64
+		wantUpdated float64
+		wantDeleted float64
+		wantKept    bool // other.com. survives the import
+	}{
+		{name: "merge", path: "/dns/import?origin=example.com.", zone: zone, wantStatus: 200, wantAdded: 2, wantUpdated: 1, wantKept: true},
+		{name: "replace", path: "/dns/import?origin=example.com.&replace=true", zone: "www IN A 192.168.1.3\n", wantStatus: 200, wantAdded: 1, wantDeleted: 2, wantKept: true},
+		{name: "replace without origin", path: "/dns/import?replace=true", zone: zone, wantStatus: 400},
+		{name: "syntax error", path: "/dns/import?origin=example.com.", zone: "www IN A nope\n", wantStatus: 400},
+		{name: "include refused", path: "/dns/import?origin=example.com.", zone: "$INCLUDE /etc/passwd\n", wantStatus: 400},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			router, store := setupTestRouter(t)
+			ctx := context.Background()
+			_ = store.Create(ctx, &types.DNSRecord{Name: "old.example.com.", Type: types.RecordTypeA, TTL: 60, Value: []string{"192.168.1.9"}})
+			_ = store.Create(ctx, &types.DNSRecord{Name: "other.com.", Type: types.RecordTypeA, TTL: 60, Value: []string{"192.168.2.1"}})
+
+			w := doZoneRequest(router, tt.path, tt.zone)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d, body: %s", w.Code, tt.wantStatus, w.Body.String())
+			}
+			if tt.wantStatus != 200 {
+				return
+			}
+			data, _ := parseResponse(t, w).Data.(map[string]any)
+			if data["added"] != tt.wantAdded || data["updated"] != tt.wantUpdated || data["deleted"] != tt.wantDeleted {
+				t.Errorf("result = %v, want added %v updated %v deleted %v", data, tt.wantAdded, tt.wantUpdated, tt.wantDeleted)
+			}
+			if _, err := store.Get(ctx, "other.com.", types.RecordTypeA); (err == nil) != tt.wantKept {
+				t.Errorf("other.com. kept = %v, want %v", err == nil, tt.wantKept)
+			}
+		})
+	}
+}
+
+func TestImportZone_KeepsMetadataAndSources(t *testing.T) {
+	router, store := setupTestRouter(t)
+	ctx := context.Background()
+	expires := time.Now().UTC().Add(time.Hour).Truncate(time.Second)
+	_ = store.Create(ctx, &types.DNSRecord{Name: "_acme-challenge.example.com.", Type: types.RecordTypeTXT, TTL: 60, Value: []string{"token"},
+		Meta: &types.RecordMeta{Labels: map[string]string{"purpose": "acme"}, ExpiresAt: expires}})
+	store.ApplySource(ctx, "discovery", []*types.DNSRecord{
+		{Name: "svc.example.com.", Type: types.RecordTypeA, TTL: 300, Value: []string{"10.0.0.1"}},
+	})
+
+	// The zone as exported: the stored records and the discovered one.
+	zone := "@ 300 IN A 192.168.1.1\n_acme-challenge 60 IN TXT \"token\"\nsvc 300 IN A 10.0.0.1\n"
+	w := doZoneRequest(router, "/dns/import?origin=example.com.&replace=true", zone)
+	if w.Code != 200 {
+		t.Fatalf("status = %d, body: %s", w.Code, w.Body.String())
+	}
+	if resp := decodeData[ImportZoneResponse](t, w); resp.Added != 0 || resp.Updated != 0 || resp.Deleted != 0 {
+		t.Errorf("result = %+v, want no changes", resp)
+	}
+	recs, _ := store.Get(ctx, "_acme-challenge.example.com.", types.RecordTypeTXT)
+	if meta := recs[0].Meta; meta == nil || meta.Labels["purpose"] != "acme" || !meta.ExpiresAt.Equal(expires) {
+		t.Errorf("Meta = %+v, want labels and expiry kept", meta)
+	}
+	persistent, _ := store.ListPersistent(ctx)
+	for _, r := range persistent {
+		if r.Name == "svc.example.com." {
+			t.Error("discovered record became persistent")
+		}
+	}
+
+	// A changed record keeps its metadata too, and a replace leaves the
+	// discovered record alone.
+	w = doZoneRequest(router, "/dns/import?origin=example.com.&replace=true", "_acme-challenge 60 IN TXT \"renewed\"\n")
+	if resp := decodeData[ImportZoneResponse](t, w); resp.Updated != 1 || resp.Deleted != 1 {
+		t.Errorf("result = %+v, want one update and one deletion", resp)
+	}
+	recs, _ = store.Get(ctx, "_acme-challenge.example.com.", types.RecordTypeTXT)
+	if meta := recs[0].Meta; recs[0].Value[0] != "renewed" || meta == nil || !meta.ExpiresAt.Equal(expires) || meta.UpdatedAt.IsZero() {
+		t.Errorf("record = %+v, meta %+v, want the new value with the expiry kept", recs[0], meta)
+	}
+	if _, err := store.Get(ctx, "svc.example.com.", types.RecordTypeA); err != nil {
+		t.Error("replace deleted the discovered record")
+	}
+}
+
+func TestImportZone_Ownership(t *testing.T) {
+	router, store := setupTestRouter(t)
+	ctx := context.Background()
+	_ = store.Create(ctx, &types.DNSRecord{Name: "_acme-challenge.example.com.", Type: types.RecordTypeTXT, TTL: 60, Value: []string{"token"},
+		Meta: &types.RecordMeta{Owner: "cert-manager"}})
+
+	for name, path := range map[string]string{
+		"update":            "/dns/import?origin=example.com.",
+		"update by another": "/dns/import?origin=example.com.&owner=external-dns",
+	} {
+		if w := doZoneRequest(router, path, "_acme-challenge 60 IN TXT \"other\"\n"); w.Code != 409 {
+			t.Errorf("%s status = %d, want 409", name, w.Code)
+		}
+	}
+	if w := doZoneRequest(router, "/dns/import?origin=example.com.&replace=true", "@ 300 IN A 192.168.1.1\n"); w.Code != 409 {
+		t.Errorf("replace status = %d, want 409", w.Code)
+	}
+	if recs, err := store.Get(ctx, "_acme-challenge.example.com.", types.RecordTypeTXT); err != nil || recs[0].Value[0] != "token" {
+		t.Errorf("owned record = %v, %v, want it unchanged", recs, err)
+	}
+
+	// Importing the same answers changes nothing and needs no owner.
+	if w := doZoneRequest(router, "/dns/import?origin=example.com.", "_acme-challenge 60 IN TXT \"token\"\n"); w.Code != 200 {
+		t.Errorf("unchanged import status = %d, want 200", w.Code)
+	}
+	w := doZoneRequest(router, "/dns/import?origin=example.com.&owner=cert-manager", "_acme-challenge 60 IN TXT \"renewed\"\nnew 60 IN TXT \"x\"\n")
+	if w.Code != 200 {
+		t.Fatalf("import by the owner status = %d, body: %s", w.Code, w.Body.String())
+	}
+	if recs, _ := store.Get(ctx, "new.example.com.", types.RecordTypeTXT); recs[0].Owner() != "cert-manager" {
+		t.Errorf("imported record owner = %q, want cert-manager", recs[0].Owner())
+	}
+}
+
+func TestImportZone_Warnings(t *testing.T) {
+	router, _ := setupTestRouter(t)
+	w := doZoneRequest(router, "/dns/import?origin=example.com.", "mail IN MX 20 mx\n")
+	if w.Code != 200 {
+		t.Fatalf("status = %d, want 200", w.Code)
+	}
+	data, _ := parseResponse(t, w).Data.(map[string]any)
+	warnings, _ := data["warnings"].([]any)
+	if len(warnings) != 1 {
+		t.Errorf("warnings = %v, want 1", data["warnings"])
+	}
+}
+
+func TestExportZone(t *testing.T) {
+	router, store := setupTestRouter(t)
+	_ = store.Create(context.Background(), &types.DNSRecord{Name: "other.com.", Type: types.RecordTypeA, TTL: 60, Value: []string{"192.168.2.1"}})
+
+	w := doRequest(router, http.MethodGet, "/dns/export?zone=example.com.", nil, "test-token")
+	if w.Code != 200 {
+		t.Fatalf("status = %d, want 200", w.Code)
+	}
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/dns") {
+		t.Errorf("Content-Type = %q, want text/dns", ct)
+	}
+	body := w.Body.String()
+	if !strings.Contains(body, "example.com.\t300\tIN\tA\t192.168.1.1") {
+		t.Errorf("export missing example.com. A record:\n%s", body)
+	}
+	if strings.Contains(body, "other.com.") {
+		t.Errorf("export contains a record outside the zone:\n%s", body)
+	}
+
+	w = doRequest(router, http.MethodGet, "/dns/export?zone=bad..name", nil, "test-token")
+	if w.Code != 400 {
+		t.Errorf("invalid zone status = %d, want 400", w.Code)
+	}
+}
+
 // --- DNS Get ---
 
 func TestGetRecord(t *testing.T) {
@@ -353,3 +682,419 @@ func TestAddRecord_InvalidJSON(t *testing.T) {
 		t.Errorf("status = %d, want 400", w.Code)
 	}
 }
+
+func TestAddRecord_NotLeader(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	store := storage.NewLeaderOnlyStorage(storage.NewMemoryStorage(), func() error {
+		return fmt.Errorf("%w: current leader is replica-0", types.ErrNotLeader)
+	})
+	router := NewServer(ServerConfig{Listen: ":0", AuthToken: "test-token"}, store).Engine()
+
+	w := doRequest(router, http.MethodPost, "/dns/add", AddRecordRequest{
+		Domain: "new.example.com.",
+		Type:   types.RecordTypeA,
+		Value:  []string{"10.0.0.1"},
+	}, "test-token")
+
+	if w.Code != 503 {
+		t.Errorf("status = %d, want 503", w.Code)
+	}
+	if resp := parseResponse(t, w); !strings.Contains(resp.Message, "replica-0") {
+		t.Errorf("message = %q, want it to name the leader", resp.Message)
+	}
+}
+
+// batchResults decodes the data of a /dns/batch response.
+func batchResults(t *testing.T, w *httptest.ResponseRecorder) BatchResponse {
+	t.Helper()
+	var resp struct{ Data BatchResponse }
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decode response: %v", err)
+	}
+	return resp.Data
+}
+
+func TestBatch(t *testing.T) {
+	router, store := setupTestRouter(t)
+	ctx := context.Background()
+	exists := true
+
+	req := BatchRequest{Operations: []BatchOperation{
+		{Op: "create", Domain: "www.example.com.", Type: types.RecordTypeA, Value: []string{"192.0.2.1"}, Owner: "deploy"},
+		{Op: "update", Domain: "example.com.", Type: types.RecordTypeA, Value: []string{"192.0.2.2"},
+			If: &BatchPrecondition{Exists: &exists, Value: []string{"192.168.1.1"}}},
+		{Op: "update", Domain: "www.example.com.", Type: types.RecordTypeA, Value: []string{"192.0.2.3"}, Owner: "deploy"},
+	}}
+
+	// A dry run reports the changes without applying them.
+	req.DryRun = true
+	w := doRequest(router, http.MethodPost, "/dns/batch", req, "test-token")
+	if w.Code != 200 {
+		t.Fatalf("dry run status = %d, body = %s", w.Code, w.Body.String())
+	}
+	if resp := batchResults(t, w); resp.Applied || resp.Changes == nil || len(resp.Changes.Added) != 1 || len(resp.Changes.Updated) != 1 {
+		t.Errorf("dry run = %+v, want one added and one updated record, not applied", resp)
+	}
+	if _, err := store.Get(ctx, "www.example.com.", types.RecordTypeA); err == nil {
+		t.Error("dry run applied its changes")
+	}
+
+	req.DryRun = false
+	w = doRequest(router, http.MethodPost, "/dns/batch", req, "test-token")
+	if w.Code != 200 {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+	}
+	resp := batchResults(t, w)
+	if !resp.Applied {
+		t.Error("batch not applied")
+	}
+	for _, r := range resp.Results {
+		if r.Status != BatchStatusOK {
+			t.Errorf("operation %d status = %s (%s)", r.Index, r.Status, r.Error)
+		}
+	}
+	recs, err := store.Get(ctx, "www.example.com.", types.RecordTypeA)
+	if err != nil || recs[0].Value[0] != "192.0.2.3" || recs[0].Owner() != "deploy" {
+		t.Errorf("www.example.com. = %v, %v", recs, err)
+	}
+}
+
+func TestBatch_Failures(t *testing.T) {
+	router, store := setupTestRouter(t)
+	ctx := context.Background()
+	_ = store.Create(ctx, &types.DNSRecord{Name: "owned.example.com.", Type: types.RecordTypeA, TTL: 300,
+		Value: []string{"192.0.2.9"}, Meta: &types.RecordMeta{Owner: "ops"}})
+	create := BatchOperation{Op: "create", Domain: "new.example.com.", Type: types.RecordTypeA, Value: []string{"192.0.2.1"}}
+
+	tests := []struct {
+		name   string
+		op     BatchOperation
+		status int
+	}{
+		{"invalid type", BatchOperation{Op: "create", Domain: "x.example.com.", Type: "BOGUS", Value: []string{"x"}}, 400},
+		{"missing value", BatchOperation{Op: "update", Domain: "example.com.", Type: types.RecordTypeA}, 400},
+		{"exists", BatchOperation{Op: "create", Domain: "example.com.", Type: types.RecordTypeA, Value: []string{"192.0.2.2"}}, 409},
+		{"not found", BatchOperation{Op: "delete", Domain: "missing.example.com.", Type: types.RecordTypeA}, 409},
+		{"owned", BatchOperation{Op: "delete", Domain: "owned.example.com.", Type: types.RecordTypeA}, 409},
+		{"precondition", BatchOperation{Op: "update", Domain: "example.com.", Type: types.RecordTypeA, Value: []string{"192.0.2.2"},
+			If: &BatchPrecondition{TTL: 60}}, 412},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := BatchRequest{Operations: []BatchOperation{create, tt.op, create}}
+			w := doRequest(router, http.MethodPost, "/dns/batch", req, "test-token")
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d, body = %s", w.Code, tt.status, w.Body.String())
+			}
+			resp := batchResults(t, w)
+			if resp.Applied || len(resp.Results) != 3 || resp.Results[1].Status != BatchStatusFailed || resp.Results[2].Status != BatchStatusSkipped {
+				t.Errorf("results = %+v, want the second operation failed and the third skipped", resp.Results)
+			}
+			// The earlier create is rolled back with the rest.
+			if _, err := store.Get(ctx, "new.example.com.", types.RecordTypeA); err == nil {
+				t.Error("failed batch applied its first operation")
+			}
+		})
+	}
+}
+
+// --- History ---
+
+func setupHistoryRouter(t *testing.T) (*gin.Engine, *storage.MemoryStorage) {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+
+	history, err := storage.NewHistory(storage.NewMemoryHistory(0))
+	if err != nil {
+		t.Fatalf("NewHistory() error = %v", err)
+	}
+	store := storage.NewMemoryStorage()
+	store.SetHistory(history)
+	_ = store.Create(context.Background(), &types.DNSRecord{
+		Name:  "example.com.",
+		Type:  types.RecordTypeA,
+		TTL:   300,
+		Value: []string{"192.168.1.1"},
+	})
+
+	srv := NewServer(ServerConfig{Listen: ":0", AuthToken: "test-token", History: history}, store)
+	return srv.Engine(), store
+}
+
+func decodeData[T any](t *testing.T, w *httptest.ResponseRecorder) T {
+	t.Helper()
+	var resp struct{ Data T }
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decode response: %v, body: %s", err, w.Body.String())
+	}
+	return resp.Data
+}
+
+func TestHistory(t *testing.T) {
+	router, _ := setupHistoryRouter(t)
+
+	req := httptest.NewRequest(http.MethodPost, "/dns/update", strings.NewReader(
+		`{"domain":"example.com.","type":"A","value":["10.0.0.1"]}`))
+	req.Header.Set("Authorization", "Bearer test-token")
+	req.Header.Set("X-Actor", "deploy-job")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != 200 {
+		t.Fatalf("update status = %d, body = %s", w.Code, w.Body.String())
+	}
+	w = doRequest(router, http.MethodPost, "/dns/add", AddRecordRequest{
+		Domain: "new.example.com.", Type: types.RecordTypeA, Value: []string{"10.0.0.2"},
+	}, "test-token")
+	if w.Code != 200 {
+		t.Fatalf("add status = %d, body = %s", w.Code, w.Body.String())
+	}
+
+	w = doRequest(router, http.MethodGet, "/dns/history?name=example.com.", nil, "test-token")
+	if w.Code != 200 {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+	}
+	resp := decodeData[HistoryResponse](t, w)
+	if resp.Version != 3 || len(resp.Entries) != 2 {
+		t.Fatalf("history = %+v, want 2 entries of example.com. at version 3", resp)
+	}
+	if e := resp.Entries[0]; e.Version != 2 || e.Actor != "deploy-job" || e.Source != types.SourceHTTP ||
+		e.Before.Value[0] != "192.168.1.1" || e.After.Value[0] != "10.0.0.1" {
+		t.Errorf("newest entry = %+v, want the update by deploy-job", e)
+	}
+	if e := resp.Entries[1]; e.Source != storage.SourceSync {
+		t.Errorf("oldest entry source = %q, want %q", e.Source, storage.SourceSync)
+	}
+
+	for _, query := range []string{"type=BOGUS", "since=yesterday", "limit=-1"} {
+		if w := doRequest(router, http.MethodGet, "/dns/history?"+query, nil, "test-token"); w.Code != 400 {
+			t.Errorf("%s status = %d, want 400", query, w.Code)
+		}
+	}
+}
+
+func TestRollback(t *testing.T) {
+	router, store := setupHistoryRouter(t)
+	ctx := context.Background()
+	_ = store.Update(ctx, &types.DNSRecord{Name: "example.com.", Type: types.RecordTypeA, TTL: 300, Value: []string{"10.0.0.1"}})
+	_ = store.Create(ctx, &types.DNSRecord{Name: "new.example.com.", Type: types.RecordTypeA, TTL: 300, Value: []string{"10.0.0.2"}})
+
+	w := doRequest(router, http.MethodPost, "/dns/rollback", RollbackRequest{Version: 1, DryRun: true}, "test-token")
+	if w.Code != 200 {
+		t.Fatalf("dry run status = %d, body = %s", w.Code, w.Body.String())
+	}
+	if resp := decodeData[RollbackResponse](t, w); resp.Applied || resp.Updated != 1 || resp.Deleted != 1 {
+		t.Errorf("dry run = %+v, want one update and one deletion, not applied", resp)
+	}
+	if _, err := store.Get(ctx, "new.example.com.", types.RecordTypeA); err != nil {
+		t.Error("dry run applied the rollback")
+	}
+
+	w = doRequest(router, http.MethodPost, "/dns/rollback", RollbackRequest{Version: 1}, "test-token")
+	if w.Code != 200 {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+	}
+	if resp := decodeData[RollbackResponse](t, w); !resp.Applied {
+		t.Errorf("rollback = %+v, want applied", resp)
+	}
+	recs, err := store.Get(ctx, "example.com.", types.RecordTypeA)
+	if err != nil || recs[0].Value[0] != "192.168.1.1" {
+		t.Errorf("example.com. = %v, %v, want the value at version 1", recs, err)
+	}
+	if _, err := store.Get(ctx, "new.example.com.", types.RecordTypeA); err == nil {
+		t.Error("record added after version 1 still present")
+	}
+
+	w = doRequest(router, http.MethodGet, "/dns/history?limit=1", nil, "test-token")
+	if e := decodeData[HistoryResponse](t, w).Entries; len(e) != 1 || e[0].Source != storage.SourceRollback {
+		t.Errorf("newest entry = %+v, want the rollback", e)
+	}
+
+	for name, body := range map[string]any{
+		"neither":        RollbackRequest{},
+		"both":           RollbackRequest{Version: 1, Time: new(time.Now())},
+		"future version": RollbackRequest{Version: 99},
+	} {
+		if w := doRequest(router, http.MethodPost, "/dns/rollback", body, "test-token"); w.Code != 400 {
+			t.Errorf("%s status = %d, want 400", name, w.Code)
+		}
+	}
+	before := time.Now().Add(-time.Hour)
+	if w := doRequest(router, http.MethodPost, "/dns/rollback", RollbackRequest{Time: &before}, "test-token"); w.Code != 410 {
+		t.Errorf("time before the history status = %d, want 410", w.Code)
+	}
+}
+
+func TestRollback_Ownership(t *testing.T) {
+	router, store := setupHistoryRouter(t)
+	ctx := context.Background()
+	_ = store.Create(ctx, &types.DNSRecord{Name: "owned.example.com.", Type: types.RecordTypeA, TTL: 300, Value: []string{"10.0.0.2"},
+		Meta: &types.RecordMeta{Owner: "ops"}})
+
+	for _, body := range []RollbackRequest{{Version: 1, DryRun: true}, {Version: 1}, {Version: 1, Owner: "deploy"}} {
+		if w := doRequest(router, http.MethodPost, "/dns/rollback", body, "test-token"); w.Code != 409 {
+			t.Errorf("rollback %+v status = %d, want 409", body, w.Code)
+		}
+	}
+	if _, err := store.Get(ctx, "owned.example.com.", types.RecordTypeA); err != nil {
+		t.Error("rollback deleted a record owned by another owner")
+	}
+
+	w := doRequest(router, http.MethodPost, "/dns/rollback", RollbackRequest{Version: 1, Owner: "ops"}, "test-token")
+	if w.Code != 200 {
+		t.Fatalf("rollback by the owner status = %d, body = %s", w.Code, w.Body.String())
+	}
+	if resp := decodeData[RollbackResponse](t, w); !resp.Applied || resp.Deleted != 1 {
+		t.Errorf("rollback = %+v, want one deletion applied", resp)
+	}
+	if _, err := store.Get(ctx, "owned.example.com.", types.RecordTypeA); err == nil {
+		t.Error("owned record still present after the owner's rollback")
+	}
+}
+
+func TestHistory_Disabled(t *testing.T) {
+	router, _ := setupTestRouter(t)
+	if w := doRequest(router, http.MethodGet, "/dns/history", nil, "test-token"); w.Code != 404 {
+		t.Errorf("status = %d, want 404", w.Code)
+	}
+}
+
+// sseEvent is a server-sent event read from a GET /dns/watch stream.
+type sseEvent struct {
+	id, event string
+	data      WatchEvent
+}
+
+// openWatch starts a GET /dns/watch stream at path and returns its events.
+// The stream is closed when the test ends.
+func openWatch(t *testing.T, router *gin.Engine, path string, header http.Header) <-chan sseEvent {
+	t.Helper()
+	server := httptest.NewServer(router)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(func() {
+		cancel()
+		server.Close()
+	})
+
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+path, nil)
+	req.Header = header.Clone()
+	if req.Header == nil {
+		req.Header = http.Header{}
+	}
+	req.Header.Set("Authorization", "Bearer test-token")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("GET %s error = %v", path, err)
+	}
+	if resp.StatusCode != 200 || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("GET %s status = %d, content type %q", path, resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+
+	events := make(chan sseEvent)
+	go func() {
+		defer resp.Body.Close()
+		defer close(events)
+		scanner := bufio.NewScanner(resp.Body)
+		var ev sseEvent
+		for scanner.Scan() {
+			line := scanner.Text()
+			switch {
+			case line == "":
+				select {
+				case events <- ev:
+				case <-ctx.Done():
+					return
+				}
+				ev = sseEvent{}
+			case strings.HasPrefix(line, "id: "):
+				ev.id = strings.TrimPrefix(line, "id: ")
+			case strings.HasPrefix(line, "event: "):
+				ev.event = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "data: "):
+				_ = json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &ev.data)
+			}
+		}
+	}()
+	return events
+}
+
+func nextEvent(t *testing.T, events <-chan sseEvent) sseEvent {
+	t.Helper()
+	select {
+	case ev, ok := <-events:
+		if !ok {
+			t.Fatal("watch stream closed")
+		}
+		return ev
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a watch event")
+	}
+	return sseEvent{}
+}
+
+func TestWatch(t *testing.T) {
+	router, store := setupTestRouter(t)
+	ctx := context.Background()
+	events := openWatch(t, router, "/dns/watch?suffix=Example.com&type=A&type=aaaa", nil)
+
+	ready := nextEvent(t, events)
+	if ready.event != "ready" || ready.id != fmt.Sprint(store.Version()) {
+		t.Fatalf("first event = %+v, want ready at version %d", ready, store.Version())
+	}
+
+	// Records outside the filter are not reported.
+	_ = store.Create(ctx, &types.DNSRecord{Name: "other.org.", Type: types.RecordTypeA, TTL: 60, Value: []string{"10.0.0.1"}})
+	_ = store.Create(ctx, &types.DNSRecord{Name: "example.com.", Type: types.RecordTypeTXT, TTL: 60, Value: []string{"v=spf1"}})
+	_ = store.Create(ctx, &types.DNSRecord{Name: "www.example.com.", Type: types.RecordTypeA, TTL: 60, Value: []string{"10.0.0.2"}})
+	_ = store.Delete(ctx, "example.com.", types.RecordTypeA)
+
+	ev := nextEvent(t, events)
+	if ev.event != "added" || ev.id != fmt.Sprint(ev.data.Version) || len(ev.data.Added) != 1 || ev.data.Added[0].Name != "www.example.com." {
+		t.Errorf("event = %+v, want www.example.com. added", ev)
+	}
+	ev = nextEvent(t, events)
+	if ev.event != "deleted" || len(ev.data.Deleted) != 1 || ev.data.Deleted[0].Domain != "example.com." {
+		t.Errorf("event = %+v, want example.com. deleted", ev)
+	}
+}
+
+func TestWatch_Resume(t *testing.T) {
+	router, store := setupTestRouter(t)
+	ctx := context.Background()
+	since := store.Version()
+	_ = store.Create(ctx, &types.DNSRecord{Name: "a.example.com.", Type: types.RecordTypeA, TTL: 60, Value: []string{"10.0.0.1"}})
+	_ = store.Create(ctx, &types.DNSRecord{Name: "b.example.com.", Type: types.RecordTypeA, TTL: 60, Value: []string{"10.0.0.2"}})
+
+	// The Last-Event-ID header resumes like "since".
+	events := openWatch(t, router, "/dns/watch", http.Header{"Last-Event-ID": {fmt.Sprint(since)}})
+	if ev := nextEvent(t, events); ev.event != "ready" || ev.data.Version != since {
+		t.Fatalf("first event = %+v, want ready at version %d", ev, since)
+	}
+	for _, name := range []string{"a.example.com.", "b.example.com."} {
+		if ev := nextEvent(t, events); ev.event != "added" || ev.data.Added[0].Name != name {
+			t.Errorf("event = %+v, want %s added", ev, name)
+		}
+	}
+}
+
+func TestWatch_Snapshot(t *testing.T) {
+	router, store := setupTestRouter(t)
+	_ = store.Create(context.Background(), &types.DNSRecord{Name: "other.org.", Type: types.RecordTypeA, TTL: 60, Value: []string{"10.0.0.1"}})
+
+	events := openWatch(t, router, "/dns/watch?snapshot=true&suffix=example.com.", nil)
+	ev := nextEvent(t, events)
+	if ev.event != "resync" || ev.data.Version != store.Version() {
+		t.Fatalf("first event = %+v, want resync at version %d", ev, store.Version())
+	}
+	if len(ev.data.Records) != 1 || ev.data.Records[0].Name != "example.com." {
+		t.Errorf("snapshot records = %+v, want only example.com.", ev.data.Records)
+	}
+}
+
+func TestWatch_InvalidParams(t *testing.T) {
+	router, _ := setupTestRouter(t)
+	for _, path := range []string{"/dns/watch?type=BOGUS", "/dns/watch?since=latest"} {
+		if w := doRequest(router, http.MethodGet, path, nil, "test-token"); w.Code != 400 {
+			t.Errorf("GET %s status = %d, want 400", path, w.Code)
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package http
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"jabberwocky238/jw238dns/types"
+
+	"github.com/gin-gonic/gin"
+)
+
+// watchKeepalive is how often GET /dns/watch writes a comment to keep
+// idle connections open through proxies.
+const watchKeepalive = 30 * time.Second
+
+// watchEventReady is the first event of a stream without a snapshot. It
+// carries the version the stream starts after.
+const watchEventReady = "ready"
+
+// EventSource is the storage GET /dns/watch streams changes from, such
+// as a storage.MemoryStorage.
+type EventSource interface {
+	// Version returns the current storage version.
+	Version() uint64
+
+	// Snapshot returns every record and the version they are at.
+	Snapshot() ([]*types.DNSRecord, uint64)
+
+	// WatchFrom returns the events after version, then every new one.
+	WatchFrom(ctx context.Context, version uint64) (<-chan types.StorageEvent, error)
+}
+
+// watchFilter selects the records a watch stream reports.
+type watchFilter struct {
+	suffix string             // Lower-case FQDN; names equal to or below it match
+	types  []types.RecordType // Empty matches every type
+}
+
+// match reports whether a record named name of type rt passes f.
+func (f watchFilter) match(name string, rt types.RecordType) bool {
+	if len(f.types) > 0 && !slices.Contains(f.types, rt) {
+		return false
+	}
+	if f.suffix == "" || f.suffix == "." {
+		return true
+	}
+	name = strings.ToLower(name)
+	return name == f.suffix || strings.HasSuffix(name, "."+f.suffix)
+}
+
+// records returns the records in recs passing f.
+func (f watchFilter) records(recs []*types.DNSRecord) []*types.DNSRecord {
+	var out []*types.DNSRecord
+	for _, r := range recs {
+		if f.match(r.Name, r.Type) {
+			out = append(out, r)
+		}
+	}
+	return out
+}
+
+// event converts ev for a stream filtered by f. It reports false for an
+// event that changes no record passing f.
+func (f watchFilter) event(ev types.StorageEvent) (WatchEvent, bool) {
+	out := WatchEvent{Type: ev.Type, Version: ev.Version, Source: ev.Source}
+	if ev.Type == types.EventResync {
+		out.Missed = ev.Missed
+		out.Records = f.records(ev.Snapshot)
+		if out.Records == nil {
+			out.Records = []*types.DNSRecord{}
+		}
+		return out, true
+	}
+	if ev.Changes == nil {
+		return out, false
+	}
+	out.Added = f.records(ev.Changes.Added)
+	out.Updated = f.records(ev.Changes.Updated)
+	for _, key := range ev.Changes.Deleted {
+		if f.match(key.Name, key.Type) {
+			out.Deleted = append(out.Deleted, RecordRef{Domain: key.Name, Type: key.Type})
+		}
+	}
+	return out, len(out.Added) > 0 || len(out.Updated) > 0 || len(out.Deleted) > 0
+}
+
+// Watch handles GET /dns/watch. It streams record changes as server-sent
+// events, each with the storage version as its id, until the client
+// disconnects. "suffix" limits the stream to names equal to or below a
+// name and "type", which may be repeated, to record types. The stream
+// resumes after the version in "since" or the Last-Event-ID header;
+// "snapshot=true" starts it with a resync event holding every matching
+// record instead.
+func (h *DNSHandler) Watch(c *gin.Context) {
+	if h.events == nil {
+		Fail(c, 404, "watch is not enabled")
+		return
+	}
+
+	f := watchFilter{suffix: strings.ToLower(c.Query("suffix"))}
+	if f.suffix != "" && !strings.HasSuffix(f.suffix, ".") {
+		f.suffix += "."
+	}
+	for _, t := range c.QueryArray("type") {
+		rt := types.RecordType(strings.ToUpper(t))
+		if !rt.IsValid() {
+			Fail(c, 400, "invalid record type")
+			return
+		}
+		f.types = append(f.types, rt)
+	}
+	since := c.Query("since")
+	if since == "" {
+		since = c.GetHeader("Last-Event-ID")
+	}
+	var from uint64
+	if since != "" {
+		v, err := strconv.ParseUint(since, 10, 64)
+		if err != nil {
+			Fail(c, 400, "since must be a version number")
+			return
+		}
+		from = v
+	}
+	snapshot, _ := strconv.ParseBool(c.Query("snapshot"))
+
+	// The first event tells the client where the stream starts.
+	var first WatchEvent
+	switch {
+	case snapshot:
+		records, version := h.events.Snapshot()
+		from = version
+		first = WatchEvent{Type: types.EventResync, Version: version, Records: f.records(records)}
+		if first.Records == nil {
+			first.Records = []*types.DNSRecord{}
+		}
+	case since == "":
+		from = h.events.Version()
+		fallthrough
+	default:
+		first = WatchEvent{Type: watchEventReady, Version: from}
+	}
+
+	ctx := c.Request.Context()
+	events, err := h.events.WatchFrom(ctx, from)
+	if err != nil {
+		Fail(c, 500, err.Error())
+		return
+	}
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no") // Stop nginx from buffering the stream
+	c.Status(200)
+	if err := writeWatchEvent(c, first); err != nil {
+		return
+	}
+
+	keepalive := time.NewTicker(watchKeepalive)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-keepalive.C:
+			if _, err := c.Writer.WriteString(": keepalive\n\n"); err != nil {
+				return
+			}
+			c.Writer.Flush()
+		case ev, ok := <-events:
+			if !ok {
+				return
+			}
+			out, ok := f.event(ev)
+			if !ok {
+				continue
+			}
+			if err := writeWatchEvent(c, out); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// writeWatchEvent writes ev as a server-sent event and flushes it.
+func writeWatchEvent(c *gin.Context, ev WatchEvent) error {
+	data, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(c.Writer, "id: %d\nevent: %s\ndata: %s\n\n", ev.Version, ev.Type, data); err != nil {
+		return err
+	}
+	c.Writer.Flush()
+	return nil
+}
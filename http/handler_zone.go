@@ -0,0 +1,159 @@
+package http
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"jabberwocky238/jw238dns/dns"
+	"jabberwocky238/jw238dns/storage"
+	"jabberwocky238/jw238dns/types"
+
+	"github.com/gin-gonic/gin"
+	mdns "github.com/miekg/dns"
+)
+
+// maxZoneImportSize caps the size of an uploaded zone file.
+const maxZoneImportSize = 16 << 20
+
+// ImportZone handles POST /dns/import. The request body is an RFC 1035
+// zone file; relative names are resolved against the "origin" query
+// parameter. Imported records are merged into the store, or with
+// replace=true they replace every record at or below origin except those
+// synthesized by a source. A record whose answers do not change keeps
+// its metadata. Like /dns/update and /dns/delete, the import fails if it
+// would change or delete a record owned by another owner than "owner".
+// $INCLUDE is not allowed.
+func (h *DNSHandler) ImportZone(c *gin.Context) {
+	origin := c.Query("origin")
+	owner := c.Query("owner")
+	replace, _ := strconv.ParseBool(c.Query("replace"))
+	if replace && origin == "" {
+		Fail(c, 400, "origin is required with replace")
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(c.Request.Body, maxZoneImportSize+1))
+	if err != nil {
+		Fail(c, 400, err.Error())
+		return
+	}
+	if len(body) > maxZoneImportSize {
+		Fail(c, 413, "zone file too large")
+		return
+	}
+
+	parsed, err := dns.ParseZone(bytes.NewReader(body), origin, "import", false)
+	if err != nil {
+		Fail(c, 400, err.Error())
+		return
+	}
+
+	// Records are read and written by key in the transaction; only the
+	// keys a replace may delete are listed before it. A record written
+	// in between is kept, as if written after the import.
+	ctx := c.Request.Context()
+	var replaced []types.RecordKey
+	if replace {
+		current, err := storage.ListPersistent(ctx, h.storage)
+		if err != nil {
+			Fail(c, 500, err.Error())
+			return
+		}
+		for _, rec := range current {
+			if mdns.IsSubDomain(mdns.Fqdn(origin), rec.Name) {
+				replaced = append(replaced, types.RecordKey{Name: rec.Name, Type: rec.Type})
+			}
+		}
+	}
+
+	now := time.Now().UTC().Truncate(time.Second)
+	var changes *types.RecordChanges
+	err = h.storage.Transaction(ctx, func(tx *storage.Tx) error {
+		imported := make(map[types.RecordKey]bool, len(parsed.Records))
+		for _, rec := range parsed.Records {
+			imported[types.RecordKey{Name: rec.Name, Type: rec.Type}] = true
+			existing, err := tx.Get(rec.Name, rec.Type)
+			switch {
+			case errors.Is(err, types.ErrRecordNotFound):
+				created := *rec
+				created.Meta = newMeta(owner, nil, "", time.Time{}, now)
+				err = tx.Create(&created)
+			case err != nil:
+			case existing.TTL == rec.TTL && slices.Equal(existing.Value, rec.Value):
+				continue // Keep the metadata
+			default:
+				if _, err := checkOwner(tx, rec.Name, rec.Type, owner); err != nil {
+					return err
+				}
+				updated := *rec
+				updated.Meta = updatedMeta(existing, owner, nil, nil, time.Time{}, now)
+				err = tx.Update(&updated)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		for _, key := range replaced {
+			if imported[key] {
+				continue
+			}
+			existing, err := checkOwner(tx, key.Name, key.Type, owner)
+			if err != nil {
+				return err
+			}
+			if existing == nil {
+				continue // Deleted since it was listed
+			}
+			if err := tx.Delete(key.Name, key.Type); err != nil {
+				return err
+			}
+		}
+		changes = tx.Changes()
+		return nil
+	})
+	switch {
+	case errors.Is(err, types.ErrRecordOwned):
+		Fail(c, 409, err.Error())
+		return
+	case err != nil:
+		FailStorage(c, err)
+		return
+	}
+
+	OK(c, ImportZoneResponse{
+		Added:    len(changes.Added),
+		Updated:  len(changes.Updated),
+		Deleted:  len(changes.Deleted),
+		Warnings: parsed.Warnings,
+	})
+}
+
+// ExportZone handles GET /dns/export. It returns the stored records as an
+// RFC 1035 zone file, limited to the "zone" query parameter when given.
+func (h *DNSHandler) ExportZone(c *gin.Context) {
+	zone := c.Query("zone")
+	if zone != "" {
+		if _, ok := mdns.IsDomainName(zone); !ok {
+			Fail(c, 400, "invalid zone name")
+			return
+		}
+	}
+
+	records, err := h.storage.List(c.Request.Context())
+	if err != nil {
+		Fail(c, 500, err.Error())
+		return
+	}
+
+	var buf strings.Builder
+	if err := dns.WriteZone(&buf, records, zone); err != nil {
+		Fail(c, 500, err.Error())
+		return
+	}
+	c.Data(200, "text/dns; charset=utf-8", []byte(buf.String()))
+}
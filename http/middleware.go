@@ -4,6 +4,9 @@ import (
 	"log/slog"
 	"time"
 
+	"jabberwocky238/jw238dns/storage"
+	"jabberwocky238/jw238dns/types"
+
 	"github.com/gin-gonic/gin"
 )
 
@@ -25,6 +28,21 @@ func AuthMiddleware(token string) gin.HandlerFunc {
 	}
 }
 
+// ActorMiddleware attributes the storage changes a request makes to its
+// client, for the change history: the X-Actor header if set, such as the
+// name of a deploy job, or else the client IP.
+func ActorMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		name := c.GetHeader("X-Actor")
+		if name == "" {
+			name = c.ClientIP()
+		}
+		ctx := storage.WithActor(c.Request.Context(), storage.Actor{Name: name, Source: types.SourceHTTP})
+		c.Request = c.Request.WithContext(ctx)
+		c.Next()
+	}
+}
+
 // LoggingMiddleware logs each HTTP request with method, path, status, and latency.
 // Health check requests are not logged to reduce noise.
 func LoggingMiddleware() gin.HandlerFunc {
@@ -33,8 +51,8 @@ func LoggingMiddleware() gin.HandlerFunc {
 		path := c.Request.URL.Path
 		c.Next()
 
-		// Skip logging for health check endpoint
-		if path == "/health" {
+		// Skip logging for health check and scrape endpoints
+		if path == "/health" || path == "/metrics" {
 			return
 		}
 
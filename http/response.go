@@ -1,6 +1,12 @@
 package http
 
-import "github.com/gin-gonic/gin"
+import (
+	"errors"
+
+	"jabberwocky238/jw238dns/types"
+
+	"github.com/gin-gonic/gin"
+)
 
 // Response is the unified JSON response structure for all API endpoints.
 type Response struct {
@@ -18,3 +24,13 @@ func OK(c *gin.Context, data any) {
 func Fail(c *gin.Context, httpStatus int, message string) {
 	c.JSON(httpStatus, Response{Code: httpStatus, Message: message})
 }
+
+// FailStorage sends the response for a storage error not handled by the
+// caller: 503 if this replica does not accept writes, 500 otherwise.
+func FailStorage(c *gin.Context, err error) {
+	if errors.Is(err, types.ErrNotLeader) {
+		Fail(c, 503, err.Error())
+		return
+	}
+	Fail(c, 500, err.Error())
+}
@@ -3,18 +3,27 @@ package http
 import (
 	"context"
 	"log/slog"
+	"net"
 	"net/http"
 	"time"
 
 	"jabberwocky238/jw238dns/storage"
 
 	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/gin-gonic/gin/otelgin"
 )
 
 // ServerConfig holds the configuration for the HTTP management server.
 type ServerConfig struct {
 	Listen    string
 	AuthToken string // Bearer token; empty disables auth.
+
+	// History serves /dns/history and /dns/rollback; nil disables them.
+	History *storage.History
+
+	// Events serves /dns/watch. If nil, the storage passed to NewServer
+	// is used if it is an EventSource; otherwise /dns/watch is disabled.
+	Events EventSource
 }
 
 // Server is the HTTP management API server.
@@ -29,30 +38,52 @@ func NewServer(cfg ServerConfig, store storage.CoreStorage) *Server {
 
 	engine := gin.New()
 	engine.Use(gin.Recovery())
+	engine.Use(otelgin.Middleware("jw238dns", otelgin.WithFilter(func(r *http.Request) bool {
+		// Don't trace probes and scrapes.
+		return r.URL.Path != "/health" && r.URL.Path != "/metrics"
+	})))
 	engine.Use(LoggingMiddleware())
 
 	// Public endpoints (no auth).
 	engine.GET("/health", HealthHandler)
 	engine.GET("/status", StatusHandler)
+	engine.GET("/metrics", MetricsHandler())
 
 	// Authenticated DNS management endpoints.
 	dnsGroup := engine.Group("/dns")
-	dnsGroup.Use(AuthMiddleware(cfg.AuthToken))
+	dnsGroup.Use(AuthMiddleware(cfg.AuthToken), ActorMiddleware())
 	{
 		h := NewDNSHandler(store)
+		h.history = cfg.History
+		h.events = cfg.Events
+		if h.events == nil {
+			h.events, _ = store.(EventSource)
+		}
 		dnsGroup.POST("/add", h.AddRecord)
 		dnsGroup.POST("/delete", h.DeleteRecord)
 		dnsGroup.POST("/update", h.UpdateRecord)
 		dnsGroup.GET("/list", h.ListRecords)
 		dnsGroup.GET("/get", h.GetRecord)
+		dnsGroup.POST("/batch", h.Batch)
+		dnsGroup.POST("/import", h.ImportZone)
+		dnsGroup.GET("/export", h.ExportZone)
+		dnsGroup.GET("/history", h.History)
+		dnsGroup.POST("/rollback", h.Rollback)
+		dnsGroup.GET("/watch", h.Watch)
+	}
+
+	// Requests, /dns/watch streams in particular, end on shutdown.
+	baseCtx, cancel := context.WithCancel(context.Background())
+	httpServer := &http.Server{
+		Addr:        cfg.Listen,
+		Handler:     engine,
+		BaseContext: func(net.Listener) context.Context { return baseCtx },
 	}
+	httpServer.RegisterOnShutdown(cancel)
 
 	return &Server{
-		httpServer: &http.Server{
-			Addr:    cfg.Listen,
-			Handler: engine,
-		},
-		engine: engine,
+		httpServer: httpServer,
+		engine:     engine,
 	}
 }
 
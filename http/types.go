@@ -1,6 +1,11 @@
 package http
 
-import "jabberwocky238/jw238dns/types"
+import (
+	"time"
+
+	"jabberwocky238/jw238dns/storage"
+	"jabberwocky238/jw238dns/types"
+)
 
 // AddRecordRequest is the request body for POST /dns/add.
 type AddRecordRequest struct {
@@ -8,12 +13,24 @@ type AddRecordRequest struct {
 	Type   types.RecordType `json:"type" binding:"required"`
 	Value  []string        `json:"value" binding:"required,min=1"`
 	TTL    uint32          `json:"ttl"`
+
+	// Optional metadata. A record with an owner can only be updated or
+	// deleted by requests naming the same owner.
+	Owner   string            `json:"owner"`
+	Labels  map[string]string `json:"labels"`
+	Comment string            `json:"comment"`
+
+	// Optional expiry: an absolute time or a duration such as "15m".
+	// The record is deleted once it passes.
+	ExpiresAt *time.Time `json:"expires_at"`
+	ExpiresIn string     `json:"expires_in"`
 }
 
 // DeleteRecordRequest is the request body for POST /dns/delete.
 type DeleteRecordRequest struct {
 	Domain string          `json:"domain" binding:"required"`
 	Type   types.RecordType `json:"type" binding:"required"`
+	Owner  string          `json:"owner"`
 }
 
 // UpdateRecordRequest is the request body for POST /dns/update.
@@ -22,4 +39,142 @@ type UpdateRecordRequest struct {
 	Type   types.RecordType `json:"type" binding:"required"`
 	Value  []string        `json:"value" binding:"required,min=1"`
 	TTL    uint32          `json:"ttl"`
+
+	// Owner must match the record's owner, if it has one; an unowned
+	// record takes it. Omitted labels and comment are kept.
+	Owner   string            `json:"owner"`
+	Labels  map[string]string `json:"labels"`
+	Comment *string           `json:"comment"`
+
+	// A new expiry, as for AddRecordRequest; omitted keeps the current one.
+	ExpiresAt *time.Time `json:"expires_at"`
+	ExpiresIn string     `json:"expires_in"`
+}
+
+// BatchRequest is the request body for POST /dns/batch. The operations
+// are applied in order, all or none.
+type BatchRequest struct {
+	Operations []BatchOperation `json:"operations" binding:"required,min=1,dive"`
+
+	// DryRun checks the operations and returns the changes they would
+	// make without applying them.
+	DryRun bool `json:"dry_run"`
+}
+
+// BatchOperation is one create, update or delete in a BatchRequest. Its
+// fields mean what they do in the single-record requests; delete only
+// uses Domain, Type and Owner.
+type BatchOperation struct {
+	Op     string           `json:"op" binding:"required,oneof=create update delete"`
+	Domain string           `json:"domain" binding:"required"`
+	Type   types.RecordType `json:"type" binding:"required"`
+	Value  []string         `json:"value"`
+	TTL    uint32           `json:"ttl"`
+
+	Owner     string            `json:"owner"`
+	Labels    map[string]string `json:"labels"`
+	Comment   *string           `json:"comment"`
+	ExpiresAt *time.Time        `json:"expires_at"`
+	ExpiresIn string            `json:"expires_in"`
+
+	// If is an optional precondition on the record, checked after the
+	// earlier operations of the batch.
+	If *BatchPrecondition `json:"if"`
+}
+
+// BatchPrecondition constrains the record a BatchOperation targets.
+// Unset fields are not checked.
+type BatchPrecondition struct {
+	Exists *bool    `json:"exists"` // The record must (not) exist
+	Value  []string `json:"value"`  // The record must have exactly these values
+	TTL    uint32   `json:"ttl"`    // The record must have this TTL
+}
+
+// BatchResponse is the response data for POST /dns/batch.
+type BatchResponse struct {
+	Applied bool          `json:"applied"`
+	DryRun  bool          `json:"dry_run"`
+	Results []BatchResult `json:"results"`
+
+	// Changes is the net effect of the batch; nil if it failed.
+	Changes *BatchChanges `json:"changes,omitempty"`
+}
+
+// Batch operation statuses.
+const (
+	BatchStatusOK      = "ok"
+	BatchStatusFailed  = "failed"
+	BatchStatusSkipped = "skipped" // Not run because an earlier operation failed
+)
+
+// BatchResult is the outcome of one BatchOperation.
+type BatchResult struct {
+	Index  int              `json:"index"`
+	Op     string           `json:"op"`
+	Domain string           `json:"domain"`
+	Type   types.RecordType `json:"type"`
+	Status string           `json:"status"`
+	Error  string           `json:"error,omitempty"`
+
+	// Record is the record as written by a create or update.
+	Record *types.DNSRecord `json:"record,omitempty"`
+}
+
+// BatchChanges lists the records a batch adds, updates and deletes.
+type BatchChanges struct {
+	Added   []*types.DNSRecord `json:"added"`
+	Updated []*types.DNSRecord `json:"updated"`
+	Deleted []RecordRef        `json:"deleted"`
+}
+
+// RecordRef identifies a record.
+type RecordRef struct {
+	Domain string           `json:"domain"`
+	Type   types.RecordType `json:"type"`
+}
+
+// WatchEvent is the data of an event sent by GET /dns/watch. Added,
+// Updated and Deleted hold the changed records passing the stream's
+// filter; a resync replaces them with Records, every such record.
+type WatchEvent struct {
+	Type    types.EventType    `json:"type"`
+	Version uint64             `json:"version"`
+	Source  string             `json:"source,omitempty"` // Source of synthesized records
+	Added   []*types.DNSRecord `json:"added,omitempty"`
+	Updated []*types.DNSRecord `json:"updated,omitempty"`
+	Deleted []RecordRef        `json:"deleted,omitempty"`
+	Missed  int                `json:"missed,omitempty"`  // Events a resync replaces
+	Records []*types.DNSRecord `json:"records,omitempty"` // For resync
+}
+
+// HistoryResponse is the response data for GET /dns/history.
+type HistoryResponse struct {
+	Version uint64                 `json:"version"` // Latest history version
+	Entries []storage.HistoryEntry `json:"entries"` // Newest first
+}
+
+// RollbackRequest is the request body for POST /dns/rollback. Exactly one
+// of Version and Time must be set.
+type RollbackRequest struct {
+	Version uint64     `json:"version"`
+	Time    *time.Time `json:"time"`
+	Owner   string     `json:"owner"` // Must own every owned record the rollback changes
+	DryRun  bool       `json:"dry_run"`
+}
+
+// RollbackResponse is the response data for POST /dns/rollback.
+type RollbackResponse struct {
+	Version uint64 `json:"version"` // Version restored
+	Applied bool   `json:"applied"`
+	Added   int    `json:"added"`
+	Updated int    `json:"updated"`
+	Deleted int    `json:"deleted"`
+}
+
+// ImportZoneResponse is the response data for POST /dns/import.
+type ImportZoneResponse struct {
+	Added    int      `json:"added"`
+	Updated  int      `json:"updated"`
+	Deleted  int      `json:"deleted"`
+	Warnings []string `json:"warnings,omitempty"`
 }
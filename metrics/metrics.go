@@ -0,0 +1,227 @@
+// Package metrics defines the Prometheus collectors exported by jw238dns
+// on the HTTP server's /metrics endpoint.
+package metrics
+
+import (
+	"time"
+
+	"jabberwocky238/jw238dns/types"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+)
+
+const namespace = "jw238dns"
+
+// Registry holds every jw238dns collector plus the Go runtime and process
+// collectors. It is served by the HTTP /metrics endpoint.
+var Registry = prometheus.NewRegistry()
+
+var (
+	// QueriesTotal counts answered DNS queries by qtype, rcode and transport.
+	QueriesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "dns",
+		Name:      "queries_total",
+		Help:      "Total number of DNS queries answered, by query type, response code and transport.",
+	}, []string{"qtype", "rcode", "transport"})
+
+	// QueryDuration observes the time spent in Frontend.ReceiveQuery.
+	QueryDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "dns",
+		Name:      "query_duration_seconds",
+		Help:      "Time spent resolving a DNS query in the frontend.",
+		Buckets:   []float64{.0001, .00025, .0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5},
+	}, []string{"transport"})
+
+	// QueryLogDroppedTotal counts query log entries dropped because the
+	// log queue was full.
+	QueryLogDroppedTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "dns",
+		Name:      "query_log_dropped_total",
+		Help:      "Total number of query log entries dropped because the log queue was full.",
+	})
+
+	// UpstreamDuration observes the round-trip time of upstream exchanges.
+	UpstreamDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "forwarder",
+		Name:      "upstream_duration_seconds",
+		Help:      "Round-trip time of queries forwarded to upstream servers.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"server"})
+
+	// UpstreamErrorsTotal counts failed upstream exchanges by reason.
+	UpstreamErrorsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "forwarder",
+		Name:      "upstream_errors_total",
+		Help:      "Total number of failed upstream exchanges (transport errors, SERVFAIL, REFUSED), by server and reason.",
+	}, []string{"server", "reason"})
+
+	// UpstreamResponsesTotal counts upstream responses by rcode.
+	UpstreamResponsesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "forwarder",
+		Name:      "upstream_responses_total",
+		Help:      "Total number of responses received from upstream servers, by server and rcode.",
+	}, []string{"server", "rcode"})
+
+	// WatchEventsDroppedTotal counts storage events dropped because a
+	// watcher's buffer was full.
+	WatchEventsDroppedTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "storage",
+		Name:      "watch_events_dropped_total",
+		Help:      "Total number of storage events dropped because a watcher was not keeping up.",
+	})
+
+	// WatchResyncsTotal counts resync events sent to watchers in place of
+	// the events they missed.
+	WatchResyncsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "storage",
+		Name:      "watch_resyncs_total",
+		Help:      "Total number of resync events sent to watchers that missed events.",
+	})
+
+	// ReloadsTotal counts reloads applied from a storage source, by source
+	// ("file", "configmap") and result ("success", "failure").
+	ReloadsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "storage",
+		Name:      "reloads_total",
+		Help:      "Total number of reloads from a storage source, by source and result.",
+	}, []string{"source", "result"})
+
+	// ConfigMapConflictsTotal counts ConfigMap updates rejected because the
+	// ConfigMap changed since it was read; each is merged and retried.
+	ConfigMapConflictsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "storage",
+		Name:      "configmap_conflicts_total",
+		Help:      "Total number of ConfigMap updates that hit a resourceVersion conflict and were retried.",
+	})
+
+	// RecordsExpiredTotal counts records deleted because their expiry
+	// passed.
+	RecordsExpiredTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "storage",
+		Name:      "records_expired_total",
+		Help:      "Total number of records deleted by the expiry janitor.",
+	})
+
+	// NotifiesTotal counts NOTIFY deliveries to secondaries by result
+	// ("acked", "rejected", "failed", "superseded").
+	NotifiesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "dns",
+		Name:      "notifies_total",
+		Help:      "Total number of NOTIFY deliveries to secondaries, by result.",
+	}, []string{"result"})
+
+	// UpdatesTotal counts RFC 2136 dynamic updates by response code.
+	UpdatesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "dns",
+		Name:      "updates_total",
+		Help:      "Total number of dynamic UPDATE requests, by response code.",
+	}, []string{"rcode"})
+
+	// TSIGErrorsTotal counts incoming messages whose TSIG signature failed
+	// verification, by TSIG error (BADKEY, BADSIG, BADTIME).
+	TSIGErrorsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "dns",
+		Name:      "tsig_errors_total",
+		Help:      "Total number of messages rejected by TSIG verification, by TSIG error.",
+	}, []string{"error"})
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		QueriesTotal,
+		QueryDuration,
+		QueryLogDroppedTotal,
+		UpstreamDuration,
+		UpstreamErrorsTotal,
+		UpstreamResponsesTotal,
+		WatchEventsDroppedTotal,
+		WatchResyncsTotal,
+		ReloadsTotal,
+		ConfigMapConflictsTotal,
+		RecordsExpiredTotal,
+		NotifiesTotal,
+		UpdatesTotal,
+		TSIGErrorsTotal,
+	)
+}
+
+// ObserveQuery records a completed DNS query.
+func ObserveQuery(qtype, rcode, transport string, elapsed time.Duration) {
+	QueriesTotal.WithLabelValues(qtype, rcode, transport).Inc()
+	QueryDuration.WithLabelValues(transport).Observe(elapsed.Seconds())
+}
+
+// ObserveReload records the outcome of a reload from the given source.
+func ObserveReload(source string, err error) {
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	ReloadsTotal.WithLabelValues(source, result).Inc()
+}
+
+// StorageStats is implemented by storage backends that can report their
+// record counts and version at scrape time.
+type StorageStats interface {
+	// CountByType returns the number of stored records for each type.
+	CountByType() map[types.RecordType]int
+
+	// Version returns the current storage version counter.
+	Version() uint64
+}
+
+// storageCollector exposes StorageStats as gauges, read at scrape time.
+type storageCollector struct {
+	stats   StorageStats
+	records *prometheus.Desc
+	version *prometheus.Desc
+}
+
+// NewStorageCollector returns a collector that reports per-type record
+// counts and the storage version of the given backend.
+func NewStorageCollector(stats StorageStats) prometheus.Collector {
+	return &storageCollector{
+		stats: stats,
+		records: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "storage", "records"),
+			"Number of stored DNS records, by record type.",
+			[]string{"type"}, nil,
+		),
+		version: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "storage", "version"),
+			"Current storage version counter.",
+			nil, nil,
+		),
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (c *storageCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.records
+	ch <- c.version
+}
+
+// Collect implements prometheus.Collector.
+func (c *storageCollector) Collect(ch chan<- prometheus.Metric) {
+	for rt, n := range c.stats.CountByType() {
+		ch <- prometheus.MustNewConstMetric(c.records, prometheus.GaugeValue, float64(n), string(rt))
+	}
+	ch <- prometheus.MustNewConstMetric(c.version, prometheus.GaugeValue, float64(c.stats.Version()))
+}
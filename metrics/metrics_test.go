@@ -0,0 +1,61 @@
+package metrics
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"jabberwocky238/jw238dns/types"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+type fakeStats struct {
+	counts  map[types.RecordType]int
+	version uint64
+}
+
+func (f *fakeStats) CountByType() map[types.RecordType]int { return f.counts }
+func (f *fakeStats) Version() uint64                       { return f.version }
+
+func TestStorageCollector(t *testing.T) {
+	c := NewStorageCollector(&fakeStats{
+		counts:  map[types.RecordType]int{types.RecordTypeA: 3, types.RecordTypeTXT: 1},
+		version: 42,
+	})
+
+	expected := `
+# HELP jw238dns_storage_records Number of stored DNS records, by record type.
+# TYPE jw238dns_storage_records gauge
+jw238dns_storage_records{type="A"} 3
+jw238dns_storage_records{type="TXT"} 1
+# HELP jw238dns_storage_version Current storage version counter.
+# TYPE jw238dns_storage_version gauge
+jw238dns_storage_version 42
+`
+	if err := testutil.CollectAndCompare(c, strings.NewReader(expected)); err != nil {
+		t.Errorf("storage collector mismatch: %v", err)
+	}
+}
+
+func TestObserveReload(t *testing.T) {
+	tests := []struct {
+		name   string
+		err    error
+		result string
+	}{
+		{name: "success", err: nil, result: "success"},
+		{name: "failure", err: errors.New("boom"), result: "failure"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			counter := ReloadsTotal.WithLabelValues("test", tt.result)
+			before := testutil.ToFloat64(counter)
+			ObserveReload("test", tt.err)
+			if got := testutil.ToFloat64(counter) - before; got != 1 {
+				t.Errorf("reloads_total{test,%s} increased by %v, want 1", tt.result, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,113 @@
+package querylog
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	dnstap "github.com/dnstap/golang-dnstap"
+	"google.golang.org/protobuf/proto"
+)
+
+// dnstapIdentity is reported in the identity field of every frame.
+var dnstapIdentity = []byte("jw238dns")
+
+// DNSTapSink writes entries as dnstap CLIENT_RESPONSE frames.
+type DNSTapSink struct {
+	output dnstap.Output
+	ch     chan []byte
+	done   chan struct{}
+}
+
+// NewDNSTapSink creates a DNSTapSink writing to the given dnstap output.
+func NewDNSTapSink(output dnstap.Output) *DNSTapSink {
+	s := &DNSTapSink{
+		output: output,
+		ch:     output.GetOutputChannel(),
+		done:   make(chan struct{}),
+	}
+	go func() {
+		defer close(s.done)
+		output.RunOutputLoop()
+	}()
+	return s
+}
+
+// NewDNSTapFileSink creates (or truncates) path and returns a DNSTapSink
+// writing a frame stream to it.
+func NewDNSTapFileSink(path string) (*DNSTapSink, error) {
+	output, err := dnstap.NewFrameStreamOutputFromFilename(path)
+	if err != nil {
+		return nil, fmt.Errorf("open dnstap file: %w", err)
+	}
+	return NewDNSTapSink(output), nil
+}
+
+// NewDNSTapSocketSink returns a DNSTapSink writing to the unix socket at
+// path. The connection is (re)established in the background.
+func NewDNSTapSocketSink(path string) (*DNSTapSink, error) {
+	output, err := dnstap.NewFrameStreamSockOutput(&net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		return nil, fmt.Errorf("open dnstap socket: %w", err)
+	}
+	return NewDNSTapSink(output), nil
+}
+
+// Write encodes one entry as a dnstap frame.
+func (s *DNSTapSink) Write(entry *Entry) error {
+	frame, err := proto.Marshal(dnstapMessage(entry))
+	if err != nil {
+		return fmt.Errorf("marshal dnstap: %w", err)
+	}
+	s.ch <- frame
+	return nil
+}
+
+// Close flushes pending frames and closes the output.
+func (s *DNSTapSink) Close() error {
+	s.output.Close()
+	<-s.done
+	return nil
+}
+
+// dnstapMessage converts an entry into a dnstap CLIENT_RESPONSE message.
+func dnstapMessage(entry *Entry) *dnstap.Dnstap {
+	msg := &dnstap.Message{
+		Type:          dnstap.Message_CLIENT_RESPONSE.Enum(),
+		QueryTimeSec:  proto.Uint64(uint64(entry.Time.Unix())),
+		QueryTimeNsec: proto.Uint32(uint32(entry.Time.Nanosecond())),
+	}
+
+	respTime := entry.Time.Add(durationFromMs(entry.LatencyMs))
+	msg.ResponseTimeSec = proto.Uint64(uint64(respTime.Unix()))
+	msg.ResponseTimeNsec = proto.Uint32(uint32(respTime.Nanosecond()))
+
+	switch entry.Transport {
+	case "tcp":
+		msg.SocketProtocol = dnstap.SocketProtocol_TCP.Enum()
+	default:
+		msg.SocketProtocol = dnstap.SocketProtocol_UDP.Enum()
+	}
+
+	if ip4 := entry.ClientIP.To4(); ip4 != nil {
+		msg.SocketFamily = dnstap.SocketFamily_INET.Enum()
+		msg.QueryAddress = ip4
+	} else if entry.ClientIP != nil {
+		msg.SocketFamily = dnstap.SocketFamily_INET6.Enum()
+		msg.QueryAddress = entry.ClientIP.To16()
+	}
+
+	msg.QueryMessage = entry.QueryWire
+	msg.ResponseMessage = entry.ResponseWire
+
+	return &dnstap.Dnstap{
+		Type:     dnstap.Dnstap_MESSAGE.Enum(),
+		Identity: dnstapIdentity,
+		Message:  msg,
+	}
+}
+
+// durationFromMs converts a millisecond latency back into a Duration.
+func durationFromMs(ms float64) time.Duration {
+	return time.Duration(ms * float64(time.Millisecond))
+}
@@ -0,0 +1,94 @@
+package querylog
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	dnstap "github.com/dnstap/golang-dnstap"
+	"github.com/miekg/dns"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestDNSTapMessage(t *testing.T) {
+	query := new(dns.Msg)
+	query.SetQuestion("example.com.", dns.TypeA)
+	resp := new(dns.Msg)
+	resp.SetReply(query)
+	queryWire, _ := query.Pack()
+	respWire, _ := resp.Pack()
+
+	now := time.Unix(1700000000, 500)
+	dt := dnstapMessage(&Entry{
+		Time:         now,
+		Transport:    "tcp",
+		LatencyMs:    2,
+		ClientIP:     net.ParseIP("10.0.0.1"),
+		QueryWire:    queryWire,
+		ResponseWire: respWire,
+	})
+
+	msg := dt.GetMessage()
+	if msg.GetType() != dnstap.Message_CLIENT_RESPONSE {
+		t.Errorf("type = %v, want CLIENT_RESPONSE", msg.GetType())
+	}
+	if msg.GetSocketProtocol() != dnstap.SocketProtocol_TCP {
+		t.Errorf("protocol = %v, want TCP", msg.GetSocketProtocol())
+	}
+	if msg.GetSocketFamily() != dnstap.SocketFamily_INET || len(msg.GetQueryAddress()) != 4 {
+		t.Errorf("family = %v, address = %v, want INET with 4 bytes", msg.GetSocketFamily(), msg.GetQueryAddress())
+	}
+	if msg.GetQueryTimeSec() != 1700000000 {
+		t.Errorf("query time = %d, want 1700000000", msg.GetQueryTimeSec())
+	}
+
+	var decoded dns.Msg
+	if err := decoded.Unpack(msg.GetResponseMessage()); err != nil {
+		t.Fatalf("unpack response message: %v", err)
+	}
+	if decoded.Id != query.Id {
+		t.Errorf("response id = %d, want %d", decoded.Id, query.Id)
+	}
+}
+
+func TestDNSTapFileSink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queries.dnstap")
+	l, err := New(Config{Format: FormatDNSTap, Output: path})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+
+	query := new(dns.Msg)
+	query.SetQuestion("example.com.", dns.TypeA)
+	wire, _ := query.Pack()
+	l.Log(&Entry{Time: time.Now(), Transport: "udp", QueryWire: wire})
+	if err := l.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	input, err := dnstap.NewFrameStreamInputFromFilename(path)
+	if err != nil {
+		t.Fatalf("open dnstap input: %v", err)
+	}
+	frames := make(chan []byte, 4)
+	go func() {
+		input.ReadInto(frames)
+		close(frames)
+	}()
+
+	var count int
+	for frame := range frames {
+		var dt dnstap.Dnstap
+		if err := proto.Unmarshal(frame, &dt); err != nil {
+			t.Fatalf("unmarshal frame: %v", err)
+		}
+		if string(dt.GetIdentity()) != "jw238dns" {
+			t.Errorf("identity = %q, want jw238dns", dt.GetIdentity())
+		}
+		count++
+	}
+	if count != 1 {
+		t.Errorf("read %d frames, want 1", count)
+	}
+}
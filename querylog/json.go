@@ -0,0 +1,50 @@
+package querylog
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+)
+
+// JSONSink writes entries as JSON lines.
+type JSONSink struct {
+	w   io.WriteCloser
+	enc *json.Encoder
+}
+
+// NewJSONSink creates a JSONSink writing to w. Closing the sink closes w.
+func NewJSONSink(w io.WriteCloser) *JSONSink {
+	return &JSONSink{w: w, enc: json.NewEncoder(w)}
+}
+
+// NewJSONFileSink opens (or creates) path for appending and returns a
+// JSONSink writing to it.
+func NewJSONFileSink(path string) (*JSONSink, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("open query log file: %w", err)
+	}
+	return NewJSONSink(f), nil
+}
+
+// NewJSONSocketSink connects to the unix socket at path and returns a
+// JSONSink writing to it.
+func NewJSONSocketSink(path string) (*JSONSink, error) {
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("dial query log socket: %w", err)
+	}
+	return NewJSONSink(conn), nil
+}
+
+// Write encodes one entry as a JSON line.
+func (s *JSONSink) Write(entry *Entry) error {
+	return s.enc.Encode(entry)
+}
+
+// Close closes the underlying writer.
+func (s *JSONSink) Close() error {
+	return s.w.Close()
+}
@@ -0,0 +1,180 @@
+// Package querylog provides sampled, asynchronous per-query logging for
+// the DNS frontend. Entries are written as JSON lines or dnstap frames to
+// a file or a unix socket.
+package querylog
+
+import (
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"jabberwocky238/jw238dns/metrics"
+)
+
+// Resolution sources reported in Entry.Source.
+const (
+	SourceLocal     = "local"     // answered from storage
+	SourceForwarded = "forwarded" // answered by an upstream server
+	SourceNone      = "none"      // no answer (NXDOMAIN, FORMERR, SERVFAIL)
+)
+
+// Output formats accepted by Config.Format.
+const (
+	FormatJSON   = "json"
+	FormatDNSTap = "dnstap"
+)
+
+// Entry describes a single answered DNS query.
+type Entry struct {
+	Time      time.Time `json:"time"`
+	Client    string    `json:"client"`
+	Transport string    `json:"transport"`
+	Name      string    `json:"qname"`
+	Type      string    `json:"qtype"`
+	Rcode     string    `json:"rcode"`
+	Answers   int       `json:"answers"`
+	LatencyMs float64   `json:"latency_ms"`
+	Source    string    `json:"source"`
+
+	// QueryWire and ResponseWire are the packed messages, used by the
+	// dnstap sink. They are packed in the query path, before the response
+	// is written, because packing a dns.Msg modifies it.
+	QueryWire    []byte `json:"-"`
+	ResponseWire []byte `json:"-"`
+	ClientIP     net.IP `json:"-"`
+}
+
+// Sink writes log entries to a destination. Write is only ever called
+// from the Logger's single writer goroutine.
+type Sink interface {
+	Write(entry *Entry) error
+	Close() error
+}
+
+// Config holds query log settings.
+type Config struct {
+	Format     string  // "json" (default) or "dnstap"
+	Output     string  // File path, or "unix:/path/to.sock" for a unix socket
+	SampleRate float64 // Fraction of queries to log, in (0, 1]; 0 logs every query
+	BufferSize int     // Entries queued before new ones are dropped
+}
+
+// DefaultConfig returns a Config with sensible defaults.
+func DefaultConfig() Config {
+	return Config{
+		Format:     FormatJSON,
+		SampleRate: 1,
+		BufferSize: 1024,
+	}
+}
+
+// Logger queues sampled entries and writes them to a Sink from a single
+// background goroutine, so logging never blocks query handling. When the
+// queue is full, entries are dropped and counted.
+type Logger struct {
+	sink       Sink
+	sampleRate float64
+	wire       bool // The sink writes QueryWire and ResponseWire
+	entries    chan *Entry
+	done       chan struct{}
+	closeOnce  sync.Once
+}
+
+// New opens the sink described by cfg and starts a Logger writing to it.
+func New(cfg Config) (*Logger, error) {
+	sink, err := openSink(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return NewLogger(sink, cfg.SampleRate, cfg.BufferSize), nil
+}
+
+// NewLogger starts a Logger writing to the given sink.
+func NewLogger(sink Sink, sampleRate float64, bufferSize int) *Logger {
+	if sampleRate <= 0 || sampleRate > 1 {
+		sampleRate = 1
+	}
+	if bufferSize <= 0 {
+		bufferSize = DefaultConfig().BufferSize
+	}
+
+	_, wire := sink.(*DNSTapSink)
+	l := &Logger{
+		sink:       sink,
+		wire:       wire,
+		sampleRate: sampleRate,
+		entries:    make(chan *Entry, bufferSize),
+		done:       make(chan struct{}),
+	}
+	go l.run()
+	return l
+}
+
+// Sampled reports whether the next query should be logged. Callers use it
+// to skip building an Entry for queries that would be discarded anyway.
+func (l *Logger) Sampled() bool {
+	return l.sampleRate >= 1 || rand.Float64() < l.sampleRate
+}
+
+// Wire reports whether entries need QueryWire and ResponseWire. Callers
+// skip packing the messages otherwise.
+func (l *Logger) Wire() bool {
+	return l.wire
+}
+
+// Log queues an entry without blocking. The entry is dropped if the
+// queue is full.
+func (l *Logger) Log(entry *Entry) {
+	select {
+	case l.entries <- entry:
+	default:
+		metrics.QueryLogDroppedTotal.Inc()
+	}
+}
+
+// Close stops accepting entries, flushes the queue and closes the sink.
+func (l *Logger) Close() error {
+	var err error
+	l.closeOnce.Do(func() {
+		close(l.entries)
+		<-l.done
+		err = l.sink.Close()
+	})
+	return err
+}
+
+func (l *Logger) run() {
+	defer close(l.done)
+	for entry := range l.entries {
+		if err := l.sink.Write(entry); err != nil {
+			slog.Warn("write query log entry", "err", err)
+		}
+	}
+}
+
+// openSink creates the sink for the configured format and output.
+func openSink(cfg Config) (Sink, error) {
+	if cfg.Output == "" {
+		return nil, fmt.Errorf("query log output is required")
+	}
+	socket, isSocket := strings.CutPrefix(cfg.Output, "unix:")
+
+	switch cfg.Format {
+	case "", FormatJSON:
+		if isSocket {
+			return NewJSONSocketSink(socket)
+		}
+		return NewJSONFileSink(cfg.Output)
+	case FormatDNSTap:
+		if isSocket {
+			return NewDNSTapSocketSink(socket)
+		}
+		return NewDNSTapFileSink(cfg.Output)
+	default:
+		return nil, fmt.Errorf("unknown query log format %q", cfg.Format)
+	}
+}
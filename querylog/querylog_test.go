@@ -0,0 +1,182 @@
+package querylog
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memorySink collects entries in memory for assertions.
+type memorySink struct {
+	mu      sync.Mutex
+	entries []*Entry
+	block   chan struct{}
+	closed  bool
+}
+
+func (s *memorySink) Write(entry *Entry) error {
+	if s.block != nil {
+		<-s.block
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entries = append(s.entries, entry)
+	return nil
+}
+
+func (s *memorySink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	return nil
+}
+
+func TestLogger_LogAndClose(t *testing.T) {
+	sink := &memorySink{}
+	l := NewLogger(sink, 1, 16)
+
+	for i := 0; i < 5; i++ {
+		l.Log(&Entry{Name: "example.com.", Type: "A"})
+	}
+	if err := l.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	if len(sink.entries) != 5 {
+		t.Errorf("sink received %d entries, want 5", len(sink.entries))
+	}
+	if !sink.closed {
+		t.Error("Close() should close the sink")
+	}
+	// Closing twice must not panic.
+	if err := l.Close(); err != nil {
+		t.Errorf("second Close() error = %v", err)
+	}
+}
+
+func TestLogger_DropsWhenFull(t *testing.T) {
+	sink := &memorySink{block: make(chan struct{})}
+	l := NewLogger(sink, 1, 1)
+
+	// The writer goroutine takes at most one entry and blocks on it; the
+	// queue holds one more. Everything after that must be dropped rather
+	// than blocking the caller.
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 10; i++ {
+			l.Log(&Entry{Name: "example.com."})
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Log() blocked on a full queue")
+	}
+
+	close(sink.block)
+	_ = l.Close()
+	if n := len(sink.entries); n < 1 || n > 2 {
+		t.Errorf("sink received %d entries, want 1 or 2", n)
+	}
+}
+
+func TestLogger_Sampled(t *testing.T) {
+	tests := []struct {
+		name    string
+		rate    float64
+		wantAll bool
+	}{
+		{name: "rate 1 logs everything", rate: 1, wantAll: true},
+		{name: "rate 0 defaults to everything", rate: 0, wantAll: true},
+		{name: "rate above 1 defaults to everything", rate: 2, wantAll: true},
+		{name: "tiny rate samples", rate: 0.0001},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := NewLogger(&memorySink{}, tt.rate, 1)
+			defer l.Close()
+
+			sampled := 0
+			for i := 0; i < 1000; i++ {
+				if l.Sampled() {
+					sampled++
+				}
+			}
+			if tt.wantAll && sampled != 1000 {
+				t.Errorf("Sampled() true %d/1000 times, want 1000", sampled)
+			}
+			if !tt.wantAll && sampled > 50 {
+				t.Errorf("Sampled() true %d/1000 times at rate %v", sampled, tt.rate)
+			}
+		})
+	}
+}
+
+func TestJSONFileSink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queries.log")
+	l, err := New(Config{Format: FormatJSON, Output: path})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+
+	l.Log(&Entry{
+		Client: "10.0.0.1", Transport: "udp", Name: "example.com.", Type: "A",
+		Rcode: "NOERROR", Answers: 1, LatencyMs: 0.5, Source: SourceLocal,
+	})
+	l.Log(&Entry{Name: "missing.com.", Type: "AAAA", Rcode: "NXDOMAIN", Source: SourceNone})
+	if err := l.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("open log: %v", err)
+	}
+	defer f.Close()
+
+	var lines []map[string]any
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var m map[string]any
+		if err := json.Unmarshal(scanner.Bytes(), &m); err != nil {
+			t.Fatalf("line is not JSON: %v: %s", err, scanner.Text())
+		}
+		lines = append(lines, m)
+	}
+
+	if len(lines) != 2 {
+		t.Fatalf("got %d lines, want 2", len(lines))
+	}
+	if lines[0]["qname"] != "example.com." || lines[0]["source"] != SourceLocal || lines[0]["client"] != "10.0.0.1" {
+		t.Errorf("unexpected first line: %v", lines[0])
+	}
+	if lines[1]["rcode"] != "NXDOMAIN" {
+		t.Errorf("second line rcode = %v, want NXDOMAIN", lines[1]["rcode"])
+	}
+}
+
+func TestNew_InvalidConfig(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  Config
+	}{
+		{name: "missing output", cfg: Config{Format: FormatJSON}},
+		{name: "unknown format", cfg: Config{Format: "xml", Output: filepath.Join(t.TempDir(), "q.log")}},
+		{name: "missing socket", cfg: Config{Format: FormatJSON, Output: "unix:" + filepath.Join(t.TempDir(), "none.sock")}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := New(tt.cfg); err == nil {
+				t.Error("New() expected error")
+			}
+		})
+	}
+}
@@ -0,0 +1,549 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"jabberwocky238/jw238dns/metrics"
+	"jabberwocky238/jw238dns/types"
+
+	bolt "go.etcd.io/bbolt"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+)
+
+// DefaultBoltJournalSize is the number of changes BoltStorage keeps in its
+// journal when OpenBoltStorage is given a non-positive size.
+const DefaultBoltJournalSize = 10000
+
+// Bucket names and meta keys of the bolt database.
+var (
+	boltRecordsBucket = []byte("records") // name\x00type -> JSON DNSRecord
+	boltChangesBucket = []byte("changes") // big-endian version -> JSON BoltChange
+	boltMetaBucket    = []byte("meta")
+	boltVersionKey    = []byte("version")
+)
+
+// ErrJournalTruncated is returned by BoltStorage.Changes when changes
+// after the requested version are no longer in the journal.
+var ErrJournalTruncated = errors.New("change journal does not reach back to the requested version")
+
+// errNoChanges rolls back a write transaction that changed nothing.
+var errNoChanges = errors.New("no changes")
+
+// BoltChange is one committed transaction in the BoltStorage journal.
+type BoltChange struct {
+	Version uint64             `json:"version"`
+	Time    time.Time          `json:"time"`
+	Added   []*types.DNSRecord `json:"added,omitempty"`
+	Updated []*types.DNSRecord `json:"updated,omitempty"`
+	Deleted []types.RecordKey  `json:"deleted,omitempty"`
+}
+
+// BoltStorage is a CoreStorage persisted in an embedded bbolt database.
+// Every write is one transaction that updates the records, bumps a durable
+// version counter and appends the change to a bounded journal, so a
+// single-record change costs a single small write however many records
+// are stored.
+type BoltStorage struct {
+	db          *bolt.DB
+	journalSize int
+
+	watchers []chan types.StorageEvent
+	watchMu  sync.Mutex
+}
+
+// OpenBoltStorage opens (or creates) the bolt database at path.
+// journalSize bounds the number of changes kept in the journal.
+func OpenBoltStorage(path string, journalSize int) (*BoltStorage, error) {
+	if journalSize <= 0 {
+		journalSize = DefaultBoltJournalSize
+	}
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("open bolt database %s: %w", path, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{boltRecordsBucket, boltChangesBucket, boltMetaBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return fmt.Errorf("create bucket %s: %w", name, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &BoltStorage{db: db, journalSize: journalSize}, nil
+}
+
+// Close closes the database.
+func (s *BoltStorage) Close() error {
+	return s.db.Close()
+}
+
+// Get returns the record matching the given name and type, falling back to
+// wildcard records like MemoryStorage does.
+func (s *BoltStorage) Get(ctx context.Context, name string, recordType types.RecordType) ([]*types.DNSRecord, error) {
+	_, span := tracer.Start(ctx, "BoltStorage.Get")
+	defer span.End()
+	span.SetAttributes(recordAttrs(name, recordType)...)
+
+	var rec *types.DNSRecord
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltRecordsBucket)
+		if data := b.Get(boltKey(name, recordType)); data != nil {
+			return json.Unmarshal(data, &rec)
+		}
+		// The wildcard may sit in any label, so scan the keys and only
+		// decode the value of a match.
+		return b.ForEach(func(k, v []byte) error {
+			storedName, rt, ok := splitBoltKey(k)
+			if rec != nil || !ok || rt != recordType || !strings.Contains(storedName, "*") {
+				return nil
+			}
+			if matched, _ := regexp.MatchString(wildcardToRegex(storedName), name); !matched {
+				return nil
+			}
+			if err := json.Unmarshal(v, &rec); err != nil {
+				return err
+			}
+			rec.Name = name
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("read record: %w", err)
+	}
+	if rec == nil {
+		return nil, types.ErrRecordNotFound
+	}
+	return []*types.DNSRecord{rec}, nil
+}
+
+// List returns all stored DNS records.
+func (s *BoltStorage) List(ctx context.Context) ([]*types.DNSRecord, error) {
+	_, span := tracer.Start(ctx, "BoltStorage.List")
+	defer span.End()
+
+	var all []*types.DNSRecord
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltRecordsBucket)
+		all = make([]*types.DNSRecord, 0, b.Stats().KeyN)
+		return b.ForEach(func(_, v []byte) error {
+			var rec types.DNSRecord
+			if err := json.Unmarshal(v, &rec); err != nil {
+				return err
+			}
+			all = append(all, &rec)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("list records: %w", err)
+	}
+	return all, nil
+}
+
+// Create adds a new DNS record. Returns ErrRecordExists if a record with
+// the same name and type already exists.
+func (s *BoltStorage) Create(ctx context.Context, record *types.DNSRecord) error {
+	_, span := tracer.Start(ctx, "BoltStorage.Create")
+	defer span.End()
+	span.SetAttributes(recordAttrs(record.Name, record.Type)...)
+
+	_, err := s.commit(func(b *bolt.Bucket) (*types.RecordChanges, error) {
+		if b.Get(boltKey(record.Name, record.Type)) != nil {
+			return nil, types.ErrRecordExists
+		}
+		return &types.RecordChanges{Added: []*types.DNSRecord{record}}, putRecord(b, record)
+	})
+	if err != nil {
+		return err
+	}
+	s.emit(types.StorageEvent{Type: types.EventAdded, Record: record, Origin: span.SpanContext()})
+	return nil
+}
+
+// Update replaces an existing DNS record. Returns ErrRecordNotFound if the
+// record does not exist.
+func (s *BoltStorage) Update(ctx context.Context, record *types.DNSRecord) error {
+	_, span := tracer.Start(ctx, "BoltStorage.Update")
+	defer span.End()
+	span.SetAttributes(recordAttrs(record.Name, record.Type)...)
+
+	_, err := s.commit(func(b *bolt.Bucket) (*types.RecordChanges, error) {
+		if b.Get(boltKey(record.Name, record.Type)) == nil {
+			return nil, types.ErrRecordNotFound
+		}
+		return &types.RecordChanges{Updated: []*types.DNSRecord{record}}, putRecord(b, record)
+	})
+	if err != nil {
+		return err
+	}
+	s.emit(types.StorageEvent{Type: types.EventUpdated, Record: record, Origin: span.SpanContext()})
+	return nil
+}
+
+// Delete removes a DNS record identified by name and type.
+func (s *BoltStorage) Delete(ctx context.Context, name string, recordType types.RecordType) error {
+	_, span := tracer.Start(ctx, "BoltStorage.Delete")
+	defer span.End()
+	span.SetAttributes(recordAttrs(name, recordType)...)
+
+	_, err := s.commit(func(b *bolt.Bucket) (*types.RecordChanges, error) {
+		k := boltKey(name, recordType)
+		if b.Get(k) == nil {
+			return nil, types.ErrRecordNotFound
+		}
+		return &types.RecordChanges{Deleted: []types.RecordKey{{Name: name, Type: recordType}}}, b.Delete(k)
+	})
+	if err != nil {
+		return err
+	}
+	s.emit(types.StorageEvent{Type: types.EventDeleted, Record: &types.DNSRecord{Name: name, Type: recordType}, Origin: span.SpanContext()})
+	return nil
+}
+
+// HotReload replaces all records atomically with the provided set. Only
+// the difference to the stored records is written and journaled.
+func (s *BoltStorage) HotReload(ctx context.Context, records []*types.DNSRecord) error {
+	_, span := tracer.Start(ctx, "BoltStorage.HotReload")
+	defer span.End()
+	span.SetAttributes(attribute.Int("dns.records", len(records)))
+
+	changed, err := s.commit(func(b *bolt.Bucket) (*types.RecordChanges, error) {
+		current := make(map[types.RecordKey]*types.DNSRecord, b.Stats().KeyN)
+		err := b.ForEach(func(_, v []byte) error {
+			var rec types.DNSRecord
+			if err := json.Unmarshal(v, &rec); err != nil {
+				return err
+			}
+			current[types.RecordKey{Name: rec.Name, Type: rec.Type}] = &rec
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		changes := diffRecordMaps(current, buildRecordMapFromSlice(records))
+		return changes, applyChanges(b, changes)
+	})
+	if err != nil || !changed {
+		return err
+	}
+	s.emit(types.StorageEvent{Type: types.EventReloaded, Origin: span.SpanContext()})
+	return nil
+}
+
+// PartialReload applies only the changed records atomically.
+func (s *BoltStorage) PartialReload(ctx context.Context, changes *types.RecordChanges) error {
+	_, span := tracer.Start(ctx, "BoltStorage.PartialReload")
+	defer span.End()
+	span.SetAttributes(
+		attribute.Int("dns.added", len(changes.Added)),
+		attribute.Int("dns.updated", len(changes.Updated)),
+		attribute.Int("dns.deleted", len(changes.Deleted)),
+	)
+
+	changed, err := s.commit(func(b *bolt.Bucket) (*types.RecordChanges, error) {
+		return changes, applyChanges(b, changes)
+	})
+	if err != nil || !changed {
+		return err
+	}
+	s.emit(types.StorageEvent{Type: types.EventReloaded, Origin: span.SpanContext()})
+	return nil
+}
+
+// Transaction implements CoreStorage. fn runs inside a bolt write
+// transaction, so it is called once and sees no other writes.
+func (s *BoltStorage) Transaction(ctx context.Context, fn func(tx *Tx) error) error {
+	_, span := tracer.Start(ctx, "BoltStorage.Transaction")
+	defer span.End()
+
+	changed, err := s.commit(func(b *bolt.Bucket) (*types.RecordChanges, error) {
+		tx := newTx(func(key types.RecordKey) (*types.DNSRecord, error) {
+			data := b.Get(boltKey(key.Name, key.Type))
+			if data == nil {
+				return nil, nil
+			}
+			var rec types.DNSRecord
+			if err := json.Unmarshal(data, &rec); err != nil {
+				return nil, fmt.Errorf("read record: %w", err)
+			}
+			return &rec, nil
+		})
+		if err := fn(tx); err != nil {
+			return nil, err
+		}
+		changes := tx.Changes()
+		return changes, applyChanges(b, changes)
+	})
+	if err != nil || !changed {
+		return err
+	}
+	s.emit(types.StorageEvent{Type: types.EventReloaded, Origin: span.SpanContext()})
+	return nil
+}
+
+// Watch returns a channel that receives storage change events. The channel
+// is closed when the provided context is cancelled.
+func (s *BoltStorage) Watch(ctx context.Context) (<-chan types.StorageEvent, error) {
+	ch := make(chan types.StorageEvent, 64)
+
+	s.watchMu.Lock()
+	s.watchers = append(s.watchers, ch)
+	s.watchMu.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		s.watchMu.Lock()
+		defer s.watchMu.Unlock()
+		for i, w := range s.watchers {
+			if w == ch {
+				s.watchers = append(s.watchers[:i], s.watchers[i+1:]...)
+				break
+			}
+		}
+		close(ch)
+	}()
+
+	return ch, nil
+}
+
+// Version returns the durable version counter: the number of write
+// transactions committed since the database was created.
+func (s *BoltStorage) Version() (uint64, error) {
+	var version uint64
+	err := s.db.View(func(tx *bolt.Tx) error {
+		version = readVersion(tx)
+		return nil
+	})
+	return version, err
+}
+
+// Changes returns the journaled changes committed after version since,
+// oldest first. It returns ErrJournalTruncated if some of them have
+// already been dropped from the journal.
+func (s *BoltStorage) Changes(ctx context.Context, since uint64) ([]BoltChange, error) {
+	_, span := tracer.Start(ctx, "BoltStorage.Changes")
+	defer span.End()
+
+	var changes []BoltChange
+	err := s.db.View(func(tx *bolt.Tx) error {
+		current := readVersion(tx)
+		if since >= current {
+			return nil
+		}
+		c := tx.Bucket(boltChangesBucket).Cursor()
+		k, v := c.Seek(versionKey(since + 1))
+		if k == nil || binary.BigEndian.Uint64(k) != since+1 {
+			return ErrJournalTruncated
+		}
+		for ; k != nil; k, v = c.Next() {
+			var change BoltChange
+			if err := json.Unmarshal(v, &change); err != nil {
+				return fmt.Errorf("decode change %d: %w", binary.BigEndian.Uint64(k), err)
+			}
+			changes = append(changes, change)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return changes, nil
+}
+
+// SyncFrom persists every change made to store until ctx is cancelled.
+// The change set of each event is written as it arrives; a resync, and
+// any gap in the event versions, is written by diffing store against the
+// database. Before returning it writes whatever store has changed since
+// the last event.
+//
+// store is expected to have been loaded from this database, so that the
+// first event only carries changes made after the load.
+func (s *BoltStorage) SyncFrom(ctx context.Context, store *MemoryStorage) error {
+	ch, err := store.Watch(ctx)
+	if err != nil {
+		return fmt.Errorf("watch storage: %w", err)
+	}
+	applied := store.Version()
+
+	for ev := range ch {
+		pctx, span := tracer.Start(ctx, "BoltStorage.Sync", linkEvent(ev)...)
+		if err := s.syncEvent(pctx, store, ev, &applied); err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			slog.Error("persist to bolt database", "err", err)
+		}
+		span.End()
+	}
+
+	// The watch ends with ctx; pick up anything that was still queued.
+	if store.Version() != applied {
+		if err := s.resync(context.WithoutCancel(ctx), store, &applied); err != nil {
+			slog.Error("persist to bolt database", "err", err)
+			return err
+		}
+	}
+	return nil
+}
+
+// syncEvent writes one store event to the database.
+func (s *BoltStorage) syncEvent(ctx context.Context, store *MemoryStorage, ev types.StorageEvent, applied *uint64) error {
+	switch {
+	case ev.Version <= *applied:
+		return nil // already covered by an earlier resync
+	case ev.Type == types.EventResync || ev.Version != *applied+1 || ev.Changes == nil:
+		return s.resync(ctx, store, applied)
+	case ev.Source != "":
+		// Synthesized records are not persisted.
+	default:
+		if err := s.PartialReload(ctx, ev.Changes); err != nil {
+			return err
+		}
+	}
+	*applied = ev.Version
+	return nil
+}
+
+// resync makes the database match store.
+func (s *BoltStorage) resync(ctx context.Context, store *MemoryStorage, applied *uint64) error {
+	records, version := store.PersistentSnapshot()
+	err := s.HotReload(ctx, records)
+	metrics.ObserveReload("bolt", err)
+	if err != nil {
+		return err
+	}
+	*applied = version
+	return nil
+}
+
+// commit runs apply against the records bucket in one write transaction,
+// then bumps the version and journals the changes apply reports. If they
+// are empty the transaction is rolled back and commit reports false.
+func (s *BoltStorage) commit(apply func(*bolt.Bucket) (*types.RecordChanges, error)) (bool, error) {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		changes, err := apply(tx.Bucket(boltRecordsBucket))
+		if err != nil {
+			return err
+		}
+		if len(changes.Added) == 0 && len(changes.Updated) == 0 && len(changes.Deleted) == 0 {
+			return errNoChanges
+		}
+
+		version := readVersion(tx) + 1
+		if err := tx.Bucket(boltMetaBucket).Put(boltVersionKey, versionKey(version)); err != nil {
+			return fmt.Errorf("write version: %w", err)
+		}
+
+		data, err := json.Marshal(BoltChange{
+			Version: version,
+			Time:    time.Now().UTC(),
+			Added:   changes.Added,
+			Updated: changes.Updated,
+			Deleted: changes.Deleted,
+		})
+		if err != nil {
+			return fmt.Errorf("encode change: %w", err)
+		}
+		journal := tx.Bucket(boltChangesBucket)
+		if err := journal.Put(versionKey(version), data); err != nil {
+			return fmt.Errorf("write change: %w", err)
+		}
+
+		// Trim the journal to journalSize entries.
+		if version > uint64(s.journalSize) {
+			oldest := versionKey(version - uint64(s.journalSize))
+			c := journal.Cursor()
+			for k, _ := c.First(); k != nil && bytes.Compare(k, oldest) <= 0; k, _ = c.Next() {
+				if err := c.Delete(); err != nil {
+					return fmt.Errorf("trim journal: %w", err)
+				}
+			}
+		}
+		return nil
+	})
+	if errors.Is(err, errNoChanges) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// applyChanges writes changes to the records bucket.
+func applyChanges(b *bolt.Bucket, changes *types.RecordChanges) error {
+	for _, r := range changes.Added {
+		if err := putRecord(b, r); err != nil {
+			return err
+		}
+	}
+	for _, r := range changes.Updated {
+		if err := putRecord(b, r); err != nil {
+			return err
+		}
+	}
+	for _, key := range changes.Deleted {
+		if err := b.Delete(boltKey(key.Name, key.Type)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// emit sends an event to all active watchers without blocking.
+func (s *BoltStorage) emit(event types.StorageEvent) {
+	s.watchMu.Lock()
+	defer s.watchMu.Unlock()
+	for _, ch := range s.watchers {
+		select {
+		case ch <- event:
+		default:
+			// Drop event if watcher is not keeping up.
+			metrics.WatchEventsDroppedTotal.Inc()
+		}
+	}
+}
+
+// putRecord stores record under its name and type.
+func putRecord(b *bolt.Bucket, record *types.DNSRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("encode record: %w", err)
+	}
+	return b.Put(boltKey(record.Name, record.Type), data)
+}
+
+// boltKey returns the records bucket key for a name and type.
+func boltKey(name string, recordType types.RecordType) []byte {
+	return []byte(name + "\x00" + string(recordType))
+}
+
+// splitBoltKey is the inverse of boltKey.
+func splitBoltKey(k []byte) (string, types.RecordType, bool) {
+	name, rt, ok := strings.Cut(string(k), "\x00")
+	return name, types.RecordType(rt), ok
+}
+
+// readVersion returns the version stored in tx, or 0 for a new database.
+func readVersion(tx *bolt.Tx) uint64 {
+	if v := tx.Bucket(boltMetaBucket).Get(boltVersionKey); len(v) == 8 {
+		return binary.BigEndian.Uint64(v)
+	}
+	return 0
+}
+
+// versionKey encodes a version so that keys sort in version order.
+func versionKey(version uint64) []byte {
+	return binary.BigEndian.AppendUint64(nil, version)
+}
@@ -0,0 +1,264 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"jabberwocky238/jw238dns/types"
+)
+
+func openTestBolt(t *testing.T, path string, journalSize int) *BoltStorage {
+	t.Helper()
+	if path == "" {
+		path = filepath.Join(t.TempDir(), "records.db")
+	}
+	s, err := OpenBoltStorage(path, journalSize)
+	if err != nil {
+		t.Fatalf("OpenBoltStorage() error = %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func aRecord(name, ip string) *types.DNSRecord {
+	return &types.DNSRecord{Name: name, Type: types.RecordTypeA, TTL: 300, Value: []string{ip}}
+}
+
+func TestBoltStorage_CRUD(t *testing.T) {
+	s := openTestBolt(t, "", 0)
+	ctx := context.Background()
+
+	if err := s.Create(ctx, aRecord("a.com.", "1.1.1.1")); err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+	if err := s.Create(ctx, aRecord("a.com.", "2.2.2.2")); !errors.Is(err, types.ErrRecordExists) {
+		t.Errorf("Create() duplicate error = %v, want ErrRecordExists", err)
+	}
+	if err := s.Update(ctx, aRecord("b.com.", "2.2.2.2")); !errors.Is(err, types.ErrRecordNotFound) {
+		t.Errorf("Update() missing error = %v, want ErrRecordNotFound", err)
+	}
+	if err := s.Update(ctx, aRecord("a.com.", "3.3.3.3")); err != nil {
+		t.Fatalf("Update() error = %v", err)
+	}
+
+	recs, err := s.Get(ctx, "a.com.", types.RecordTypeA)
+	if err != nil || len(recs) != 1 || recs[0].Value[0] != "3.3.3.3" {
+		t.Fatalf("Get() = %v, %v, want updated record", recs, err)
+	}
+	if _, err := s.Get(ctx, "a.com.", types.RecordTypeAAAA); !errors.Is(err, types.ErrRecordNotFound) {
+		t.Errorf("Get() other type error = %v, want ErrRecordNotFound", err)
+	}
+
+	if err := s.Delete(ctx, "a.com.", types.RecordTypeA); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+	if err := s.Delete(ctx, "a.com.", types.RecordTypeA); !errors.Is(err, types.ErrRecordNotFound) {
+		t.Errorf("Delete() missing error = %v, want ErrRecordNotFound", err)
+	}
+
+	// Failed writes do not count as versions.
+	if v, _ := s.Version(); v != 3 {
+		t.Errorf("Version() = %d, want 3", v)
+	}
+}
+
+func TestBoltStorage_GetWildcard(t *testing.T) {
+	s := openTestBolt(t, "", 0)
+	ctx := context.Background()
+	_ = s.Create(ctx, aRecord("*.example.com.", "10.0.0.1"))
+
+	recs, err := s.Get(ctx, "test.example.com.", types.RecordTypeA)
+	if err != nil || len(recs) != 1 {
+		t.Fatalf("Get() wildcard = %v, %v", recs, err)
+	}
+	if recs[0].Name != "test.example.com." {
+		t.Errorf("Name = %q, want the queried name", recs[0].Name)
+	}
+	if _, err := s.Get(ctx, "a.b.example.com.", types.RecordTypeA); !errors.Is(err, types.ErrRecordNotFound) {
+		t.Errorf("Get() two labels deep error = %v, want ErrRecordNotFound", err)
+	}
+}
+
+func TestBoltStorage_DurableAcrossReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "records.db")
+	ctx := context.Background()
+
+	s, err := OpenBoltStorage(path, 0)
+	if err != nil {
+		t.Fatalf("OpenBoltStorage() error = %v", err)
+	}
+	_ = s.Create(ctx, aRecord("a.com.", "1.1.1.1"))
+	_ = s.Create(ctx, aRecord("b.com.", "2.2.2.2"))
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	s = openTestBolt(t, path, 0)
+	recs, err := s.List(ctx)
+	if err != nil || len(recs) != 2 {
+		t.Fatalf("List() after reopen = %v, %v, want 2 records", recs, err)
+	}
+	if v, _ := s.Version(); v != 2 {
+		t.Errorf("Version() after reopen = %d, want 2", v)
+	}
+	_ = s.Delete(ctx, "a.com.", types.RecordTypeA)
+	if v, _ := s.Version(); v != 3 {
+		t.Errorf("Version() continues at %d, want 3", v)
+	}
+}
+
+func TestBoltStorage_HotReload(t *testing.T) {
+	s := openTestBolt(t, "", 0)
+	ctx := context.Background()
+	_ = s.Create(ctx, aRecord("keep.com.", "1.1.1.1"))
+	_ = s.Create(ctx, aRecord("change.com.", "2.2.2.2"))
+	_ = s.Create(ctx, aRecord("drop.com.", "3.3.3.3"))
+
+	desired := []*types.DNSRecord{
+		aRecord("keep.com.", "1.1.1.1"),
+		aRecord("change.com.", "9.9.9.9"),
+		aRecord("new.com.", "4.4.4.4"),
+	}
+	if err := s.HotReload(ctx, desired); err != nil {
+		t.Fatalf("HotReload() error = %v", err)
+	}
+
+	changes, err := s.Changes(ctx, 3)
+	if err != nil || len(changes) != 1 {
+		t.Fatalf("Changes(3) = %v, %v, want one reload entry", changes, err)
+	}
+	c := changes[0]
+	if len(c.Added) != 1 || len(c.Updated) != 1 || len(c.Deleted) != 1 {
+		t.Errorf("journaled reload = %+v, want 1 added, 1 updated, 1 deleted", c)
+	}
+
+	// Reloading the same set writes nothing.
+	if err := s.HotReload(ctx, desired); err != nil {
+		t.Fatalf("HotReload() again error = %v", err)
+	}
+	if v, _ := s.Version(); v != 4 {
+		t.Errorf("Version() after no-op reload = %d, want 4", v)
+	}
+}
+
+func TestBoltStorage_Changes(t *testing.T) {
+	s := openTestBolt(t, "", 3)
+	ctx := context.Background()
+	for i := range 5 {
+		_ = s.Create(ctx, aRecord(fmt.Sprintf("r%d.com.", i), "1.1.1.1"))
+	}
+
+	tests := []struct {
+		name    string
+		since   uint64
+		want    []uint64
+		wantErr error
+	}{
+		{name: "within journal", since: 3, want: []uint64{4, 5}},
+		{name: "oldest kept", since: 2, want: []uint64{3, 4, 5}},
+		{name: "up to date", since: 5},
+		{name: "trimmed", since: 1, wantErr: ErrJournalTruncated},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			changes, err := s.Changes(ctx, tt.since)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Changes(%d) error = %v, want %v", tt.since, err, tt.wantErr)
+			}
+			if len(changes) != len(tt.want) {
+				t.Fatalf("Changes(%d) returned %d entries, want %d", tt.since, len(changes), len(tt.want))
+			}
+			for i, c := range changes {
+				if c.Version != tt.want[i] {
+					t.Errorf("entry %d version = %d, want %d", i, c.Version, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestBoltStorage_Watch(t *testing.T) {
+	s := openTestBolt(t, "", 0)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ch, _ := s.Watch(ctx)
+	_ = s.Create(ctx, aRecord("a.com.", "1.1.1.1"))
+	_ = s.Create(ctx, aRecord("a.com.", "1.1.1.1")) // fails, no event
+
+	select {
+	case ev := <-ch:
+		if ev.Type != types.EventAdded || ev.Record.Name != "a.com." {
+			t.Errorf("event = %+v, want added a.com.", ev)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no event received")
+	}
+	select {
+	case ev := <-ch:
+		t.Errorf("unexpected event %+v", ev)
+	default:
+	}
+}
+
+func TestBoltStorage_SyncFrom(t *testing.T) {
+	s := openTestBolt(t, "", 0)
+	store := NewMemoryStorage()
+	ctx, cancel := context.WithCancel(context.Background())
+
+	done := make(chan error, 1)
+	go func() { done <- s.SyncFrom(ctx, store) }()
+	time.Sleep(50 * time.Millisecond)
+
+	_ = store.Create(ctx, aRecord("a.com.", "1.1.1.1"))
+	_ = store.Create(ctx, aRecord("b.com.", "2.2.2.2"))
+	_ = store.Update(ctx, aRecord("a.com.", "3.3.3.3"))
+	_ = store.Delete(ctx, "b.com.", types.RecordTypeA)
+	_ = store.PartialReload(ctx, &types.RecordChanges{Added: []*types.DNSRecord{aRecord("c.com.", "4.4.4.4")}})
+	// Cancel straight away: whatever is still queued is flushed on return.
+	_ = store.Create(ctx, aRecord("d.com.", "5.5.5.5"))
+	cancel()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("SyncFrom() error = %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("SyncFrom() did not return after cancel")
+	}
+
+	recs, _ := s.List(context.Background())
+	want, _ := store.List(context.Background())
+	changes := DiffRecords(recs, want)
+	if len(changes.Added)+len(changes.Updated)+len(changes.Deleted) != 0 {
+		t.Errorf("database differs from store: %+v", changes)
+	}
+}
+
+func BenchmarkBoltStorage_List(b *testing.B) {
+	s, err := OpenBoltStorage(filepath.Join(b.TempDir(), "records.db"), 0)
+	if err != nil {
+		b.Fatalf("OpenBoltStorage() error = %v", err)
+	}
+	defer s.Close()
+
+	records := make([]*types.DNSRecord, 100000)
+	for i := range records {
+		records[i] = aRecord(fmt.Sprintf("host%d.example.com.", i), "10.0.0.1")
+	}
+	ctx := context.Background()
+	if err := s.HotReload(ctx, records); err != nil {
+		b.Fatalf("HotReload() error = %v", err)
+	}
+
+	for b.Loop() {
+		if _, err := s.List(ctx); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -4,16 +4,21 @@ import (
 	"context"
 	"fmt"
 	"log/slog"
+	"slices"
 	"sync"
 	"time"
 
+	"jabberwocky238/jw238dns/metrics"
 	"jabberwocky238/jw238dns/types"
 
+	"go.opentelemetry.io/otel/codes"
 	"gopkg.in/yaml.v3"
 	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
 )
 
 // configYAML is the top-level structure inside the ConfigMap's config.yaml key.
@@ -32,6 +37,24 @@ type ConfigMapWatcher struct {
 
 	mu      sync.Mutex
 	syncing bool // guards against echo loops during bidirectional sync
+	// base is the record set last read from or written to the ConfigMap:
+	// the common ancestor of the store and the ConfigMap for three-way
+	// merges. baseKnown is false until the first read or write.
+	base      []*types.DNSRecord
+	baseKnown bool
+
+	// persistMu serialises applying and persisting, so each merge starts
+	// from the base the previous one left.
+	persistMu sync.Mutex
+
+	lead *leadership
+
+	// owns reports whether a record name belongs in this ConfigMap; nil
+	// owns every name. Set for the shards of a ShardedConfigMapWatcher.
+	owns func(name string) bool
+	// adopt makes the first read keep records already in the store that
+	// the ConfigMap lacks, so they move into a newly added shard.
+	adopt bool
 }
 
 // NewConfigMapWatcher creates a ConfigMapWatcher that watches the named
@@ -45,6 +68,7 @@ func NewConfigMapWatcher(client kubernetes.Interface, namespace, name, dataKey s
 		name:      name,
 		dataKey:   dataKey,
 		store:     store,
+		lead:      &leadership{},
 	}
 }
 
@@ -93,24 +117,49 @@ func (w *ConfigMapWatcher) watchOnce(ctx context.Context) error {
 			}
 			if event.Type == watch.Added || event.Type == watch.Modified {
 				cm, ok := event.Object.(*corev1.ConfigMap)
-				if !ok {
+				if !ok || cm.Name != w.name {
 					continue
 				}
 				records, err := parseConfigMap(cm, w.dataKey)
 				if err != nil {
+					metrics.ObserveReload("configmap", err)
 					slog.Error("parse configmap", "err", err)
 					continue
 				}
+				records, foreign := w.split(records)
+				for _, r := range foreign {
+					slog.Warn("ignoring record outside the configmap's zone", "configmap", w.name, "name", r.Name, "type", r.Type)
+				}
 				w.applyRecords(ctx, records)
 			}
 		}
 	}
 }
 
-// applyRecords computes a diff and applies a partial reload.
+// applyRecords merges the ConfigMap records with the changes made to the
+// store since the last sync and applies the result via a partial reload.
+// Local changes not yet in the ConfigMap are persisted afterwards.
 func (w *ConfigMapWatcher) applyRecords(ctx context.Context, records []*types.DNSRecord) {
+	ctx, span := tracer.Start(ctx, "ConfigMapWatcher.applyRecords")
+	defer span.End()
+
+	if w.mergeFromConfigMap(ctx, records) {
+		if err := w.PersistToConfigMap(ctx); err != nil {
+			slog.Error("persist to configmap", "err", err)
+		}
+	}
+}
+
+// mergeFromConfigMap applies records to the store and reports whether the
+// store holds local changes the ConfigMap lacks.
+func (w *ConfigMapWatcher) mergeFromConfigMap(ctx context.Context, records []*types.DNSRecord) bool {
+	w.persistMu.Lock()
+	defer w.persistMu.Unlock()
+
 	w.mu.Lock()
 	w.syncing = true
+	base, known := w.base, w.baseKnown
+	w.base, w.baseKnown = records, true
 	w.mu.Unlock()
 
 	defer func() {
@@ -119,17 +168,83 @@ func (w *ConfigMapWatcher) applyRecords(ctx context.Context, records []*types.DN
 		w.mu.Unlock()
 	}()
 
-	changes := w.store.CalculateChanges(records)
-	if len(changes.Added) == 0 && len(changes.Updated) == 0 && len(changes.Deleted) == 0 {
-		return
+	ours, err := w.ownedRecords(ctx)
+	if err != nil {
+		slog.Error("list records", "err", err)
+		return false
 	}
-	if err := w.store.PartialReload(ctx, changes); err != nil {
+	desired := records
+	if known {
+		desired = mergeRecords(base, ours, records)
+	} else if w.adopt {
+		desired = mergeRecords(nil, ours, records)
+	}
+	err = w.reconcile(ctx, ours, desired)
+	metrics.ObserveReload("configmap", err)
+	if err != nil {
 		slog.Error("partial reload from configmap", "err", err)
 	}
+	if !known && !w.adopt {
+		return false
+	}
+	pending := DiffRecords(records, desired)
+	return len(pending.Added) != 0 || len(pending.Updated) != 0 || len(pending.Deleted) != 0
+}
+
+// reconcile applies the changes that turn ours, a listing of the store,
+// into desired. Records changed in the store since ours was listed are
+// left alone; the next persist writes them to the ConfigMap.
+func (w *ConfigMapWatcher) reconcile(ctx context.Context, ours, desired []*types.DNSRecord) error {
+	changes := DiffRecords(ours, desired)
+	if len(changes.Added) == 0 && len(changes.Updated) == 0 && len(changes.Deleted) == 0 {
+		return nil
+	}
+	current, err := w.ownedRecords(ctx)
+	if err != nil {
+		return fmt.Errorf("list records: %w", err)
+	}
+	listed, now := buildRecordMapFromSlice(ours), buildRecordMapFromSlice(current)
+	unchanged := func(key types.RecordKey) bool {
+		a, wasListed := listed[key]
+		b, isStored := now[key]
+		if wasListed != isStored {
+			return false
+		}
+		return !wasListed || recordsEqual(a, b)
+	}
+
+	filtered := &types.RecordChanges{}
+	for _, r := range changes.Added {
+		if unchanged(types.RecordKey{Name: r.Name, Type: r.Type}) {
+			filtered.Added = append(filtered.Added, r)
+		}
+	}
+	for _, r := range changes.Updated {
+		if unchanged(types.RecordKey{Name: r.Name, Type: r.Type}) {
+			filtered.Updated = append(filtered.Updated, r)
+		}
+	}
+	for _, key := range changes.Deleted {
+		if unchanged(key) {
+			filtered.Deleted = append(filtered.Deleted, key)
+		}
+	}
+	if len(filtered.Added) == 0 && len(filtered.Updated) == 0 && len(filtered.Deleted) == 0 {
+		return nil
+	}
+	return w.store.PartialReload(ctx, filtered)
 }
 
 // PersistToConfigMap writes the current storage contents back to the
 // ConfigMap (Storage -> ConfigMap direction of bidirectional sync).
+//
+// The changes made to the store since the last sync are merged into the
+// ConfigMap as it is now, so edits made concurrently by other replicas or
+// with kubectl are kept; where both changed the same record, the store
+// wins. The update is conditional on the resourceVersion that was read and
+// is retried from a fresh read on conflict. Changes merged in from the
+// ConfigMap are applied to the store. With leader election enabled, only
+// the leader persists.
 func (w *ConfigMapWatcher) PersistToConfigMap(ctx context.Context) error {
 	w.mu.Lock()
 	if w.syncing {
@@ -137,40 +252,97 @@ func (w *ConfigMapWatcher) PersistToConfigMap(ctx context.Context) error {
 		return nil // skip echo
 	}
 	w.mu.Unlock()
+	if !w.IsLeader() {
+		return nil
+	}
 
-	records, err := w.store.List(ctx)
+	w.persistMu.Lock()
+	defer w.persistMu.Unlock()
+
+	ours, err := w.ownedRecords(ctx)
 	if err != nil {
 		return fmt.Errorf("list records: %w", err)
 	}
-
-	cfg := configYAML{Records: records}
-	data, err := yaml.Marshal(&cfg)
-	if err != nil {
-		return fmt.Errorf("marshal yaml: %w", err)
+	w.mu.Lock()
+	base, known := w.base, w.baseKnown
+	w.mu.Unlock()
+	if c := DiffRecords(base, ours); known && len(c.Added) == 0 && len(c.Updated) == 0 && len(c.Deleted) == 0 {
+		return nil // nothing changed locally since the last sync
 	}
 
-	cm, err := w.client.CoreV1().ConfigMaps(w.namespace).Get(ctx, w.name, metav1.GetOptions{})
+	configMaps := w.client.CoreV1().ConfigMaps(w.namespace)
+	var merged []*types.DNSRecord
+	var attempts int
+	var written bool
+	err = retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		attempts++
+		cm, err := configMaps.Get(ctx, w.name, metav1.GetOptions{})
+		if err != nil {
+			return fmt.Errorf("get configmap: %w", err)
+		}
+		var theirs, foreign []*types.DNSRecord
+		_, present := cm.Data[w.dataKey]
+		if present {
+			if theirs, err = parseConfigMap(cm, w.dataKey); err != nil {
+				return fmt.Errorf("not overwriting configmap %s/%s: %w", w.namespace, w.name, err)
+			}
+			// Records outside this shard's zone are kept as they are.
+			theirs, foreign = w.split(theirs)
+		}
+
+		merged = ours
+		if known {
+			merged = mergeRecords(base, ours, theirs)
+		} else if w.adopt {
+			merged = mergeRecords(nil, ours, theirs)
+		}
+		if c := DiffRecords(theirs, merged); present && len(c.Added) == 0 && len(c.Updated) == 0 && len(c.Deleted) == 0 {
+			written = false
+			return nil
+		}
+
+		data, err := yaml.Marshal(&configYAML{Records: append(slices.Clone(merged), foreign...)})
+		if err != nil {
+			return fmt.Errorf("marshal yaml: %w", err)
+		}
+		if cm.Data == nil {
+			cm.Data = make(map[string]string)
+		}
+		cm.Data[w.dataKey] = string(data)
+
+		// cm carries the resourceVersion it was read at, so a write made
+		// since fails with a conflict instead of being overwritten.
+		if _, err := configMaps.Update(ctx, cm, metav1.UpdateOptions{}); err != nil {
+			if apierrors.IsConflict(err) {
+				metrics.ConfigMapConflictsTotal.Inc()
+				slog.Debug("configmap changed concurrently, merging again", "attempt", attempts)
+			}
+			return fmt.Errorf("update configmap: %w", err)
+		}
+		written = true
+		return nil
+	})
 	if err != nil {
-		return fmt.Errorf("get configmap: %w", err)
+		return err
 	}
 
-	if cm.Data == nil {
-		cm.Data = make(map[string]string)
+	w.mu.Lock()
+	w.base, w.baseKnown = merged, true
+	w.mu.Unlock()
+	if err := w.reconcile(ctx, ours, merged); err != nil {
+		return fmt.Errorf("apply merged configmap records: %w", err)
 	}
-	cm.Data[w.dataKey] = string(data)
 
-	_, err = w.client.CoreV1().ConfigMaps(w.namespace).Update(ctx, cm, metav1.UpdateOptions{})
-	if err != nil {
-		return fmt.Errorf("update configmap: %w", err)
+	if written {
+		slog.Info("persisted records to configmap", "records", len(merged), "attempts", attempts)
 	}
-
-	slog.Info("persisted records to configmap", "records", len(records))
 	return nil
 }
 
 // WatchAndSync starts both the ConfigMap watcher and a goroutine that
 // listens on the storage Watch channel to persist changes back to the
-// ConfigMap. It blocks until ctx is cancelled.
+// ConfigMap, and campaigns for leadership if leader election is enabled.
+// It blocks until ctx is cancelled.
 func (w *ConfigMapWatcher) WatchAndSync(ctx context.Context) error {
 	ch, err := w.store.Watch(ctx)
 	if err != nil {
@@ -182,20 +354,75 @@ func (w *ConfigMapWatcher) WatchAndSync(ctx context.Context) error {
 			select {
 			case <-ctx.Done():
 				return
-			case _, ok := <-ch:
+			case ev, ok := <-ch:
 				if !ok {
 					return
 				}
-				if err := w.PersistToConfigMap(ctx); err != nil {
+				pctx, span := tracer.Start(ctx, "ConfigMapWatcher.PersistToConfigMap", linkEvent(ev)...)
+				if err := w.PersistToConfigMap(pctx); err != nil {
+					span.RecordError(err)
+					span.SetStatus(codes.Error, err.Error())
 					slog.Error("persist to configmap", "err", err)
 				}
+				span.End()
 			}
 		}
 	}()
 
+	if w.lead.config != nil {
+		go func() {
+			if err := w.runLeaderElection(ctx); err != nil && ctx.Err() == nil {
+				slog.Error("configmap leader election failed", "err", err)
+			}
+		}()
+	}
+
 	return w.Watch(ctx)
 }
 
+// ownedRecords lists the persistent records that belong in this ConfigMap.
+func (w *ConfigMapWatcher) ownedRecords(ctx context.Context) ([]*types.DNSRecord, error) {
+	records, err := w.store.ListPersistent(ctx)
+	if err != nil || w.owns == nil {
+		return records, err
+	}
+	owned, _ := w.split(records)
+	return owned, nil
+}
+
+// split separates records that belong in this ConfigMap from the rest.
+func (w *ConfigMapWatcher) split(records []*types.DNSRecord) (owned, foreign []*types.DNSRecord) {
+	if w.owns == nil {
+		return records, nil
+	}
+	for _, r := range records {
+		if w.owns(r.Name) {
+			owned = append(owned, r)
+		} else {
+			foreign = append(foreign, r)
+		}
+	}
+	return owned, foreign
+}
+
+// Load reads the records that belong in this ConfigMap from the API
+// server, without applying them to the store.
+func (w *ConfigMapWatcher) Load(ctx context.Context) ([]*types.DNSRecord, error) {
+	cm, err := w.client.CoreV1().ConfigMaps(w.namespace).Get(ctx, w.name, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("get configmap: %w", err)
+	}
+	if _, ok := cm.Data[w.dataKey]; !ok {
+		return nil, nil
+	}
+	records, err := parseConfigMap(cm, w.dataKey)
+	if err != nil {
+		return nil, err
+	}
+	owned, _ := w.split(records)
+	return owned, nil
+}
+
 // parseConfigMap extracts DNS records from the given ConfigMap.
 func parseConfigMap(cm *corev1.ConfigMap, dataKey string) ([]*types.DNSRecord, error) {
 	raw, ok := cm.Data[dataKey]
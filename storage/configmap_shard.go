@@ -0,0 +1,301 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+
+	"jabberwocky238/jw238dns/types"
+
+	"go.opentelemetry.io/otel/codes"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
+// AnnotationShardZone names the zone whose records a shard ConfigMap
+// holds. A shard without it holds the records no other shard's zone
+// covers.
+const AnnotationShardZone = "jw238dns/zone"
+
+// ShardedConfigMapWatcher spreads records across the ConfigMaps matching a
+// label selector, for record sets too large for one ConfigMap key. Each
+// record belongs to the shard with the longest zone containing its name.
+//
+// Every shard is a ConfigMapWatcher limited to its own records: it
+// watches its ConfigMap independently, and store changes are persisted
+// only to the shard owning the changed record. Shards are added and
+// removed as ConfigMaps gain or lose the label; removing a shard removes
+// its records, and a new shard takes over the records in its zone.
+type ShardedConfigMapWatcher struct {
+	client    kubernetes.Interface
+	namespace string
+	selector  string
+	dataKey   string
+	store     *MemoryStorage
+	lead      *leadership
+
+	mu     sync.RWMutex
+	shards map[string]*configMapShard // by ConfigMap name
+
+	// syncMu serialises starting and stopping shards.
+	syncMu sync.Mutex
+}
+
+type configMapShard struct {
+	zone    string // Lower-case FQDN; "." for the catch-all shard
+	watcher *ConfigMapWatcher
+	cancel  context.CancelFunc
+}
+
+// NewShardedConfigMapWatcher creates a ShardedConfigMapWatcher over the
+// ConfigMaps in namespace matching selector, with records under dataKey.
+func NewShardedConfigMapWatcher(client kubernetes.Interface, namespace, selector, dataKey string, store *MemoryStorage) *ShardedConfigMapWatcher {
+	return &ShardedConfigMapWatcher{
+		client:    client,
+		namespace: namespace,
+		selector:  selector,
+		dataKey:   dataKey,
+		store:     store,
+		lead:      &leadership{},
+		shards:    make(map[string]*configMapShard),
+	}
+}
+
+// EnableLeaderElection makes the shards persist only while this replica
+// holds the lease. It must be called before WatchAndSync.
+func (s *ShardedConfigMapWatcher) EnableLeaderElection(cfg LeaderElectionConfig) {
+	s.lead.config = &cfg
+}
+
+// IsLeader reports whether this replica persists to the shards.
+func (s *ShardedConfigMapWatcher) IsLeader() bool {
+	return s.lead.isLeader()
+}
+
+// CheckLeader returns nil if this replica is the leader, or an error
+// wrapping types.ErrNotLeader that names the current leader.
+func (s *ShardedConfigMapWatcher) CheckLeader() error {
+	return s.lead.check()
+}
+
+// WatchAndSync watches the shard ConfigMaps and persists store changes to
+// the owning shards until ctx is cancelled, campaigning for leadership if
+// leader election is enabled.
+func (s *ShardedConfigMapWatcher) WatchAndSync(ctx context.Context) error {
+	ch, err := s.store.Watch(ctx)
+	if err != nil {
+		return fmt.Errorf("watch storage: %w", err)
+	}
+
+	factory := informers.NewSharedInformerFactoryWithOptions(s.client, 0,
+		informers.WithNamespace(s.namespace),
+		informers.WithTweakListOptions(func(o *metav1.ListOptions) { o.LabelSelector = s.selector }))
+	informer := factory.Core().V1().ConfigMaps().Informer()
+	resync := func(any) { s.syncShards(ctx, informer.GetStore()) }
+	if _, err := informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    resync,
+		UpdateFunc: func(_, obj any) { resync(obj) },
+		DeleteFunc: resync,
+	}); err != nil {
+		return fmt.Errorf("add shard event handler: %w", err)
+	}
+	factory.Start(ctx.Done())
+	if !cache.WaitForCacheSync(ctx.Done(), informer.HasSynced) {
+		return fmt.Errorf("sync shard configmaps: %w", context.Cause(ctx))
+	}
+	slog.Info("watching configmap shards", "namespace", s.namespace, "selector", s.selector, "shards", s.shardCount())
+
+	if s.lead.config != nil {
+		go func() {
+			err := s.lead.run(ctx, s.client, s.namespace, s.persistAll)
+			if err != nil && ctx.Err() == nil {
+				slog.Error("configmap leader election failed", "err", err)
+			}
+		}()
+	}
+
+	for ev := range ch {
+		pctx, span := tracer.Start(ctx, "ShardedConfigMapWatcher.Persist", linkEvent(ev)...)
+		if err := s.persistEvent(pctx, ev); err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			slog.Error("persist to configmap shard", "err", err)
+		}
+		span.End()
+	}
+	return ctx.Err()
+}
+
+// persistEvent persists a single-record change to the shard owning the
+// record, and any other change to every shard.
+func (s *ShardedConfigMapWatcher) persistEvent(ctx context.Context, ev types.StorageEvent) error {
+	if ev.Record == nil {
+		s.persistAll(ctx)
+		return nil
+	}
+	shard := s.shard(s.ownerOf(ev.Record.Name))
+	if shard == nil {
+		return fmt.Errorf("no configmap shard holds %s; add a shard without the %s annotation to catch it", ev.Record.Name, AnnotationShardZone)
+	}
+	return shard.watcher.PersistToConfigMap(ctx)
+}
+
+// persistAll persists every shard.
+func (s *ShardedConfigMapWatcher) persistAll(ctx context.Context) {
+	s.mu.RLock()
+	watchers := make([]*ConfigMapWatcher, 0, len(s.shards))
+	for _, shard := range s.shards {
+		watchers = append(watchers, shard.watcher)
+	}
+	s.mu.RUnlock()
+
+	for _, w := range watchers {
+		if err := w.PersistToConfigMap(ctx); err != nil {
+			slog.Error("persist to configmap shard", "configmap", w.name, "err", err)
+		}
+	}
+}
+
+// syncShards starts a shard for every ConfigMap in cms, restarts shards
+// whose zone changed, and stops shards whose ConfigMap is gone.
+func (s *ShardedConfigMapWatcher) syncShards(ctx context.Context, cms cache.Store) {
+	s.syncMu.Lock()
+	defer s.syncMu.Unlock()
+
+	zones := make(map[string]string)
+	for _, item := range cms.List() {
+		if cm, ok := item.(*corev1.ConfigMap); ok {
+			zones[cm.Name] = shardZone(cm.Annotations[AnnotationShardZone])
+		}
+	}
+
+	s.mu.RLock()
+	var removed []string
+	var changed bool
+	for name, shard := range s.shards {
+		zone, ok := zones[name]
+		if !ok {
+			removed = append(removed, name)
+		} else if zone != shard.zone {
+			changed = true
+		}
+	}
+	var added []string
+	for name := range zones {
+		if _, ok := s.shards[name]; !ok {
+			added = append(added, name)
+		}
+	}
+	s.mu.RUnlock()
+	if len(removed) == 0 && len(added) == 0 && !changed {
+		return
+	}
+
+	for _, name := range removed {
+		s.removeShard(ctx, name)
+	}
+	for name, zone := range zones {
+		if shard := s.shard(name); shard == nil || shard.zone != zone {
+			s.startShard(ctx, name, zone)
+		}
+	}
+	// Records whose owner changed are written to their new shard.
+	s.persistAll(ctx)
+}
+
+// startShard starts (or restarts) the shard for the named ConfigMap.
+func (s *ShardedConfigMapWatcher) startShard(ctx context.Context, name, zone string) {
+	w := NewConfigMapWatcher(s.client, s.namespace, name, s.dataKey, s.store)
+	w.lead = s.lead
+	w.owns = func(record string) bool { return s.ownerOf(record) == name }
+	w.adopt = true
+
+	sctx, cancel := context.WithCancel(ctx)
+	s.mu.Lock()
+	if old := s.shards[name]; old != nil {
+		old.cancel()
+	}
+	s.shards[name] = &configMapShard{zone: zone, watcher: w, cancel: cancel}
+	s.mu.Unlock()
+
+	go func() {
+		if err := w.Watch(sctx); err != nil && sctx.Err() == nil {
+			slog.Error("configmap shard watcher failed", "configmap", name, "err", err)
+		}
+	}()
+	slog.Info("started configmap shard", "configmap", name, "zone", zone)
+}
+
+// removeShard stops the named shard and removes its records from the store.
+func (s *ShardedConfigMapWatcher) removeShard(ctx context.Context, name string) {
+	shard := s.shard(name)
+	if shard == nil {
+		return
+	}
+	owned, err := shard.watcher.ownedRecords(ctx)
+	if err != nil {
+		slog.Error("list records", "err", err)
+	}
+
+	s.mu.Lock()
+	shard.cancel()
+	delete(s.shards, name)
+	s.mu.Unlock()
+
+	changes := &types.RecordChanges{}
+	for _, r := range owned {
+		changes.Deleted = append(changes.Deleted, types.RecordKey{Name: r.Name, Type: r.Type})
+	}
+	if len(changes.Deleted) > 0 {
+		if err := s.store.PartialReload(ctx, changes); err != nil {
+			slog.Error("remove configmap shard records", "configmap", name, "err", err)
+		}
+	}
+	slog.Info("removed configmap shard", "configmap", name, "zone", shard.zone, "records", len(changes.Deleted))
+}
+
+// ownerOf returns the name of the shard holding records named name: the
+// one with the longest zone containing it, ties going to the first
+// ConfigMap name. It returns "" if no shard's zone contains name.
+func (s *ShardedConfigMapWatcher) ownerOf(name string) string {
+	name = strings.ToLower(name)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var owner, ownerZone string
+	for cmName, shard := range s.shards {
+		if !inZone(name, shard.zone) {
+			continue
+		}
+		if owner == "" || len(shard.zone) > len(ownerZone) || (len(shard.zone) == len(ownerZone) && cmName < owner) {
+			owner, ownerZone = cmName, shard.zone
+		}
+	}
+	return owner
+}
+
+func (s *ShardedConfigMapWatcher) shard(name string) *configMapShard {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.shards[name]
+}
+
+func (s *ShardedConfigMapWatcher) shardCount() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.shards)
+}
+
+// shardZone normalises an AnnotationShardZone value; empty means ".".
+func shardZone(zone string) string {
+	zone = strings.ToLower(strings.TrimSpace(zone))
+	if zone == "" || zone == "." {
+		return "."
+	}
+	return strings.TrimSuffix(zone, ".") + "."
+}
@@ -0,0 +1,144 @@
+package storage
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"jabberwocky238/jw238dns/types"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func shardConfigMap(name, zone string) *corev1.ConfigMap {
+	cm := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", Labels: map[string]string{"app": "jw238dns-records"}},
+		Data:       map[string]string{"config.yaml": "records: []\n"},
+	}
+	if zone != "" {
+		cm.Annotations = map[string]string{AnnotationShardZone: zone}
+	}
+	return cm
+}
+
+// shardRecords returns the names of the records in the named ConfigMap.
+func shardRecords(t *testing.T, client *fake.Clientset, name string) []string {
+	t.Helper()
+	cm, err := client.CoreV1().ConfigMaps("default").Get(context.Background(), name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("get configmap %s: %v", name, err)
+	}
+	records, err := parseConfigMap(cm, "config.yaml")
+	if err != nil {
+		t.Fatalf("parse configmap %s: %v", name, err)
+	}
+	var names []string
+	for _, r := range records {
+		names = append(names, r.Name)
+	}
+	return names
+}
+
+func waitForShardRecords(t *testing.T, client *fake.Clientset, name string, want ...string) {
+	t.Helper()
+	var got []string
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(20 * time.Millisecond) {
+		got = shardRecords(t, client, name)
+		if len(got) == len(want) {
+			match := true
+			for i := range want {
+				match = match && got[i] == want[i]
+			}
+			if match {
+				return
+			}
+		}
+	}
+	t.Fatalf("configmap %s records = %v, want %v", name, got, want)
+}
+
+func TestShardedConfigMapWatcher(t *testing.T) {
+	client := fake.NewSimpleClientset(
+		shardConfigMap("records-example", "example.com"),
+		shardConfigMap("records-sub", "sub.example.com."),
+		shardConfigMap("records-rest", ""),
+		&corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "unrelated", Namespace: "default"}},
+	)
+	store := NewMemoryStorage()
+	s := NewShardedConfigMapWatcher(client, "default", "app=jw238dns-records", "config.yaml", store)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { _ = s.WatchAndSync(ctx) }()
+
+	for deadline := time.Now().Add(2 * time.Second); s.shardCount() != 3; time.Sleep(20 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("shards = %d, want 3", s.shardCount())
+		}
+	}
+	if got := s.ownerOf("www.sub.example.com."); got != "records-sub" {
+		t.Errorf("ownerOf(www.sub.example.com.) = %q, want the longest zone", got)
+	}
+	if got := s.ownerOf("other.org."); got != "records-rest" {
+		t.Errorf("ownerOf(other.org.) = %q, want the catch-all", got)
+	}
+	// Give the shard watchers time to register their watches.
+	time.Sleep(100 * time.Millisecond)
+
+	// Each shard loads its own ConfigMap.
+	for name, data := range map[string]string{
+		"records-example": "records:\n  - name: www.example.com.\n    type: A\n    ttl: 300\n    value: [192.0.2.1]\n",
+		"records-sub":     "records:\n  - name: api.sub.example.com.\n    type: A\n    ttl: 300\n    value: [192.0.2.2]\n",
+	} {
+		current, _ := client.CoreV1().ConfigMaps("default").Get(ctx, name, metav1.GetOptions{})
+		current.Data = map[string]string{"config.yaml": data}
+		if _, err := client.CoreV1().ConfigMaps("default").Update(ctx, current, metav1.UpdateOptions{}); err != nil {
+			t.Fatalf("update configmap %s: %v", name, err)
+		}
+	}
+	waitForRecord(t, store, "www.example.com.", types.RecordTypeA, "192.0.2.1")
+	waitForRecord(t, store, "api.sub.example.com.", types.RecordTypeA, "192.0.2.2")
+
+	// Changes are persisted only to the owning shard.
+	for _, r := range []*types.DNSRecord{
+		{Name: "new.sub.example.com.", Type: types.RecordTypeA, TTL: 60, Value: []string{"192.0.2.3"}},
+		{Name: "other.org.", Type: types.RecordTypeA, TTL: 60, Value: []string{"192.0.2.4"}},
+	} {
+		if err := store.Create(ctx, r); err != nil {
+			t.Fatalf("Create(%s) error = %v", r.Name, err)
+		}
+	}
+	waitForShardRecords(t, client, "records-sub", "api.sub.example.com.", "new.sub.example.com.")
+	waitForShardRecords(t, client, "records-rest", "other.org.")
+	waitForShardRecords(t, client, "records-example", "www.example.com.")
+
+	// Removing a shard removes its records.
+	if err := client.CoreV1().ConfigMaps("default").Delete(ctx, "records-sub", metav1.DeleteOptions{}); err != nil {
+		t.Fatalf("delete configmap: %v", err)
+	}
+	for deadline := time.Now().Add(2 * time.Second); ; time.Sleep(20 * time.Millisecond) {
+		if _, err := store.Get(ctx, "api.sub.example.com.", types.RecordTypeA); err != nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("api.sub.example.com. still served after its shard was removed")
+		}
+	}
+	if _, err := store.Get(ctx, "www.example.com.", types.RecordTypeA); err != nil {
+		t.Errorf("www.example.com. removed with another shard: %v", err)
+	}
+}
+
+func TestShardZone(t *testing.T) {
+	for in, want := range map[string]string{
+		"":             ".",
+		".":            ".",
+		"Example.COM":  "example.com.",
+		"example.com.": "example.com.",
+	} {
+		if got := shardZone(in); got != want {
+			t.Errorf("shardZone(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
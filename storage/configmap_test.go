@@ -7,9 +7,13 @@ import (
 
 	"jabberwocky238/jw238dns/types"
 
+	"gopkg.in/yaml.v3"
 	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
 )
 
 func TestParseConfigMap(t *testing.T) {
@@ -384,3 +388,151 @@ func TestConfigMapWatcher_PersistToConfigMap_NilData(t *testing.T) {
 		t.Error("expected Data to be initialized after persist")
 	}
 }
+
+// recordsConfigMap returns the test ConfigMap holding records.
+func recordsConfigMap(t *testing.T, records ...*types.DNSRecord) *corev1.ConfigMap {
+	t.Helper()
+	data, err := yaml.Marshal(&configYAML{Records: records})
+	if err != nil {
+		t.Fatalf("marshal records: %v", err)
+	}
+	return &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "jw238dns-config", Namespace: "default"},
+		Data:       map[string]string{"config.yaml": string(data)},
+	}
+}
+
+// configMapRecordNames returns the record names stored in the test
+// ConfigMap.
+func configMapRecordNames(t *testing.T, client *fake.Clientset) map[string]bool {
+	t.Helper()
+	cm, err := client.CoreV1().ConfigMaps("default").Get(context.Background(), "jw238dns-config", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("get configmap: %v", err)
+	}
+	records, err := parseConfigMap(cm, "config.yaml")
+	if err != nil {
+		t.Fatalf("parseConfigMap() error = %v", err)
+	}
+	names := make(map[string]bool)
+	for _, r := range records {
+		names[r.Name] = true
+	}
+	return names
+}
+
+func TestConfigMapWatcher_PersistMergesOnConflict(t *testing.T) {
+	ctx := context.Background()
+	fakeClient := fake.NewSimpleClientset(recordsConfigMap(t, aRecord("a.com.", "1.1.1.1")))
+	store := NewMemoryStorage()
+	w := NewConfigMapWatcher(fakeClient, "default", "jw238dns-config", "config.yaml", store)
+	w.applyRecords(ctx, []*types.DNSRecord{aRecord("a.com.", "1.1.1.1")})
+
+	// The first update loses a race with a kubectl edit adding c.com.
+	conflicts := 0
+	fakeClient.PrependReactor("update", "configmaps", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if conflicts > 0 {
+			return false, nil, nil
+		}
+		conflicts++
+		edited := recordsConfigMap(t, aRecord("a.com.", "1.1.1.1"), aRecord("c.com.", "3.3.3.3"))
+		if err := fakeClient.Tracker().Update(corev1.SchemeGroupVersion.WithResource("configmaps"), edited, "default"); err != nil {
+			t.Fatalf("concurrent edit: %v", err)
+		}
+		return true, nil, apierrors.NewConflict(corev1.Resource("configmaps"), "jw238dns-config", nil)
+	})
+
+	_ = store.Create(ctx, aRecord("b.com.", "2.2.2.2"))
+	if err := w.PersistToConfigMap(ctx); err != nil {
+		t.Fatalf("PersistToConfigMap() error = %v", err)
+	}
+
+	if conflicts != 1 {
+		t.Fatalf("conflicts = %d, want 1", conflicts)
+	}
+	names := configMapRecordNames(t, fakeClient)
+	for _, want := range []string{"a.com.", "b.com.", "c.com."} {
+		if !names[want] {
+			t.Errorf("configmap records = %v, missing %s", names, want)
+		}
+	}
+	if _, err := store.Get(ctx, "c.com.", types.RecordTypeA); err != nil {
+		t.Errorf("concurrent edit not applied to the store: %v", err)
+	}
+}
+
+func TestConfigMapWatcher_PersistSkipsUnchanged(t *testing.T) {
+	ctx := context.Background()
+	fakeClient := fake.NewSimpleClientset(recordsConfigMap(t, aRecord("a.com.", "1.1.1.1")))
+	store := NewMemoryStorage()
+	w := NewConfigMapWatcher(fakeClient, "default", "jw238dns-config", "config.yaml", store)
+	w.applyRecords(ctx, []*types.DNSRecord{aRecord("a.com.", "1.1.1.1")})
+
+	updates := 0
+	fakeClient.PrependReactor("update", "configmaps", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		updates++
+		return false, nil, nil
+	})
+	if err := w.PersistToConfigMap(ctx); err != nil {
+		t.Fatalf("PersistToConfigMap() error = %v", err)
+	}
+	if updates != 0 {
+		t.Errorf("updates = %d, want 0 when the store matches the configmap", updates)
+	}
+}
+
+func TestConfigMapWatcher_ApplyKeepsUnpersistedChanges(t *testing.T) {
+	ctx := context.Background()
+	fakeClient := fake.NewSimpleClientset(recordsConfigMap(t, aRecord("a.com.", "1.1.1.1"), aRecord("c.com.", "3.3.3.3")))
+	store := NewMemoryStorage()
+	w := NewConfigMapWatcher(fakeClient, "default", "jw238dns-config", "config.yaml", store)
+	w.applyRecords(ctx, []*types.DNSRecord{aRecord("a.com.", "1.1.1.1")})
+
+	// b.com. is created locally before it is persisted; meanwhile another
+	// replica adds c.com.
+	_ = store.Create(ctx, aRecord("b.com.", "2.2.2.2"))
+	w.applyRecords(ctx, []*types.DNSRecord{aRecord("a.com.", "1.1.1.1"), aRecord("c.com.", "3.3.3.3")})
+
+	for _, name := range []string{"a.com.", "b.com.", "c.com."} {
+		if _, err := store.Get(ctx, name, types.RecordTypeA); err != nil {
+			t.Errorf("store missing %s after apply: %v", name, err)
+		}
+	}
+	if names := configMapRecordNames(t, fakeClient); !names["b.com."] || !names["c.com."] {
+		t.Errorf("configmap records = %v, want b.com. persisted alongside c.com.", names)
+	}
+}
+
+func TestConfigMapWatcher_Load(t *testing.T) {
+	fakeClient := fake.NewSimpleClientset()
+	store := NewMemoryStorage()
+	w := NewConfigMapWatcher(fakeClient, "default", "jw238dns-config", "config.yaml", store)
+	ctx := context.Background()
+
+	if _, err := w.Load(ctx); err == nil {
+		t.Error("Load() of a missing ConfigMap succeeded")
+	}
+	cm := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "jw238dns-config", Namespace: "default"},
+		Data: map[string]string{"config.yaml": `records:
+  - name: load.com.
+    type: A
+    ttl: 300
+    value: ["1.2.3.4"]
+`},
+	}
+	if _, err := fakeClient.CoreV1().ConfigMaps("default").Create(ctx, cm, metav1.CreateOptions{}); err != nil {
+		t.Fatalf("create configmap: %v", err)
+	}
+
+	records, err := w.Load(ctx)
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if len(records) != 1 || records[0].Name != "load.com." {
+		t.Errorf("Load() = %v, want load.com.", records)
+	}
+	if recs, _ := store.List(ctx); len(recs) != 0 {
+		t.Errorf("Load() applied %d records to the store", len(recs))
+	}
+}
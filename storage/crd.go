@@ -0,0 +1,601 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+
+	"jabberwocky238/jw238dns/metrics"
+	"jabberwocky238/jw238dns/types"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/retry"
+)
+
+// DNSRecordGVR identifies the DNSRecord custom resource. The definition is
+// in assets/crd-dnsrecord.yaml.
+var DNSRecordGVR = schema.GroupVersionResource{Group: "dns.jw238dns.io", Version: "v1alpha1", Resource: "dnsrecords"}
+
+// DNSRecord status condition type and reasons.
+const (
+	ConditionServed = "Served"
+
+	ReasonServed           = "Served"
+	ReasonInvalidValue     = "InvalidValue"
+	ReasonDuplicate        = "Duplicate"
+	ReasonConflictingCNAME = "ConflictingCNAME"
+)
+
+// crdRecordIndex indexes DNSRecord objects by the name/type they define.
+const crdRecordIndex = "record"
+
+// dnsRecordObject is a DNSRecord object. The spec is a record as in the
+// other storage formats.
+type dnsRecordObject struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata"`
+	Spec              types.DNSRecord `json:"spec"`
+	Status            dnsRecordStatus `json:"status"`
+}
+
+type dnsRecordStatus struct {
+	ObservedGeneration int64              `json:"observedGeneration,omitempty"`
+	Conditions         []metav1.Condition `json:"conditions,omitempty"`
+}
+
+// CRDStorage serves records defined by DNSRecord objects. An informer
+// feeds the objects into a MemoryStorage, and every object gets a Served
+// condition saying whether its record is served and why not.
+//
+// CRDStorage is also a CoreStorage for the HTTP API and dynamic updates:
+// reads come from the MemoryStorage, and writes create, update or delete
+// DNSRecord objects, which reach the MemoryStorage through the informer.
+type CRDStorage struct {
+	client         dynamic.Interface
+	namespace      string // Watched namespace; empty watches all
+	writeNamespace string // Namespace of objects created through the API
+	store          *MemoryStorage
+
+	informer cache.SharedIndexInformer
+	dirty    chan struct{}
+
+	txMu sync.Mutex // serialises transactions
+}
+
+// NewCRDStorage creates a CRDStorage watching DNSRecord objects in
+// namespace, or in all namespaces if it is empty. Records created through
+// the API become objects in writeNamespace, which defaults to namespace.
+func NewCRDStorage(client dynamic.Interface, namespace, writeNamespace string, store *MemoryStorage) *CRDStorage {
+	if writeNamespace == "" {
+		writeNamespace = namespace
+	}
+	if writeNamespace == "" {
+		writeNamespace = metav1.NamespaceDefault
+	}
+	factory := dynamicinformer.NewFilteredDynamicSharedInformerFactory(client, 0, namespace, nil)
+	return &CRDStorage{
+		client:         client,
+		namespace:      namespace,
+		writeNamespace: writeNamespace,
+		store:          store,
+		informer:       factory.ForResource(DNSRecordGVR).Informer(),
+		dirty:          make(chan struct{}, 1),
+	}
+}
+
+// Start starts the informer, waits for the initial list and applies it to
+// the store, then keeps the store and object status in sync until ctx is
+// cancelled.
+func (s *CRDStorage) Start(ctx context.Context) error {
+	if err := s.informer.AddIndexers(cache.Indexers{crdRecordIndex: indexByRecord}); err != nil {
+		return fmt.Errorf("add dnsrecord index: %w", err)
+	}
+	trigger := func(any) { s.trigger() }
+	if _, err := s.informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    trigger,
+		UpdateFunc: func(_, obj any) { s.trigger() },
+		DeleteFunc: trigger,
+	}); err != nil {
+		return fmt.Errorf("add dnsrecord event handler: %w", err)
+	}
+
+	go s.informer.Run(ctx.Done())
+	if !cache.WaitForCacheSync(ctx.Done(), s.informer.HasSynced) {
+		return fmt.Errorf("sync dnsrecord informer: %w", context.Cause(ctx))
+	}
+	s.reconcile(ctx)
+
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-s.dirty:
+				s.reconcile(ctx)
+			}
+		}
+	}()
+	return nil
+}
+
+// trigger schedules a reconcile; bursts of events are coalesced.
+func (s *CRDStorage) trigger() {
+	select {
+	case s.dirty <- struct{}{}:
+	default:
+	}
+}
+
+// reconcile decides which objects are served, applies their records to the
+// store and writes each object's Served condition.
+func (s *CRDStorage) reconcile(ctx context.Context) {
+	ctx, span := tracer.Start(ctx, "CRDStorage.reconcile")
+	defer span.End()
+
+	objs := s.objects()
+	records, conditions := resolveDNSRecords(objs)
+
+	changes := s.store.CalculateChanges(records)
+	if len(changes.Added) != 0 || len(changes.Updated) != 0 || len(changes.Deleted) != 0 {
+		err := s.store.PartialReload(ctx, changes)
+		metrics.ObserveReload("crd", err)
+		if err != nil {
+			slog.Error("partial reload from dnsrecords", "err", err)
+			return
+		}
+		slog.Info("applied dnsrecords", "records", len(records),
+			"added", len(changes.Added), "updated", len(changes.Updated), "deleted", len(changes.Deleted))
+	}
+
+	for i, obj := range objs {
+		if err := s.updateStatus(ctx, obj, conditions[i]); err != nil {
+			// A conflict means the object changed; its update event
+			// triggers another reconcile.
+			if !apierrors.IsConflict(err) && !apierrors.IsNotFound(err) {
+				slog.Warn("update dnsrecord status", "namespace", obj.Namespace, "name", obj.Name, "err", err)
+			}
+		}
+	}
+}
+
+// objects returns the objects in the informer cache, oldest first.
+func (s *CRDStorage) objects() []*dnsRecordObject {
+	var objs []*dnsRecordObject
+	for _, item := range s.informer.GetStore().List() {
+		obj, err := toDNSRecordObject(item)
+		if err != nil {
+			slog.Warn("decode dnsrecord", "err", err)
+			continue
+		}
+		objs = append(objs, obj)
+	}
+	slices.SortFunc(objs, func(a, b *dnsRecordObject) int {
+		if c := a.CreationTimestamp.Compare(b.CreationTimestamp.Time); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Namespace+"/"+a.Name, b.Namespace+"/"+b.Name)
+	})
+	return objs
+}
+
+// resolveDNSRecords returns the records to serve for objs, ordered oldest
+// first, and the Served condition of each object. Invalid objects are not
+// served. Where several objects define the same name and type, or a CNAME
+// shares its name with other records, the oldest object wins.
+func resolveDNSRecords(objs []*dnsRecordObject) ([]*types.DNSRecord, []metav1.Condition) {
+	var records []*types.DNSRecord
+	conditions := make([]metav1.Condition, len(objs))
+	owners := make(map[types.RecordKey]*dnsRecordObject)
+	typesByName := make(map[string]map[types.RecordType]*dnsRecordObject)
+
+	for i, obj := range objs {
+		condition := func(status metav1.ConditionStatus, reason, message string) {
+			conditions[i] = metav1.Condition{
+				Type:               ConditionServed,
+				Status:             status,
+				Reason:             reason,
+				Message:            message,
+				ObservedGeneration: obj.Generation,
+			}
+		}
+
+		rec := normalizeCRDRecord(obj.Spec)
+		if err := validateCRDRecord(rec); err != nil {
+			condition(metav1.ConditionFalse, ReasonInvalidValue, err.Error())
+			continue
+		}
+		key := types.RecordKey{Name: rec.Name, Type: rec.Type}
+		if owner, ok := owners[key]; ok {
+			condition(metav1.ConditionFalse, ReasonDuplicate,
+				fmt.Sprintf("%s %s is already defined by %s/%s", rec.Name, rec.Type, owner.Namespace, owner.Name))
+			continue
+		}
+		if conflict := cnameConflict(typesByName[rec.Name], rec.Type); conflict != nil {
+			condition(metav1.ConditionFalse, ReasonConflictingCNAME,
+				fmt.Sprintf("a CNAME cannot coexist with other records at %s; conflicts with %s/%s", rec.Name, conflict.Namespace, conflict.Name))
+			continue
+		}
+
+		owners[key] = obj
+		if typesByName[rec.Name] == nil {
+			typesByName[rec.Name] = make(map[types.RecordType]*dnsRecordObject)
+		}
+		typesByName[rec.Name][rec.Type] = obj
+		records = append(records, rec)
+		condition(metav1.ConditionTrue, ReasonServed, fmt.Sprintf("serving %s %s", rec.Name, rec.Type))
+	}
+	return records, conditions
+}
+
+// cnameConflict returns the object that stops a record of type rt from
+// being served at a name already holding claimed.
+func cnameConflict(claimed map[types.RecordType]*dnsRecordObject, rt types.RecordType) *dnsRecordObject {
+	for t, obj := range claimed {
+		if t == types.RecordTypeCNAME || rt == types.RecordTypeCNAME {
+			return obj
+		}
+	}
+	return nil
+}
+
+// normalizeCRDRecord fully qualifies the record name and applies the
+// default TTL, as the HTTP API does.
+func normalizeCRDRecord(spec types.DNSRecord) *types.DNSRecord {
+	rec := spec
+	rec.Name = strings.ToLower(rec.Name)
+	if rec.Name != "" && !strings.HasSuffix(rec.Name, ".") {
+		rec.Name += "."
+	}
+	rec.Type = types.RecordType(strings.ToUpper(string(rec.Type)))
+	if rec.TTL == 0 {
+		rec.TTL = 300
+	}
+	rec.Value = slices.Clone(rec.Value)
+	rec.Meta = rec.Meta.Clone()
+	return &rec
+}
+
+// validateCRDRecord rejects records that cannot be served.
+func validateCRDRecord(rec *types.DNSRecord) error {
+	if rec.Name == "" {
+		return types.ErrInvalidName
+	}
+	if !rec.Type.IsValid() {
+		return fmt.Errorf("%w %q", types.ErrInvalidRecordType, rec.Type)
+	}
+	if len(rec.Value) == 0 {
+		return errors.New("no values")
+	}
+	for _, v := range rec.Value {
+		switch rec.Type {
+		case types.RecordTypeA:
+			if addr, err := netip.ParseAddr(v); err != nil || !addr.Is4() {
+				return fmt.Errorf("%q is not an IPv4 address", v)
+			}
+		case types.RecordTypeAAAA:
+			if addr, err := netip.ParseAddr(v); err != nil || !addr.Is6() || addr.Is4In6() {
+				return fmt.Errorf("%q is not an IPv6 address", v)
+			}
+		default:
+			if strings.TrimSpace(v) == "" {
+				return errors.New("empty value")
+			}
+		}
+	}
+	if rec.Type == types.RecordTypeCNAME && len(rec.Value) != 1 {
+		return fmt.Errorf("a CNAME has exactly one target, got %d", len(rec.Value))
+	}
+	return nil
+}
+
+// updateStatus writes condition to obj unless it already has it.
+func (s *CRDStorage) updateStatus(ctx context.Context, obj *dnsRecordObject, condition metav1.Condition) error {
+	current := apimeta.FindStatusCondition(obj.Status.Conditions, ConditionServed)
+	if current != nil && current.Status == condition.Status && current.Reason == condition.Reason &&
+		current.Message == condition.Message && current.ObservedGeneration == condition.ObservedGeneration &&
+		obj.Status.ObservedGeneration == obj.Generation {
+		return nil
+	}
+
+	status := obj.Status
+	status.Conditions = slices.Clone(status.Conditions)
+	status.ObservedGeneration = obj.Generation
+	apimeta.SetStatusCondition(&status.Conditions, condition)
+
+	u, err := obj.withStatus(status).unstructured()
+	if err != nil {
+		return err
+	}
+	_, err = s.client.Resource(DNSRecordGVR).Namespace(obj.Namespace).UpdateStatus(ctx, u, metav1.UpdateOptions{})
+	return err
+}
+
+// withStatus returns a copy of obj with status replaced.
+func (obj *dnsRecordObject) withStatus(status dnsRecordStatus) *dnsRecordObject {
+	out := &dnsRecordObject{TypeMeta: obj.TypeMeta, Spec: obj.Spec, Status: status}
+	obj.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	out.Spec.Value = slices.Clone(obj.Spec.Value)
+	return out
+}
+
+// unstructured encodes obj for the dynamic client. It goes through JSON
+// so that numbers become int64, as in objects read from the API server.
+func (obj *dnsRecordObject) unstructured() (*unstructured.Unstructured, error) {
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return nil, fmt.Errorf("encode dnsrecord: %w", err)
+	}
+	u := &unstructured.Unstructured{}
+	if err := u.UnmarshalJSON(data); err != nil {
+		return nil, fmt.Errorf("encode dnsrecord: %w", err)
+	}
+	return u, nil
+}
+
+// setNestedMeta sets spec.meta of an object to meta, or removes it if meta
+// is nil.
+func setNestedMeta(obj map[string]any, meta *types.RecordMeta) error {
+	if meta == nil {
+		unstructured.RemoveNestedField(obj, "spec", "meta")
+		return nil
+	}
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return fmt.Errorf("encode metadata: %w", err)
+	}
+	var m map[string]any
+	if err := json.Unmarshal(data, &m); err != nil {
+		return fmt.Errorf("encode metadata: %w", err)
+	}
+	return unstructured.SetNestedMap(obj, m, "spec", "meta")
+}
+
+// toDNSRecordObject decodes an object from the informer cache.
+func toDNSRecordObject(item any) (*dnsRecordObject, error) {
+	u, ok := item.(*unstructured.Unstructured)
+	if !ok {
+		return nil, fmt.Errorf("unexpected object %T", item)
+	}
+	var obj dnsRecordObject
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(u.Object, &obj); err != nil {
+		return nil, fmt.Errorf("%s/%s: %w", u.GetNamespace(), u.GetName(), err)
+	}
+	return &obj, nil
+}
+
+// indexByRecord indexes an object by the normalised name/type it defines.
+func indexByRecord(item any) ([]string, error) {
+	obj, err := toDNSRecordObject(item)
+	if err != nil {
+		return nil, nil
+	}
+	rec := normalizeCRDRecord(obj.Spec)
+	return []string{crdIndexKey(rec.Name, rec.Type)}, nil
+}
+
+func crdIndexKey(name string, rt types.RecordType) string {
+	return name + "/" + string(rt)
+}
+
+// objectsFor returns the cached objects defining name and type.
+func (s *CRDStorage) objectsFor(name string, rt types.RecordType) ([]*dnsRecordObject, error) {
+	rec := normalizeCRDRecord(types.DNSRecord{Name: name, Type: rt})
+	items, err := s.informer.GetIndexer().ByIndex(crdRecordIndex, crdIndexKey(rec.Name, rec.Type))
+	if err != nil {
+		return nil, fmt.Errorf("look up dnsrecords: %w", err)
+	}
+	var objs []*dnsRecordObject
+	for _, item := range items {
+		if obj, err := toDNSRecordObject(item); err == nil {
+			objs = append(objs, obj)
+		}
+	}
+	return objs, nil
+}
+
+// objectName derives a DNSRecord object name from a record, e.g.
+// "www.example.com-a" for www.example.com. A.
+func objectName(rec *types.DNSRecord) string {
+	name := strings.TrimSuffix(strings.ToLower(rec.Name), ".")
+	name = strings.NewReplacer("*", "wildcard", "_", "-").Replace(name)
+	name = strings.Trim(name, "-.") + "-" + strings.ToLower(string(rec.Type))
+	if errs := validation.IsDNS1123Subdomain(name); len(errs) > 0 {
+		return ""
+	}
+	return name
+}
+
+// Get implements CoreStorage by reading the served records.
+func (s *CRDStorage) Get(ctx context.Context, name string, recordType types.RecordType) ([]*types.DNSRecord, error) {
+	return s.store.Get(ctx, name, recordType)
+}
+
+// List implements CoreStorage by reading the served records.
+func (s *CRDStorage) List(ctx context.Context) ([]*types.DNSRecord, error) {
+	return s.store.List(ctx)
+}
+
+// ListPersistent returns the served records except those synthesized by a
+// source.
+func (s *CRDStorage) ListPersistent(ctx context.Context) ([]*types.DNSRecord, error) {
+	return s.store.ListPersistent(ctx)
+}
+
+// Watch implements CoreStorage by watching the served records.
+func (s *CRDStorage) Watch(ctx context.Context) (<-chan types.StorageEvent, error) {
+	return s.store.Watch(ctx)
+}
+
+// Create implements CoreStorage by creating a DNSRecord object in the
+// write namespace.
+func (s *CRDStorage) Create(ctx context.Context, record *types.DNSRecord) error {
+	rec := normalizeCRDRecord(*record)
+	objs, err := s.objectsFor(rec.Name, rec.Type)
+	if err != nil {
+		return err
+	}
+	if len(objs) > 0 {
+		return types.ErrRecordExists
+	}
+
+	obj := &dnsRecordObject{
+		TypeMeta: metav1.TypeMeta{APIVersion: DNSRecordGVR.GroupVersion().String(), Kind: "DNSRecord"},
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: s.writeNamespace,
+			Labels:    map[string]string{"app.kubernetes.io/managed-by": "jw238dns"},
+		},
+		Spec: *rec,
+	}
+	if obj.Name = objectName(rec); obj.Name == "" {
+		obj.GenerateName = "record-"
+	}
+	u, err := obj.unstructured()
+	if err != nil {
+		return err
+	}
+	_, err = s.client.Resource(DNSRecordGVR).Namespace(s.writeNamespace).Create(ctx, u, metav1.CreateOptions{})
+	if apierrors.IsAlreadyExists(err) {
+		return types.ErrRecordExists
+	}
+	if err != nil {
+		return fmt.Errorf("create dnsrecord: %w", err)
+	}
+	return nil
+}
+
+// Update implements CoreStorage by updating the spec of the DNSRecord
+// objects defining the record.
+func (s *CRDStorage) Update(ctx context.Context, record *types.DNSRecord) error {
+	rec := normalizeCRDRecord(*record)
+	objs, err := s.objectsFor(rec.Name, rec.Type)
+	if err != nil {
+		return err
+	}
+	if len(objs) == 0 {
+		return types.ErrRecordNotFound
+	}
+	for _, obj := range objs {
+		resource := s.client.Resource(DNSRecordGVR).Namespace(obj.Namespace)
+		err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+			u, err := resource.Get(ctx, obj.Name, metav1.GetOptions{})
+			if err != nil {
+				return err
+			}
+			if err := unstructured.SetNestedField(u.Object, int64(rec.TTL), "spec", "ttl"); err != nil {
+				return err
+			}
+			if err := unstructured.SetNestedStringSlice(u.Object, rec.Value, "spec", "value"); err != nil {
+				return err
+			}
+			if err := setNestedMeta(u.Object, rec.Meta); err != nil {
+				return err
+			}
+			_, err = resource.Update(ctx, u, metav1.UpdateOptions{})
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("update dnsrecord %s/%s: %w", obj.Namespace, obj.Name, err)
+		}
+	}
+	return nil
+}
+
+// Delete implements CoreStorage by deleting the DNSRecord objects defining
+// the record.
+func (s *CRDStorage) Delete(ctx context.Context, name string, recordType types.RecordType) error {
+	objs, err := s.objectsFor(name, recordType)
+	if err != nil {
+		return err
+	}
+	if len(objs) == 0 {
+		return types.ErrRecordNotFound
+	}
+	for _, obj := range objs {
+		err := s.client.Resource(DNSRecordGVR).Namespace(obj.Namespace).Delete(ctx, obj.Name, metav1.DeleteOptions{})
+		if err != nil && !apierrors.IsNotFound(err) {
+			return fmt.Errorf("delete dnsrecord %s/%s: %w", obj.Namespace, obj.Name, err)
+		}
+	}
+	return nil
+}
+
+// HotReload implements CoreStorage by creating, updating and deleting
+// objects until the served records match records.
+func (s *CRDStorage) HotReload(ctx context.Context, records []*types.DNSRecord) error {
+	current, err := s.store.ListPersistent(ctx)
+	if err != nil {
+		return fmt.Errorf("list records: %w", err)
+	}
+	return s.PartialReload(ctx, DiffRecords(current, records))
+}
+
+// PartialReload implements CoreStorage. Each change is a separate API
+// call, so a failure leaves the earlier changes applied.
+func (s *CRDStorage) PartialReload(ctx context.Context, changes *types.RecordChanges) error {
+	for _, key := range changes.Deleted {
+		if err := s.Delete(ctx, key.Name, key.Type); err != nil && !errors.Is(err, types.ErrRecordNotFound) {
+			return err
+		}
+	}
+	for _, rec := range changes.Added {
+		err := s.Create(ctx, rec)
+		if errors.Is(err, types.ErrRecordExists) {
+			err = s.Update(ctx, rec)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	for _, rec := range changes.Updated {
+		if err := s.Update(ctx, rec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Transaction implements CoreStorage. Kubernetes has no transactions
+// spanning several objects, so fn reads the served records and the
+// changes are applied with PartialReload: a failure part way leaves the
+// earlier changes applied. Transactions are serialised within this
+// process only.
+func (s *CRDStorage) Transaction(ctx context.Context, fn func(tx *Tx) error) error {
+	s.txMu.Lock()
+	defer s.txMu.Unlock()
+
+	tx := newTx(func(key types.RecordKey) (*types.DNSRecord, error) {
+		records, err := s.store.Get(ctx, key.Name, key.Type)
+		if err != nil && !errors.Is(err, types.ErrRecordNotFound) {
+			return nil, err
+		}
+		for _, r := range records {
+			if r.Name == key.Name { // Not a wildcard match
+				return r, nil
+			}
+		}
+		return nil, nil
+	})
+	if err := fn(tx); err != nil {
+		return err
+	}
+	changes := tx.Changes()
+	if emptyChanges(changes) {
+		return nil
+	}
+	return s.PartialReload(ctx, changes)
+}
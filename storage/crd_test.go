@@ -0,0 +1,178 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"jabberwocky238/jw238dns/types"
+
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+)
+
+func dnsRecordObj(name string, age time.Duration, spec types.DNSRecord) *dnsRecordObject {
+	return &dnsRecordObject{
+		TypeMeta: metav1.TypeMeta{APIVersion: DNSRecordGVR.GroupVersion().String(), Kind: "DNSRecord"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:              name,
+			Namespace:         "dns",
+			Generation:        1,
+			CreationTimestamp: metav1.NewTime(time.Now().Add(-age).Truncate(time.Second)),
+		},
+		Spec: spec,
+	}
+}
+
+func newTestCRD(t *testing.T, objs ...*dnsRecordObject) (*CRDStorage, *dynamicfake.FakeDynamicClient) {
+	t.Helper()
+	var items []runtime.Object
+	for _, obj := range objs {
+		u, err := obj.unstructured()
+		if err != nil {
+			t.Fatalf("unstructured() error = %v", err)
+		}
+		items = append(items, u)
+	}
+	client := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{DNSRecordGVR: "DNSRecordList"}, items...)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	s := NewCRDStorage(client, "dns", "", NewMemoryStorage())
+	if err := s.Start(ctx); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	return s, client
+}
+
+// servedCondition waits for the Served condition of the named object to
+// have reason.
+func servedCondition(t *testing.T, client *dynamicfake.FakeDynamicClient, name, reason string) *metav1.Condition {
+	t.Helper()
+	var obj *dnsRecordObject
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(20 * time.Millisecond) {
+		u, err := client.Resource(DNSRecordGVR).Namespace("dns").Get(context.Background(), name, metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("get dnsrecord %s: %v", name, err)
+		}
+		if obj, err = toDNSRecordObject(u); err != nil {
+			t.Fatalf("decode dnsrecord %s: %v", name, err)
+		}
+		if c := apimeta.FindStatusCondition(obj.Status.Conditions, ConditionServed); c != nil && c.Reason == reason {
+			return c
+		}
+	}
+	t.Fatalf("dnsrecord %s status = %+v, want reason %s", name, obj.Status, reason)
+	return nil
+}
+
+func TestResolveDNSRecords(t *testing.T) {
+	objs := []*dnsRecordObject{
+		dnsRecordObj("www-a", 3*time.Hour, types.DNSRecord{Name: "WWW.example.com", Type: "a", Value: []string{"192.0.2.1"}}),
+		dnsRecordObj("www-a-dup", 2*time.Hour, types.DNSRecord{Name: "www.example.com.", Type: "A", Value: []string{"192.0.2.2"}}),
+		dnsRecordObj("www-cname", time.Hour, types.DNSRecord{Name: "www.example.com.", Type: "CNAME", Value: []string{"other.example.com."}}),
+		dnsRecordObj("bad-a", time.Hour, types.DNSRecord{Name: "bad.example.com.", Type: "A", Value: []string{"2001:db8::1"}}),
+		dnsRecordObj("bad-type", time.Hour, types.DNSRecord{Name: "bad.example.com.", Type: "BOGUS", Value: []string{"x"}}),
+	}
+
+	records, conditions := resolveDNSRecords(objs)
+	if len(records) != 1 || records[0].Name != "www.example.com." || records[0].TTL != 300 {
+		t.Fatalf("records = %v, want only normalised www.example.com. A", records)
+	}
+	want := []string{ReasonServed, ReasonDuplicate, ReasonConflictingCNAME, ReasonInvalidValue, ReasonInvalidValue}
+	for i, c := range conditions {
+		if c.Reason != want[i] {
+			t.Errorf("%s reason = %s (%s), want %s", objs[i].Name, c.Reason, c.Message, want[i])
+		}
+		if served := c.Status == metav1.ConditionTrue; served != (i == 0) {
+			t.Errorf("%s status = %s", objs[i].Name, c.Status)
+		}
+	}
+}
+
+func TestObjectName(t *testing.T) {
+	tests := []struct {
+		rec  types.DNSRecord
+		want string
+	}{
+		{types.DNSRecord{Name: "www.example.com.", Type: types.RecordTypeA}, "www.example.com-a"},
+		{types.DNSRecord{Name: "*.Example.com.", Type: types.RecordTypeTXT}, "wildcard.example.com-txt"},
+		{types.DNSRecord{Name: "_acme-challenge.example.com.", Type: types.RecordTypeTXT}, "acme-challenge.example.com-txt"},
+		{types.DNSRecord{Name: "a b.example.com.", Type: types.RecordTypeA}, ""},
+	}
+	for _, tt := range tests {
+		if got := objectName(&tt.rec); got != tt.want {
+			t.Errorf("objectName(%s %s) = %q, want %q", tt.rec.Name, tt.rec.Type, got, tt.want)
+		}
+	}
+}
+
+func TestCRDStorage_StartServesAndReportsStatus(t *testing.T) {
+	s, client := newTestCRD(t,
+		dnsRecordObj("web", 2*time.Hour, types.DNSRecord{Name: "web.example.com.", Type: "A", TTL: 60, Value: []string{"192.0.2.1"}}),
+		dnsRecordObj("web-alias", time.Hour, types.DNSRecord{Name: "web.example.com.", Type: "CNAME", Value: []string{"cdn.example.net."}}),
+	)
+
+	recs, err := s.Get(context.Background(), "web.example.com.", types.RecordTypeA)
+	if err != nil || len(recs) != 1 || recs[0].TTL != 60 {
+		t.Fatalf("Get() = %v, %v, want web.example.com. A with TTL 60", recs, err)
+	}
+	if c := servedCondition(t, client, "web", ReasonServed); c.Status != metav1.ConditionTrue || c.ObservedGeneration != 1 {
+		t.Errorf("web condition = %+v, want True for generation 1", c)
+	}
+	servedCondition(t, client, "web-alias", ReasonConflictingCNAME)
+}
+
+func TestCRDStorage_CRUDThroughObjects(t *testing.T) {
+	s, client := newTestCRD(t)
+	ctx := context.Background()
+
+	if err := s.Create(ctx, aRecord("api.example.com", "192.0.2.10")); err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+	servedCondition(t, client, "api.example.com-a", ReasonServed)
+	if recs, err := s.Get(ctx, "api.example.com.", types.RecordTypeA); err != nil || len(recs) != 1 {
+		t.Fatalf("Get() after Create() = %v, %v", recs, err)
+	}
+	if err := s.Create(ctx, aRecord("api.example.com.", "192.0.2.11")); !errors.Is(err, types.ErrRecordExists) {
+		t.Errorf("Create() duplicate error = %v, want ErrRecordExists", err)
+	}
+
+	updated := aRecord("api.example.com.", "192.0.2.20")
+	updated.Meta = &types.RecordMeta{Owner: "ops", UpdatedAt: time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)}
+	if err := s.Update(ctx, updated); err != nil {
+		t.Fatalf("Update() error = %v", err)
+	}
+	for deadline := time.Now().Add(2 * time.Second); ; time.Sleep(20 * time.Millisecond) {
+		recs, _ := s.Get(ctx, "api.example.com.", types.RecordTypeA)
+		if len(recs) == 1 && recs[0].Meta.Equal(updated.Meta) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Get() after Update() = %v, want the updated metadata", recs)
+		}
+	}
+	u, err := client.Resource(DNSRecordGVR).Namespace("dns").Get(ctx, "api.example.com-a", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("get dnsrecord: %v", err)
+	}
+	if values, _, _ := unstructured.NestedStringSlice(u.Object, "spec", "value"); len(values) != 1 || values[0] != "192.0.2.20" {
+		t.Errorf("spec.value after Update() = %v, want [192.0.2.20]", values)
+	}
+	if err := s.Update(ctx, aRecord("missing.example.com.", "192.0.2.1")); !errors.Is(err, types.ErrRecordNotFound) {
+		t.Errorf("Update() missing error = %v, want ErrRecordNotFound", err)
+	}
+
+	if err := s.Delete(ctx, "api.example.com.", types.RecordTypeA); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+	if _, err := client.Resource(DNSRecordGVR).Namespace("dns").Get(ctx, "api.example.com-a", metav1.GetOptions{}); err == nil {
+		t.Error("dnsrecord still exists after Delete()")
+	}
+}
@@ -0,0 +1,344 @@
+package storage
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"jabberwocky238/jw238dns/metrics"
+	"jabberwocky238/jw238dns/types"
+
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
+// Annotations read by KubernetesDiscovery.
+const (
+	// AnnotationHostname lists the names, separated by commas, to publish
+	// for a Service, Ingress or Gateway. On an Ingress or Gateway an empty
+	// value publishes the hosts of its rules or listeners.
+	AnnotationHostname = "jw238dns/hostname"
+	// AnnotationTTL overrides the TTL of the published records.
+	AnnotationTTL = "jw238dns/ttl"
+)
+
+// discoverySource names the records KubernetesDiscovery synthesizes.
+const discoverySource = "kubernetes"
+
+// GatewayGVR identifies Gateway API gateways.
+var GatewayGVR = schema.GroupVersionResource{Group: "gateway.networking.k8s.io", Version: "v1", Resource: "gateways"}
+
+// KubernetesDiscovery publishes records for annotated Services, Ingresses
+// and Gateways. LoadBalancer Services, Ingresses and Gateways get A and
+// AAAA records for their load balancer IPs, or a CNAME to their load
+// balancer hostname; ExternalName Services get a CNAME to the external
+// name.
+//
+// The records are applied with MemoryStorage.ApplySource, so they are
+// served but never persisted, and records from the storage backend win
+// when both define the same name and type.
+type KubernetesDiscovery struct {
+	store *MemoryStorage
+	ttl   uint32
+
+	factory  informers.SharedInformerFactory
+	services cache.SharedIndexInformer
+	ingress  cache.SharedIndexInformer
+	gateways cache.SharedIndexInformer // nil: Gateway discovery disabled
+	dirty    chan struct{}
+}
+
+// NewKubernetesDiscovery creates a KubernetesDiscovery watching namespace,
+// or all namespaces if it is empty. Gateways are watched through dyn
+// unless it is nil. ttl is the default TTL of published records.
+func NewKubernetesDiscovery(client kubernetes.Interface, dyn dynamic.Interface, namespace string, ttl uint32, store *MemoryStorage) *KubernetesDiscovery {
+	if ttl == 0 {
+		ttl = 300
+	}
+	// The periodic resync re-publishes records whose name was held by
+	// another record when they were last applied.
+	const resync = 10 * time.Minute
+	factory := informers.NewSharedInformerFactoryWithOptions(client, resync, informers.WithNamespace(namespace))
+	d := &KubernetesDiscovery{
+		store:    store,
+		ttl:      ttl,
+		factory:  factory,
+		services: factory.Core().V1().Services().Informer(),
+		ingress:  factory.Networking().V1().Ingresses().Informer(),
+		dirty:    make(chan struct{}, 1),
+	}
+	if dyn != nil {
+		dynFactory := dynamicinformer.NewFilteredDynamicSharedInformerFactory(dyn, resync, namespace, nil)
+		d.gateways = dynFactory.ForResource(GatewayGVR).Informer()
+	}
+	return d
+}
+
+// Start starts the informers, waits for the initial lists and publishes
+// their records, then keeps the records in sync until ctx is cancelled.
+func (d *KubernetesDiscovery) Start(ctx context.Context) error {
+	handler := cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(any) { d.trigger() },
+		UpdateFunc: func(_, _ any) { d.trigger() },
+		DeleteFunc: func(any) { d.trigger() },
+	}
+	synced := []cache.InformerSynced{}
+	for _, informer := range []cache.SharedIndexInformer{d.services, d.ingress, d.gateways} {
+		if informer == nil {
+			continue
+		}
+		if _, err := informer.AddEventHandler(handler); err != nil {
+			return fmt.Errorf("add discovery event handler: %w", err)
+		}
+		synced = append(synced, informer.HasSynced)
+	}
+
+	d.factory.Start(ctx.Done())
+	if d.gateways != nil {
+		go d.gateways.Run(ctx.Done())
+	}
+	if !cache.WaitForCacheSync(ctx.Done(), synced...) {
+		return fmt.Errorf("sync discovery informers: %w", context.Cause(ctx))
+	}
+	d.reconcile(ctx)
+
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-d.dirty:
+				d.reconcile(ctx)
+			}
+		}
+	}()
+	return nil
+}
+
+// trigger schedules a reconcile; bursts of events are coalesced.
+func (d *KubernetesDiscovery) trigger() {
+	select {
+	case d.dirty <- struct{}{}:
+	default:
+	}
+}
+
+// reconcile publishes the records for the objects in the informer caches.
+func (d *KubernetesDiscovery) reconcile(ctx context.Context) {
+	ctx, span := tracer.Start(ctx, "KubernetesDiscovery.reconcile")
+	defer span.End()
+
+	targets := make(discoveryTargets)
+	for _, item := range d.services.GetStore().List() {
+		if svc, ok := item.(*corev1.Service); ok {
+			d.addService(targets, svc)
+		}
+	}
+	for _, item := range d.ingress.GetStore().List() {
+		if ing, ok := item.(*networkingv1.Ingress); ok {
+			d.addIngress(targets, ing)
+		}
+	}
+	if d.gateways != nil {
+		for _, item := range d.gateways.GetStore().List() {
+			if gw, ok := item.(*unstructured.Unstructured); ok {
+				d.addGateway(targets, gw)
+			}
+		}
+	}
+
+	records := targets.records()
+	conflicts := d.store.ApplySource(ctx, discoverySource, records)
+	metrics.ObserveReload(discoverySource, nil)
+	for _, key := range conflicts {
+		slog.Warn("discovered record shadowed by an existing record", "name", key.Name, "type", key.Type)
+	}
+}
+
+// addService adds the targets of an annotated LoadBalancer or ExternalName
+// Service.
+func (d *KubernetesDiscovery) addService(targets discoveryTargets, svc *corev1.Service) {
+	names, ok := svc.Annotations[AnnotationHostname]
+	if !ok {
+		return
+	}
+	var addrs []string
+	switch svc.Spec.Type {
+	case corev1.ServiceTypeLoadBalancer:
+		for _, lb := range svc.Status.LoadBalancer.Ingress {
+			addrs = append(addrs, lb.IP, lb.Hostname)
+		}
+	case corev1.ServiceTypeExternalName:
+		addrs = append(addrs, svc.Spec.ExternalName)
+	default:
+		return
+	}
+	d.add(targets, "service", svc.Namespace, svc.Name, svc.Annotations, splitHostnames(names), addrs)
+}
+
+// addIngress adds the targets of an annotated Ingress.
+func (d *KubernetesDiscovery) addIngress(targets discoveryTargets, ing *networkingv1.Ingress) {
+	names, ok := ing.Annotations[AnnotationHostname]
+	if !ok {
+		return
+	}
+	hosts := splitHostnames(names)
+	if len(hosts) == 0 {
+		for _, rule := range ing.Spec.Rules {
+			hosts = append(hosts, rule.Host)
+		}
+	}
+	var addrs []string
+	for _, lb := range ing.Status.LoadBalancer.Ingress {
+		addrs = append(addrs, lb.IP, lb.Hostname)
+	}
+	d.add(targets, "ingress", ing.Namespace, ing.Name, ing.Annotations, hosts, addrs)
+}
+
+// addGateway adds the targets of an annotated Gateway.
+func (d *KubernetesDiscovery) addGateway(targets discoveryTargets, gw *unstructured.Unstructured) {
+	names, ok := gw.GetAnnotations()[AnnotationHostname]
+	if !ok {
+		return
+	}
+	hosts := splitHostnames(names)
+	if len(hosts) == 0 {
+		listeners, _, _ := unstructured.NestedSlice(gw.Object, "spec", "listeners")
+		for _, l := range listeners {
+			if l, ok := l.(map[string]any); ok {
+				host, _, _ := unstructured.NestedString(l, "hostname")
+				hosts = append(hosts, host)
+			}
+		}
+	}
+	var addrs []string
+	addresses, _, _ := unstructured.NestedSlice(gw.Object, "status", "addresses")
+	for _, a := range addresses {
+		if a, ok := a.(map[string]any); ok {
+			value, _, _ := unstructured.NestedString(a, "value")
+			addrs = append(addrs, value)
+		}
+	}
+	d.add(targets, "gateway", gw.GetNamespace(), gw.GetName(), gw.GetAnnotations(), hosts, addrs)
+}
+
+// add records that hosts point at addrs, which are IP addresses or
+// hostnames; empty entries are ignored.
+func (d *KubernetesDiscovery) add(targets discoveryTargets, kind, namespace, name string, annotations map[string]string, hosts, addrs []string) {
+	ttl := d.ttl
+	if v, ok := annotations[AnnotationTTL]; ok {
+		n, err := strconv.ParseUint(v, 10, 32)
+		if err != nil {
+			slog.Warn("invalid discovery ttl annotation", "kind", kind, "namespace", namespace, "name", name, "value", v)
+		} else {
+			ttl = uint32(n)
+		}
+	}
+	for _, host := range hosts {
+		host = strings.ToLower(strings.TrimSpace(host))
+		if host == "" {
+			continue
+		}
+		if !strings.HasSuffix(host, ".") {
+			host += "."
+		}
+		for _, addr := range addrs {
+			if addr != "" {
+				targets.add(host, addr, ttl, kind+" "+namespace+"/"+name)
+			}
+		}
+	}
+}
+
+// discoveryTargets collects the addresses published at each name.
+type discoveryTargets map[string]*discoveryTarget
+
+type discoveryTarget struct {
+	ttl       uint32
+	v4, v6    []string
+	hostnames []string
+	objects   []string // "<kind> <namespace>/<name>" of the publishing objects
+}
+
+func (t discoveryTargets) add(name, addr string, ttl uint32, object string) {
+	target := t[name]
+	if target == nil {
+		target = &discoveryTarget{ttl: ttl}
+		t[name] = target
+	}
+	target.ttl = min(target.ttl, ttl)
+	target.objects = append(target.objects, object)
+	if ip, err := netip.ParseAddr(addr); err == nil {
+		if ip.Is4() || ip.Is4In6() {
+			target.v4 = append(target.v4, ip.Unmap().String())
+		} else {
+			target.v6 = append(target.v6, ip.String())
+		}
+		return
+	}
+	target.hostnames = append(target.hostnames, strings.TrimSuffix(strings.ToLower(addr), ".")+".")
+}
+
+// records returns the records for the collected targets, sorted by name
+// and type. A name with load balancer IPs gets A and AAAA records;
+// otherwise it gets a CNAME to the first load balancer hostname, since a
+// CNAME cannot coexist with other records or have several targets.
+// The metadata names the objects publishing each name.
+func (t discoveryTargets) records() []*types.DNSRecord {
+	var records []*types.DNSRecord
+	for name, target := range t {
+		meta := func() *types.RecordMeta {
+			return &types.RecordMeta{
+				Source:  types.SourceKubernetes,
+				Comment: "published by " + strings.Join(sortedUnique(target.objects), ", "),
+			}
+		}
+		if v4 := sortedUnique(target.v4); len(v4) > 0 {
+			records = append(records, &types.DNSRecord{Name: name, Type: types.RecordTypeA, TTL: target.ttl, Value: v4, Meta: meta()})
+		}
+		if v6 := sortedUnique(target.v6); len(v6) > 0 {
+			records = append(records, &types.DNSRecord{Name: name, Type: types.RecordTypeAAAA, TTL: target.ttl, Value: v6, Meta: meta()})
+		}
+		if len(target.v4) == 0 && len(target.v6) == 0 && len(target.hostnames) > 0 {
+			hostnames := sortedUnique(target.hostnames)
+			if len(hostnames) > 1 {
+				slog.Warn("several discovered hostnames for one name, using the first", "name", name, "hostnames", hostnames)
+			}
+			records = append(records, &types.DNSRecord{Name: name, Type: types.RecordTypeCNAME, TTL: target.ttl, Value: hostnames[:1], Meta: meta()})
+		}
+	}
+	slices.SortFunc(records, func(a, b *types.DNSRecord) int {
+		return cmp.Or(cmp.Compare(a.Name, b.Name), cmp.Compare(a.Type, b.Type))
+	})
+	return records
+}
+
+func sortedUnique(values []string) []string {
+	out := slices.Clone(values)
+	slices.Sort(out)
+	return slices.Compact(out)
+}
+
+// splitHostnames splits an AnnotationHostname value.
+func splitHostnames(value string) []string {
+	var hosts []string
+	for _, h := range strings.Split(value, ",") {
+		if h = strings.TrimSpace(h); h != "" {
+			hosts = append(hosts, h)
+		}
+	}
+	return hosts
+}
@@ -0,0 +1,130 @@
+package storage
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"jabberwocky238/jw238dns/types"
+
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// waitForRecord waits until store holds name/rt with want as its first value.
+func waitForRecord(t *testing.T, store *MemoryStorage, name string, rt types.RecordType, want string) {
+	t.Helper()
+	var recs []*types.DNSRecord
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(20 * time.Millisecond) {
+		recs, _ = store.Get(context.Background(), name, rt)
+		if len(recs) == 1 && recs[0].Value[0] == want {
+			return
+		}
+	}
+	t.Fatalf("%s %s = %v, want %s", name, rt, recs, want)
+}
+
+func TestKubernetesDiscovery_ServicesAndIngresses(t *testing.T) {
+	lb := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "apps", Annotations: map[string]string{
+			AnnotationHostname: "web.example.com, www.example.com",
+			AnnotationTTL:      "60",
+		}},
+		Spec: corev1.ServiceSpec{Type: corev1.ServiceTypeLoadBalancer},
+		Status: corev1.ServiceStatus{LoadBalancer: corev1.LoadBalancerStatus{Ingress: []corev1.LoadBalancerIngress{
+			{IP: "192.0.2.10"}, {IP: "2001:db8::10"},
+		}}},
+	}
+	external := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "db", Namespace: "apps", Annotations: map[string]string{AnnotationHostname: "db.example.com"}},
+		Spec:       corev1.ServiceSpec{Type: corev1.ServiceTypeExternalName, ExternalName: "db.provider.net"},
+	}
+	unannotated := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "internal", Namespace: "apps"},
+		Spec:       corev1.ServiceSpec{Type: corev1.ServiceTypeLoadBalancer},
+		Status: corev1.ServiceStatus{LoadBalancer: corev1.LoadBalancerStatus{Ingress: []corev1.LoadBalancerIngress{
+			{IP: "192.0.2.99"},
+		}}},
+	}
+	ing := &networkingv1.Ingress{
+		ObjectMeta: metav1.ObjectMeta{Name: "shop", Namespace: "apps", Annotations: map[string]string{AnnotationHostname: ""}},
+		Spec:       networkingv1.IngressSpec{Rules: []networkingv1.IngressRule{{Host: "shop.example.com"}}},
+		Status: networkingv1.IngressStatus{LoadBalancer: networkingv1.IngressLoadBalancerStatus{Ingress: []networkingv1.IngressLoadBalancerIngress{
+			{Hostname: "lb-123.elb.example.net"},
+		}}},
+	}
+	client := fake.NewSimpleClientset(lb, external, unannotated, ing)
+	store := NewMemoryStorage()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if err := NewKubernetesDiscovery(client, nil, "", 0, store).Start(ctx); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+
+	waitForRecord(t, store, "web.example.com.", types.RecordTypeA, "192.0.2.10")
+	waitForRecord(t, store, "www.example.com.", types.RecordTypeAAAA, "2001:db8::10")
+	waitForRecord(t, store, "db.example.com.", types.RecordTypeCNAME, "db.provider.net.")
+	waitForRecord(t, store, "shop.example.com.", types.RecordTypeCNAME, "lb-123.elb.example.net.")
+	if recs, _ := store.Get(ctx, "web.example.com.", types.RecordTypeA); recs[0].TTL != 60 {
+		t.Errorf("web.example.com. TTL = %d, want 60 from the annotation", recs[0].TTL)
+	}
+	if recs, _ := store.List(ctx); len(recs) != 6 {
+		t.Errorf("List() = %d records, want 6", len(recs))
+	}
+	if recs, _ := store.ListPersistent(ctx); len(recs) != 0 {
+		t.Errorf("ListPersistent() = %v, want no discovered records", recs)
+	}
+
+	// Removing the annotation withdraws the records.
+	delete(lb.Annotations, AnnotationHostname)
+	if _, err := client.CoreV1().Services("apps").Update(ctx, lb, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("update service: %v", err)
+	}
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(20 * time.Millisecond) {
+		if _, err := store.Get(ctx, "web.example.com.", types.RecordTypeA); err != nil {
+			return
+		}
+	}
+	t.Error("web.example.com. still served after the annotation was removed")
+}
+
+func TestKubernetesDiscovery_Gateways(t *testing.T) {
+	gw := &unstructured.Unstructured{Object: map[string]any{
+		"apiVersion": "gateway.networking.k8s.io/v1",
+		"kind":       "Gateway",
+		"metadata": map[string]any{
+			"name":        "public",
+			"namespace":   "infra",
+			"annotations": map[string]any{AnnotationHostname: ""},
+		},
+		"spec": map[string]any{"listeners": []any{
+			map[string]any{"name": "https", "hostname": "api.example.com"},
+		}},
+		"status": map[string]any{"addresses": []any{
+			map[string]any{"type": "IPAddress", "value": "198.51.100.7"},
+		}},
+	}}
+	dyn := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{GatewayGVR: "GatewayList"})
+	store := NewMemoryStorage()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Created through the resource: the fake client would guess
+	// "gatewaies" for a Gateway passed to the constructor.
+	if _, err := dyn.Resource(GatewayGVR).Namespace("infra").Create(ctx, gw, metav1.CreateOptions{}); err != nil {
+		t.Fatalf("create gateway: %v", err)
+	}
+
+	if err := NewKubernetesDiscovery(fake.NewSimpleClientset(), dyn, "", 0, store).Start(ctx); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	waitForRecord(t, store, "api.example.com.", types.RecordTypeA, "198.51.100.7")
+}
@@ -0,0 +1,501 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"strings"
+	"time"
+
+	"jabberwocky238/jw238dns/metrics"
+	"jabberwocky238/jw238dns/types"
+
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Defaults for EtcdStorage.
+const (
+	DefaultEtcdPrefix = "/jw238dns/records/"
+
+	// DefaultEtcdMaxTxnOps matches etcd's default --max-txn-ops.
+	DefaultEtcdMaxTxnOps = 128
+)
+
+// etcdTxnAttempts is how often EtcdStorage.Transaction calls fn before
+// giving up on concurrent writers.
+const etcdTxnAttempts = 5
+
+// EtcdStorage is a CoreStorage that keeps each record as a JSON value
+// under prefix + name + "/" + type in etcd. Several jw238dns replicas can
+// share it: writes are guarded by transactions, and every replica follows
+// changes with etcd watches.
+//
+// The etcd revision serves as the storage version. Watches resume from the
+// last revision they delivered after a dropped connection; if that
+// revision has been compacted away an EventReloaded is sent instead.
+type EtcdStorage struct {
+	client    *clientv3.Client
+	prefix    string
+	maxTxnOps int
+}
+
+// NewEtcdStorage creates an EtcdStorage using client. An empty prefix
+// means DefaultEtcdPrefix. maxTxnOps must not exceed the server's
+// --max-txn-ops; a non-positive value means DefaultEtcdMaxTxnOps.
+func NewEtcdStorage(client *clientv3.Client, prefix string, maxTxnOps int) *EtcdStorage {
+	if prefix == "" {
+		prefix = DefaultEtcdPrefix
+	}
+	if !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	if maxTxnOps <= 0 {
+		maxTxnOps = DefaultEtcdMaxTxnOps
+	}
+	return &EtcdStorage{client: client, prefix: prefix, maxTxnOps: maxTxnOps}
+}
+
+// Get returns the record matching the given name and type, falling back to
+// wildcard records like MemoryStorage does.
+func (s *EtcdStorage) Get(ctx context.Context, name string, recordType types.RecordType) ([]*types.DNSRecord, error) {
+	ctx, span := tracer.Start(ctx, "EtcdStorage.Get")
+	defer span.End()
+	span.SetAttributes(recordAttrs(name, recordType)...)
+
+	resp, err := s.client.Get(ctx, s.key(name, recordType))
+	if err != nil {
+		return nil, fmt.Errorf("get record: %w", err)
+	}
+	if len(resp.Kvs) > 0 {
+		rec, err := decodeEtcdRecord(resp.Kvs[0])
+		if err != nil {
+			return nil, err
+		}
+		return []*types.DNSRecord{rec}, nil
+	}
+
+	// The wildcard may sit in any label, so list the keys and only fetch
+	// the value of a match.
+	keys, err := s.client.Get(ctx, s.prefix, clientv3.WithPrefix(), clientv3.WithKeysOnly())
+	if err != nil {
+		return nil, fmt.Errorf("list keys: %w", err)
+	}
+	for _, kv := range keys.Kvs {
+		storedName, rt, ok := s.splitKey(kv.Key)
+		if !ok || rt != recordType || !strings.Contains(storedName, "*") {
+			continue
+		}
+		if matched, _ := regexp.MatchString(wildcardToRegex(storedName), name); !matched {
+			continue
+		}
+		resp, err := s.client.Get(ctx, string(kv.Key))
+		if err != nil {
+			return nil, fmt.Errorf("get record: %w", err)
+		}
+		if len(resp.Kvs) == 0 {
+			continue // deleted meanwhile
+		}
+		rec, err := decodeEtcdRecord(resp.Kvs[0])
+		if err != nil {
+			return nil, err
+		}
+		rec.Name = name
+		return []*types.DNSRecord{rec}, nil
+	}
+	return nil, types.ErrRecordNotFound
+}
+
+// List returns all stored DNS records.
+func (s *EtcdStorage) List(ctx context.Context) ([]*types.DNSRecord, error) {
+	ctx, span := tracer.Start(ctx, "EtcdStorage.List")
+	defer span.End()
+
+	records, _, err := s.snapshot(ctx)
+	return records, err
+}
+
+// Create adds a new DNS record. Returns ErrRecordExists if a record with
+// the same name and type already exists.
+func (s *EtcdStorage) Create(ctx context.Context, record *types.DNSRecord) error {
+	ctx, span := tracer.Start(ctx, "EtcdStorage.Create")
+	defer span.End()
+	span.SetAttributes(recordAttrs(record.Name, record.Type)...)
+
+	key := s.key(record.Name, record.Type)
+	put, err := s.putOp(record)
+	if err != nil {
+		return err
+	}
+	resp, err := s.client.Txn(ctx).
+		If(clientv3.Compare(clientv3.CreateRevision(key), "=", 0)).
+		Then(put).
+		Commit()
+	if err != nil {
+		return fmt.Errorf("create record: %w", err)
+	}
+	if !resp.Succeeded {
+		return types.ErrRecordExists
+	}
+	return nil
+}
+
+// Update replaces an existing DNS record. Returns ErrRecordNotFound if the
+// record does not exist.
+func (s *EtcdStorage) Update(ctx context.Context, record *types.DNSRecord) error {
+	ctx, span := tracer.Start(ctx, "EtcdStorage.Update")
+	defer span.End()
+	span.SetAttributes(recordAttrs(record.Name, record.Type)...)
+
+	key := s.key(record.Name, record.Type)
+	put, err := s.putOp(record)
+	if err != nil {
+		return err
+	}
+	resp, err := s.client.Txn(ctx).
+		If(clientv3.Compare(clientv3.CreateRevision(key), ">", 0)).
+		Then(put).
+		Commit()
+	if err != nil {
+		return fmt.Errorf("update record: %w", err)
+	}
+	if !resp.Succeeded {
+		return types.ErrRecordNotFound
+	}
+	return nil
+}
+
+// Delete removes a DNS record identified by name and type.
+func (s *EtcdStorage) Delete(ctx context.Context, name string, recordType types.RecordType) error {
+	ctx, span := tracer.Start(ctx, "EtcdStorage.Delete")
+	defer span.End()
+	span.SetAttributes(recordAttrs(name, recordType)...)
+
+	resp, err := s.client.Delete(ctx, s.key(name, recordType))
+	if err != nil {
+		return fmt.Errorf("delete record: %w", err)
+	}
+	if resp.Deleted == 0 {
+		return types.ErrRecordNotFound
+	}
+	return nil
+}
+
+// HotReload replaces all records with the provided set. Only the
+// difference to the stored records is written, and it is written
+// atomically as long as it fits in one transaction (see PartialReload).
+func (s *EtcdStorage) HotReload(ctx context.Context, records []*types.DNSRecord) error {
+	ctx, span := tracer.Start(ctx, "EtcdStorage.HotReload")
+	defer span.End()
+	span.SetAttributes(attribute.Int("dns.records", len(records)))
+
+	current, err := s.List(ctx)
+	if err != nil {
+		return err
+	}
+	return s.PartialReload(ctx, DiffRecords(current, records))
+}
+
+// PartialReload applies only the changed records. etcd limits the number
+// of operations in a transaction, so changes are committed in
+// transactions of at most maxTxnOps operations; each is atomic, but a
+// failure part way leaves the earlier ones applied.
+func (s *EtcdStorage) PartialReload(ctx context.Context, changes *types.RecordChanges) error {
+	ctx, span := tracer.Start(ctx, "EtcdStorage.PartialReload")
+	defer span.End()
+	span.SetAttributes(
+		attribute.Int("dns.added", len(changes.Added)),
+		attribute.Int("dns.updated", len(changes.Updated)),
+		attribute.Int("dns.deleted", len(changes.Deleted)),
+	)
+
+	ops, err := s.changeOps(changes)
+	if err != nil {
+		return err
+	}
+	for len(ops) > 0 {
+		n := min(len(ops), s.maxTxnOps)
+		if _, err := s.client.Txn(ctx).Then(ops[:n]...).Commit(); err != nil {
+			return fmt.Errorf("apply changes: %w", err)
+		}
+		ops = ops[n:]
+	}
+	return nil
+}
+
+// Transaction implements CoreStorage. The changes are written in one
+// etcd transaction that only succeeds if none of the records fn read has
+// changed since; otherwise fn is called again with fresh records. Unlike
+// PartialReload, a transaction must fit within maxTxnOps operations.
+func (s *EtcdStorage) Transaction(ctx context.Context, fn func(tx *Tx) error) error {
+	ctx, span := tracer.Start(ctx, "EtcdStorage.Transaction")
+	defer span.End()
+
+	for range etcdTxnAttempts {
+		var cmps []clientv3.Cmp
+		tx := newTx(func(key types.RecordKey) (*types.DNSRecord, error) {
+			k := s.key(key.Name, key.Type)
+			resp, err := s.client.Get(ctx, k)
+			if err != nil {
+				return nil, fmt.Errorf("get record: %w", err)
+			}
+			if len(resp.Kvs) == 0 {
+				cmps = append(cmps, clientv3.Compare(clientv3.ModRevision(k), "=", 0))
+				return nil, nil
+			}
+			cmps = append(cmps, clientv3.Compare(clientv3.ModRevision(k), "=", resp.Kvs[0].ModRevision))
+			return decodeEtcdRecord(resp.Kvs[0])
+		})
+		if err := fn(tx); err != nil {
+			return err
+		}
+
+		ops, err := s.changeOps(tx.Changes())
+		if err != nil {
+			return err
+		}
+		if len(ops) == 0 {
+			return nil
+		}
+		if len(ops) > s.maxTxnOps || len(cmps) > s.maxTxnOps {
+			return fmt.Errorf("transaction reads %d and writes %d records, more than the %d allowed", len(cmps), len(ops), s.maxTxnOps)
+		}
+		resp, err := s.client.Txn(ctx).If(cmps...).Then(ops...).Commit()
+		if err != nil {
+			return fmt.Errorf("apply changes: %w", err)
+		}
+		if resp.Succeeded {
+			return nil
+		}
+	}
+	return fmt.Errorf("transaction: records kept changing after %d attempts", etcdTxnAttempts)
+}
+
+// Watch returns a channel that receives an event for every record changed
+// after the call, by this process or any other writer. The channel is
+// closed when ctx is cancelled.
+func (s *EtcdStorage) Watch(ctx context.Context) (<-chan types.StorageEvent, error) {
+	revision, err := s.Revision(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return s.WatchFrom(ctx, revision), nil
+}
+
+// WatchFrom is Watch for changes made after revision, such as the one
+// returned by LoadInto. If the changes from revision on have been
+// compacted, the channel starts with an EventReloaded.
+func (s *EtcdStorage) WatchFrom(ctx context.Context, revision int64) <-chan types.StorageEvent {
+	ch := make(chan types.StorageEvent, 64)
+	go func() {
+		defer close(ch)
+		s.follow(ctx, revision, func(events []types.StorageEvent, _ int64) {
+			for _, ev := range events {
+				select {
+				case ch <- ev:
+				case <-ctx.Done():
+					return
+				}
+			}
+		})
+	}()
+	return ch
+}
+
+// Revision returns the current etcd revision of the cluster.
+func (s *EtcdStorage) Revision(ctx context.Context) (int64, error) {
+	resp, err := s.client.Get(ctx, s.prefix, clientv3.WithPrefix(), clientv3.WithCountOnly())
+	if err != nil {
+		return 0, fmt.Errorf("read revision: %w", err)
+	}
+	return resp.Header.Revision, nil
+}
+
+// LoadInto replaces the contents of store with the records in etcd, and
+// returns the revision they correspond to.
+func (s *EtcdStorage) LoadInto(ctx context.Context, store *MemoryStorage) (int64, error) {
+	records, revision, err := s.snapshot(ctx)
+	if err == nil {
+		if changes := store.CalculateChanges(records); len(changes.Added) > 0 || len(changes.Updated) > 0 || len(changes.Deleted) > 0 {
+			err = store.PartialReload(ctx, changes)
+		}
+	}
+	metrics.ObserveReload("etcd", err)
+	return revision, err
+}
+
+// SyncTo applies every change made after revision, by any writer, to
+// store until ctx is cancelled. revision is normally the one returned by
+// LoadInto.
+func (s *EtcdStorage) SyncTo(ctx context.Context, store *MemoryStorage, revision int64) error {
+	s.follow(ctx, revision, func(events []types.StorageEvent, revision int64) {
+		ctx, span := tracer.Start(ctx, "EtcdStorage.SyncTo")
+		defer span.End()
+
+		changes := &types.RecordChanges{}
+		for _, ev := range events {
+			switch ev.Type {
+			case types.EventAdded:
+				changes.Added = append(changes.Added, ev.Record)
+			case types.EventUpdated:
+				changes.Updated = append(changes.Updated, ev.Record)
+			case types.EventDeleted:
+				changes.Deleted = append(changes.Deleted, types.RecordKey{Name: ev.Record.Name, Type: ev.Record.Type})
+			case types.EventReloaded:
+				if _, err := s.LoadInto(ctx, store); err != nil {
+					slog.Error("reload from etcd", "err", err)
+				}
+				return
+			}
+		}
+		err := store.PartialReload(ctx, changes)
+		metrics.ObserveReload("etcd", err)
+		if err != nil {
+			slog.Error("apply etcd changes", "revision", revision, "err", err)
+		}
+	})
+	return ctx.Err()
+}
+
+// follow watches the prefix from after revision and calls apply with the
+// events of each watch response and the revision they bring a follower
+// to. When the watch ends it is resumed from the last delivered revision;
+// when that revision has been compacted, apply gets a single
+// EventReloaded and the watch restarts from the current revision.
+func (s *EtcdStorage) follow(ctx context.Context, revision int64, apply func([]types.StorageEvent, int64)) {
+	for ctx.Err() == nil {
+		wctx, cancel := context.WithCancel(clientv3.WithRequireLeader(ctx))
+		wch := s.client.Watch(wctx, s.prefix, clientv3.WithPrefix(), clientv3.WithRev(revision+1))
+		for resp := range wch {
+			if resp.CompactRevision > 0 || errors.Is(resp.Err(), rpctypes.ErrCompacted) {
+				current, err := s.Revision(ctx)
+				if err != nil {
+					break
+				}
+				slog.Warn("etcd watch revision compacted, reloading", "revision", revision, "compacted", resp.CompactRevision)
+				apply([]types.StorageEvent{{Type: types.EventReloaded}}, current)
+				revision = current
+				break
+			}
+			if err := resp.Err(); err != nil {
+				slog.Warn("etcd watch error, resuming", "revision", revision, "err", err)
+				break
+			}
+			events := s.watchEvents(resp.Events)
+			if len(events) > 0 {
+				apply(events, resp.Header.Revision)
+			}
+			revision = max(revision, resp.Header.Revision)
+		}
+		cancel()
+
+		select {
+		case <-ctx.Done():
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// watchEvents converts etcd watch events to storage events, skipping keys
+// that do not hold records.
+func (s *EtcdStorage) watchEvents(evs []*clientv3.Event) []types.StorageEvent {
+	events := make([]types.StorageEvent, 0, len(evs))
+	for _, ev := range evs {
+		name, rt, ok := s.splitKey(ev.Kv.Key)
+		if !ok {
+			continue
+		}
+		if ev.Type == mvccpb.DELETE {
+			events = append(events, types.StorageEvent{Type: types.EventDeleted, Record: &types.DNSRecord{Name: name, Type: rt}})
+			continue
+		}
+		rec, err := decodeEtcdRecord(ev.Kv)
+		if err != nil {
+			slog.Warn("skip undecodable etcd record", "key", string(ev.Kv.Key), "err", err)
+			continue
+		}
+		typ := types.EventUpdated
+		if ev.IsCreate() {
+			typ = types.EventAdded
+		}
+		events = append(events, types.StorageEvent{Type: typ, Record: rec})
+	}
+	return events
+}
+
+// snapshot returns all records and the revision they were read at.
+func (s *EtcdStorage) snapshot(ctx context.Context) ([]*types.DNSRecord, int64, error) {
+	resp, err := s.client.Get(ctx, s.prefix, clientv3.WithPrefix())
+	if err != nil {
+		return nil, 0, fmt.Errorf("list records: %w", err)
+	}
+	records := make([]*types.DNSRecord, 0, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		if _, _, ok := s.splitKey(kv.Key); !ok {
+			continue
+		}
+		rec, err := decodeEtcdRecord(kv)
+		if err != nil {
+			return nil, 0, err
+		}
+		records = append(records, rec)
+	}
+	return records, resp.Header.Revision, nil
+}
+
+// changeOps returns the operations applying changes.
+func (s *EtcdStorage) changeOps(changes *types.RecordChanges) ([]clientv3.Op, error) {
+	var ops []clientv3.Op
+	for _, r := range append(append([]*types.DNSRecord{}, changes.Added...), changes.Updated...) {
+		op, err := s.putOp(r)
+		if err != nil {
+			return nil, err
+		}
+		ops = append(ops, op)
+	}
+	for _, key := range changes.Deleted {
+		ops = append(ops, clientv3.OpDelete(s.key(key.Name, key.Type)))
+	}
+	return ops, nil
+}
+
+// putOp returns the operation storing record.
+func (s *EtcdStorage) putOp(record *types.DNSRecord) (clientv3.Op, error) {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return clientv3.Op{}, fmt.Errorf("encode record: %w", err)
+	}
+	return clientv3.OpPut(s.key(record.Name, record.Type), string(data)), nil
+}
+
+// key returns the etcd key of a name and type.
+func (s *EtcdStorage) key(name string, recordType types.RecordType) string {
+	return s.prefix + name + "/" + string(recordType)
+}
+
+// splitKey is the inverse of key.
+func (s *EtcdStorage) splitKey(key []byte) (string, types.RecordType, bool) {
+	rest, ok := strings.CutPrefix(string(key), s.prefix)
+	if !ok {
+		return "", "", false
+	}
+	i := strings.LastIndexByte(rest, '/')
+	if i <= 0 {
+		return "", "", false
+	}
+	return rest[:i], types.RecordType(rest[i+1:]), true
+}
+
+// decodeEtcdRecord decodes the record stored in kv.
+func decodeEtcdRecord(kv *mvccpb.KeyValue) (*types.DNSRecord, error) {
+	var rec types.DNSRecord
+	if err := json.Unmarshal(kv.Value, &rec); err != nil {
+		return nil, fmt.Errorf("decode record %s: %w", kv.Key, err)
+	}
+	return &rec, nil
+}
@@ -0,0 +1,243 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+
+	"jabberwocky238/jw238dns/types"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/server/v3/embed"
+)
+
+// freeURL returns an http URL on a free local port.
+func freeURL(t *testing.T) url.URL {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	return url.URL{Scheme: "http", Host: ln.Addr().String()}
+}
+
+// startEtcd starts an embedded etcd server for the test and returns its
+// client endpoint.
+func startEtcd(t *testing.T) string {
+	t.Helper()
+	cfg := embed.NewConfig()
+	cfg.Dir = t.TempDir()
+	cfg.LogLevel = "error"
+	client, peer := freeURL(t), freeURL(t)
+	cfg.ListenClientUrls, cfg.AdvertiseClientUrls = []url.URL{client}, []url.URL{client}
+	cfg.ListenPeerUrls, cfg.AdvertisePeerUrls = []url.URL{peer}, []url.URL{peer}
+	cfg.InitialCluster = cfg.InitialClusterFromName(cfg.Name)
+
+	e, err := embed.StartEtcd(cfg)
+	if err != nil {
+		t.Fatalf("start embedded etcd: %v", err)
+	}
+	t.Cleanup(e.Close)
+	select {
+	case <-e.Server.ReadyNotify():
+	case <-time.After(30 * time.Second):
+		t.Fatal("embedded etcd did not become ready")
+	}
+	return client.String()
+}
+
+// newTestEtcd returns an EtcdStorage on a new embedded server, and its
+// client.
+func newTestEtcd(t *testing.T, maxTxnOps int) (*EtcdStorage, *clientv3.Client) {
+	t.Helper()
+	client, err := clientv3.New(clientv3.Config{Endpoints: []string{startEtcd(t)}, DialTimeout: 5 * time.Second})
+	if err != nil {
+		t.Fatalf("etcd client: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return NewEtcdStorage(client, "", maxTxnOps), client
+}
+
+func TestEtcdStorage_CRUD(t *testing.T) {
+	s, _ := newTestEtcd(t, 0)
+	ctx := context.Background()
+
+	if err := s.Create(ctx, aRecord("a.com.", "1.1.1.1")); err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+	if err := s.Create(ctx, aRecord("a.com.", "2.2.2.2")); !errors.Is(err, types.ErrRecordExists) {
+		t.Errorf("Create() duplicate error = %v, want ErrRecordExists", err)
+	}
+	if err := s.Update(ctx, aRecord("b.com.", "2.2.2.2")); !errors.Is(err, types.ErrRecordNotFound) {
+		t.Errorf("Update() missing error = %v, want ErrRecordNotFound", err)
+	}
+	if err := s.Update(ctx, aRecord("a.com.", "3.3.3.3")); err != nil {
+		t.Fatalf("Update() error = %v", err)
+	}
+	recs, err := s.Get(ctx, "a.com.", types.RecordTypeA)
+	if err != nil || len(recs) != 1 || recs[0].Value[0] != "3.3.3.3" {
+		t.Fatalf("Get() = %v, %v, want updated record", recs, err)
+	}
+
+	if err := s.Delete(ctx, "a.com.", types.RecordTypeA); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+	if err := s.Delete(ctx, "a.com.", types.RecordTypeA); !errors.Is(err, types.ErrRecordNotFound) {
+		t.Errorf("Delete() missing error = %v, want ErrRecordNotFound", err)
+	}
+	if recs, _ := s.List(ctx); len(recs) != 0 {
+		t.Errorf("List() after delete = %v, want empty", recs)
+	}
+}
+
+func TestEtcdStorage_GetWildcard(t *testing.T) {
+	s, _ := newTestEtcd(t, 0)
+	ctx := context.Background()
+	_ = s.Create(ctx, aRecord("*.example.com.", "10.0.0.1"))
+
+	recs, err := s.Get(ctx, "test.example.com.", types.RecordTypeA)
+	if err != nil || len(recs) != 1 || recs[0].Name != "test.example.com." {
+		t.Fatalf("Get() wildcard = %v, %v", recs, err)
+	}
+	if _, err := s.Get(ctx, "test.example.com.", types.RecordTypeAAAA); !errors.Is(err, types.ErrRecordNotFound) {
+		t.Errorf("Get() other type error = %v, want ErrRecordNotFound", err)
+	}
+}
+
+func TestEtcdStorage_HotReloadBatches(t *testing.T) {
+	s, _ := newTestEtcd(t, 3)
+	ctx := context.Background()
+	_ = s.Create(ctx, aRecord("drop.com.", "1.1.1.1"))
+
+	var desired []*types.DNSRecord
+	for i := range 10 {
+		desired = append(desired, aRecord(fmt.Sprintf("r%d.com.", i), "2.2.2.2"))
+	}
+	if err := s.HotReload(ctx, desired); err != nil {
+		t.Fatalf("HotReload() error = %v", err)
+	}
+	recs, _ := s.List(ctx)
+	if changes := DiffRecords(recs, desired); len(changes.Added)+len(changes.Updated)+len(changes.Deleted) != 0 {
+		t.Errorf("records after HotReload() differ: %+v", changes)
+	}
+}
+
+func TestEtcdStorage_WatchSeesOtherReplica(t *testing.T) {
+	writer, client := newTestEtcd(t, 0)
+	reader := NewEtcdStorage(client, writer.prefix, 0)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch, err := reader.Watch(ctx)
+	if err != nil {
+		t.Fatalf("Watch() error = %v", err)
+	}
+
+	_ = writer.Create(ctx, aRecord("a.com.", "1.1.1.1"))
+	_ = writer.Update(ctx, aRecord("a.com.", "2.2.2.2"))
+	_ = writer.Delete(ctx, "a.com.", types.RecordTypeA)
+
+	want := []types.EventType{types.EventAdded, types.EventUpdated, types.EventDeleted}
+	for i, wantType := range want {
+		select {
+		case ev := <-ch:
+			if ev.Type != wantType || ev.Record.Name != "a.com." {
+				t.Errorf("event %d = %s %s, want %s a.com.", i, ev.Type, ev.Record.Name, wantType)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("event %d not received", i)
+		}
+	}
+}
+
+func TestEtcdStorage_WatchFromCompactedRevision(t *testing.T) {
+	s, client := newTestEtcd(t, 0)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	start, err := s.Revision(ctx)
+	if err != nil {
+		t.Fatalf("Revision() error = %v", err)
+	}
+	_ = s.Create(ctx, aRecord("a.com.", "1.1.1.1"))
+	_ = s.Create(ctx, aRecord("b.com.", "2.2.2.2"))
+	current, _ := s.Revision(ctx)
+	if _, err := client.Compact(ctx, current); err != nil {
+		t.Fatalf("Compact() error = %v", err)
+	}
+
+	ch := s.WatchFrom(ctx, start)
+	select {
+	case ev := <-ch:
+		if ev.Type != types.EventReloaded {
+			t.Fatalf("first event = %s, want %s", ev.Type, types.EventReloaded)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event after compaction")
+	}
+
+	// The watch carries on from the current revision.
+	_ = s.Create(ctx, aRecord("c.com.", "3.3.3.3"))
+	select {
+	case ev := <-ch:
+		if ev.Type != types.EventAdded || ev.Record.Name != "c.com." {
+			t.Errorf("event = %s %v, want added c.com.", ev.Type, ev.Record)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("watch did not resume after reload")
+	}
+}
+
+func TestEtcdStorage_SyncTo(t *testing.T) {
+	s, _ := newTestEtcd(t, 0)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	_ = s.Create(ctx, aRecord("before.com.", "1.1.1.1"))
+	store := NewMemoryStorage()
+	revision, err := s.LoadInto(ctx, store)
+	if err != nil {
+		t.Fatalf("LoadInto() error = %v", err)
+	}
+	go s.SyncTo(ctx, store, revision)
+
+	_ = s.Create(ctx, aRecord("after.com.", "2.2.2.2"))
+	_ = s.Delete(ctx, "before.com.", types.RecordTypeA)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		want, _ := s.List(ctx)
+		got, _ := store.List(ctx)
+		if changes := DiffRecords(got, want); len(changes.Added)+len(changes.Updated)+len(changes.Deleted) == 0 {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Error("store did not converge to the etcd contents")
+}
+
+func TestEtcdStorage_SplitKey(t *testing.T) {
+	s := NewEtcdStorage(nil, "/p", 0)
+	tests := []struct {
+		key      string
+		wantName string
+		wantType types.RecordType
+		wantOK   bool
+	}{
+		{key: "/p/a.com./A", wantName: "a.com.", wantType: types.RecordTypeA, wantOK: true},
+		{key: "/p/_acme-challenge.a.com./TXT", wantName: "_acme-challenge.a.com.", wantType: types.RecordTypeTXT, wantOK: true},
+		{key: "/other/a.com./A"},
+		{key: "/p/A"},
+	}
+	for _, tt := range tests {
+		name, rt, ok := s.splitKey([]byte(tt.key))
+		if name != tt.wantName || rt != tt.wantType || ok != tt.wantOK {
+			t.Errorf("splitKey(%q) = %q, %q, %v, want %q, %q, %v", tt.key, name, rt, ok, tt.wantName, tt.wantType, tt.wantOK)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"jabberwocky238/jw238dns/metrics"
+	"jabberwocky238/jw238dns/types"
+)
+
+// DefaultExpiryInterval is the longest the ExpiryJanitor waits between
+// sweeps when no change wakes it earlier.
+const DefaultExpiryInterval = time.Minute
+
+// ExpiryJanitor deletes records whose RecordMeta.ExpiresAt has passed.
+// Deletions go through CoreStorage.Delete, so watchers and persistence
+// see them like any other delete. Given a LeaderOnlyStorage, only the
+// leader deletes; followers see the deletion through their storage.
+type ExpiryJanitor struct {
+	store    CoreStorage
+	interval time.Duration
+	now      func() time.Time
+}
+
+// NewExpiryJanitor creates an ExpiryJanitor for store that sweeps at least
+// every interval; a non-positive interval means DefaultExpiryInterval.
+func NewExpiryJanitor(store CoreStorage, interval time.Duration) *ExpiryJanitor {
+	if interval <= 0 {
+		interval = DefaultExpiryInterval
+	}
+	return &ExpiryJanitor{store: store, interval: interval, now: time.Now}
+}
+
+// Run sweeps until ctx is cancelled: when the earliest expiry is due,
+// after a reload, and at least every interval. A record written with an
+// earlier expiry than any seen moves the next sweep forward.
+func (j *ExpiryJanitor) Run(ctx context.Context) error {
+	events, err := j.store.Watch(ctx)
+	if err != nil {
+		return fmt.Errorf("watch storage: %w", err)
+	}
+
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	var due time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case ev, ok := <-events:
+			if !ok {
+				return ctx.Err()
+			}
+			if ev.Record != nil {
+				if at := ev.Record.Expires(); !at.IsZero() && at.Before(due) {
+					due = at
+					timer.Reset(max(at.Sub(j.now()), 0))
+				}
+				continue
+			}
+			if c := ev.Changes; c != nil && len(c.Added) == 0 && len(c.Updated) == 0 {
+				continue // Deletions, such as the sweep's own, bring no expiry
+			}
+		case <-timer.C:
+		}
+
+		next := j.Sweep(ctx)
+		due = j.now().Add(j.interval)
+		if !next.IsZero() && next.Before(due) {
+			due = next
+		}
+		timer.Reset(max(due.Sub(j.now()), 0))
+	}
+}
+
+// Sweep deletes the expired records and returns the earliest expiry of
+// the remaining ones, or the zero time if none expires. Each record is
+// deleted in a transaction that checks it is still expired.
+func (j *ExpiryJanitor) Sweep(ctx context.Context) time.Time {
+	records, err := j.store.List(ctx)
+	if err != nil {
+		slog.Error("expiry: list records", "err", err)
+		return time.Time{}
+	}
+
+	ctx = WithActor(ctx, Actor{Name: "expiry-janitor", Source: SourceExpiry})
+	now := j.now()
+	var next time.Time
+	for _, r := range records {
+		at := r.Expires()
+		if at.IsZero() {
+			continue
+		}
+		if at.After(now) {
+			if next.IsZero() || at.Before(next) {
+				next = at
+			}
+			continue
+		}
+
+		// The record may have been extended or recreated since it was
+		// listed: check its expiry again where it is deleted.
+		err := j.store.Transaction(ctx, func(tx *Tx) error {
+			rec, err := tx.Get(r.Name, r.Type)
+			if err != nil {
+				return err
+			}
+			at = rec.Expires()
+			if at.IsZero() || at.After(now) {
+				return nil
+			}
+			return tx.Delete(r.Name, r.Type)
+		})
+		switch {
+		case err == nil && !at.IsZero() && at.After(now):
+			if next.IsZero() || at.Before(next) {
+				next = at
+			}
+		case err == nil && !at.IsZero():
+			metrics.RecordsExpiredTotal.Inc()
+			slog.Info("deleted expired record", "name", r.Name, "type", r.Type, "expired_at", at)
+		case err == nil:
+			// No longer expires.
+		case errors.Is(err, types.ErrRecordNotFound):
+			// Deleted concurrently.
+		case errors.Is(err, types.ErrNotLeader):
+			return next // The leader deletes it.
+		default:
+			slog.Warn("delete expired record", "name", r.Name, "type", r.Type, "err", err)
+		}
+	}
+	return next
+}
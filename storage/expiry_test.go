@@ -0,0 +1,118 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"jabberwocky238/jw238dns/types"
+)
+
+func expiringRecord(name string, at time.Time) *types.DNSRecord {
+	r := aRecord(name, "192.0.2.1")
+	r.Meta = &types.RecordMeta{ExpiresAt: at}
+	return r
+}
+
+func TestExpiryJanitor_Sweep(t *testing.T) {
+	store := NewMemoryStorage()
+	ctx := context.Background()
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	for _, r := range []*types.DNSRecord{
+		expiringRecord("expired.com.", now.Add(-time.Second)),
+		expiringRecord("due.com.", now),
+		expiringRecord("later.com.", now.Add(time.Hour)),
+		expiringRecord("soon.com.", now.Add(time.Minute)),
+		aRecord("forever.com.", "192.0.2.2"),
+	} {
+		if err := store.Create(ctx, r); err != nil {
+			t.Fatalf("Create() error = %v", err)
+		}
+	}
+
+	j := NewExpiryJanitor(store, 0)
+	j.now = func() time.Time { return now }
+	if next := j.Sweep(ctx); !next.Equal(now.Add(time.Minute)) {
+		t.Errorf("Sweep() = %v, want the earliest remaining expiry", next)
+	}
+	for name, want := range map[string]bool{"expired.com.": false, "due.com.": false, "later.com.": true, "soon.com.": true, "forever.com.": true} {
+		_, err := store.Get(ctx, name, types.RecordTypeA)
+		if got := err == nil; got != want {
+			t.Errorf("%s present = %v, want %v", name, got, want)
+		}
+	}
+}
+
+// extendingStorage is a CoreStorage that extends the expiry of a record
+// after List returns it, like a write racing the janitor.
+type extendingStorage struct {
+	*MemoryStorage
+	extended *types.DNSRecord
+}
+
+func (s extendingStorage) List(ctx context.Context) ([]*types.DNSRecord, error) {
+	records, err := s.MemoryStorage.List(ctx)
+	_ = s.MemoryStorage.Update(ctx, s.extended)
+	return records, err
+}
+
+func TestExpiryJanitor_SweepRechecksExpiry(t *testing.T) {
+	store := NewMemoryStorage()
+	ctx := context.Background()
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	_ = store.Create(ctx, expiringRecord("renewed.com.", now.Add(-time.Second)))
+
+	j := NewExpiryJanitor(extendingStorage{store, expiringRecord("renewed.com.", now.Add(time.Hour))}, 0)
+	j.now = func() time.Time { return now }
+	if next := j.Sweep(ctx); !next.Equal(now.Add(time.Hour)) {
+		t.Errorf("Sweep() = %v, want the extended expiry", next)
+	}
+	if _, err := store.Get(ctx, "renewed.com.", types.RecordTypeA); err != nil {
+		t.Errorf("extended record was deleted: %v", err)
+	}
+}
+
+func TestExpiryJanitor_SweepFollower(t *testing.T) {
+	store := NewMemoryStorage()
+	ctx := context.Background()
+	_ = store.Create(ctx, expiringRecord("expired.com.", time.Now().Add(-time.Second)))
+
+	follower := NewLeaderOnlyStorage(store, func() error { return types.ErrNotLeader })
+	NewExpiryJanitor(follower, 0).Sweep(ctx)
+	if _, err := store.Get(ctx, "expired.com.", types.RecordTypeA); err != nil {
+		t.Errorf("follower deleted the record: %v", err)
+	}
+}
+
+func TestExpiryJanitor_Run(t *testing.T) {
+	store := NewMemoryStorage()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	events, _ := store.Watch(ctx)
+	done := make(chan error, 1)
+	go func() { done <- NewExpiryJanitor(store, time.Hour).Run(ctx) }()
+
+	// A record created after the first sweep still expires on time,
+	// long before the hour-long interval.
+	time.Sleep(50 * time.Millisecond)
+	if err := store.Create(ctx, expiringRecord("temp.com.", time.Now().Add(100*time.Millisecond))); err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+	timeout := time.After(2 * time.Second)
+	for deleted := false; !deleted; {
+		select {
+		case ev := <-events:
+			deleted = ev.Changes != nil && slices.Contains(ev.Changes.Deleted, types.RecordKey{Name: "temp.com.", Type: types.RecordTypeA})
+		case <-timeout:
+			t.Fatal("expired record was not deleted")
+		}
+	}
+
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Errorf("Run() = %v, want context.Canceled", err)
+	}
+}
@@ -0,0 +1,708 @@
+package storage
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"jabberwocky238/jw238dns/types"
+)
+
+// DefaultHistorySize is the number of entries a memory history keeps when
+// NewMemoryHistory is given a non-positive size.
+const DefaultHistorySize = 10000
+
+// Sources of history entries besides the record metadata sources.
+const (
+	// SourceSync marks changes that reached the store from its backend
+	// without a known actor: edits to the ConfigMap, file or database, and
+	// writes by other replicas.
+	SourceSync = "sync"
+
+	// SourceExpiry marks deletions by the ExpiryJanitor.
+	SourceExpiry = "expiry"
+
+	// SourceRollback marks changes made by a rollback.
+	SourceRollback = "rollback"
+)
+
+// pendingTTL bounds how long an attribution registered by Attributed
+// waits for its change to reach the store.
+const pendingTTL = time.Minute
+
+// ErrHistoryUnavailable is returned when the history no longer reaches
+// back to the requested version or time.
+var ErrHistoryUnavailable = errors.New("history does not reach back that far")
+
+// Actor identifies who made a change and through what, such as an API
+// client through SourceHTTP or a TSIG key through SourceUpdate.
+type Actor struct {
+	Name   string
+	Source string
+}
+
+type actorKey struct{}
+
+// WithActor returns a context attributing the changes made with it to
+// actor.
+func WithActor(ctx context.Context, actor Actor) context.Context {
+	return context.WithValue(ctx, actorKey{}, actor)
+}
+
+// ActorFrom returns the actor set by WithActor.
+func ActorFrom(ctx context.Context) (Actor, bool) {
+	actor, ok := ctx.Value(actorKey{}).(Actor)
+	return actor, ok
+}
+
+// HistoryEntry records a change to one record. Entries of the same
+// change share its version.
+type HistoryEntry struct {
+	Version uint64           `json:"version"`
+	Time    time.Time        `json:"time"`
+	Actor   string           `json:"actor,omitempty"`
+	Source  string           `json:"source"`
+	Op      types.EventType  `json:"op"`
+	Name    string           `json:"name"`
+	Type    types.RecordType `json:"type"`
+	Before  *types.DNSRecord `json:"before,omitempty"` // nil when added
+	After   *types.DNSRecord `json:"after,omitempty"`  // nil when deleted
+}
+
+// HistoryBackend stores history entries. Entries are only appended, in
+// version order.
+type HistoryBackend interface {
+	// Append stores entries after the existing ones.
+	Append(entries []HistoryEntry) error
+
+	// Entries returns the stored entries, oldest first. A bounded backend
+	// may have dropped the oldest ones.
+	Entries() ([]HistoryEntry, error)
+
+	// Close releases the backend.
+	Close() error
+}
+
+// HistoryQuery selects history entries. Zero fields match everything.
+type HistoryQuery struct {
+	Name  string
+	Type  types.RecordType
+	Since time.Time // Entries at or after Since
+	Until time.Time // Entries before Until
+	Limit int       // At most Limit entries, the newest
+}
+
+// History is an audit log of the persistent records of a MemoryStorage:
+// every change to them, with the actor, the source and the record before
+// and after. Synthesized records are not tracked. It is attached with
+// MemoryStorage.SetHistory and builds the entries of each change from its
+// change set while the storage is locked. The first change is instead
+// diffed against the state it last recorded, so a restart only records
+// what changed while the process was down. Entries are written to the
+// backend by a goroutine of their own, so a slow backend never holds up
+// the storage; reads wait for the entries recorded before them.
+//
+// History versions count recorded changes, continue across restarts with
+// a persistent backend, and are unrelated to the storage version.
+type History struct {
+	backend HistoryBackend
+	now     func() time.Time
+	done    chan struct{} // Closed when the appender exits
+
+	mu       sync.Mutex
+	cond     *sync.Cond // Signalled when queue or appended changes
+	version  uint64
+	appended uint64 // Version of the last entries written to the backend
+	synced   bool   // state has been compared with the whole storage
+	closed   bool
+	queue    [][]HistoryEntry // Entries of each change waiting for the appender
+	state    map[types.RecordKey]*types.DNSRecord
+	pending  map[types.RecordKey]pendingActor
+}
+
+type pendingActor struct {
+	actor Actor
+	at    time.Time
+}
+
+// NewHistory creates a History stored in backend, resuming from the
+// entries it holds.
+func NewHistory(backend HistoryBackend) (*History, error) {
+	entries, err := backend.Entries()
+	if err != nil {
+		return nil, fmt.Errorf("read history: %w", err)
+	}
+	h := &History{
+		backend: backend,
+		now:     time.Now,
+		done:    make(chan struct{}),
+		state:   make(map[types.RecordKey]*types.DNSRecord),
+		pending: make(map[types.RecordKey]pendingActor),
+	}
+	h.cond = sync.NewCond(&h.mu)
+	for _, e := range entries {
+		key := types.RecordKey{Name: e.Name, Type: e.Type}
+		if e.After == nil {
+			delete(h.state, key)
+		} else {
+			h.state[key] = e.After
+		}
+		h.version = e.Version
+	}
+	h.appended = h.version
+	go h.appendLoop()
+	return h, nil
+}
+
+// Close writes the entries still queued and closes the backend. Changes
+// made after Close are not recorded.
+func (h *History) Close() error {
+	h.mu.Lock()
+	h.closed = true
+	h.cond.Broadcast()
+	h.mu.Unlock()
+	<-h.done
+	return h.backend.Close()
+}
+
+// appendLoop writes queued entries to the backend until the history is
+// closed and the queue is empty.
+func (h *History) appendLoop() {
+	defer close(h.done)
+	for {
+		h.mu.Lock()
+		for len(h.queue) == 0 && !h.closed {
+			h.cond.Wait()
+		}
+		queue := h.queue
+		h.queue = nil
+		h.mu.Unlock()
+		if len(queue) == 0 {
+			return // Closed
+		}
+
+		for _, entries := range queue {
+			if err := h.backend.Append(entries); err != nil {
+				slog.Error("append history", "version", entries[0].Version, "err", err)
+			}
+		}
+		h.mu.Lock()
+		h.appended = queue[len(queue)-1][0].Version
+		h.cond.Broadcast()
+		h.mu.Unlock()
+	}
+}
+
+// waitLocked waits until every recorded change is in the backend. Caller
+// must hold h.mu.
+func (h *History) waitLocked() {
+	for h.appended < h.version && !h.closed {
+		h.cond.Wait()
+	}
+}
+
+// entries returns the backend's entries once every recorded change is
+// in it.
+func (h *History) entries() ([]HistoryEntry, error) {
+	h.mu.Lock()
+	h.waitLocked()
+	h.mu.Unlock()
+	return h.backend.Entries()
+}
+
+// Version returns the version of the last recorded change.
+func (h *History) Version() uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.version
+}
+
+// Entries returns the entries matching q, newest first.
+func (h *History) Entries(q HistoryQuery) ([]HistoryEntry, error) {
+	entries, err := h.entries()
+	if err != nil {
+		return nil, err
+	}
+	var out []HistoryEntry
+	for _, e := range slices.Backward(entries) {
+		if q.Limit > 0 && len(out) == q.Limit {
+			break
+		}
+		if (q.Name != "" && !strings.EqualFold(e.Name, q.Name)) ||
+			(q.Type != "" && e.Type != q.Type) ||
+			(!q.Since.IsZero() && e.Time.Before(q.Since)) ||
+			(!q.Until.IsZero() && !e.Time.Before(q.Until)) {
+			continue
+		}
+		out = append(out, e)
+	}
+	return out, nil
+}
+
+// VersionAt returns the version current at time t: that of the last
+// change made at or before t. It returns ErrHistoryUnavailable if t is
+// before the oldest entry.
+func (h *History) VersionAt(t time.Time) (uint64, error) {
+	entries, err := h.entries()
+	if err != nil {
+		return 0, err
+	}
+	for _, e := range slices.Backward(entries) {
+		if !e.Time.After(t) {
+			return e.Version, nil
+		}
+	}
+	return 0, ErrHistoryUnavailable
+}
+
+// RecordsAt returns the persistent records as they were at version, by
+// undoing the later changes. It returns ErrHistoryUnavailable if some of
+// those changes are no longer kept.
+func (h *History) RecordsAt(version uint64) ([]*types.DNSRecord, error) {
+	// Read the entries and the state together, so they agree.
+	h.mu.Lock()
+	h.waitLocked()
+	entries, err := h.backend.Entries()
+	current := h.version
+	state := make(map[types.RecordKey]*types.DNSRecord, len(h.state))
+	for key, rec := range h.state {
+		state[key] = rec
+	}
+	h.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	if version > current {
+		return nil, fmt.Errorf("version %d is newer than the latest %d", version, current)
+	}
+	if version < current && (len(entries) == 0 || entries[0].Version > version+1) {
+		return nil, ErrHistoryUnavailable
+	}
+	for _, e := range slices.Backward(entries) {
+		if e.Version <= version {
+			break
+		}
+		key := types.RecordKey{Name: e.Name, Type: e.Type}
+		if e.Before == nil {
+			delete(state, key)
+		} else {
+			state[key] = e.Before
+		}
+	}
+
+	records := make([]*types.DNSRecord, 0, len(state))
+	for _, rec := range state {
+		records = append(records, rec)
+	}
+	slices.SortFunc(records, func(a, b *types.DNSRecord) int {
+		if c := strings.Compare(a.Name, b.Name); c != 0 {
+			return c
+		}
+		return strings.Compare(string(a.Type), string(b.Type))
+	})
+	return records, nil
+}
+
+// record queues the entries of changes, a change to the persistent
+// records made with ctx. The first time, the recorded state is instead
+// compared with persistent(), which returns every persistent record after
+// the change. It is called by MemoryStorage with its lock held.
+func (h *History) record(ctx context.Context, changes *types.RecordChanges, persistent func() []*types.DNSRecord) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return
+	}
+
+	now := h.now().UTC()
+	actor, direct := ActorFrom(ctx)
+
+	var entries []HistoryEntry
+	add := func(key types.RecordKey, before, after *types.DNSRecord) {
+		e := HistoryEntry{
+			Version: h.version + 1,
+			Time:    now,
+			Name:    key.Name,
+			Type:    key.Type,
+			Before:  before,
+			After:   after,
+		}
+		switch {
+		case before == nil:
+			e.Op = types.EventAdded
+		case after == nil:
+			e.Op = types.EventDeleted
+		default:
+			e.Op = types.EventUpdated
+		}
+		a, ok := actor, direct
+		if p, found := h.pending[key]; found {
+			a, ok = p.actor, true
+			delete(h.pending, key)
+		}
+		e.Actor, e.Source = a.Name, a.Source
+		if !ok || e.Source == "" {
+			e.Source = SourceSync
+		}
+		entries = append(entries, e)
+	}
+	state := h.state
+	if !h.synced {
+		// Compare everything once, to catch up with changes made while
+		// the history was not attached.
+		state = make(map[types.RecordKey]*types.DNSRecord, len(h.state))
+		for key, rec := range buildRecordMapFromSlice(persistent()) {
+			if old, ok := h.state[key]; !ok || !recordsEqual(old, rec) {
+				add(key, old, rec)
+			}
+			state[key] = rec
+		}
+		for key, old := range h.state {
+			if _, ok := state[key]; !ok {
+				add(key, old, nil)
+			}
+		}
+		h.synced = true
+	} else {
+		// Records the change set names that the state lacks were
+		// synthesized until now: adding or updating one adds it, and
+		// deleting one changes nothing.
+		for _, rec := range slices.Concat(changes.Added, changes.Updated) {
+			key := types.RecordKey{Name: rec.Name, Type: rec.Type}
+			if old, ok := state[key]; !ok || !recordsEqual(old, rec) {
+				add(key, old, rec)
+				state[key] = rec
+			}
+		}
+		for _, key := range changes.Deleted {
+			if old, ok := state[key]; ok {
+				add(key, old, nil)
+				delete(state, key)
+			}
+		}
+	}
+	for key, p := range h.pending {
+		if now.Sub(p.at) > pendingTTL {
+			delete(h.pending, key)
+		}
+	}
+	if len(entries) == 0 {
+		return
+	}
+
+	slices.SortFunc(entries, func(a, b HistoryEntry) int {
+		if c := strings.Compare(a.Name, b.Name); c != 0 {
+			return c
+		}
+		return strings.Compare(string(a.Type), string(b.Type))
+	})
+	// The state follows the store even if the entries cannot be written,
+	// so later entries stay correct.
+	h.version++
+	h.state = state
+	h.queue = append(h.queue, entries)
+	h.cond.Broadcast()
+}
+
+// expect attributes the next change to each of keys to the actor in ctx,
+// for writes that reach the store through a backend and lose ctx.
+func (h *History) expect(ctx context.Context, keys ...types.RecordKey) {
+	actor, ok := ActorFrom(ctx)
+	if !ok {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	now := h.now().UTC()
+	for _, key := range keys {
+		h.pending[key] = pendingActor{actor: actor, at: now}
+	}
+}
+
+// Attributed returns store with the actor in the context of each write
+// carried over to the history entries it causes, even when the change
+// reaches the MemoryStorage later, through a database or Kubernetes.
+func (h *History) Attributed(store CoreStorage) CoreStorage {
+	return &attributedStorage{CoreStorage: store, history: h}
+}
+
+// attributedStorage is the CoreStorage returned by History.Attributed.
+type attributedStorage struct {
+	CoreStorage
+	history *History
+}
+
+// ListPersistent returns the records of the wrapped storage except those
+// synthesized by a source.
+func (s *attributedStorage) ListPersistent(ctx context.Context) ([]*types.DNSRecord, error) {
+	return ListPersistent(ctx, s.CoreStorage)
+}
+
+// Create implements CoreStorage.
+func (s *attributedStorage) Create(ctx context.Context, record *types.DNSRecord) error {
+	s.history.expect(ctx, types.RecordKey{Name: record.Name, Type: record.Type})
+	return s.CoreStorage.Create(ctx, record)
+}
+
+// Update implements CoreStorage.
+func (s *attributedStorage) Update(ctx context.Context, record *types.DNSRecord) error {
+	s.history.expect(ctx, types.RecordKey{Name: record.Name, Type: record.Type})
+	return s.CoreStorage.Update(ctx, record)
+}
+
+// Delete implements CoreStorage.
+func (s *attributedStorage) Delete(ctx context.Context, name string, recordType types.RecordType) error {
+	s.history.expect(ctx, types.RecordKey{Name: name, Type: recordType})
+	return s.CoreStorage.Delete(ctx, name, recordType)
+}
+
+// HotReload implements CoreStorage.
+func (s *attributedStorage) HotReload(ctx context.Context, records []*types.DNSRecord) error {
+	if _, ok := ActorFrom(ctx); ok {
+		current, err := s.CoreStorage.List(ctx)
+		if err != nil {
+			return err
+		}
+		s.history.expect(ctx, changedKeys(DiffRecords(current, records))...)
+	}
+	return s.CoreStorage.HotReload(ctx, records)
+}
+
+// PartialReload implements CoreStorage.
+func (s *attributedStorage) PartialReload(ctx context.Context, changes *types.RecordChanges) error {
+	s.history.expect(ctx, changedKeys(changes)...)
+	return s.CoreStorage.PartialReload(ctx, changes)
+}
+
+// Transaction implements CoreStorage.
+func (s *attributedStorage) Transaction(ctx context.Context, fn func(tx *Tx) error) error {
+	return s.CoreStorage.Transaction(ctx, func(tx *Tx) error {
+		if err := fn(tx); err != nil {
+			return err
+		}
+		s.history.expect(ctx, changedKeys(tx.Changes())...)
+		return nil
+	})
+}
+
+// changedKeys returns the keys of the records in changes.
+func changedKeys(changes *types.RecordChanges) []types.RecordKey {
+	var keys []types.RecordKey
+	for _, r := range changes.Added {
+		keys = append(keys, types.RecordKey{Name: r.Name, Type: r.Type})
+	}
+	for _, r := range changes.Updated {
+		keys = append(keys, types.RecordKey{Name: r.Name, Type: r.Type})
+	}
+	return append(keys, changes.Deleted...)
+}
+
+// MemoryHistory is a HistoryBackend keeping the newest entries in memory.
+type MemoryHistory struct {
+	mu      sync.RWMutex
+	entries []HistoryEntry
+	max     int
+}
+
+// NewMemoryHistory creates a MemoryHistory keeping at most max entries; a
+// non-positive max means DefaultHistorySize.
+func NewMemoryHistory(max int) *MemoryHistory {
+	if max <= 0 {
+		max = DefaultHistorySize
+	}
+	return &MemoryHistory{max: max}
+}
+
+// Append implements HistoryBackend.
+func (m *MemoryHistory) Append(entries []HistoryEntry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.entries = append(m.entries, entries...)
+	if len(m.entries) > m.max {
+		m.entries = slices.Clone(m.entries[len(m.entries)-m.max:])
+	}
+	return nil
+}
+
+// Entries implements HistoryBackend.
+func (m *MemoryHistory) Entries() ([]HistoryEntry, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return slices.Clone(m.entries), nil
+}
+
+// Close implements HistoryBackend.
+func (m *MemoryHistory) Close() error { return nil }
+
+// FileHistory is a HistoryBackend appending entries to a file, one JSON
+// object per line. It keeps the newest entries, up to a number and an
+// age, in memory for reading. Dropped entries stay in the file until it
+// holds twice the number kept, when it is rewritten with the kept ones.
+type FileHistory struct {
+	path   string
+	max    int
+	maxAge time.Duration
+
+	mu      sync.RWMutex
+	file    *os.File
+	lines   int // Entries in the file, kept or not
+	entries []HistoryEntry
+}
+
+// OpenFileHistory opens or creates the history file at path, keeping at
+// most max entries, no older than maxAge. A non-positive max means
+// DefaultHistorySize, and a zero maxAge keeps entries of any age.
+// Unreadable lines, such as one partly written before a crash, are
+// skipped.
+func OpenFileHistory(path string, max int, maxAge time.Duration) (*FileHistory, error) {
+	if max <= 0 {
+		max = DefaultHistorySize
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("open history: %w", err)
+	}
+	var entries []HistoryEntry
+	line := 0
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16<<20)
+	for scanner.Scan() {
+		line++
+		var e HistoryEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			slog.Warn("skipping unreadable history entry", "path", path, "line", line, "err", err)
+			continue
+		}
+		entries = append(entries, e)
+	}
+	if err := scanner.Err(); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("read history: %w", err)
+	}
+
+	// End a partly written line so the next entry starts on its own.
+	if info, err := f.Stat(); err == nil && info.Size() > 0 {
+		last := make([]byte, 1)
+		if _, err := f.ReadAt(last, info.Size()-1); err == nil && last[0] != '\n' {
+			if _, err := f.Write([]byte{'\n'}); err != nil {
+				f.Close()
+				return nil, fmt.Errorf("repair history: %w", err)
+			}
+		}
+	}
+	h := &FileHistory{path: path, max: max, maxAge: maxAge, file: f, lines: line, entries: entries}
+	if err := h.trimLocked(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return h, nil
+}
+
+// Append implements HistoryBackend.
+func (f *FileHistory) Append(entries []HistoryEntry) error {
+	var buf []byte
+	for _, e := range entries {
+		data, err := json.Marshal(e)
+		if err != nil {
+			return fmt.Errorf("encode history entry: %w", err)
+		}
+		buf = append(append(buf, data...), '\n')
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, err := f.file.Write(buf); err != nil {
+		return fmt.Errorf("write history: %w", err)
+	}
+	if err := f.file.Sync(); err != nil {
+		return fmt.Errorf("sync history: %w", err)
+	}
+	f.entries = append(f.entries, entries...)
+	f.lines += len(entries)
+	return f.trimLocked()
+}
+
+// trimLocked drops the entries beyond the newest f.max and those older
+// than f.maxAge, and rewrites the file once it holds twice f.max lines.
+// Entries of a change are dropped together, so none is kept in part.
+// Caller must hold f.mu for writing.
+func (f *FileHistory) trimLocked() error {
+	drop := max(len(f.entries)-f.max, 0)
+	if f.maxAge > 0 {
+		cutoff := time.Now().Add(-f.maxAge)
+		for drop < len(f.entries) && f.entries[drop].Time.Before(cutoff) {
+			drop++
+		}
+	}
+	for drop > 0 && drop < len(f.entries) && f.entries[drop].Version == f.entries[drop-1].Version {
+		drop++
+	}
+	f.entries = f.entries[drop:]
+	if f.lines < 2*f.max {
+		return nil
+	}
+	f.entries = slices.Clone(f.entries)
+	return f.rewriteLocked()
+}
+
+// rewriteLocked replaces the file with one holding only the kept entries.
+// Caller must hold f.mu for writing.
+func (f *FileHistory) rewriteLocked() error {
+	var buf []byte
+	for _, e := range f.entries {
+		data, err := json.Marshal(e)
+		if err != nil {
+			return fmt.Errorf("encode history entry: %w", err)
+		}
+		buf = append(append(buf, data...), '\n')
+	}
+
+	// Atomic write: write to temp file in the same directory, then rename.
+	tmp, err := os.CreateTemp(filepath.Dir(f.path), ".jw238dns-history-*.tmp")
+	if err != nil {
+		return fmt.Errorf("create temp file: %w", err)
+	}
+	tmpName := tmp.Name()
+	if _, err = tmp.Write(buf); err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmpName, f.path)
+	}
+	if err != nil {
+		os.Remove(tmpName)
+		return fmt.Errorf("compact history: %w", err)
+	}
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("reopen history: %w", err)
+	}
+	f.file.Close()
+	f.file, f.lines = file, len(f.entries)
+	return nil
+}
+
+// Entries implements HistoryBackend.
+func (f *FileHistory) Entries() ([]HistoryEntry, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return slices.Clone(f.entries), nil
+}
+
+// Close implements HistoryBackend.
+func (f *FileHistory) Close() error {
+	return f.file.Close()
+}
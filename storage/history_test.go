@@ -0,0 +1,281 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"jabberwocky238/jw238dns/types"
+)
+
+func newTestHistory(t *testing.T, backend HistoryBackend) (*History, *time.Time) {
+	t.Helper()
+	h, err := NewHistory(backend)
+	if err != nil {
+		t.Fatalf("NewHistory() error = %v", err)
+	}
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	h.now = func() time.Time { return now }
+	return h, &now
+}
+
+func TestHistory_Record(t *testing.T) {
+	h, now := newTestHistory(t, NewMemoryHistory(0))
+	store := NewMemoryStorage()
+	store.SetHistory(h)
+	ctx := context.Background()
+	alice := WithActor(ctx, Actor{Name: "alice", Source: types.SourceHTTP})
+
+	if err := store.Create(alice, aRecord("a.com.", "192.0.2.1")); err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+	*now = now.Add(time.Minute)
+	if err := store.Update(ctx, aRecord("a.com.", "192.0.2.2")); err != nil {
+		t.Fatalf("Update() error = %v", err)
+	}
+	*now = now.Add(time.Minute)
+	if err := store.HotReload(alice, []*types.DNSRecord{aRecord("b.com.", "192.0.2.3")}); err != nil {
+		t.Fatalf("HotReload() error = %v", err)
+	}
+	// Synthesized records are not tracked.
+	store.ApplySource(ctx, "discovery", []*types.DNSRecord{aRecord("svc.com.", "192.0.2.9")})
+
+	if v := h.Version(); v != 3 {
+		t.Fatalf("Version() = %d, want 3", v)
+	}
+	entries, err := h.Entries(HistoryQuery{})
+	if err != nil {
+		t.Fatalf("Entries() error = %v", err)
+	}
+	want := []struct {
+		version uint64
+		op      types.EventType
+		name    string
+		actor   string
+		source  string
+	}{
+		{3, types.EventAdded, "b.com.", "alice", types.SourceHTTP},
+		{3, types.EventDeleted, "a.com.", "alice", types.SourceHTTP},
+		{2, types.EventUpdated, "a.com.", "", SourceSync},
+		{1, types.EventAdded, "a.com.", "alice", types.SourceHTTP},
+	}
+	if len(entries) != len(want) {
+		t.Fatalf("Entries() = %d entries, want %d", len(entries), len(want))
+	}
+	for i, w := range want {
+		e := entries[i]
+		if e.Version != w.version || e.Op != w.op || e.Name != w.name || e.Actor != w.actor || e.Source != w.source {
+			t.Errorf("entry %d = %+v, want %+v", i, e, w)
+		}
+	}
+	if e := entries[2]; e.Before.Value[0] != "192.0.2.1" || e.After.Value[0] != "192.0.2.2" {
+		t.Errorf("update entry before/after = %v/%v", e.Before.Value, e.After.Value)
+	}
+
+	got, _ := h.Entries(HistoryQuery{Name: "A.COM.", Limit: 2})
+	if len(got) != 2 || got[0].Version != 3 || got[1].Version != 2 {
+		t.Errorf("Entries(name, limit) = %+v, want versions 3 and 2 of a.com.", got)
+	}
+	start := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	got, _ = h.Entries(HistoryQuery{Since: start.Add(time.Minute), Until: start.Add(2 * time.Minute)})
+	if len(got) != 1 || got[0].Version != 2 {
+		t.Errorf("Entries(since, until) = %+v, want version 2", got)
+	}
+
+	if v, err := h.VersionAt(start.Add(90 * time.Second)); err != nil || v != 2 {
+		t.Errorf("VersionAt() = %d, %v, want 2", v, err)
+	}
+	if _, err := h.VersionAt(start.Add(-time.Second)); !errors.Is(err, ErrHistoryUnavailable) {
+		t.Errorf("VersionAt() before the history = %v, want ErrHistoryUnavailable", err)
+	}
+	records, err := h.RecordsAt(1)
+	if err != nil {
+		t.Fatalf("RecordsAt() error = %v", err)
+	}
+	if len(records) != 1 || records[0].Name != "a.com." || records[0].Value[0] != "192.0.2.1" {
+		t.Errorf("RecordsAt(1) = %v, want a.com. at 192.0.2.1", records)
+	}
+	if _, err := h.RecordsAt(4); err == nil {
+		t.Error("RecordsAt() of a future version succeeded")
+	}
+}
+
+func TestHistory_RecordsAtTruncated(t *testing.T) {
+	h, _ := newTestHistory(t, NewMemoryHistory(2))
+	store := NewMemoryStorage()
+	store.SetHistory(h)
+	ctx := context.Background()
+	for _, ip := range []string{"192.0.2.1", "192.0.2.2", "192.0.2.3"} {
+		_ = store.HotReload(ctx, []*types.DNSRecord{aRecord("a.com.", ip)})
+	}
+
+	// Version 1 is restored by undoing the two kept entries; version 0
+	// needs the dropped one.
+	if records, err := h.RecordsAt(1); err != nil || records[0].Value[0] != "192.0.2.1" {
+		t.Errorf("RecordsAt(1) = %v, %v, want a.com. at 192.0.2.1", records, err)
+	}
+	if _, err := h.RecordsAt(0); !errors.Is(err, ErrHistoryUnavailable) {
+		t.Errorf("RecordsAt() past the kept entries = %v, want ErrHistoryUnavailable", err)
+	}
+}
+
+func TestFileHistory_Reopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.jsonl")
+	records := []*types.DNSRecord{aRecord("a.com.", "192.0.2.1"), aRecord("b.com.", "192.0.2.2")}
+
+	f, err := OpenFileHistory(path, 0, 0)
+	if err != nil {
+		t.Fatalf("OpenFileHistory() error = %v", err)
+	}
+	h, _ := newTestHistory(t, f)
+	store := NewMemoryStorage()
+	store.SetHistory(h)
+	_ = store.HotReload(context.Background(), records)
+	h.Close()
+
+	// A restart loading the same records, and one changed since, records
+	// only the change.
+	f, err = OpenFileHistory(path, 0, 0)
+	if err != nil {
+		t.Fatalf("OpenFileHistory() error = %v", err)
+	}
+	h, _ = newTestHistory(t, f)
+	defer h.Close()
+	if v := h.Version(); v != 1 {
+		t.Fatalf("Version() after reopen = %d, want 1", v)
+	}
+	store = NewMemoryStorage()
+	store.SetHistory(h)
+	_ = store.HotReload(context.Background(), []*types.DNSRecord{records[0], aRecord("b.com.", "192.0.2.3")})
+
+	entries, _ := h.Entries(HistoryQuery{})
+	if len(entries) != 3 {
+		t.Fatalf("Entries() = %d entries, want 3", len(entries))
+	}
+	if e := entries[0]; e.Version != 2 || e.Name != "b.com." || e.Op != types.EventUpdated {
+		t.Errorf("newest entry = %+v, want the update of b.com. at version 2", e)
+	}
+}
+
+func TestFileHistory_Retention(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.jsonl")
+	f, err := OpenFileHistory(path, 3, time.Hour)
+	if err != nil {
+		t.Fatalf("OpenFileHistory() error = %v", err)
+	}
+	now := time.Now().UTC()
+	entry := func(version uint64, name string, age time.Duration) HistoryEntry {
+		return HistoryEntry{Version: version, Time: now.Add(-age), Op: types.EventAdded, Name: name, Type: types.RecordTypeA}
+	}
+	_ = f.Append([]HistoryEntry{entry(1, "old.com.", 2*time.Hour)})
+	_ = f.Append([]HistoryEntry{entry(2, "a.com.", 0), entry(2, "b.com.", 0)})
+	_ = f.Append([]HistoryEntry{entry(3, "c.com.", 0), entry(3, "d.com.", 0)})
+
+	// The expired entry is dropped, and so is all of version 2 rather
+	// than one of its entries.
+	entries, _ := f.Entries()
+	if len(entries) != 2 || entries[0].Version != 3 {
+		t.Fatalf("Entries() = %+v, want the two entries of version 3", entries)
+	}
+
+	// The file is compacted once it holds twice as many entries as kept.
+	_ = f.Append([]HistoryEntry{entry(4, "e.com.", 0)})
+	f.Close()
+	f, err = OpenFileHistory(path, 3, time.Hour)
+	if err != nil {
+		t.Fatalf("OpenFileHistory() error = %v", err)
+	}
+	defer f.Close()
+	if f.lines != 3 {
+		t.Errorf("file holds %d entries after compaction, want 3", f.lines)
+	}
+	if entries, _ := f.Entries(); len(entries) != 3 || entries[2].Version != 4 {
+		t.Errorf("Entries() after reopen = %+v, want versions 3 and 4", entries)
+	}
+}
+
+// blockingHistory is a HistoryBackend whose Append waits for release.
+type blockingHistory struct {
+	*MemoryHistory
+	release chan struct{}
+}
+
+func (b blockingHistory) Append(entries []HistoryEntry) error {
+	<-b.release
+	return b.MemoryHistory.Append(entries)
+}
+
+func TestHistory_AppendsOutsideStorageLock(t *testing.T) {
+	backend := blockingHistory{MemoryHistory: NewMemoryHistory(0), release: make(chan struct{})}
+	h, _ := newTestHistory(t, backend)
+	store := NewMemoryStorage()
+	store.SetHistory(h)
+	ctx := context.Background()
+
+	// Writes and reads of the storage go on while the backend is stuck.
+	for _, name := range []string{"a.com.", "b.com."} {
+		if err := store.Create(ctx, aRecord(name, "192.0.2.1")); err != nil {
+			t.Fatalf("Create() error = %v", err)
+		}
+	}
+	if recs, err := store.Get(ctx, "b.com.", types.RecordTypeA); err != nil || len(recs) != 1 {
+		t.Fatalf("Get() = %v, %v while the history backend is blocked", recs, err)
+	}
+
+	// Reads of the history wait for the queued entries.
+	close(backend.release)
+	entries, err := h.Entries(HistoryQuery{})
+	if err != nil || len(entries) != 2 || entries[0].Name != "b.com." {
+		t.Errorf("Entries() = %+v, %v, want both creations", entries, err)
+	}
+	if err := h.Close(); err != nil {
+		t.Errorf("Close() error = %v", err)
+	}
+}
+
+// detachedStorage applies writes to a MemoryStorage without their
+// context, like a database or Kubernetes backend syncing them back.
+type detachedStorage struct {
+	*MemoryStorage
+}
+
+func (s detachedStorage) Create(_ context.Context, record *types.DNSRecord) error {
+	return s.MemoryStorage.Create(context.Background(), record)
+}
+
+func (s detachedStorage) Transaction(_ context.Context, fn func(tx *Tx) error) error {
+	return s.MemoryStorage.Transaction(context.Background(), fn)
+}
+
+func TestHistory_Attributed(t *testing.T) {
+	h, _ := newTestHistory(t, NewMemoryHistory(0))
+	store := NewMemoryStorage()
+	store.SetHistory(h)
+	ctx := WithActor(context.Background(), Actor{Name: "key.", Source: types.SourceUpdate})
+	s := h.Attributed(detachedStorage{store})
+
+	if err := s.Create(ctx, aRecord("a.com.", "192.0.2.1")); err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+	err := s.Transaction(ctx, func(tx *Tx) error {
+		return tx.Create(aRecord("b.com.", "192.0.2.2"))
+	})
+	if err != nil {
+		t.Fatalf("Transaction() error = %v", err)
+	}
+	// Without a pending attribution a change comes from the backend.
+	_ = store.Create(context.Background(), aRecord("c.com.", "192.0.2.3"))
+
+	entries, _ := h.Entries(HistoryQuery{})
+	for _, e := range entries {
+		wantActor, wantSource := "key.", types.SourceUpdate
+		if e.Name == "c.com." {
+			wantActor, wantSource = "", SourceSync
+		}
+		if e.Actor != wantActor || e.Source != wantSource {
+			t.Errorf("%s attributed to %q/%q, want %q/%q", e.Name, e.Actor, e.Source, wantActor, wantSource)
+		}
+	}
+}
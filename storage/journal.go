@@ -0,0 +1,441 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"jabberwocky238/jw238dns/types"
+)
+
+// DefaultJournalSize is the number of journal entries kept per zone when
+// NewJournal is given a non-positive size.
+const DefaultJournalSize = 1000
+
+// JournalEntry describes one change to a zone: the records removed and
+// added when its serial moved from From to Serial. An updated record
+// appears in both lists (old value removed, new value added).
+type JournalEntry struct {
+	Zone    string
+	From    uint32
+	Serial  uint32
+	Deleted []*types.DNSRecord
+	Added   []*types.DNSRecord
+}
+
+// Journal tracks zones and their per-change history on top of a
+// MemoryStorage, for serving AXFR and IXFR. Zones are the names that
+// carry an SOA record. Each zone's serial advances whenever a record in
+// the zone changes.
+//
+// Serials are derived from the storage version, offset by the journal's
+// start time. That keeps them increasing across restarts only while there
+// were fewer changes than seconds since the last start; SetSerialFile
+// makes them increase regardless. The serial in a stored SOA record's
+// value is ignored.
+type Journal struct {
+	store   *MemoryStorage
+	maxSize int
+
+	// serialFile holds the highest serial served, written after changes
+	// outside mu so SOA answers never wait for the disk. fileMu orders
+	// the writes; written is the last serial written.
+	serialFile string
+	fileMu     sync.Mutex
+	written    uint32
+
+	mu          sync.RWMutex
+	base        uint32 // serial corresponding to startVer
+	startVer    uint64
+	version     uint64
+	snapshot    map[types.RecordKey]*types.DNSRecord
+	zones       map[string]uint32 // zone apex -> current serial
+	history     map[string][]JournalEntry
+	subscribers []chan<- string
+}
+
+// NewJournal creates a Journal over the given store and takes its initial
+// snapshot. maxSize bounds the number of entries kept per zone; IXFR
+// requests older than the retained history fall back to AXFR.
+func NewJournal(store *MemoryStorage, maxSize int) *Journal {
+	if maxSize <= 0 {
+		maxSize = DefaultJournalSize
+	}
+	records, version := store.Snapshot()
+
+	j := &Journal{
+		store:    store,
+		maxSize:  maxSize,
+		base:     uint32(time.Now().Unix()),
+		startVer: version,
+		version:  version,
+		snapshot: buildRecordMapFromSlice(records),
+		zones:    make(map[string]uint32),
+		history:  make(map[string][]JournalEntry),
+	}
+	for _, zone := range zonesOf(j.snapshot) {
+		j.zones[zone] = j.base
+	}
+	return j
+}
+
+// SetSerialFile persists the highest serial served to path, and starts
+// serials after the one found there if that is not older than the current
+// time, comparing serials with RFC 1982 arithmetic. Serials then never go
+// backwards across restarts, however fast the zones change. Call it
+// before Run.
+func (j *Journal) SetSerialFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("read serial file: %w", err)
+	}
+
+	j.mu.Lock()
+	if err == nil {
+		last, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 32)
+		if err != nil {
+			j.mu.Unlock()
+			return fmt.Errorf("parse serial file %s: %w", path, err)
+		}
+		if !serialLess(uint32(last), j.base) {
+			j.base = uint32(last) + 1
+			for zone := range j.zones {
+				j.zones[zone] = j.base
+			}
+		}
+	}
+	j.serialFile = path
+	base := j.base
+	j.mu.Unlock()
+
+	return j.writeSerial(base)
+}
+
+// writeSerial writes serial to the serial file, unless a newer one was
+// written already.
+func (j *Journal) writeSerial(serial uint32) error {
+	j.fileMu.Lock()
+	defer j.fileMu.Unlock()
+	if j.written != 0 && !serialLess(j.written, serial) {
+		return nil
+	}
+
+	// Atomic write: write to temp file in the same directory, then rename.
+	dir := filepath.Dir(j.serialFile)
+	tmp, err := os.CreateTemp(dir, ".jw238dns-serial-*.tmp")
+	if err != nil {
+		return fmt.Errorf("create temp file: %w", err)
+	}
+	tmpName := tmp.Name()
+	if _, err := fmt.Fprintf(tmp, "%d\n", serial); err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmpName, j.serialFile)
+	}
+	if err != nil {
+		os.Remove(tmpName)
+		return fmt.Errorf("write serial file: %w", err)
+	}
+	j.written = serial
+	return nil
+}
+
+// Run subscribes to storage events and updates the journal on each one.
+// It blocks until ctx is cancelled.
+func (j *Journal) Run(ctx context.Context) error {
+	ch, err := j.store.Watch(ctx)
+	if err != nil {
+		return fmt.Errorf("watch storage: %w", err)
+	}
+	// Catch changes made between NewJournal and Watch.
+	j.Sync()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case _, ok := <-ch:
+			if !ok {
+				return nil
+			}
+			j.Sync()
+		}
+	}
+}
+
+// Sync diffs the current storage contents against the last snapshot and
+// appends the differences to each affected zone's history. Diffing (rather
+// than replaying event payloads) keeps the journal correct when events are
+// coalesced or dropped.
+func (j *Journal) Sync() {
+	records, version := j.store.Snapshot()
+
+	j.mu.Lock()
+	if version == j.version {
+		j.mu.Unlock()
+		return
+	}
+	current := buildRecordMapFromSlice(records)
+	serial := j.serialForLocked(version)
+
+	// Zones that exist after this change. Removed zones lose their history.
+	newZones := make(map[string]uint32)
+	for _, zone := range zonesOf(current) {
+		if s, ok := j.zones[zone]; ok {
+			newZones[zone] = s
+		} else {
+			newZones[zone] = serial
+		}
+	}
+	zoneList := sortedZones(newZones)
+
+	entries := make(map[string]*JournalEntry)
+	entryFor := func(name string) *JournalEntry {
+		zone := zoneFor(name, zoneList)
+		if zone == "" {
+			return nil
+		}
+		e, ok := entries[zone]
+		if !ok {
+			// Zones created by this change start with empty history.
+			from, existed := j.zones[zone]
+			if !existed {
+				return nil
+			}
+			e = &JournalEntry{Zone: zone, From: from, Serial: serial}
+			entries[zone] = e
+		}
+		return e
+	}
+
+	for key, rec := range current {
+		old, exists := j.snapshot[key]
+		if exists && answersEqual(old, rec) {
+			continue
+		}
+		e := entryFor(key.Name)
+		if e == nil {
+			continue
+		}
+		if exists {
+			e.Deleted = append(e.Deleted, old)
+		}
+		e.Added = append(e.Added, rec)
+	}
+	for key, old := range j.snapshot {
+		if _, exists := current[key]; exists {
+			continue
+		}
+		if e := entryFor(key.Name); e != nil {
+			e.Deleted = append(e.Deleted, old)
+		}
+	}
+
+	var changed []string
+	for zone, e := range entries {
+		newZones[zone] = serial
+		hist := append(j.history[zone], *e)
+		if len(hist) > j.maxSize {
+			hist = hist[len(hist)-j.maxSize:]
+		}
+		j.history[zone] = hist
+		changed = append(changed, zone)
+	}
+	for zone := range j.history {
+		if _, ok := newZones[zone]; !ok {
+			delete(j.history, zone)
+		}
+	}
+
+	j.snapshot = current
+	j.version = version
+	j.zones = newZones
+	subscribers := j.subscribers
+	serialFile := j.serialFile
+	j.mu.Unlock()
+
+	if serialFile != "" && len(changed) > 0 {
+		if err := j.writeSerial(serial); err != nil {
+			slog.Warn("persist zone serial", "path", serialFile, "error", err)
+		}
+	}
+
+	sort.Strings(changed)
+	for _, zone := range changed {
+		slog.Debug("zone changed", "zone", zone, "serial", serial)
+		for _, sub := range subscribers {
+			select {
+			case sub <- zone:
+			default:
+			}
+		}
+	}
+}
+
+// Subscribe registers ch to receive the apex of every zone that changes.
+// Sends never block; a full channel misses notifications.
+func (j *Journal) Subscribe(ch chan<- string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.subscribers = append(j.subscribers, ch)
+}
+
+// Zones returns the apex names of all known zones, sorted.
+func (j *Journal) Zones() []string {
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+	zones := make([]string, 0, len(j.zones))
+	for zone := range j.zones {
+		zones = append(zones, zone)
+	}
+	sort.Strings(zones)
+	return zones
+}
+
+// Serial returns the current serial of the zone with the given apex.
+func (j *Journal) Serial(zone string) (uint32, bool) {
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+	s, ok := j.zones[strings.ToLower(zone)]
+	return s, ok
+}
+
+// ZoneFor returns the apex of the most specific zone containing name, or
+// "" if name is not inside any zone.
+func (j *Journal) ZoneFor(name string) string {
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+	return zoneFor(name, sortedZones(j.zones))
+}
+
+// Zone returns the zone's SOA record, every other record in the zone, and
+// the zone's serial, all from the same snapshot.
+func (j *Journal) Zone(zone string) (*types.DNSRecord, []*types.DNSRecord, uint32, bool) {
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+
+	zone = strings.ToLower(zone)
+	serial, ok := j.zones[zone]
+	if !ok {
+		return nil, nil, 0, false
+	}
+	zoneList := sortedZones(j.zones)
+
+	var soa *types.DNSRecord
+	var records []*types.DNSRecord
+	for key, rec := range j.snapshot {
+		if zoneFor(key.Name, zoneList) != zone {
+			continue
+		}
+		if key.Type == types.RecordTypeSOA && strings.EqualFold(key.Name, zone) {
+			soa = rec
+			continue
+		}
+		records = append(records, rec)
+	}
+	sort.Slice(records, func(a, b int) bool {
+		if records[a].Name != records[b].Name {
+			return records[a].Name < records[b].Name
+		}
+		return records[a].Type < records[b].Type
+	})
+	return soa, records, serial, soa != nil
+}
+
+// Since returns the zone's history after the given serial, oldest first.
+// It returns false if the journal no longer holds every change since that
+// serial, in which case the caller should fall back to a full transfer.
+func (j *Journal) Since(zone string, serial uint32) ([]JournalEntry, bool) {
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+
+	zone = strings.ToLower(zone)
+	current, ok := j.zones[zone]
+	if !ok {
+		return nil, false
+	}
+	if serial == current {
+		return nil, true
+	}
+
+	hist := j.history[zone]
+	for i, e := range hist {
+		if e.From == serial {
+			out := make([]JournalEntry, len(hist)-i)
+			copy(out, hist[i:])
+			return out, true
+		}
+	}
+	return nil, false
+}
+
+// serialForLocked maps a storage version to a zone serial.
+func (j *Journal) serialForLocked(version uint64) uint32 {
+	return j.base + uint32(version-j.startVer)
+}
+
+// serialLess reports whether serial a is before b in RFC 1982 serial
+// number arithmetic.
+func serialLess(a, b uint32) bool {
+	return a != b && b-a < 1<<31
+}
+
+// zonesOf returns the lower-cased names that carry an SOA record.
+func zonesOf(records map[types.RecordKey]*types.DNSRecord) []string {
+	var zones []string
+	for key := range records {
+		if key.Type == types.RecordTypeSOA {
+			zones = append(zones, strings.ToLower(key.Name))
+		}
+	}
+	return zones
+}
+
+// sortedZones returns zone apexes ordered longest first, so the first
+// match in zoneFor is the most specific zone.
+func sortedZones(zones map[string]uint32) []string {
+	out := make([]string, 0, len(zones))
+	for zone := range zones {
+		out = append(out, zone)
+	}
+	sort.Slice(out, func(a, b int) bool {
+		if len(out[a]) != len(out[b]) {
+			return len(out[a]) > len(out[b])
+		}
+		return out[a] < out[b]
+	})
+	return out
+}
+
+// zoneFor returns the first zone in zones (ordered longest first) that
+// contains name, or "".
+func zoneFor(name string, zones []string) string {
+	name = strings.ToLower(name)
+	for _, zone := range zones {
+		if inZone(name, zone) {
+			return zone
+		}
+	}
+	return ""
+}
+
+// inZone reports whether the lower-cased name is the apex of zone or
+// below it.
+func inZone(name, zone string) bool {
+	if zone == "." {
+		return true
+	}
+	return name == zone || strings.HasSuffix(name, "."+zone)
+}
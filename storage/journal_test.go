@@ -0,0 +1,210 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"jabberwocky238/jw238dns/types"
+)
+
+func setupJournalStorage(t *testing.T) *MemoryStorage {
+	t.Helper()
+	store := NewMemoryStorage()
+	ctx := context.Background()
+	for _, r := range []*types.DNSRecord{
+		{Name: "example.com.", Type: types.RecordTypeSOA, TTL: 300, Value: []string{"ns1.example.com. admin.example.com. 1 3600 900 604800 86400"}},
+		{Name: "example.com.", Type: types.RecordTypeA, TTL: 300, Value: []string{"192.168.1.1"}},
+		{Name: "www.example.com.", Type: types.RecordTypeA, TTL: 300, Value: []string{"192.168.1.2"}},
+		{Name: "sub.example.com.", Type: types.RecordTypeSOA, TTL: 300, Value: []string{"ns1.sub.example.com. admin.sub.example.com. 1 3600 900 604800 86400"}},
+		{Name: "a.sub.example.com.", Type: types.RecordTypeA, TTL: 300, Value: []string{"10.0.0.1"}},
+		{Name: "other.org.", Type: types.RecordTypeA, TTL: 300, Value: []string{"10.9.9.9"}},
+	} {
+		if err := store.Create(ctx, r); err != nil {
+			t.Fatalf("setup: create %s %s: %v", r.Name, r.Type, err)
+		}
+	}
+	return store
+}
+
+func TestJournal_Zones(t *testing.T) {
+	j := NewJournal(setupJournalStorage(t), 0)
+
+	zones := j.Zones()
+	if len(zones) != 2 || zones[0] != "example.com." || zones[1] != "sub.example.com." {
+		t.Fatalf("Zones() = %v, want [example.com. sub.example.com.]", zones)
+	}
+
+	tests := []struct {
+		name string
+		want string
+	}{
+		{name: "www.example.com.", want: "example.com."},
+		{name: "a.sub.example.com.", want: "sub.example.com."},
+		{name: "SUB.Example.COM.", want: "sub.example.com."},
+		{name: "other.org.", want: ""},
+	}
+	for _, tt := range tests {
+		if got := j.ZoneFor(tt.name); got != tt.want {
+			t.Errorf("ZoneFor(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestJournal_Zone(t *testing.T) {
+	j := NewJournal(setupJournalStorage(t), 0)
+
+	soa, records, serial, ok := j.Zone("example.com.")
+	if !ok {
+		t.Fatal("Zone(example.com.) not found")
+	}
+	if soa == nil || soa.Type != types.RecordTypeSOA {
+		t.Errorf("Zone() soa = %v, want SOA record", soa)
+	}
+	// The child zone's records are not part of the parent.
+	if len(records) != 2 {
+		t.Errorf("Zone() returned %d records, want 2: %v", len(records), records)
+	}
+	if s, _ := j.Serial("example.com."); s != serial {
+		t.Errorf("Serial() = %d, want %d", s, serial)
+	}
+
+	if _, _, _, ok := j.Zone("other.org."); ok {
+		t.Error("Zone(other.org.) should not exist without an SOA")
+	}
+}
+
+func TestJournal_SyncAndSince(t *testing.T) {
+	store := setupJournalStorage(t)
+	j := NewJournal(store, 0)
+	ctx := context.Background()
+
+	start, _ := j.Serial("example.com.")
+	subStart, _ := j.Serial("sub.example.com.")
+
+	_ = store.Update(ctx, &types.DNSRecord{Name: "www.example.com.", Type: types.RecordTypeA, TTL: 300, Value: []string{"192.168.1.3"}})
+	j.Sync()
+	mid, _ := j.Serial("example.com.")
+	if mid <= start {
+		t.Fatalf("serial after update = %d, want > %d", mid, start)
+	}
+
+	_ = store.Delete(ctx, "example.com.", types.RecordTypeA)
+	_ = store.Create(ctx, &types.DNSRecord{Name: "new.example.com.", Type: types.RecordTypeTXT, TTL: 300, Value: []string{"hello"}})
+	j.Sync()
+	end, _ := j.Serial("example.com.")
+
+	if s, _ := j.Serial("sub.example.com."); s != subStart {
+		t.Errorf("unchanged zone serial moved from %d to %d", subStart, s)
+	}
+
+	entries, ok := j.Since("example.com.", start)
+	if !ok {
+		t.Fatal("Since(start) should have full history")
+	}
+	if len(entries) != 2 {
+		t.Fatalf("Since(start) returned %d entries, want 2", len(entries))
+	}
+	if entries[0].From != start || entries[0].Serial != mid || entries[1].From != mid || entries[1].Serial != end {
+		t.Errorf("unexpected serial chain: %+v", entries)
+	}
+	if len(entries[0].Deleted) != 1 || len(entries[0].Added) != 1 || entries[0].Added[0].Value[0] != "192.168.1.3" {
+		t.Errorf("update entry = %+v, want one delete and one add", entries[0])
+	}
+	if len(entries[1].Deleted) != 1 || len(entries[1].Added) != 1 {
+		t.Errorf("second entry = %+v, want one delete and one add", entries[1])
+	}
+
+	if entries, ok := j.Since("example.com.", end); !ok || len(entries) != 0 {
+		t.Errorf("Since(current) = %v, %v, want empty and ok", entries, ok)
+	}
+	if _, ok := j.Since("example.com.", start-100); ok {
+		t.Error("Since(unknown serial) should report missing history")
+	}
+}
+
+func TestJournal_HistoryIsBounded(t *testing.T) {
+	store := setupJournalStorage(t)
+	j := NewJournal(store, 2)
+	ctx := context.Background()
+
+	start, _ := j.Serial("example.com.")
+	for _, ip := range []string{"1.1.1.1", "2.2.2.2", "3.3.3.3"} {
+		_ = store.Update(ctx, &types.DNSRecord{Name: "www.example.com.", Type: types.RecordTypeA, TTL: 300, Value: []string{ip}})
+		j.Sync()
+	}
+
+	if _, ok := j.Since("example.com.", start); ok {
+		t.Error("Since(start) should fail once history is trimmed")
+	}
+}
+
+func TestJournal_SerialFileRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "serial")
+	ctx := context.Background()
+
+	// Many more changes than seconds pass before the restart.
+	store := setupJournalStorage(t)
+	j := NewJournal(store, 0)
+	if err := j.SetSerialFile(path); err != nil {
+		t.Fatalf("SetSerialFile() error = %v", err)
+	}
+	for i := range 100 {
+		_ = store.Update(ctx, &types.DNSRecord{Name: "www.example.com.", Type: types.RecordTypeA, TTL: 300, Value: []string{fmt.Sprintf("10.0.0.%d", i)}})
+		j.Sync()
+	}
+	before, _ := j.Serial("example.com.")
+
+	restarted := NewJournal(setupJournalStorage(t), 0)
+	if err := restarted.SetSerialFile(path); err != nil {
+		t.Fatalf("SetSerialFile() after restart error = %v", err)
+	}
+	for _, zone := range []string{"example.com.", "sub.example.com."} {
+		if after, _ := restarted.Serial(zone); !serialLess(before, after) {
+			t.Errorf("%s serial after restart = %d, want after %d", zone, after, before)
+		}
+	}
+}
+
+func TestSerialLess(t *testing.T) {
+	tests := []struct {
+		a, b uint32
+		want bool
+	}{
+		{a: 1, b: 2, want: true},
+		{a: 2, b: 1, want: false},
+		{a: 5, b: 5, want: false},
+		{a: 0xFFFFFFFF, b: 0, want: true}, // Wraps around
+		{a: 0, b: 0xFFFFFFFF, want: false},
+	}
+	for _, tt := range tests {
+		if got := serialLess(tt.a, tt.b); got != tt.want {
+			t.Errorf("serialLess(%d, %d) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestJournal_RunNotifiesSubscribers(t *testing.T) {
+	store := setupJournalStorage(t)
+	j := NewJournal(store, 0)
+	changed := make(chan string, 4)
+	j.Subscribe(changed)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go j.Run(ctx)
+	time.Sleep(50 * time.Millisecond)
+
+	_ = store.Create(ctx, &types.DNSRecord{Name: "b.sub.example.com.", Type: types.RecordTypeA, TTL: 300, Value: []string{"10.0.0.2"}})
+
+	select {
+	case zone := <-changed:
+		if zone != "sub.example.com." {
+			t.Errorf("changed zone = %q, want sub.example.com.", zone)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for zone change notification")
+	}
+}
@@ -3,6 +3,7 @@ package storage
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
 	"os"
@@ -10,9 +11,10 @@ import (
 	"sync"
 	"time"
 
+	"jabberwocky238/jw238dns/metrics"
 	"jabberwocky238/jw238dns/types"
 
-	"github.com/fsnotify/fsnotify"
+	"go.opentelemetry.io/otel/codes"
 )
 
 // JSONFileLoader loads DNS records from a JSON file and watches it for
@@ -23,7 +25,9 @@ type JSONFileLoader struct {
 	store *MemoryStorage
 
 	mu      sync.Mutex
-	syncing bool // guards against echo loops during bidirectional sync
+	syncing bool               // guards against echo loops during bidirectional sync
+	synced  []*types.DNSRecord // file contents as of the last load or save; nil before either
+	loadErr error              // why the file was last rejected; nil once it loads again
 }
 
 // NewJSONFileLoader creates a JSONFileLoader for the given file path.
@@ -52,17 +56,74 @@ func (l *JSONFileLoader) Load() ([]*types.DNSRecord, error) {
 
 	var records []*types.DNSRecord
 	if err := json.Unmarshal(data, &records); err != nil {
+		var syntaxErr *json.SyntaxError
+		if errors.As(err, &syntaxErr) {
+			line, col := lineColumn(data, syntaxErr.Offset)
+			return nil, fmt.Errorf("unmarshal json: line %d, column %d: %w", line, col, err)
+		}
 		return nil, fmt.Errorf("unmarshal json: %w", err)
 	}
+	if err := validateRecords(records); err != nil {
+		return nil, err
+	}
 
 	return records, nil
 }
 
+// validateRecords rejects records the store cannot serve and duplicate
+// name/type pairs, which would otherwise silently shadow each other.
+func validateRecords(records []*types.DNSRecord) error {
+	seen := make(map[types.RecordKey]int, len(records))
+	for i, r := range records {
+		if r == nil {
+			return fmt.Errorf("record %d: null record", i)
+		}
+		if r.Name == "" {
+			return fmt.Errorf("record %d: %w", i, types.ErrInvalidName)
+		}
+		if !r.Type.IsValid() {
+			return fmt.Errorf("record %d (%s): %w %q", i, r.Name, types.ErrInvalidRecordType, r.Type)
+		}
+		if len(r.Value) == 0 {
+			return fmt.Errorf("record %d (%s %s): no values", i, r.Name, r.Type)
+		}
+		key := types.RecordKey{Name: r.Name, Type: r.Type}
+		if first, ok := seen[key]; ok {
+			return fmt.Errorf("record %d (%s %s): duplicates record %d", i, r.Name, r.Type, first)
+		}
+		seen[key] = i
+	}
+	return nil
+}
+
+// lineColumn converts a byte offset in data into a 1-based line and
+// column.
+func lineColumn(data []byte, offset int64) (int, int) {
+	line, col := 1, 1
+	for _, b := range data[:min(offset, int64(len(data)))] {
+		if b == '\n' {
+			line++
+			col = 1
+			continue
+		}
+		col++
+	}
+	return line, col
+}
+
 // LoadAndApply reads the JSON file and applies the records to the store
-// using CalculateChanges + PartialReload.
+// using CalculateChanges + PartialReload. An invalid file leaves the store
+// untouched, and Save refuses to overwrite it until it loads again.
 func (l *JSONFileLoader) LoadAndApply(ctx context.Context) error {
 	records, err := l.Load()
+	l.mu.Lock()
+	l.loadErr = err
+	if err == nil {
+		l.synced = append([]*types.DNSRecord{}, records...)
+	}
+	l.mu.Unlock()
 	if err != nil {
+		metrics.ObserveReload("file", err)
 		return err
 	}
 
@@ -81,78 +142,48 @@ func (l *JSONFileLoader) LoadAndApply(ctx context.Context) error {
 		return nil
 	}
 
-	return l.store.PartialReload(ctx, changes)
+	err = l.store.PartialReload(ctx, changes)
+	metrics.ObserveReload("file", err)
+	return err
 }
 
 // Watch uses fsnotify to watch the JSON file for changes. On each write
 // event it reloads the file and applies changes to the store. It blocks
 // until the context is cancelled.
 func (l *JSONFileLoader) Watch(ctx context.Context) error {
-	watcher, err := fsnotify.NewWatcher()
-	if err != nil {
-		return fmt.Errorf("create fsnotify watcher: %w", err)
-	}
-	defer watcher.Close()
-
-	// Watch the directory so we catch atomic rename-based writes.
-	dir := filepath.Dir(l.path)
-	if err := watcher.Add(dir); err != nil {
-		return fmt.Errorf("watch directory %s: %w", dir, err)
-	}
-
-	// Debounce timer to coalesce rapid writes.
-	var debounce *time.Timer
-
-	for {
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		case event, ok := <-watcher.Events:
-			if !ok {
-				return nil
-			}
-			// Only react to writes/creates for our specific file.
-			absEvent, _ := filepath.Abs(event.Name)
-			absPath, _ := filepath.Abs(l.path)
-			if absEvent != absPath {
-				continue
-			}
-			if event.Op&(fsnotify.Write|fsnotify.Create) == 0 {
-				continue
-			}
-
-			// Debounce: wait a short period before reloading.
-			if debounce != nil {
-				debounce.Stop()
-			}
-			debounce = time.AfterFunc(100*time.Millisecond, func() {
-				if err := l.LoadAndApply(ctx); err != nil {
-					slog.Error("reload json file", "err", err)
-				}
-			})
-		case err, ok := <-watcher.Errors:
-			if !ok {
-				return nil
-			}
-			slog.Warn("fsnotify error", "err", err)
+	return WatchFiles(ctx, []string{l.path}, func() {
+		if err := l.LoadAndApply(ctx); err != nil {
+			slog.Error("reload json file", "err", err)
 		}
-	}
+	})
 }
 
 // Save writes the current storage contents to the JSON file using an
-// atomic write (write to temp file, then rename).
+// atomic write (write to temp file, then rename). It does nothing when the
+// file already holds the same records, and refuses to overwrite a file
+// that failed to load so that hand edits in progress are not lost.
 func (l *JSONFileLoader) Save(ctx context.Context) error {
 	l.mu.Lock()
 	if l.syncing {
 		l.mu.Unlock()
 		return nil // skip echo
 	}
+	synced, loadErr := l.synced, l.loadErr
 	l.mu.Unlock()
+	if loadErr != nil {
+		return fmt.Errorf("not overwriting invalid json file %s: %w", l.path, loadErr)
+	}
 
-	records, err := l.store.List(ctx)
+	records, err := l.store.ListPersistent(ctx)
 	if err != nil {
 		return fmt.Errorf("list records: %w", err)
 	}
+	if synced != nil {
+		changes := DiffRecords(synced, records)
+		if len(changes.Added) == 0 && len(changes.Updated) == 0 && len(changes.Deleted) == 0 {
+			return nil // file is already up to date
+		}
+	}
 
 	// If records is nil, marshal as empty array.
 	if records == nil {
@@ -192,34 +223,70 @@ func (l *JSONFileLoader) Save(ctx context.Context) error {
 		return fmt.Errorf("rename temp file: %w", err)
 	}
 
+	l.mu.Lock()
+	l.synced = records
+	l.mu.Unlock()
+
 	slog.Info("persisted records to json file", "path", l.path, "records", len(records))
 	return nil
 }
 
 // WatchAndSync starts both the file watcher and a goroutine that listens
 // on the storage Watch channel to persist changes back to the JSON file.
-// It blocks until ctx is cancelled.
+// Bursts of storage changes are coalesced into one write. It blocks until
+// ctx is cancelled, then writes any change not yet persisted before
+// returning.
 func (l *JSONFileLoader) WatchAndSync(ctx context.Context) error {
 	ch, err := l.store.Watch(ctx)
 	if err != nil {
 		return fmt.Errorf("watch storage: %w", err)
 	}
 
+	done := make(chan struct{})
 	go func() {
-		for {
-			select {
-			case <-ctx.Done():
-				return
-			case _, ok := <-ch:
-				if !ok {
-					return
-				}
-				if err := l.Save(ctx); err != nil {
-					slog.Error("persist to json file", "err", err)
-				}
-			}
-		}
+		defer close(done)
+		l.persist(ctx, ch)
 	}()
 
-	return l.Watch(ctx)
+	err = l.Watch(ctx)
+	<-done
+	return err
+}
+
+// persist saves the store after each burst of events on ch, and once
+// more when ctx is cancelled.
+func (l *JSONFileLoader) persist(ctx context.Context, ch <-chan types.StorageEvent) {
+	timer := time.NewTimer(watchDebounce)
+	timer.Stop()
+	var last types.StorageEvent
+
+	save := func(ctx context.Context) {
+		pctx, span := tracer.Start(ctx, "JSONFileLoader.Save", linkEvent(last)...)
+		defer span.End()
+		if err := l.Save(pctx); err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			slog.Error("persist to json file", "err", err)
+		}
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			// Flush whatever is not on disk yet; Save is a no-op otherwise.
+			save(context.WithoutCancel(ctx))
+			return
+		case ev, ok := <-ch:
+			if !ok {
+				// The storage watch ends with ctx; flush on the next loop.
+				ch = nil
+				continue
+			}
+			last = ev
+			timer.Reset(watchDebounce)
+		case <-timer.C:
+			save(ctx)
+		}
+	}
 }
@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
@@ -46,6 +47,30 @@ func TestJSONFileLoader_Load(t *testing.T) {
 			content: "",
 			create:  true,
 		},
+		{
+			name:    "missing name",
+			content: `[{"type":"A","ttl":300,"value":["1.2.3.4"]}]`,
+			create:  true,
+			wantErr: true,
+		},
+		{
+			name:    "unknown type",
+			content: `[{"name":"a.com.","type":"BOGUS","ttl":300,"value":["1.2.3.4"]}]`,
+			create:  true,
+			wantErr: true,
+		},
+		{
+			name:    "no values",
+			content: `[{"name":"a.com.","type":"A","ttl":300,"value":[]}]`,
+			create:  true,
+			wantErr: true,
+		},
+		{
+			name:    "duplicate name and type",
+			content: `[{"name":"a.com.","type":"A","ttl":300,"value":["1.2.3.4"]},{"name":"a.com.","type":"A","ttl":60,"value":["5.6.7.8"]}]`,
+			create:  true,
+			wantErr: true,
+		},
 	}
 
 	for _, tt := range tests {
@@ -397,6 +422,39 @@ func TestJSONFileLoader_RoundTrip(t *testing.T) {
 	}
 }
 
+func TestJSONFileLoader_RoundTripMetadata(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "records.json")
+	ctx := context.Background()
+	meta := &types.RecordMeta{
+		Owner:     "cert-manager",
+		Source:    types.SourceHTTP,
+		CreatedAt: time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC),
+		UpdatedAt: time.Date(2026, 2, 3, 4, 5, 6, 0, time.UTC),
+		Labels:    map[string]string{"team": "web"},
+		Comment:   "challenge",
+	}
+
+	store := NewMemoryStorage()
+	_ = store.Create(ctx, &types.DNSRecord{
+		Name: "meta.com.", Type: types.RecordTypeTXT, TTL: 60, Value: []string{"token"}, Meta: meta,
+	})
+	if err := NewJSONFileLoader(path, store).Save(ctx); err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+
+	store2 := NewMemoryStorage()
+	if err := NewJSONFileLoader(path, store2).LoadAndApply(ctx); err != nil {
+		t.Fatalf("LoadAndApply() error = %v", err)
+	}
+	recs, err := store2.Get(ctx, "meta.com.", types.RecordTypeTXT)
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	if !recs[0].Meta.Equal(meta) {
+		t.Errorf("Meta after round trip = %+v, want %+v", recs[0].Meta, meta)
+	}
+}
+
 func TestJSONFileLoader_WatchAndSync(t *testing.T) {
 	dir := t.TempDir()
 	path := filepath.Join(dir, "records.json")
@@ -512,3 +570,112 @@ func TestJSONFileLoader_Save_OverwritesExisting(t *testing.T) {
 		t.Errorf("expected [new.com.], got %v", records)
 	}
 }
+
+func TestJSONFileLoader_Load_SyntaxErrorPosition(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "records.json")
+	content := "[\n  {\"name\": \"a.com.\",\n   \"type\": \"A\" oops}\n]"
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+
+	_, err := NewJSONFileLoader(path, NewMemoryStorage()).Load()
+	if err == nil || !strings.Contains(err.Error(), "line 3") {
+		t.Errorf("Load() error = %v, want it to name line 3", err)
+	}
+}
+
+func TestJSONFileLoader_Save_RefusesAfterInvalidLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "records.json")
+	const broken = `[{"name":"a.com.","type":"A"`
+	if err := os.WriteFile(path, []byte(broken), 0o644); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+
+	store := NewMemoryStorage()
+	ctx := context.Background()
+	loader := NewJSONFileLoader(path, store)
+	if err := loader.LoadAndApply(ctx); err == nil {
+		t.Fatal("LoadAndApply() of invalid file should fail")
+	}
+
+	_ = store.Create(ctx, &types.DNSRecord{Name: "b.com.", Type: types.RecordTypeA, TTL: 300, Value: []string{"2.2.2.2"}})
+	if err := loader.Save(ctx); err == nil {
+		t.Error("Save() after invalid load should fail")
+	}
+	if data, _ := os.ReadFile(path); string(data) != broken {
+		t.Errorf("invalid file was overwritten: %q", data)
+	}
+
+	// Once the file is fixed, saving works again.
+	if err := os.WriteFile(path, []byte("[]"), 0o644); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+	if err := loader.LoadAndApply(ctx); err != nil {
+		t.Fatalf("LoadAndApply() error = %v", err)
+	}
+	_ = store.Create(ctx, &types.DNSRecord{Name: "c.com.", Type: types.RecordTypeA, TTL: 300, Value: []string{"3.3.3.3"}})
+	if err := loader.Save(ctx); err != nil {
+		t.Errorf("Save() after fix error = %v", err)
+	}
+}
+
+func TestJSONFileLoader_Save_SkipsUnchanged(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "records.json")
+	// Hand-written formatting must survive a save that changes nothing.
+	const content = `[{"name":"a.com.","type":"A","ttl":300,"value":["1.2.3.4"]}]`
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+
+	ctx := context.Background()
+	loader := NewJSONFileLoader(path, NewMemoryStorage())
+	if err := loader.LoadAndApply(ctx); err != nil {
+		t.Fatalf("LoadAndApply() error = %v", err)
+	}
+	if err := loader.Save(ctx); err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+	if data, _ := os.ReadFile(path); string(data) != content {
+		t.Errorf("unchanged records rewrote the file: %q", data)
+	}
+}
+
+func TestJSONFileLoader_WatchAndSync_FlushesOnCancel(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "records.json")
+	if err := os.WriteFile(path, []byte("[]"), 0o644); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+
+	store := NewMemoryStorage()
+	loader := NewJSONFileLoader(path, store)
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := loader.LoadAndApply(ctx); err != nil {
+		t.Fatalf("LoadAndApply() error = %v", err)
+	}
+
+	syncErr := make(chan error, 1)
+	go func() {
+		syncErr <- loader.WatchAndSync(ctx)
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	// Cancel before the debounced write fires; the change must still land.
+	_ = store.Create(ctx, &types.DNSRecord{Name: "late.com.", Type: types.RecordTypeA, TTL: 300, Value: []string{"9.9.9.9"}})
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+
+	select {
+	case <-syncErr:
+	case <-time.After(2 * time.Second):
+		t.Fatal("WatchAndSync() did not return after cancel")
+	}
+
+	data, _ := os.ReadFile(path)
+	var records []*types.DNSRecord
+	if err := json.Unmarshal(data, &records); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	if len(records) != 1 || records[0].Name != "late.com." {
+		t.Errorf("file after shutdown = %v, want [late.com.]", records)
+	}
+}
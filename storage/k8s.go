@@ -1,19 +1,88 @@
 package storage
 
 import (
+	"errors"
 	"fmt"
 
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
 )
 
-// NewK8sClient creates a Kubernetes client using in-cluster configuration.
-// This function must be called from within a Kubernetes pod.
-func NewK8sClient() (kubernetes.Interface, error) {
-	// Use in-cluster config (required for running inside K8s)
-	config, err := rest.InClusterConfig()
+// K8sClientConfig selects how Kubernetes clients reach the API server.
+// The zero value uses the in-cluster configuration, falling back to the
+// default kubeconfig ($KUBECONFIG or ~/.kube/config) outside a cluster.
+type K8sClientConfig struct {
+	Kubeconfig string // Kubeconfig path; set with Context to skip in-cluster config
+	Context    string // Kubeconfig context; empty uses the current context
+
+	ImpersonateUser   string   // Act as this user
+	ImpersonateGroups []string // Act as a member of these groups
+
+	QPS   float32 // Client-side rate limit; 0 uses the client-go default
+	Burst int     // Client-side burst; 0 uses the client-go default
+}
+
+// NewK8sRESTConfig returns the REST configuration described by cfg. With
+// neither a kubeconfig path nor a context set, the in-cluster
+// configuration is tried first.
+func NewK8sRESTConfig(cfg K8sClientConfig) (*rest.Config, error) {
+	var config *rest.Config
+	if cfg.Kubeconfig == "" && cfg.Context == "" {
+		inCluster, err := rest.InClusterConfig()
+		if err == nil {
+			config = inCluster
+		} else {
+			kubeconfig, kerr := loadKubeconfig(cfg)
+			if kerr != nil {
+				return nil, fmt.Errorf("no kubernetes configuration: in-cluster: %w; kubeconfig: %w", err, kerr)
+			}
+			config = kubeconfig
+		}
+	} else {
+		kubeconfig, err := loadKubeconfig(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("load kubeconfig: %w", err)
+		}
+		config = kubeconfig
+	}
+
+	if cfg.ImpersonateUser != "" || len(cfg.ImpersonateGroups) > 0 {
+		config.Impersonate = rest.ImpersonationConfig{
+			UserName: cfg.ImpersonateUser,
+			Groups:   cfg.ImpersonateGroups,
+		}
+	}
+	if cfg.QPS > 0 {
+		config.QPS = cfg.QPS
+	}
+	if cfg.Burst > 0 {
+		config.Burst = cfg.Burst
+	}
+	return config, nil
+}
+
+// loadKubeconfig loads cfg.Kubeconfig, or the default kubeconfig if it is
+// empty, selecting cfg.Context.
+func loadKubeconfig(cfg K8sClientConfig) (*rest.Config, error) {
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	if cfg.Kubeconfig != "" {
+		rules.ExplicitPath = cfg.Kubeconfig
+	}
+	overrides := &clientcmd.ConfigOverrides{CurrentContext: cfg.Context}
+	config, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, overrides).ClientConfig()
+	if clientcmd.IsEmptyConfig(err) {
+		return nil, errors.New("no kubeconfig found; set kubeconfig or KUBECONFIG")
+	}
+	return config, err
+}
+
+// NewK8sClient creates a Kubernetes client configured by cfg.
+func NewK8sClient(cfg K8sClientConfig) (kubernetes.Interface, error) {
+	config, err := NewK8sRESTConfig(cfg)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get in-cluster config: %w", err)
+		return nil, err
 	}
 
 	clientset, err := kubernetes.NewForConfig(config)
@@ -23,3 +92,19 @@ func NewK8sClient() (kubernetes.Interface, error) {
 
 	return clientset, nil
 }
+
+// NewK8sDynamicClient creates a dynamic Kubernetes client, used for custom
+// resources, configured by cfg.
+func NewK8sDynamicClient(cfg K8sClientConfig) (dynamic.Interface, error) {
+	config, err := NewK8sRESTConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := dynamic.NewForConfig(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create dynamic client: %w", err)
+	}
+
+	return client, nil
+}
@@ -1,13 +1,46 @@
 package storage
 
 import (
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 )
 
+const testKubeconfig = `apiVersion: v1
+kind: Config
+clusters:
+- name: dev
+  cluster:
+    server: https://dev.example.com:6443
+- name: prod
+  cluster:
+    server: https://prod.example.com:6443
+users:
+- name: admin
+  user:
+    token: secret
+contexts:
+- name: dev
+  context: {cluster: dev, user: admin}
+- name: prod
+  context: {cluster: prod, user: admin}
+current-context: dev
+`
+
+func writeKubeconfig(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config")
+	if err := os.WriteFile(path, []byte(testKubeconfig), 0o600); err != nil {
+		t.Fatalf("write kubeconfig: %v", err)
+	}
+	return path
+}
+
 func TestNewK8sClient(t *testing.T) {
 	// This test will fail outside of a Kubernetes cluster
 	// as it requires in-cluster configuration
-	_, err := NewK8sClient()
+	_, err := NewK8sClient(K8sClientConfig{})
 
 	// We expect an error when running outside K8s
 	if err == nil {
@@ -16,3 +49,60 @@ func TestNewK8sClient(t *testing.T) {
 		t.Logf("Expected error outside K8s cluster: %v", err)
 	}
 }
+
+func TestNewK8sRESTConfig_Kubeconfig(t *testing.T) {
+	path := writeKubeconfig(t)
+
+	config, err := NewK8sRESTConfig(K8sClientConfig{
+		Kubeconfig:        path,
+		Context:           "prod",
+		ImpersonateUser:   "jw238dns",
+		ImpersonateGroups: []string{"dns-admins"},
+		QPS:               50,
+		Burst:             100,
+	})
+	if err != nil {
+		t.Fatalf("NewK8sRESTConfig() error = %v", err)
+	}
+	if config.Host != "https://prod.example.com:6443" {
+		t.Errorf("Host = %q, want the prod context's server", config.Host)
+	}
+	if config.Impersonate.UserName != "jw238dns" || len(config.Impersonate.Groups) != 1 {
+		t.Errorf("Impersonate = %+v", config.Impersonate)
+	}
+	if config.QPS != 50 || config.Burst != 100 {
+		t.Errorf("QPS, Burst = %v, %v, want 50, 100", config.QPS, config.Burst)
+	}
+
+	config, err = NewK8sRESTConfig(K8sClientConfig{Kubeconfig: path})
+	if err != nil || config.Host != "https://dev.example.com:6443" {
+		t.Errorf("NewK8sRESTConfig() current context = %v, %v, want dev server", config, err)
+	}
+	if _, err := NewK8sRESTConfig(K8sClientConfig{Kubeconfig: path, Context: "missing"}); err == nil {
+		t.Error("NewK8sRESTConfig() with unknown context succeeded")
+	}
+}
+
+func TestNewK8sRESTConfig_FallsBackToKubeconfig(t *testing.T) {
+	t.Setenv("KUBERNETES_SERVICE_HOST", "")
+	t.Setenv("KUBECONFIG", writeKubeconfig(t))
+
+	config, err := NewK8sRESTConfig(K8sClientConfig{})
+	if err != nil || config.Host != "https://dev.example.com:6443" {
+		t.Fatalf("NewK8sRESTConfig() = %v, %v, want the KUBECONFIG cluster", config, err)
+	}
+}
+
+func TestNewK8sRESTConfig_NoConfiguration(t *testing.T) {
+	t.Setenv("KUBERNETES_SERVICE_HOST", "")
+	t.Setenv("KUBECONFIG", filepath.Join(t.TempDir(), "missing"))
+	t.Setenv("HOME", t.TempDir())
+
+	_, err := NewK8sRESTConfig(K8sClientConfig{})
+	if err == nil {
+		t.Fatal("NewK8sRESTConfig() succeeded with no configuration")
+	}
+	if msg := err.Error(); !strings.Contains(msg, "in-cluster") || !strings.Contains(msg, "kubeconfig") {
+		t.Errorf("error = %q, want both sources explained", msg)
+	}
+}
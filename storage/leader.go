@@ -0,0 +1,201 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync/atomic"
+	"time"
+
+	"jabberwocky238/jw238dns/types"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+// LeaderElectionConfig configures leader election among replicas sharing a
+// ConfigMap. The leader holds a coordination.k8s.io Lease in the
+// ConfigMap's namespace.
+type LeaderElectionConfig struct {
+	LeaseName     string
+	Identity      string // Unique per replica, typically the pod name
+	LeaseDuration time.Duration
+	RenewDeadline time.Duration
+	RetryPeriod   time.Duration
+}
+
+// DefaultLeaderElectionConfig returns the client-go recommended timings
+// for the given lease and identity.
+func DefaultLeaderElectionConfig(leaseName, identity string) LeaderElectionConfig {
+	return LeaderElectionConfig{
+		LeaseName:     leaseName,
+		Identity:      identity,
+		LeaseDuration: 15 * time.Second,
+		RenewDeadline: 10 * time.Second,
+		RetryPeriod:   2 * time.Second,
+	}
+}
+
+// EnableLeaderElection makes the watcher take part in leader election when
+// WatchAndSync runs; only the leader then persists to the ConfigMap. It
+// must be called before WatchAndSync.
+func (w *ConfigMapWatcher) EnableLeaderElection(cfg LeaderElectionConfig) {
+	w.lead.config = &cfg
+}
+
+// IsLeader reports whether this replica persists to the ConfigMap: always
+// without leader election, otherwise while it holds the lease.
+func (w *ConfigMapWatcher) IsLeader() bool {
+	return w.lead.isLeader()
+}
+
+// CheckLeader returns nil if this replica is the leader, or an error
+// wrapping types.ErrNotLeader that names the current leader.
+func (w *ConfigMapWatcher) CheckLeader() error {
+	return w.lead.check()
+}
+
+// runLeaderElection campaigns for the lease, persisting whatever reached
+// the store while following whenever leadership is gained.
+func (w *ConfigMapWatcher) runLeaderElection(ctx context.Context) error {
+	return w.lead.run(ctx, w.client, w.namespace, func(ctx context.Context) {
+		if err := w.PersistToConfigMap(ctx); err != nil {
+			slog.Error("persist to configmap", "err", err)
+		}
+	})
+}
+
+// leadership is a replica's part in leader election. The shards of a
+// ShardedConfigMapWatcher share one.
+type leadership struct {
+	config *LeaderElectionConfig // nil: every replica leads
+	leader atomic.Bool
+	holder atomic.Value // string identity of the current lease holder
+}
+
+func (l *leadership) isLeader() bool {
+	return l.config == nil || l.leader.Load()
+}
+
+func (l *leadership) check() error {
+	if l.isLeader() {
+		return nil
+	}
+	holder, _ := l.holder.Load().(string)
+	if holder == "" {
+		return fmt.Errorf("%w: no leader elected yet", types.ErrNotLeader)
+	}
+	return fmt.Errorf("%w: current leader is %s", types.ErrNotLeader, holder)
+}
+
+// run campaigns for the lease in namespace until ctx is cancelled,
+// standing again whenever leadership is lost, and calls onStarted each
+// time it is gained. The lease is released on cancellation so another
+// replica takes over without waiting for expiry.
+func (l *leadership) run(ctx context.Context, client kubernetes.Interface, namespace string, onStarted func(context.Context)) error {
+	cfg := *l.config
+	elector, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Lock: &resourcelock.LeaseLock{
+			LeaseMeta:  metav1.ObjectMeta{Name: cfg.LeaseName, Namespace: namespace},
+			Client:     client.CoordinationV1(),
+			LockConfig: resourcelock.ResourceLockConfig{Identity: cfg.Identity},
+		},
+		LeaseDuration:   cfg.LeaseDuration,
+		RenewDeadline:   cfg.RenewDeadline,
+		RetryPeriod:     cfg.RetryPeriod,
+		ReleaseOnCancel: true,
+		Name:            cfg.LeaseName,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(ctx context.Context) {
+				l.leader.Store(true)
+				slog.Info("became configmap leader", "lease", cfg.LeaseName, "identity", cfg.Identity)
+				onStarted(ctx)
+			},
+			OnStoppedLeading: func() {
+				l.leader.Store(false)
+				slog.Info("stopped leading configmap", "lease", cfg.LeaseName, "identity", cfg.Identity)
+			},
+			OnNewLeader: func(identity string) {
+				l.holder.Store(identity)
+			},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("leader election: %w", err)
+	}
+	for ctx.Err() == nil {
+		elector.Run(ctx)
+	}
+	return ctx.Err()
+}
+
+// LeaderOnlyStorage passes reads through to a CoreStorage and rejects
+// writes while check returns an error. With leader election, followers
+// wrap their store in it so that API writes are not silently dropped: a
+// follower never persists, and its store is replaced from the ConfigMap.
+type LeaderOnlyStorage struct {
+	CoreStorage
+	check func() error
+}
+
+// NewLeaderOnlyStorage returns a LeaderOnlyStorage over s gated by check,
+// typically ConfigMapWatcher.CheckLeader.
+func NewLeaderOnlyStorage(s CoreStorage, check func() error) *LeaderOnlyStorage {
+	return &LeaderOnlyStorage{CoreStorage: s, check: check}
+}
+
+// ListPersistent returns the records of the wrapped storage except those
+// synthesized by a source.
+func (s *LeaderOnlyStorage) ListPersistent(ctx context.Context) ([]*types.DNSRecord, error) {
+	return ListPersistent(ctx, s.CoreStorage)
+}
+
+// Create implements CoreStorage.
+func (s *LeaderOnlyStorage) Create(ctx context.Context, record *types.DNSRecord) error {
+	if err := s.check(); err != nil {
+		return err
+	}
+	return s.CoreStorage.Create(ctx, record)
+}
+
+// Update implements CoreStorage.
+func (s *LeaderOnlyStorage) Update(ctx context.Context, record *types.DNSRecord) error {
+	if err := s.check(); err != nil {
+		return err
+	}
+	return s.CoreStorage.Update(ctx, record)
+}
+
+// Delete implements CoreStorage.
+func (s *LeaderOnlyStorage) Delete(ctx context.Context, name string, recordType types.RecordType) error {
+	if err := s.check(); err != nil {
+		return err
+	}
+	return s.CoreStorage.Delete(ctx, name, recordType)
+}
+
+// HotReload implements CoreStorage.
+func (s *LeaderOnlyStorage) HotReload(ctx context.Context, records []*types.DNSRecord) error {
+	if err := s.check(); err != nil {
+		return err
+	}
+	return s.CoreStorage.HotReload(ctx, records)
+}
+
+// PartialReload implements CoreStorage.
+func (s *LeaderOnlyStorage) PartialReload(ctx context.Context, changes *types.RecordChanges) error {
+	if err := s.check(); err != nil {
+		return err
+	}
+	return s.CoreStorage.PartialReload(ctx, changes)
+}
+
+// Transaction implements CoreStorage.
+func (s *LeaderOnlyStorage) Transaction(ctx context.Context, fn func(tx *Tx) error) error {
+	if err := s.check(); err != nil {
+		return err
+	}
+	return s.CoreStorage.Transaction(ctx, fn)
+}
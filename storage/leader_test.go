@@ -0,0 +1,110 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"jabberwocky238/jw238dns/types"
+
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestConfigMapWatcher_LeaderElection(t *testing.T) {
+	fakeClient := fake.NewSimpleClientset(recordsConfigMap(t))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var watchers []*ConfigMapWatcher
+	for _, id := range []string{"replica-0", "replica-1"} {
+		w := NewConfigMapWatcher(fakeClient, "default", "jw238dns-config", "config.yaml", NewMemoryStorage())
+		w.EnableLeaderElection(LeaderElectionConfig{
+			LeaseName:     "jw238dns-leader",
+			Identity:      id,
+			LeaseDuration: time.Second,
+			RenewDeadline: 500 * time.Millisecond,
+			RetryPeriod:   100 * time.Millisecond,
+		})
+		if w.IsLeader() {
+			t.Fatalf("%s is leader before the election ran", id)
+		}
+		go w.WatchAndSync(ctx)
+		watchers = append(watchers, w)
+	}
+
+	var leader, follower *ConfigMapWatcher
+	deadline := time.Now().Add(5 * time.Second)
+	for leader == nil && time.Now().Before(deadline) {
+		for i, w := range watchers {
+			if w.IsLeader() {
+				leader, follower = w, watchers[1-i]
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if leader == nil {
+		t.Fatal("no leader elected")
+	}
+	if follower.IsLeader() {
+		t.Fatal("both replicas lead")
+	}
+
+	err := follower.CheckLeader()
+	if !errors.Is(err, types.ErrNotLeader) {
+		t.Fatalf("follower CheckLeader() = %v, want ErrNotLeader", err)
+	}
+	if err := leader.CheckLeader(); err != nil {
+		t.Errorf("leader CheckLeader() = %v, want nil", err)
+	}
+
+	// A record reaching the follower's store directly is not persisted by
+	// it; the leader's is.
+	_ = follower.store.Create(ctx, aRecord("follower.com.", "1.1.1.1"))
+	_ = leader.store.Create(ctx, aRecord("leader.com.", "2.2.2.2"))
+	deadline = time.Now().Add(2 * time.Second)
+	for !configMapRecordNames(t, fakeClient)["leader.com."] && time.Now().Before(deadline) {
+		time.Sleep(20 * time.Millisecond)
+	}
+	names := configMapRecordNames(t, fakeClient)
+	if !names["leader.com."] {
+		t.Error("leader did not persist its record")
+	}
+	if names["follower.com."] {
+		t.Error("follower persisted its record")
+	}
+}
+
+func TestLeaderOnlyStorage(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStorage()
+	_ = store.Create(ctx, aRecord("a.com.", "1.1.1.1"))
+	leading := false
+	s := NewLeaderOnlyStorage(store, func() error {
+		if !leading {
+			return types.ErrNotLeader
+		}
+		return nil
+	})
+
+	writes := map[string]func() error{
+		"Create":        func() error { return s.Create(ctx, aRecord("b.com.", "2.2.2.2")) },
+		"Update":        func() error { return s.Update(ctx, aRecord("a.com.", "3.3.3.3")) },
+		"Delete":        func() error { return s.Delete(ctx, "a.com.", types.RecordTypeA) },
+		"HotReload":     func() error { return s.HotReload(ctx, nil) },
+		"PartialReload": func() error { return s.PartialReload(ctx, &types.RecordChanges{}) },
+	}
+	for name, write := range writes {
+		if err := write(); !errors.Is(err, types.ErrNotLeader) {
+			t.Errorf("%s() as follower error = %v, want ErrNotLeader", name, err)
+		}
+	}
+	if recs, err := s.Get(ctx, "a.com.", types.RecordTypeA); err != nil || recs[0].Value[0] != "1.1.1.1" {
+		t.Errorf("Get() as follower = %v, %v, want unchanged record", recs, err)
+	}
+
+	leading = true
+	if err := s.Create(ctx, aRecord("b.com.", "2.2.2.2")); err != nil {
+		t.Errorf("Create() as leader error = %v", err)
+	}
+}
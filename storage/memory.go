@@ -7,28 +7,51 @@ import (
 	"strings"
 	"sync"
 
+	"jabberwocky238/jw238dns/tracing"
 	"jabberwocky238/jw238dns/types"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
+// tracer traces storage calls and persistence.
+var tracer = tracing.Tracer()
+
 // MemoryStorage is a thread-safe in-memory implementation of CoreStorage.
 type MemoryStorage struct {
 	mu       sync.RWMutex
 	records  map[string]map[types.RecordType][]*types.DNSRecord // domain -> type -> records
 	version  uint64
-	watchers []chan types.StorageEvent
+	watchers []*watcher
 	watchMu  sync.Mutex
+
+	// events holds the latest events, oldest first, for WatchFrom.
+	// Guarded by mu.
+	events []types.StorageEvent
+
+	// sourced maps records synthesized by a source, such as Kubernetes
+	// discovery, to the source's name. They are served but not persisted.
+	// Guarded by mu.
+	sourced map[types.RecordKey]string
+
+	history *History // Guarded by mu
 }
 
 // NewMemoryStorage creates a new empty MemoryStorage.
 func NewMemoryStorage() *MemoryStorage {
 	return &MemoryStorage{
 		records: make(map[string]map[types.RecordType][]*types.DNSRecord),
+		sourced: make(map[types.RecordKey]string),
 	}
 }
 
 // Get returns all records matching the given name and type.
 // Supports wildcard matching: if exact match fails, tries wildcard patterns.
-func (s *MemoryStorage) Get(_ context.Context, name string, recordType types.RecordType) ([]*types.DNSRecord, error) {
+func (s *MemoryStorage) Get(ctx context.Context, name string, recordType types.RecordType) ([]*types.DNSRecord, error) {
+	_, span := tracer.Start(ctx, "MemoryStorage.Get")
+	defer span.End()
+	span.SetAttributes(recordAttrs(name, recordType)...)
+
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
@@ -47,9 +70,12 @@ func (s *MemoryStorage) Get(_ context.Context, name string, recordType types.Rec
 	// Try wildcard match: *.example.com matches test.example.com
 	recs := s.matchWildcard(name, recordType)
 	if len(recs) > 0 {
-		// Replace wildcard name with actual queried name
-		for _, rec := range recs {
-			rec.Name = name
+		// Replace wildcard name with actual queried name, on copies so
+		// the stored records keep theirs.
+		for i, rec := range recs {
+			cp := *rec
+			cp.Name = name
+			recs[i] = &cp
 		}
 		return recs, nil
 	}
@@ -106,7 +132,10 @@ func wildcardToRegex(wildcard string) string {
 }
 
 // List returns all stored DNS records.
-func (s *MemoryStorage) List(_ context.Context) ([]*types.DNSRecord, error) {
+func (s *MemoryStorage) List(ctx context.Context) ([]*types.DNSRecord, error) {
+	_, span := tracer.Start(ctx, "MemoryStorage.List")
+	defer span.End()
+
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
@@ -121,7 +150,11 @@ func (s *MemoryStorage) List(_ context.Context) ([]*types.DNSRecord, error) {
 
 // Create adds a new DNS record to storage. Returns ErrRecordExists if a
 // record with the same name and type already exists.
-func (s *MemoryStorage) Create(_ context.Context, record *types.DNSRecord) error {
+func (s *MemoryStorage) Create(ctx context.Context, record *types.DNSRecord) error {
+	_, span := tracer.Start(ctx, "MemoryStorage.Create")
+	defer span.End()
+	span.SetAttributes(recordAttrs(record.Name, record.Type)...)
+
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
@@ -134,14 +167,25 @@ func (s *MemoryStorage) Create(_ context.Context, record *types.DNSRecord) error
 
 	s.addRecordLocked(record)
 	s.version++
-
-	s.emit(types.StorageEvent{Type: types.EventAdded, Record: record})
+	changes := &types.RecordChanges{Added: []*types.DNSRecord{record}}
+	s.recordLocked(ctx, changes)
+
+	s.emit(types.StorageEvent{
+		Type:    types.EventAdded,
+		Record:  record,
+		Changes: changes,
+		Origin:  span.SpanContext(),
+	})
 	return nil
 }
 
 // Update replaces an existing DNS record. Returns ErrRecordNotFound if the
 // record does not exist.
-func (s *MemoryStorage) Update(_ context.Context, record *types.DNSRecord) error {
+func (s *MemoryStorage) Update(ctx context.Context, record *types.DNSRecord) error {
+	_, span := tracer.Start(ctx, "MemoryStorage.Update")
+	defer span.End()
+	span.SetAttributes(recordAttrs(record.Name, record.Type)...)
+
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
@@ -154,14 +198,26 @@ func (s *MemoryStorage) Update(_ context.Context, record *types.DNSRecord) error
 	}
 
 	s.updateRecordLocked(record)
+	delete(s.sourced, types.RecordKey{Name: record.Name, Type: record.Type})
 	s.version++
-
-	s.emit(types.StorageEvent{Type: types.EventUpdated, Record: record})
+	changes := &types.RecordChanges{Updated: []*types.DNSRecord{record}}
+	s.recordLocked(ctx, changes)
+
+	s.emit(types.StorageEvent{
+		Type:    types.EventUpdated,
+		Record:  record,
+		Changes: changes,
+		Origin:  span.SpanContext(),
+	})
 	return nil
 }
 
 // Delete removes a DNS record identified by name and type.
-func (s *MemoryStorage) Delete(_ context.Context, name string, recordType types.RecordType) error {
+func (s *MemoryStorage) Delete(ctx context.Context, name string, recordType types.RecordType) error {
+	_, span := tracer.Start(ctx, "MemoryStorage.Delete")
+	defer span.End()
+	span.SetAttributes(recordAttrs(name, recordType)...)
+
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
@@ -174,43 +230,68 @@ func (s *MemoryStorage) Delete(_ context.Context, name string, recordType types.
 	}
 
 	s.deleteRecordLocked(name, recordType)
+	delete(s.sourced, types.RecordKey{Name: name, Type: recordType})
 	s.version++
-
-	s.emit(types.StorageEvent{Type: types.EventDeleted, Record: &types.DNSRecord{Name: name, Type: recordType}})
+	changes := &types.RecordChanges{Deleted: []types.RecordKey{{Name: name, Type: recordType}}}
+	s.recordLocked(ctx, changes)
+
+	s.emit(types.StorageEvent{
+		Type:    types.EventDeleted,
+		Record:  &types.DNSRecord{Name: name, Type: recordType},
+		Changes: changes,
+		Origin:  span.SpanContext(),
+	})
 	return nil
 }
 
 // HotReload replaces all records atomically with the provided set.
-func (s *MemoryStorage) HotReload(_ context.Context, records []*types.DNSRecord) error {
+// Records synthesized by a source are kept unless the set replaces them.
+func (s *MemoryStorage) HotReload(ctx context.Context, records []*types.DNSRecord) error {
+	_, span := tracer.Start(ctx, "MemoryStorage.HotReload")
+	defer span.End()
+	span.SetAttributes(attribute.Int("dns.records", len(records)))
+
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	changes := DiffRecords(s.persistentLocked(), records)
+	var kept []*types.DNSRecord
+	for key := range s.sourced {
+		kept = append(kept, s.records[key.Name][key.Type]...)
+	}
 	s.records = make(map[string]map[types.RecordType][]*types.DNSRecord)
+	for _, r := range kept {
+		s.addRecordLocked(r)
+	}
 	for _, r := range records {
 		s.addRecordLocked(r)
+		delete(s.sourced, types.RecordKey{Name: r.Name, Type: r.Type})
 	}
 	s.version++
+	s.recordLocked(ctx, changes)
 
 	slog.Info("hot reload complete", "records", len(records), "version", s.version)
-	s.emit(types.StorageEvent{Type: types.EventReloaded})
+	s.emit(types.StorageEvent{Type: types.EventReloaded, Changes: changes, Origin: span.SpanContext()})
 	return nil
 }
 
-// PartialReload applies only the changed records atomically.
-func (s *MemoryStorage) PartialReload(_ context.Context, changes *types.RecordChanges) error {
+// PartialReload applies only the changed records atomically. Changed
+// records are no longer considered synthesized by a source.
+func (s *MemoryStorage) PartialReload(ctx context.Context, changes *types.RecordChanges) error {
+	_, span := tracer.Start(ctx, "MemoryStorage.PartialReload")
+	defer span.End()
+	span.SetAttributes(
+		attribute.Int("dns.added", len(changes.Added)),
+		attribute.Int("dns.updated", len(changes.Updated)),
+		attribute.Int("dns.deleted", len(changes.Deleted)),
+	)
+
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	for _, r := range changes.Added {
-		s.addRecordLocked(r)
-	}
-	for _, r := range changes.Updated {
-		s.updateRecordLocked(r)
-	}
-	for _, key := range changes.Deleted {
-		s.deleteRecordLocked(key.Name, key.Type)
-	}
+	s.applyChangesLocked(changes)
 	s.version++
+	s.recordLocked(ctx, changes)
 
 	slog.Info("partial reload complete",
 		"added", len(changes.Added),
@@ -218,33 +299,69 @@ func (s *MemoryStorage) PartialReload(_ context.Context, changes *types.RecordCh
 		"deleted", len(changes.Deleted),
 		"version", s.version,
 	)
-	s.emit(types.StorageEvent{Type: types.EventReloaded})
+	s.emit(types.StorageEvent{Type: types.EventReloaded, Changes: changes, Origin: span.SpanContext()})
 	return nil
 }
 
-// Watch returns a channel that receives storage change events. The channel
-// is closed when the provided context is cancelled.
-func (s *MemoryStorage) Watch(ctx context.Context) (<-chan types.StorageEvent, error) {
-	ch := make(chan types.StorageEvent, 64)
-
-	s.watchMu.Lock()
-	s.watchers = append(s.watchers, ch)
-	s.watchMu.Unlock()
-
-	go func() {
-		<-ctx.Done()
-		s.watchMu.Lock()
-		defer s.watchMu.Unlock()
-		for i, w := range s.watchers {
-			if w == ch {
-				s.watchers = append(s.watchers[:i], s.watchers[i+1:]...)
-				break
-			}
+// Transaction implements CoreStorage. The storage is locked while fn
+// runs, so fn is called once and sees no other writes; the changes are
+// applied like PartialReload.
+func (s *MemoryStorage) Transaction(ctx context.Context, fn func(tx *Tx) error) error {
+	_, span := tracer.Start(ctx, "MemoryStorage.Transaction")
+	defer span.End()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tx := newTx(func(key types.RecordKey) (*types.DNSRecord, error) {
+		if recs := s.records[key.Name][key.Type]; len(recs) > 0 {
+			return recs[0], nil
 		}
-		close(ch)
-	}()
+		return nil, nil
+	})
+	if err := fn(tx); err != nil {
+		return err
+	}
+	changes := tx.Changes()
+	span.SetAttributes(
+		attribute.Int("dns.added", len(changes.Added)),
+		attribute.Int("dns.updated", len(changes.Updated)),
+		attribute.Int("dns.deleted", len(changes.Deleted)),
+	)
+	if emptyChanges(changes) {
+		return nil
+	}
+
+	s.applyChangesLocked(changes)
+	s.version++
+	s.recordLocked(ctx, changes)
+
+	slog.Info("transaction committed",
+		"added", len(changes.Added),
+		"updated", len(changes.Updated),
+		"deleted", len(changes.Deleted),
+		"version", s.version,
+	)
+	s.emit(types.StorageEvent{Type: types.EventReloaded, Changes: changes, Origin: span.SpanContext()})
+	return nil
+}
+
+// SetHistory makes h record every change to the persistent records. It
+// should be called before the records are loaded: the first change is
+// recorded against the state h last recorded, so a load after a restart
+// records only what changed while the process was down.
+func (s *MemoryStorage) SetHistory(h *History) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.history = h
+}
 
-	return ch, nil
+// recordLocked records changes, made with ctx, in the history, if any.
+// Caller must hold s.mu.
+func (s *MemoryStorage) recordLocked(ctx context.Context, changes *types.RecordChanges) {
+	if s.history != nil {
+		s.history.record(ctx, changes, s.persistentLocked)
+	}
 }
 
 // Version returns the current storage version counter.
@@ -254,6 +371,60 @@ func (s *MemoryStorage) Version() uint64 {
 	return s.version
 }
 
+// Snapshot returns all stored records together with the storage version
+// they correspond to, read under a single lock.
+func (s *MemoryStorage) Snapshot() ([]*types.DNSRecord, uint64) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var all []*types.DNSRecord
+	for _, byType := range s.records {
+		for _, recs := range byType {
+			all = append(all, recs...)
+		}
+	}
+	return all, s.version
+}
+
+// CountByType returns the number of stored records for each record type.
+func (s *MemoryStorage) CountByType() map[types.RecordType]int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	counts := make(map[types.RecordType]int)
+	for _, byType := range s.records {
+		for rt, recs := range byType {
+			counts[rt] += len(recs)
+		}
+	}
+	return counts
+}
+
+// recordAttrs returns the span attributes identifying a record.
+func recordAttrs(name string, recordType types.RecordType) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		attribute.String("dns.name", name),
+		attribute.String("dns.type", string(recordType)),
+	}
+}
+
+// eventSpanContext returns the span context of the storage call that
+// produced the event, set as its Origin.
+func eventSpanContext(event types.StorageEvent) trace.SpanContext {
+	sc, _ := event.Origin.(trace.SpanContext)
+	return sc
+}
+
+// linkEvent returns span options linking a new span to the storage call
+// that produced the event, if that call was traced.
+func linkEvent(event types.StorageEvent) []trace.SpanStartOption {
+	sc := eventSpanContext(event)
+	if !sc.IsValid() {
+		return nil
+	}
+	return []trace.SpanStartOption{trace.WithLinks(trace.Link{SpanContext: sc})}
+}
+
 // --- internal helpers (caller must hold s.mu write lock) ---
 
 func (s *MemoryStorage) addRecordLocked(record *types.DNSRecord) {
@@ -270,6 +441,23 @@ func (s *MemoryStorage) updateRecordLocked(record *types.DNSRecord) {
 	s.records[record.Name][record.Type] = []*types.DNSRecord{record}
 }
 
+// applyChangesLocked applies changes. Changed records are no longer
+// considered synthesized by a source.
+func (s *MemoryStorage) applyChangesLocked(changes *types.RecordChanges) {
+	for _, r := range changes.Added {
+		s.addRecordLocked(r)
+		delete(s.sourced, types.RecordKey{Name: r.Name, Type: r.Type})
+	}
+	for _, r := range changes.Updated {
+		s.updateRecordLocked(r)
+		delete(s.sourced, types.RecordKey{Name: r.Name, Type: r.Type})
+	}
+	for _, key := range changes.Deleted {
+		s.deleteRecordLocked(key.Name, key.Type)
+		delete(s.sourced, key)
+	}
+}
+
 func (s *MemoryStorage) deleteRecordLocked(name string, recordType types.RecordType) {
 	byType, ok := s.records[name]
 	if !ok {
@@ -280,16 +468,3 @@ func (s *MemoryStorage) deleteRecordLocked(name string, recordType types.RecordT
 		delete(s.records, name)
 	}
 }
-
-// emit sends an event to all active watchers without blocking.
-func (s *MemoryStorage) emit(event types.StorageEvent) {
-	s.watchMu.Lock()
-	defer s.watchMu.Unlock()
-	for _, ch := range s.watchers {
-		select {
-		case ch <- event:
-		default:
-			// Drop event if watcher is not keeping up.
-		}
-	}
-}
@@ -8,6 +8,9 @@ import (
 	"time"
 
 	"jabberwocky238/jw238dns/types"
+
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 )
 
 func setupTestStorage(t *testing.T) *MemoryStorage {
@@ -302,6 +305,24 @@ func TestMemoryStorage_Version(t *testing.T) {
 	}
 }
 
+func TestMemoryStorage_CountByType(t *testing.T) {
+	store := setupTestStorage(t)
+	_ = store.Create(context.Background(), &types.DNSRecord{
+		Name: "other.com.", Type: types.RecordTypeA, TTL: 300, Value: []string{"10.0.0.1"},
+	})
+
+	counts := store.CountByType()
+	if counts[types.RecordTypeA] != 2 {
+		t.Errorf("CountByType()[A] = %d, want 2", counts[types.RecordTypeA])
+	}
+	if counts[types.RecordTypeAAAA] != 1 {
+		t.Errorf("CountByType()[AAAA] = %d, want 1", counts[types.RecordTypeAAAA])
+	}
+	if _, ok := counts[types.RecordTypeTXT]; ok {
+		t.Error("CountByType() should not report types with no records")
+	}
+}
+
 func TestMemoryStorage_Watch(t *testing.T) {
 	store := NewMemoryStorage()
 	ctx, cancel := context.WithCancel(context.Background())
@@ -339,6 +360,48 @@ func TestMemoryStorage_Watch(t *testing.T) {
 	}
 }
 
+func TestMemoryStorage_WatchCarriesSpanContext(t *testing.T) {
+	provider := sdktrace.NewTracerProvider()
+	prev := otel.GetTracerProvider()
+	otel.SetTracerProvider(provider)
+	defer otel.SetTracerProvider(prev)
+
+	store := NewMemoryStorage()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ch, err := store.Watch(ctx)
+	if err != nil {
+		t.Fatalf("Watch() error = %v", err)
+	}
+
+	reqCtx, span := provider.Tracer("test").Start(context.Background(), "request")
+	_ = store.Create(reqCtx, &types.DNSRecord{
+		Name: "traced.com.", Type: types.RecordTypeA, TTL: 300, Value: []string{"1.1.1.1"},
+	})
+	span.End()
+
+	select {
+	case ev := <-ch:
+		sc := eventSpanContext(ev)
+		if !sc.IsValid() {
+			t.Fatal("event span context should be valid")
+		}
+		if sc.TraceID() != span.SpanContext().TraceID() {
+			t.Error("event span context should belong to the request trace")
+		}
+		if len(linkEvent(ev)) != 1 {
+			t.Error("linkEvent() should return a link option for a traced event")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for watch event")
+	}
+
+	if len(linkEvent(types.StorageEvent{})) != 0 {
+		t.Error("linkEvent() should return no options for an untraced event")
+	}
+}
+
 func TestMemoryStorage_ConcurrentAccess(t *testing.T) {
 	store := NewMemoryStorage()
 	ctx := context.Background()
@@ -1,25 +1,43 @@
 package storage
 
 import (
+	"cmp"
+	"slices"
+
 	"jabberwocky238/jw238dns/types"
 )
 
 // CalculateChanges compares a new set of records against the current contents
 // of the MemoryStorage and returns the diff as a RecordChanges value.
 // The caller can then pass the result to PartialReload for an atomic update.
+// Records synthesized by a source are not compared, so they are never
+// deleted, but a new record with the same name and type replaces one.
 func (s *MemoryStorage) CalculateChanges(newRecords []*types.DNSRecord) *types.RecordChanges {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
+	current := s.buildRecordMapLocked()
+	for key := range s.sourced {
+		delete(current, key)
+	}
+	return diffRecordMaps(current, buildRecordMapFromSlice(newRecords))
+}
+
+// DiffRecords returns the changes that turn current into desired. It is
+// CalculateChanges for callers that only have a CoreStorage, or want to
+// diff a subset of the store.
+func DiffRecords(current, desired []*types.DNSRecord) *types.RecordChanges {
+	return diffRecordMaps(buildRecordMapFromSlice(current), buildRecordMapFromSlice(desired))
+}
+
+// diffRecordMaps compares two record maps and returns the diff.
+func diffRecordMaps(oldMap, newMap map[types.RecordKey]*types.DNSRecord) *types.RecordChanges {
 	changes := &types.RecordChanges{
 		Added:   []*types.DNSRecord{},
 		Updated: []*types.DNSRecord{},
 		Deleted: []types.RecordKey{},
 	}
 
-	oldMap := s.buildRecordMapLocked()
-	newMap := buildRecordMapFromSlice(newRecords)
-
 	// Find added and updated records.
 	for key, newRec := range newMap {
 		if oldRec, exists := oldMap[key]; exists {
@@ -41,6 +59,32 @@ func (s *MemoryStorage) CalculateChanges(newRecords []*types.DNSRecord) *types.R
 	return changes
 }
 
+// mergeRecords performs a three-way merge: it applies the changes that
+// turn base into ours on top of theirs. Where both sides changed the same
+// record, ours wins. The result is sorted by name and type.
+func mergeRecords(base, ours, theirs []*types.DNSRecord) []*types.DNSRecord {
+	merged := buildRecordMapFromSlice(theirs)
+	changes := DiffRecords(base, ours)
+	for _, r := range changes.Added {
+		merged[types.RecordKey{Name: r.Name, Type: r.Type}] = r
+	}
+	for _, r := range changes.Updated {
+		merged[types.RecordKey{Name: r.Name, Type: r.Type}] = r
+	}
+	for _, key := range changes.Deleted {
+		delete(merged, key)
+	}
+
+	out := make([]*types.DNSRecord, 0, len(merged))
+	for _, r := range merged {
+		out = append(out, r)
+	}
+	slices.SortFunc(out, func(a, b *types.DNSRecord) int {
+		return cmp.Or(cmp.Compare(a.Name, b.Name), cmp.Compare(a.Type, b.Type))
+	})
+	return out
+}
+
 // buildRecordMapLocked returns a flat map of RecordKey -> DNSRecord from the
 // current storage contents. Caller must hold at least s.mu.RLock.
 func (s *MemoryStorage) buildRecordMapLocked() map[types.RecordKey]*types.DNSRecord {
@@ -64,18 +108,14 @@ func buildRecordMapFromSlice(records []*types.DNSRecord) map[types.RecordKey]*ty
 	return m
 }
 
-// recordsEqual reports whether two DNS records have the same TTL and values.
+// recordsEqual reports whether two DNS records have the same TTL, values
+// and metadata.
 func recordsEqual(a, b *types.DNSRecord) bool {
-	if a.TTL != b.TTL {
-		return false
-	}
-	if len(a.Value) != len(b.Value) {
-		return false
-	}
-	for i := range a.Value {
-		if a.Value[i] != b.Value[i] {
-			return false
-		}
-	}
-	return true
+	return answersEqual(a, b) && a.Meta.Equal(b.Meta)
+}
+
+// answersEqual reports whether two DNS records have the same TTL and
+// values, so they produce the same answers whatever their metadata.
+func answersEqual(a, b *types.DNSRecord) bool {
+	return a.TTL == b.TTL && slices.Equal(a.Value, b.Value)
 }
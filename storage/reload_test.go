@@ -142,6 +142,82 @@ func TestMemoryStorage_CalculateChanges(t *testing.T) {
 	}
 }
 
+func TestDiffRecords(t *testing.T) {
+	current := []*types.DNSRecord{
+		{Name: "a.com.", Type: types.RecordTypeA, TTL: 300, Value: []string{"1.2.3.4"}},
+		{Name: "b.com.", Type: types.RecordTypeA, TTL: 300, Value: []string{"5.6.7.8"}},
+		{Name: "c.com.", Type: types.RecordTypeA, TTL: 300, Value: []string{"9.9.9.9"}},
+	}
+	desired := []*types.DNSRecord{
+		{Name: "a.com.", Type: types.RecordTypeA, TTL: 300, Value: []string{"1.2.3.4"}},
+		{Name: "b.com.", Type: types.RecordTypeA, TTL: 60, Value: []string{"5.6.7.8"}},
+		{Name: "d.com.", Type: types.RecordTypeTXT, TTL: 300, Value: []string{"new"}},
+	}
+
+	changes := DiffRecords(current, desired)
+	if len(changes.Added) != 1 || changes.Added[0].Name != "d.com." {
+		t.Errorf("Added = %v, want d.com.", changes.Added)
+	}
+	if len(changes.Updated) != 1 || changes.Updated[0].Name != "b.com." {
+		t.Errorf("Updated = %v, want b.com.", changes.Updated)
+	}
+	if len(changes.Deleted) != 1 || changes.Deleted[0].Name != "c.com." {
+		t.Errorf("Deleted = %v, want c.com.", changes.Deleted)
+	}
+}
+
+func TestMergeRecords(t *testing.T) {
+	tests := []struct {
+		name   string
+		base   []*types.DNSRecord
+		ours   []*types.DNSRecord
+		theirs []*types.DNSRecord
+		want   []*types.DNSRecord
+	}{
+		{
+			name:   "both add",
+			base:   []*types.DNSRecord{aRecord("a.com.", "1.1.1.1")},
+			ours:   []*types.DNSRecord{aRecord("a.com.", "1.1.1.1"), aRecord("b.com.", "2.2.2.2")},
+			theirs: []*types.DNSRecord{aRecord("a.com.", "1.1.1.1"), aRecord("c.com.", "3.3.3.3")},
+			want:   []*types.DNSRecord{aRecord("a.com.", "1.1.1.1"), aRecord("b.com.", "2.2.2.2"), aRecord("c.com.", "3.3.3.3")},
+		},
+		{
+			name:   "ours deletes, theirs updates another",
+			base:   []*types.DNSRecord{aRecord("a.com.", "1.1.1.1"), aRecord("b.com.", "2.2.2.2")},
+			ours:   []*types.DNSRecord{aRecord("b.com.", "2.2.2.2")},
+			theirs: []*types.DNSRecord{aRecord("a.com.", "1.1.1.1"), aRecord("b.com.", "9.9.9.9")},
+			want:   []*types.DNSRecord{aRecord("b.com.", "9.9.9.9")},
+		},
+		{
+			name:   "both update, ours wins",
+			base:   []*types.DNSRecord{aRecord("a.com.", "1.1.1.1")},
+			ours:   []*types.DNSRecord{aRecord("a.com.", "2.2.2.2")},
+			theirs: []*types.DNSRecord{aRecord("a.com.", "3.3.3.3")},
+			want:   []*types.DNSRecord{aRecord("a.com.", "2.2.2.2")},
+		},
+		{
+			name:   "theirs deletes untouched record",
+			base:   []*types.DNSRecord{aRecord("a.com.", "1.1.1.1"), aRecord("b.com.", "2.2.2.2")},
+			ours:   []*types.DNSRecord{aRecord("a.com.", "1.1.1.1"), aRecord("b.com.", "2.2.2.2")},
+			theirs: []*types.DNSRecord{aRecord("b.com.", "2.2.2.2")},
+			want:   []*types.DNSRecord{aRecord("b.com.", "2.2.2.2")},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := mergeRecords(tt.base, tt.ours, tt.theirs)
+			if len(got) != len(tt.want) {
+				t.Fatalf("mergeRecords() = %d records, want %d", len(got), len(tt.want))
+			}
+			for i := range got {
+				if got[i].Name != tt.want[i].Name || !recordsEqual(got[i], tt.want[i]) {
+					t.Errorf("record %d = %s %v, want %s %v", i, got[i].Name, got[i].Value, tt.want[i].Name, tt.want[i].Value)
+				}
+			}
+		})
+	}
+}
+
 func TestMemoryStorage_HotReload(t *testing.T) {
 	store := NewMemoryStorage()
 	ctx := context.Background()
@@ -294,6 +370,18 @@ func TestRecordsEqual(t *testing.T) {
 			b:    &types.DNSRecord{TTL: 300, Value: []string{}},
 			want: true,
 		},
+		{
+			name: "different metadata",
+			a:    &types.DNSRecord{TTL: 300, Value: []string{"1.2.3.4"}, Meta: &types.RecordMeta{Comment: "old"}},
+			b:    &types.DNSRecord{TTL: 300, Value: []string{"1.2.3.4"}, Meta: &types.RecordMeta{Comment: "new"}},
+			want: false,
+		},
+		{
+			name: "empty and no metadata",
+			a:    &types.DNSRecord{TTL: 300, Value: []string{"1.2.3.4"}, Meta: &types.RecordMeta{}},
+			b:    &types.DNSRecord{TTL: 300, Value: []string{"1.2.3.4"}},
+			want: true,
+		},
 	}
 
 	for _, tt := range tests {
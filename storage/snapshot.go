@@ -0,0 +1,108 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"time"
+
+	"jabberwocky238/jw238dns/types"
+)
+
+// SnapshotFormat is the version of the snapshot format written by
+// WriteSnapshot. ReadSnapshot accepts this and earlier versions.
+const SnapshotFormat = 1
+
+// Snapshot is a backup of the persistent records, with their metadata,
+// that can be restored into any storage backend.
+type Snapshot struct {
+	Format    int                `json:"format"`
+	CreatedAt time.Time          `json:"created_at"`
+	Source    string             `json:"source,omitempty"` // Storage type the records were read from
+	Zones     []string           `json:"zones"`            // Names with an SOA record
+	Records   []*types.DNSRecord `json:"records"`
+}
+
+// NewSnapshot creates a snapshot of records, read from the storage type
+// source.
+func NewSnapshot(source string, records []*types.DNSRecord) *Snapshot {
+	records = slices.Clone(records)
+	slices.SortFunc(records, func(a, b *types.DNSRecord) int {
+		if c := strings.Compare(a.Name, b.Name); c != 0 {
+			return c
+		}
+		return strings.Compare(string(a.Type), string(b.Type))
+	})
+	zones := []string{}
+	for _, r := range records {
+		if r.Type == types.RecordTypeSOA {
+			zones = append(zones, r.Name)
+		}
+	}
+	if records == nil {
+		records = []*types.DNSRecord{}
+	}
+	return &Snapshot{
+		Format:    SnapshotFormat,
+		CreatedAt: time.Now().UTC().Truncate(time.Second),
+		Source:    source,
+		Zones:     zones,
+		Records:   records,
+	}
+}
+
+// WriteSnapshot writes s to w as indented JSON, gzip-compressed if
+// compress is set.
+func WriteSnapshot(w io.Writer, s *Snapshot, compress bool) error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshal snapshot: %w", err)
+	}
+	data = append(data, '\n')
+	if !compress {
+		_, err := w.Write(data)
+		return err
+	}
+	gz := gzip.NewWriter(w)
+	if _, err := gz.Write(data); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// ReadSnapshot reads a snapshot written by WriteSnapshot, compressed or
+// not. It rejects snapshots of a newer format and invalid or duplicate
+// records.
+func ReadSnapshot(r io.Reader) (*Snapshot, error) {
+	br := bufio.NewReader(r)
+	if magic, _ := br.Peek(2); bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, fmt.Errorf("decompress snapshot: %w", err)
+		}
+		defer gz.Close()
+		r = gz
+	} else {
+		r = br
+	}
+
+	var s Snapshot
+	if err := json.NewDecoder(r).Decode(&s); err != nil {
+		return nil, fmt.Errorf("unmarshal snapshot: %w", err)
+	}
+	switch {
+	case s.Format == 0:
+		return nil, fmt.Errorf("not a snapshot: format version missing")
+	case s.Format > SnapshotFormat:
+		return nil, fmt.Errorf("snapshot format %d is newer than the supported %d", s.Format, SnapshotFormat)
+	}
+	if err := validateRecords(s.Records); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
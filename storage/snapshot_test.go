@@ -0,0 +1,71 @@
+package storage
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"jabberwocky238/jw238dns/types"
+)
+
+func TestSnapshot_RoundTrip(t *testing.T) {
+	soa := &types.DNSRecord{Name: "example.com.", Type: types.RecordTypeSOA, TTL: 3600,
+		Value: []string{"ns1.example.com. admin.example.com. 1 3600 900 604800 86400"}}
+	www := aRecord("www.example.com.", "192.0.2.1")
+	www.Meta = &types.RecordMeta{Owner: "deploy", Labels: map[string]string{"env": "prod"}}
+	snap := NewSnapshot("file", []*types.DNSRecord{www, soa})
+
+	if len(snap.Zones) != 1 || snap.Zones[0] != "example.com." {
+		t.Errorf("Zones = %v, want [example.com.]", snap.Zones)
+	}
+	for _, compress := range []bool{false, true} {
+		var buf bytes.Buffer
+		if err := WriteSnapshot(&buf, snap, compress); err != nil {
+			t.Fatalf("WriteSnapshot(compress=%v) error = %v", compress, err)
+		}
+		got, err := ReadSnapshot(&buf)
+		if err != nil {
+			t.Fatalf("ReadSnapshot(compress=%v) error = %v", compress, err)
+		}
+		if got.Format != SnapshotFormat || got.Source != "file" || !got.CreatedAt.Equal(snap.CreatedAt) {
+			t.Errorf("header = %d %q %v, want %d %q %v", got.Format, got.Source, got.CreatedAt,
+				SnapshotFormat, "file", snap.CreatedAt)
+		}
+		if c := DiffRecords(snap.Records, got.Records); len(c.Added)+len(c.Updated)+len(c.Deleted) != 0 {
+			t.Errorf("records differ after a round trip: %+v", c)
+		}
+		if r := got.Records[1]; r.Owner() != "deploy" || r.Meta.Labels["env"] != "prod" {
+			t.Errorf("metadata lost: %+v", r.Meta)
+		}
+	}
+}
+
+func TestReadSnapshot_Invalid(t *testing.T) {
+	tests := map[string]string{
+		"not json":       "records:\n",
+		"no format":      `{"records": []}`,
+		"newer format":   `{"format": 99, "records": []}`,
+		"duplicate":      `{"format": 1, "records": [{"name": "a.com.", "type": "A", "value": ["192.0.2.1"]}, {"name": "a.com.", "type": "A", "value": ["192.0.2.2"]}]}`,
+		"invalid record": `{"format": 1, "records": [{"name": "a.com.", "type": "BOGUS", "value": ["x"]}]}`,
+	}
+	for name, data := range tests {
+		if _, err := ReadSnapshot(strings.NewReader(data)); err == nil {
+			t.Errorf("%s: ReadSnapshot() succeeded", name)
+		}
+	}
+}
+
+func TestNewSnapshot_Empty(t *testing.T) {
+	var buf bytes.Buffer
+	if err := WriteSnapshot(&buf, NewSnapshot("sql", nil), false); err != nil {
+		t.Fatalf("WriteSnapshot() error = %v", err)
+	}
+	if !strings.Contains(buf.String(), `"records": []`) {
+		t.Errorf("empty snapshot = %s, want an empty records array", buf.String())
+	}
+	snap, err := ReadSnapshot(&buf)
+	if err != nil || len(snap.Records) != 0 || time.Since(snap.CreatedAt) > time.Minute {
+		t.Errorf("ReadSnapshot() = %+v, %v", snap, err)
+	}
+}
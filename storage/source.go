@@ -0,0 +1,124 @@
+package storage
+
+import (
+	"context"
+	"log/slog"
+
+	"jabberwocky238/jw238dns/types"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// ApplySource replaces the records synthesized by the named source with
+// records. Synthesized records are served like any other, but are left
+// out of ListPersistent, so persistence never writes them back.
+//
+// Records from other sources, or written through the API or a storage
+// backend, take precedence: their keys are skipped and returned as
+// conflicts. Writing a synthesized record through the API or a reload
+// takes it over from the source.
+func (s *MemoryStorage) ApplySource(ctx context.Context, source string, records []*types.DNSRecord) []types.RecordKey {
+	_, span := tracer.Start(ctx, "MemoryStorage.ApplySource")
+	defer span.End()
+	span.SetAttributes(attribute.String("dns.source", source), attribute.Int("dns.records", len(records)))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	current := s.buildRecordMapLocked()
+	desired := buildRecordMapFromSlice(records)
+
+	var conflicts []types.RecordKey
+	changes := &types.RecordChanges{}
+	for key, rec := range desired {
+		existing, exists := current[key]
+		if exists && s.sourced[key] != source {
+			conflicts = append(conflicts, key)
+			continue
+		}
+		if !exists {
+			changes.Added = append(changes.Added, rec)
+		} else if !recordsEqual(existing, rec) {
+			changes.Updated = append(changes.Updated, rec)
+		}
+	}
+	for key, owner := range s.sourced {
+		if _, ok := desired[key]; owner == source && !ok {
+			changes.Deleted = append(changes.Deleted, key)
+		}
+	}
+	if len(changes.Added) == 0 && len(changes.Updated) == 0 && len(changes.Deleted) == 0 {
+		return conflicts
+	}
+
+	for _, r := range changes.Added {
+		s.addRecordLocked(r)
+		s.sourced[types.RecordKey{Name: r.Name, Type: r.Type}] = source
+	}
+	for _, r := range changes.Updated {
+		s.updateRecordLocked(r)
+	}
+	for _, key := range changes.Deleted {
+		s.deleteRecordLocked(key.Name, key.Type)
+		delete(s.sourced, key)
+	}
+	s.version++
+
+	slog.Info("source records applied",
+		"source", source,
+		"added", len(changes.Added),
+		"updated", len(changes.Updated),
+		"deleted", len(changes.Deleted),
+		"version", s.version,
+	)
+	s.emit(types.StorageEvent{Type: types.EventReloaded, Changes: changes, Source: source, Origin: span.SpanContext()})
+	return conflicts
+}
+
+// ListPersistent returns the stored records except those synthesized by a
+// source. Persistence writes this set rather than List.
+func (s *MemoryStorage) ListPersistent(ctx context.Context) ([]*types.DNSRecord, error) {
+	_, span := tracer.Start(ctx, "MemoryStorage.ListPersistent")
+	defer span.End()
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.persistentLocked(), nil
+}
+
+// persistentLister is implemented by storages that serve records
+// synthesized by a source, and by wrappers of them.
+type persistentLister interface {
+	ListPersistent(ctx context.Context) ([]*types.DNSRecord, error)
+}
+
+// ListPersistent returns the records of store except those synthesized by
+// a source: store.ListPersistent if it has one, else store.List.
+func ListPersistent(ctx context.Context, store CoreStorage) ([]*types.DNSRecord, error) {
+	if l, ok := store.(persistentLister); ok {
+		return l.ListPersistent(ctx)
+	}
+	return store.List(ctx)
+}
+
+// PersistentSnapshot is Snapshot without the records synthesized by a
+// source.
+func (s *MemoryStorage) PersistentSnapshot() ([]*types.DNSRecord, uint64) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.persistentLocked(), s.version
+}
+
+// persistentLocked returns the records not synthesized by a source. Caller
+// must hold at least s.mu.RLock.
+func (s *MemoryStorage) persistentLocked() []*types.DNSRecord {
+	var out []*types.DNSRecord
+	for name, byType := range s.records {
+		for rt, recs := range byType {
+			if _, ok := s.sourced[types.RecordKey{Name: name, Type: rt}]; !ok {
+				out = append(out, recs...)
+			}
+		}
+	}
+	return out
+}
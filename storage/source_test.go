@@ -0,0 +1,66 @@
+package storage
+
+import (
+	"context"
+	"testing"
+
+	"jabberwocky238/jw238dns/types"
+)
+
+func TestMemoryStorage_ApplySource(t *testing.T) {
+	s := NewMemoryStorage()
+	ctx := context.Background()
+	_ = s.Create(ctx, aRecord("static.com.", "1.1.1.1"))
+
+	conflicts := s.ApplySource(ctx, "test", []*types.DNSRecord{
+		aRecord("static.com.", "9.9.9.9"),
+		aRecord("found.com.", "2.2.2.2"),
+	})
+	if len(conflicts) != 1 || conflicts[0].Name != "static.com." {
+		t.Errorf("ApplySource() conflicts = %v, want static.com.", conflicts)
+	}
+	if recs, _ := s.Get(ctx, "static.com.", types.RecordTypeA); recs[0].Value[0] != "1.1.1.1" {
+		t.Errorf("static.com. = %v, want the existing record kept", recs[0].Value)
+	}
+	if recs, err := s.Get(ctx, "found.com.", types.RecordTypeA); err != nil || len(recs) != 1 {
+		t.Fatalf("Get() synthesized record = %v, %v", recs, err)
+	}
+	if recs, _ := s.ListPersistent(ctx); len(recs) != 1 || recs[0].Name != "static.com." {
+		t.Errorf("ListPersistent() = %v, want only static.com.", recs)
+	}
+
+	// Reloads from a storage backend leave synthesized records alone.
+	if err := s.HotReload(ctx, []*types.DNSRecord{aRecord("other.com.", "3.3.3.3")}); err != nil {
+		t.Fatalf("HotReload() error = %v", err)
+	}
+	if _, err := s.Get(ctx, "found.com.", types.RecordTypeA); err != nil {
+		t.Errorf("Get() synthesized record after HotReload() error = %v", err)
+	}
+	if changes := s.CalculateChanges(nil); len(changes.Deleted) != 1 || changes.Deleted[0].Name != "other.com." {
+		t.Errorf("CalculateChanges() deleted = %v, want only other.com.", changes.Deleted)
+	}
+
+	s.ApplySource(ctx, "test", nil)
+	if recs, _ := s.List(ctx); len(recs) != 1 {
+		t.Errorf("List() after emptying source = %v, want only other.com.", recs)
+	}
+}
+
+func TestMemoryStorage_ApplySourceTakenOver(t *testing.T) {
+	s := NewMemoryStorage()
+	ctx := context.Background()
+	s.ApplySource(ctx, "test", []*types.DNSRecord{aRecord("found.com.", "2.2.2.2")})
+
+	// Updating a synthesized record makes it persistent; the source no
+	// longer changes or deletes it.
+	if err := s.Update(ctx, aRecord("found.com.", "4.4.4.4")); err != nil {
+		t.Fatalf("Update() error = %v", err)
+	}
+	if recs, _ := s.ListPersistent(ctx); len(recs) != 1 {
+		t.Errorf("ListPersistent() after Update() = %v, want found.com.", recs)
+	}
+	s.ApplySource(ctx, "test", nil)
+	if recs, err := s.Get(ctx, "found.com.", types.RecordTypeA); err != nil || recs[0].Value[0] != "4.4.4.4" {
+		t.Errorf("Get() after source emptied = %v, %v, want updated record kept", recs, err)
+	}
+}
@@ -0,0 +1,872 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"jabberwocky238/jw238dns/metrics"
+	"jabberwocky238/jw238dns/types"
+
+	_ "github.com/go-sql-driver/mysql"
+	"github.com/jackc/pgx/v5"
+	_ "github.com/jackc/pgx/v5/stdlib"
+	"go.opentelemetry.io/otel/attribute"
+	_ "modernc.org/sqlite"
+)
+
+// Defaults for SQLConfig.
+const (
+	DefaultSQLPollInterval = 2 * time.Second
+	DefaultSQLJournalSize  = 10000
+)
+
+// sqlNotifyChannel is the PostgreSQL NOTIFY channel signalled on every
+// committed change.
+const sqlNotifyChannel = "jw238dns_changes"
+
+// SQLConfig configures an SQLStorage.
+type SQLConfig struct {
+	Driver       string        // "postgres", "mysql" or "sqlite"
+	DSN          string        // Driver-specific data source name
+	PollInterval time.Duration // How often other writers' changes are polled for
+	Listen       bool          // PostgreSQL only: wake up on NOTIFY instead of waiting for the next poll
+	JournalSize  int           // Changes kept for followers that fall behind
+	AutoMigrate  bool          // Apply missing migrations on open instead of failing
+}
+
+// sqlDialect holds what differs between the supported databases.
+type sqlDialect struct {
+	name       string // "postgres", "mysql" or "sqlite"
+	driverName string // database/sql driver
+}
+
+// rebind rewrites ? placeholders to the dialect's syntax.
+func (d sqlDialect) rebind(query string) string {
+	if d.name != "postgres" {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, c := range query {
+		if c == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+// openSQLDB opens a database/sql handle for the named driver.
+func openSQLDB(driver, dsn string) (*sql.DB, sqlDialect, error) {
+	var d sqlDialect
+	switch driver {
+	case "postgres", "postgresql", "pgx":
+		d = sqlDialect{name: "postgres", driverName: "pgx"}
+	case "mysql":
+		d = sqlDialect{name: "mysql", driverName: "mysql"}
+	case "sqlite", "sqlite3":
+		d = sqlDialect{name: "sqlite", driverName: "sqlite"}
+	default:
+		return nil, d, fmt.Errorf("unsupported sql driver %q (want postgres, mysql or sqlite)", driver)
+	}
+	db, err := sql.Open(d.driverName, dsn)
+	if err != nil {
+		return nil, d, fmt.Errorf("open %s database: %w", d.name, err)
+	}
+	if d.name == "sqlite" {
+		// SQLite allows one writer at a time; sharing one connection
+		// avoids SQLITE_BUSY between our own transactions.
+		db.SetMaxOpenConns(1)
+	}
+	return db, d, nil
+}
+
+// SQLStorage is a CoreStorage kept in SQL tables, so that several
+// jw238dns replicas can share one source of truth. Every write is one
+// transaction that updates jw238dns_records, bumps the version in
+// jw238dns_version and logs the changed keys in jw238dns_changes.
+//
+// Changes made by other replicas are found by polling the version, or on
+// PostgreSQL by LISTEN/NOTIFY, and reading the change log. Watch and
+// SyncTo follow that log.
+type SQLStorage struct {
+	db          *sql.DB
+	dialect     sqlDialect
+	dsn         string
+	poll        time.Duration
+	journalSize int
+	stop        context.CancelFunc
+
+	notifyMu sync.Mutex
+	notifyCh chan struct{} // closed and replaced whenever a change may have been committed
+}
+
+// OpenSQLStorage connects to the database described by cfg. The schema
+// must be up to date (see MigrateSQL) unless cfg.AutoMigrate is set.
+func OpenSQLStorage(ctx context.Context, cfg SQLConfig) (*SQLStorage, error) {
+	if cfg.PollInterval <= 0 {
+		cfg.PollInterval = DefaultSQLPollInterval
+	}
+	if cfg.JournalSize <= 0 {
+		cfg.JournalSize = DefaultSQLJournalSize
+	}
+	db, d, err := openSQLDB(cfg.Driver, cfg.DSN)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("connect to %s database: %w", d.name, err)
+	}
+
+	if cfg.AutoMigrate {
+		if _, _, err := migrateSQL(ctx, db, d); err != nil {
+			db.Close()
+			return nil, err
+		}
+	} else {
+		// The connection works, so an error means there is no schema yet.
+		version, _ := schemaVersion(ctx, db)
+		if version != len(sqlMigrations) {
+			db.Close()
+			return nil, fmt.Errorf("database schema is at version %d, want %d: run \"jw238dns migrate\"", version, len(sqlMigrations))
+		}
+	}
+
+	lctx, stop := context.WithCancel(context.Background())
+	s := &SQLStorage{
+		db:          db,
+		dialect:     d,
+		dsn:         cfg.DSN,
+		poll:        cfg.PollInterval,
+		journalSize: cfg.JournalSize,
+		stop:        stop,
+		notifyCh:    make(chan struct{}),
+	}
+	if cfg.Listen && d.name == "postgres" {
+		go s.listen(lctx)
+	}
+	return s, nil
+}
+
+// Close stops listening for notifications and closes the database.
+func (s *SQLStorage) Close() error {
+	s.stop()
+	return s.db.Close()
+}
+
+// Get returns the record matching the given name and type, falling back to
+// wildcard records like MemoryStorage does.
+func (s *SQLStorage) Get(ctx context.Context, name string, recordType types.RecordType) ([]*types.DNSRecord, error) {
+	ctx, span := tracer.Start(ctx, "SQLStorage.Get")
+	defer span.End()
+	span.SetAttributes(recordAttrs(name, recordType)...)
+
+	rec, err := s.getRecord(ctx, s.db, name, recordType)
+	if err != nil {
+		return nil, err
+	}
+	if rec != nil {
+		return []*types.DNSRecord{rec}, nil
+	}
+
+	rows, err := s.db.QueryContext(ctx, s.dialect.rebind(
+		`SELECT name, type, ttl, value, meta FROM jw238dns_records WHERE type = ? AND name LIKE ?`), string(recordType), "%*%")
+	if err != nil {
+		return nil, fmt.Errorf("query wildcard records: %w", err)
+	}
+	wildcards, err := scanRecords(rows)
+	if err != nil {
+		return nil, err
+	}
+	for _, w := range wildcards {
+		if matched, _ := regexp.MatchString(wildcardToRegex(w.Name), name); matched {
+			w.Name = name
+			return []*types.DNSRecord{w}, nil
+		}
+	}
+	return nil, types.ErrRecordNotFound
+}
+
+// List returns all stored DNS records.
+func (s *SQLStorage) List(ctx context.Context) ([]*types.DNSRecord, error) {
+	ctx, span := tracer.Start(ctx, "SQLStorage.List")
+	defer span.End()
+
+	records, _, err := s.snapshot(ctx)
+	return records, err
+}
+
+// Create adds a new DNS record. Returns ErrRecordExists if a record with
+// the same name and type already exists.
+func (s *SQLStorage) Create(ctx context.Context, record *types.DNSRecord) error {
+	ctx, span := tracer.Start(ctx, "SQLStorage.Create")
+	defer span.End()
+	span.SetAttributes(recordAttrs(record.Name, record.Type)...)
+
+	return s.commit(ctx, func(tx *sql.Tx) (*types.RecordChanges, error) {
+		existing, err := s.getRecord(ctx, tx, record.Name, record.Type)
+		if err != nil {
+			return nil, err
+		}
+		if existing != nil {
+			return nil, types.ErrRecordExists
+		}
+		changes := &types.RecordChanges{Added: []*types.DNSRecord{record}}
+		return changes, s.applyChanges(ctx, tx, changes)
+	})
+}
+
+// Update replaces an existing DNS record. Returns ErrRecordNotFound if the
+// record does not exist.
+func (s *SQLStorage) Update(ctx context.Context, record *types.DNSRecord) error {
+	ctx, span := tracer.Start(ctx, "SQLStorage.Update")
+	defer span.End()
+	span.SetAttributes(recordAttrs(record.Name, record.Type)...)
+
+	return s.commit(ctx, func(tx *sql.Tx) (*types.RecordChanges, error) {
+		existing, err := s.getRecord(ctx, tx, record.Name, record.Type)
+		if err != nil {
+			return nil, err
+		}
+		if existing == nil {
+			return nil, types.ErrRecordNotFound
+		}
+		changes := &types.RecordChanges{Updated: []*types.DNSRecord{record}}
+		return changes, s.applyChanges(ctx, tx, changes)
+	})
+}
+
+// Delete removes a DNS record identified by name and type.
+func (s *SQLStorage) Delete(ctx context.Context, name string, recordType types.RecordType) error {
+	ctx, span := tracer.Start(ctx, "SQLStorage.Delete")
+	defer span.End()
+	span.SetAttributes(recordAttrs(name, recordType)...)
+
+	return s.commit(ctx, func(tx *sql.Tx) (*types.RecordChanges, error) {
+		existing, err := s.getRecord(ctx, tx, name, recordType)
+		if err != nil {
+			return nil, err
+		}
+		if existing == nil {
+			return nil, types.ErrRecordNotFound
+		}
+		changes := &types.RecordChanges{Deleted: []types.RecordKey{{Name: name, Type: recordType}}}
+		return changes, s.applyChanges(ctx, tx, changes)
+	})
+}
+
+// HotReload replaces all records atomically with the provided set. Only
+// the difference to the stored records is written and logged.
+func (s *SQLStorage) HotReload(ctx context.Context, records []*types.DNSRecord) error {
+	ctx, span := tracer.Start(ctx, "SQLStorage.HotReload")
+	defer span.End()
+	span.SetAttributes(attribute.Int("dns.records", len(records)))
+
+	return s.commit(ctx, func(tx *sql.Tx) (*types.RecordChanges, error) {
+		rows, err := tx.QueryContext(ctx, `SELECT name, type, ttl, value, meta FROM jw238dns_records`)
+		if err != nil {
+			return nil, fmt.Errorf("list records: %w", err)
+		}
+		current, err := scanRecords(rows)
+		if err != nil {
+			return nil, err
+		}
+		changes := DiffRecords(current, records)
+		return changes, s.applyChanges(ctx, tx, changes)
+	})
+}
+
+// PartialReload applies only the changed records atomically.
+func (s *SQLStorage) PartialReload(ctx context.Context, changes *types.RecordChanges) error {
+	ctx, span := tracer.Start(ctx, "SQLStorage.PartialReload")
+	defer span.End()
+	span.SetAttributes(
+		attribute.Int("dns.added", len(changes.Added)),
+		attribute.Int("dns.updated", len(changes.Updated)),
+		attribute.Int("dns.deleted", len(changes.Deleted)),
+	)
+
+	return s.commit(ctx, func(tx *sql.Tx) (*types.RecordChanges, error) {
+		return changes, s.applyChanges(ctx, tx, changes)
+	})
+}
+
+// Transaction implements CoreStorage. fn reads the records inside the
+// database transaction that writes its changes, after commit locks the
+// version row, so transactions from all replicas run one at a time and
+// what fn read still holds when its changes are written.
+func (s *SQLStorage) Transaction(ctx context.Context, fn func(tx *Tx) error) error {
+	ctx, span := tracer.Start(ctx, "SQLStorage.Transaction")
+	defer span.End()
+
+	return s.commit(ctx, func(sqlTx *sql.Tx) (*types.RecordChanges, error) {
+		tx := newTx(func(key types.RecordKey) (*types.DNSRecord, error) {
+			return s.getRecord(ctx, sqlTx, key.Name, key.Type)
+		})
+		if err := fn(tx); err != nil {
+			return nil, err
+		}
+		changes := tx.Changes()
+		return changes, s.applyChanges(ctx, sqlTx, changes)
+	})
+}
+
+// Watch returns a channel that receives an event for every record changed
+// after the call, by this process or any other writer. Events are read
+// from the change log and carry the record as stored when they were read;
+// if the log no longer reaches back far enough a single EventReloaded is
+// sent instead. The channel is closed when ctx is cancelled.
+func (s *SQLStorage) Watch(ctx context.Context) (<-chan types.StorageEvent, error) {
+	version, err := s.Version(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	ch := make(chan types.StorageEvent, 64)
+	go func() {
+		defer close(ch)
+		s.follow(ctx, version, func(events []types.StorageEvent, _ uint64) {
+			for _, ev := range events {
+				select {
+				case ch <- ev:
+				case <-ctx.Done():
+					return
+				}
+			}
+		})
+	}()
+	return ch, nil
+}
+
+// Version returns the number of write transactions committed to the
+// database.
+func (s *SQLStorage) Version(ctx context.Context) (uint64, error) {
+	var version uint64
+	if err := s.db.QueryRowContext(ctx, `SELECT version FROM jw238dns_version`).Scan(&version); err != nil {
+		return 0, fmt.Errorf("read version: %w", err)
+	}
+	return version, nil
+}
+
+// LoadInto replaces the contents of store with the records in the
+// database, and returns the version they correspond to.
+func (s *SQLStorage) LoadInto(ctx context.Context, store *MemoryStorage) (uint64, error) {
+	records, version, err := s.snapshot(ctx)
+	if err == nil {
+		if changes := store.CalculateChanges(records); len(changes.Added) > 0 || len(changes.Updated) > 0 || len(changes.Deleted) > 0 {
+			err = store.PartialReload(ctx, changes)
+		}
+	}
+	metrics.ObserveReload("sql", err)
+	return version, err
+}
+
+// SyncTo applies every change committed after version, by any writer, to
+// store until ctx is cancelled. version is normally the one returned by
+// LoadInto.
+func (s *SQLStorage) SyncTo(ctx context.Context, store *MemoryStorage, version uint64) error {
+	s.follow(ctx, version, func(events []types.StorageEvent, version uint64) {
+		ctx, span := tracer.Start(ctx, "SQLStorage.SyncTo")
+		defer span.End()
+
+		changes := &types.RecordChanges{}
+		for _, ev := range events {
+			switch ev.Type {
+			case types.EventAdded:
+				changes.Added = append(changes.Added, ev.Record)
+			case types.EventUpdated:
+				changes.Updated = append(changes.Updated, ev.Record)
+			case types.EventDeleted:
+				changes.Deleted = append(changes.Deleted, types.RecordKey{Name: ev.Record.Name, Type: ev.Record.Type})
+			case types.EventReloaded:
+				// The change log was trimmed past version: start over.
+				if _, err := s.LoadInto(ctx, store); err != nil {
+					slog.Error("reload from sql database", "err", err)
+				}
+				return
+			}
+		}
+		err := store.PartialReload(ctx, changes)
+		metrics.ObserveReload("sql", err)
+		if err != nil {
+			slog.Error("apply sql changes", "version", version, "err", err)
+		}
+	})
+	return ctx.Err()
+}
+
+// follow calls apply with the events committed after version each time
+// the database changes, until ctx is cancelled.
+func (s *SQLStorage) follow(ctx context.Context, version uint64, apply func([]types.StorageEvent, uint64)) {
+	ticker := time.NewTicker(s.poll)
+	defer ticker.Stop()
+
+	for {
+		wake := s.changed()
+		events, latest, err := s.changesSince(ctx, version)
+		switch {
+		case err != nil && ctx.Err() == nil:
+			slog.Warn("read sql change log", "err", err)
+		case len(events) > 0:
+			apply(events, latest)
+			version = latest
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// changesSince returns an event per record changed after version, and the
+// version the events bring a follower to.
+func (s *SQLStorage) changesSince(ctx context.Context, version uint64) ([]types.StorageEvent, uint64, error) {
+	tx, err := s.beginRead(ctx)
+	if err != nil {
+		return nil, version, err
+	}
+	defer tx.Rollback()
+
+	var latest uint64
+	if err := tx.QueryRowContext(ctx, `SELECT version FROM jw238dns_version`).Scan(&latest); err != nil {
+		return nil, version, fmt.Errorf("read version: %w", err)
+	}
+	if latest <= version {
+		return nil, version, nil
+	}
+
+	rows, err := tx.QueryContext(ctx, s.dialect.rebind(
+		`SELECT version, name, type, op FROM jw238dns_changes WHERE version > ? AND version <= ? ORDER BY version`), version, latest)
+	if err != nil {
+		return nil, version, fmt.Errorf("read change log: %w", err)
+	}
+	type change struct {
+		key types.RecordKey
+		op  types.EventType
+	}
+	var changes []change
+	first := uint64(0)
+	for rows.Next() {
+		var v uint64
+		var c change
+		var rt, op string
+		if err := rows.Scan(&v, &c.key.Name, &rt, &op); err != nil {
+			rows.Close()
+			return nil, version, fmt.Errorf("read change log: %w", err)
+		}
+		if first == 0 {
+			first = v
+		}
+		c.key.Type, c.op = types.RecordType(rt), types.EventType(op)
+		changes = append(changes, c)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, version, fmt.Errorf("read change log: %w", err)
+	}
+	if first != version+1 {
+		return []types.StorageEvent{{Type: types.EventReloaded}}, latest, nil
+	}
+
+	// Report each record once, as it is now, in the order of its last change.
+	last := make(map[types.RecordKey]int, len(changes))
+	for i, c := range changes {
+		last[c.key] = i
+	}
+	var events []types.StorageEvent
+	for i, c := range changes {
+		if last[c.key] != i {
+			continue
+		}
+		rec, err := s.getRecord(ctx, tx, c.key.Name, c.key.Type)
+		if err != nil {
+			return nil, version, err
+		}
+		switch {
+		case rec == nil:
+			events = append(events, types.StorageEvent{Type: types.EventDeleted, Record: &types.DNSRecord{Name: c.key.Name, Type: c.key.Type}})
+		case c.op == types.EventAdded:
+			events = append(events, types.StorageEvent{Type: types.EventAdded, Record: rec})
+		default:
+			events = append(events, types.StorageEvent{Type: types.EventUpdated, Record: rec})
+		}
+	}
+	return events, latest, nil
+}
+
+// snapshot returns all records and the version they correspond to.
+func (s *SQLStorage) snapshot(ctx context.Context) ([]*types.DNSRecord, uint64, error) {
+	tx, err := s.beginRead(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer tx.Rollback()
+
+	var version uint64
+	if err := tx.QueryRowContext(ctx, `SELECT version FROM jw238dns_version`).Scan(&version); err != nil {
+		return nil, 0, fmt.Errorf("read version: %w", err)
+	}
+	rows, err := tx.QueryContext(ctx, `SELECT name, type, ttl, value, meta FROM jw238dns_records`)
+	if err != nil {
+		return nil, 0, fmt.Errorf("list records: %w", err)
+	}
+	records, err := scanRecords(rows)
+	return records, version, err
+}
+
+// beginRead starts a read-only transaction that sees a single snapshot of
+// the database.
+func (s *SQLStorage) beginRead(ctx context.Context) (*sql.Tx, error) {
+	opts := &sql.TxOptions{ReadOnly: true}
+	if s.dialect.name != "sqlite" {
+		// SQLite transactions are serializable already and the driver
+		// rejects other levels.
+		opts.Isolation = sql.LevelRepeatableRead
+	}
+	tx, err := s.db.BeginTx(ctx, opts)
+	if err != nil {
+		return nil, fmt.Errorf("begin transaction: %w", err)
+	}
+	return tx, nil
+}
+
+// commit runs apply in a write transaction, then bumps the version and
+// logs the changes apply reports. Nothing is committed if they are empty.
+// The version row is locked before apply runs, so writers from all
+// replicas are serialised and what apply reads still holds when it
+// writes.
+func (s *SQLStorage) commit(ctx context.Context, apply func(*sql.Tx) (*types.RecordChanges, error)) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `UPDATE jw238dns_version SET version = version`); err != nil {
+		return fmt.Errorf("lock version: %w", err)
+	}
+	changes, err := apply(tx)
+	if err != nil {
+		return err
+	}
+	if len(changes.Added) == 0 && len(changes.Updated) == 0 && len(changes.Deleted) == 0 {
+		return nil
+	}
+
+	if _, err := tx.ExecContext(ctx, `UPDATE jw238dns_version SET version = version + 1`); err != nil {
+		return fmt.Errorf("bump version: %w", err)
+	}
+	var version uint64
+	if err := tx.QueryRowContext(ctx, `SELECT version FROM jw238dns_version`).Scan(&version); err != nil {
+		return fmt.Errorf("read version: %w", err)
+	}
+
+	logChange := func(name string, rt types.RecordType, op types.EventType) error {
+		_, err := tx.ExecContext(ctx, s.dialect.rebind(
+			`INSERT INTO jw238dns_changes (version, name, type, op) VALUES (?, ?, ?, ?)`), version, name, string(rt), string(op))
+		if err != nil {
+			return fmt.Errorf("log change: %w", err)
+		}
+		return nil
+	}
+	for _, r := range changes.Added {
+		if err := logChange(r.Name, r.Type, types.EventAdded); err != nil {
+			return err
+		}
+	}
+	for _, r := range changes.Updated {
+		if err := logChange(r.Name, r.Type, types.EventUpdated); err != nil {
+			return err
+		}
+	}
+	for _, key := range changes.Deleted {
+		if err := logChange(key.Name, key.Type, types.EventDeleted); err != nil {
+			return err
+		}
+	}
+
+	if version > uint64(s.journalSize) {
+		if _, err := tx.ExecContext(ctx, s.dialect.rebind(
+			`DELETE FROM jw238dns_changes WHERE version <= ?`), version-uint64(s.journalSize)); err != nil {
+			return fmt.Errorf("trim change log: %w", err)
+		}
+	}
+	if s.dialect.name == "postgres" {
+		// Delivered to listeners when the transaction commits.
+		if _, err := tx.ExecContext(ctx, `SELECT pg_notify($1, $2)`, sqlNotifyChannel, strconv.FormatUint(version, 10)); err != nil {
+			return fmt.Errorf("notify: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("commit: %w", err)
+	}
+	s.signal()
+	return nil
+}
+
+// applyChanges writes changes to jw238dns_records, and keeps the zones in
+// jw238dns_zones and the zone column of the records up to date.
+func (s *SQLStorage) applyChanges(ctx context.Context, tx *sql.Tx, changes *types.RecordChanges) error {
+	zones, err := s.zones(ctx, tx)
+	if err != nil {
+		return err
+	}
+	soaChanged := false
+	for _, r := range slices.Concat(changes.Added, changes.Updated) {
+		if err := s.putRecord(ctx, tx, r, zoneFor(r.Name, zones)); err != nil {
+			return err
+		}
+		soaChanged = soaChanged || r.Type == types.RecordTypeSOA
+	}
+	for _, key := range changes.Deleted {
+		if _, err := tx.ExecContext(ctx, s.dialect.rebind(
+			`DELETE FROM jw238dns_records WHERE name = ? AND type = ?`), key.Name, string(key.Type)); err != nil {
+			return fmt.Errorf("delete record: %w", err)
+		}
+		soaChanged = soaChanged || key.Type == types.RecordTypeSOA
+	}
+	if soaChanged {
+		return rebuildSQLZones(ctx, tx, s.dialect)
+	}
+	return nil
+}
+
+// zones returns the zone apexes in jw238dns_zones, longest first.
+func (s *SQLStorage) zones(ctx context.Context, q sqlQuerier) ([]string, error) {
+	rows, err := q.QueryContext(ctx, `SELECT name FROM jw238dns_zones`)
+	if err != nil {
+		return nil, fmt.Errorf("read zones: %w", err)
+	}
+	defer rows.Close()
+	zones := make(map[string]uint32)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, fmt.Errorf("read zones: %w", err)
+		}
+		zones[name] = 0
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("read zones: %w", err)
+	}
+	return sortedZones(zones), nil
+}
+
+// rebuildSQLZones refills jw238dns_zones from the SOA records and sets
+// the zone column of every record whose zone changed.
+func rebuildSQLZones(ctx context.Context, tx *sql.Tx, d sqlDialect) error {
+	rows, err := tx.QueryContext(ctx, `SELECT name, type, zone FROM jw238dns_records`)
+	if err != nil {
+		return fmt.Errorf("read record zones: %w", err)
+	}
+	type recordZone struct {
+		name, rt string
+		zone     sql.NullString
+	}
+	var records []recordZone
+	zones := make(map[string]uint32)
+	for rows.Next() {
+		var r recordZone
+		if err := rows.Scan(&r.name, &r.rt, &r.zone); err != nil {
+			rows.Close()
+			return fmt.Errorf("read record zones: %w", err)
+		}
+		records = append(records, r)
+		if r.rt == string(types.RecordTypeSOA) {
+			zones[strings.ToLower(r.name)] = 0
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("read record zones: %w", err)
+	}
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM jw238dns_zones`); err != nil {
+		return fmt.Errorf("clear zones: %w", err)
+	}
+	for zone := range zones {
+		if _, err := tx.ExecContext(ctx, d.rebind(`INSERT INTO jw238dns_zones (name) VALUES (?)`), zone); err != nil {
+			return fmt.Errorf("insert zone: %w", err)
+		}
+	}
+	sorted := sortedZones(zones)
+	for _, r := range records {
+		zone := zoneFor(r.name, sorted)
+		if r.zone.String == zone && r.zone.Valid == (zone != "") {
+			continue
+		}
+		if _, err := tx.ExecContext(ctx, d.rebind(`UPDATE jw238dns_records SET zone = ? WHERE name = ? AND type = ?`),
+			sql.NullString{String: zone, Valid: zone != ""}, r.name, r.rt); err != nil {
+			return fmt.Errorf("set record zone: %w", err)
+		}
+	}
+	return nil
+}
+
+// Zones returns the apexes of the stored zones, the lower-cased names
+// with an SOA record, sorted.
+func (s *SQLStorage) Zones(ctx context.Context) ([]string, error) {
+	zones, err := s.zones(ctx, s.db)
+	slices.Sort(zones)
+	return zones, err
+}
+
+// ListZone returns the records of the zone with the given apex, leaving
+// out those in zones delegated below it.
+func (s *SQLStorage) ListZone(ctx context.Context, zone string) ([]*types.DNSRecord, error) {
+	ctx, span := tracer.Start(ctx, "SQLStorage.ListZone")
+	defer span.End()
+
+	rows, err := s.db.QueryContext(ctx, s.dialect.rebind(
+		`SELECT name, type, ttl, value, meta FROM jw238dns_records WHERE zone = ? ORDER BY name, type`), strings.ToLower(zone))
+	if err != nil {
+		return nil, fmt.Errorf("list zone: %w", err)
+	}
+	return scanRecords(rows)
+}
+
+// putRecord inserts or replaces record, in zone if not empty. A delete
+// and insert is used because the upsert syntax differs between databases.
+func (s *SQLStorage) putRecord(ctx context.Context, tx *sql.Tx, record *types.DNSRecord, zone string) error {
+	value, err := json.Marshal(record.Value)
+	if err != nil {
+		return fmt.Errorf("encode values: %w", err)
+	}
+	if _, err := tx.ExecContext(ctx, s.dialect.rebind(
+		`DELETE FROM jw238dns_records WHERE name = ? AND type = ?`), record.Name, string(record.Type)); err != nil {
+		return fmt.Errorf("replace record: %w", err)
+	}
+	var meta sql.NullString
+	if record.Meta != nil {
+		data, err := json.Marshal(record.Meta)
+		if err != nil {
+			return fmt.Errorf("encode metadata: %w", err)
+		}
+		meta = sql.NullString{String: string(data), Valid: true}
+	}
+	if _, err := tx.ExecContext(ctx, s.dialect.rebind(
+		`INSERT INTO jw238dns_records (name, type, ttl, value, meta, zone) VALUES (?, ?, ?, ?, ?, ?)`),
+		record.Name, string(record.Type), int64(record.TTL), string(value), meta, sql.NullString{String: zone, Valid: zone != ""}); err != nil {
+		return fmt.Errorf("insert record: %w", err)
+	}
+	return nil
+}
+
+// sqlQuerier is implemented by *sql.DB and *sql.Tx.
+type sqlQuerier interface {
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+}
+
+// getRecord returns the record stored under name and type, or nil.
+func (s *SQLStorage) getRecord(ctx context.Context, q sqlQuerier, name string, recordType types.RecordType) (*types.DNSRecord, error) {
+	rows, err := q.QueryContext(ctx, s.dialect.rebind(
+		`SELECT name, type, ttl, value, meta FROM jw238dns_records WHERE name = ? AND type = ?`), name, string(recordType))
+	if err != nil {
+		return nil, fmt.Errorf("read record: %w", err)
+	}
+	records, err := scanRecords(rows)
+	if err != nil || len(records) == 0 {
+		return nil, err
+	}
+	return records[0], nil
+}
+
+// scanRecords reads and closes rows of name, type, ttl, value, meta.
+func scanRecords(rows *sql.Rows) ([]*types.DNSRecord, error) {
+	defer rows.Close()
+	var records []*types.DNSRecord
+	for rows.Next() {
+		var rec types.DNSRecord
+		var rt, value string
+		var ttl int64
+		var meta sql.NullString
+		if err := rows.Scan(&rec.Name, &rt, &ttl, &value, &meta); err != nil {
+			return nil, fmt.Errorf("read record: %w", err)
+		}
+		if err := json.Unmarshal([]byte(value), &rec.Value); err != nil {
+			return nil, fmt.Errorf("decode values of %s %s: %w", rec.Name, rt, err)
+		}
+		if meta.Valid {
+			if err := json.Unmarshal([]byte(meta.String), &rec.Meta); err != nil {
+				return nil, fmt.Errorf("decode metadata of %s %s: %w", rec.Name, rt, err)
+			}
+		}
+		rec.Type, rec.TTL = types.RecordType(rt), uint32(ttl)
+		records = append(records, &rec)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("read records: %w", err)
+	}
+	return records, nil
+}
+
+// changed returns a channel that is closed the next time a change may
+// have been committed.
+func (s *SQLStorage) changed() <-chan struct{} {
+	s.notifyMu.Lock()
+	defer s.notifyMu.Unlock()
+	return s.notifyCh
+}
+
+// signal wakes everything waiting on changed.
+func (s *SQLStorage) signal() {
+	s.notifyMu.Lock()
+	defer s.notifyMu.Unlock()
+	close(s.notifyCh)
+	s.notifyCh = make(chan struct{})
+}
+
+// listen signals on every PostgreSQL NOTIFY from any writer until ctx is
+// cancelled, reconnecting after errors. Polling carries on regardless, so
+// a lost connection only delays changes.
+func (s *SQLStorage) listen(ctx context.Context) {
+	for {
+		err := s.listenOnce(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		slog.Warn("sql listen error, retrying", "err", err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(5 * time.Second):
+		}
+	}
+}
+
+// listenOnce runs a single LISTEN session.
+func (s *SQLStorage) listenOnce(ctx context.Context) error {
+	conn, err := pgx.Connect(ctx, s.dsn)
+	if err != nil {
+		return fmt.Errorf("connect: %w", err)
+	}
+	defer conn.Close(context.WithoutCancel(ctx))
+
+	if _, err := conn.Exec(ctx, "LISTEN "+sqlNotifyChannel); err != nil {
+		return fmt.Errorf("listen: %w", err)
+	}
+	// Catch up on anything committed while we were not listening.
+	s.signal()
+	for {
+		if _, err := conn.WaitForNotification(ctx); err != nil {
+			return fmt.Errorf("wait for notification: %w", err)
+		}
+		s.signal()
+	}
+}
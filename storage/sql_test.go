@@ -0,0 +1,427 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"jabberwocky238/jw238dns/types"
+)
+
+// sqliteDSN returns the DSN of a fresh SQLite database file.
+func sqliteDSN(t *testing.T) string {
+	t.Helper()
+	return "file:" + filepath.Join(t.TempDir(), "records.db") + "?_pragma=busy_timeout(5000)"
+}
+
+// openTestSQL opens an SQLStorage on dsn, migrating it if needed.
+func openTestSQL(t *testing.T, dsn string, journalSize int) *SQLStorage {
+	t.Helper()
+	s, err := OpenSQLStorage(context.Background(), SQLConfig{
+		Driver:       "sqlite",
+		DSN:          dsn,
+		PollInterval: 20 * time.Millisecond,
+		JournalSize:  journalSize,
+		AutoMigrate:  true,
+	})
+	if err != nil {
+		t.Fatalf("OpenSQLStorage() error = %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestMigrateSQL(t *testing.T) {
+	dsn := sqliteDSN(t)
+	ctx := context.Background()
+
+	_, err := OpenSQLStorage(ctx, SQLConfig{Driver: "sqlite", DSN: dsn})
+	if err == nil || !strings.Contains(err.Error(), "jw238dns migrate") {
+		t.Fatalf("OpenSQLStorage() on empty database error = %v, want a hint to migrate", err)
+	}
+
+	from, to, err := MigrateSQL(ctx, "sqlite", dsn)
+	if err != nil {
+		t.Fatalf("MigrateSQL() error = %v", err)
+	}
+	if from != 0 || to != len(sqlMigrations) {
+		t.Errorf("MigrateSQL() = %d -> %d, want 0 -> %d", from, to, len(sqlMigrations))
+	}
+
+	from, to, err = MigrateSQL(ctx, "sqlite", dsn)
+	if err != nil || from != to {
+		t.Errorf("second MigrateSQL() = %d -> %d, %v, want no-op", from, to, err)
+	}
+
+	s, err := OpenSQLStorage(ctx, SQLConfig{Driver: "sqlite", DSN: dsn})
+	if err != nil {
+		t.Fatalf("OpenSQLStorage() after migrate error = %v", err)
+	}
+	s.Close()
+}
+
+func TestOpenSQLStorage_UnknownDriver(t *testing.T) {
+	if _, err := OpenSQLStorage(context.Background(), SQLConfig{Driver: "oracle"}); err == nil {
+		t.Error("OpenSQLStorage() with unknown driver should fail")
+	}
+}
+
+func TestSQLDialect_Rebind(t *testing.T) {
+	const q = `SELECT a FROM t WHERE b = ? AND c = ?`
+	tests := []struct {
+		dialect string
+		want    string
+	}{
+		{dialect: "postgres", want: `SELECT a FROM t WHERE b = $1 AND c = $2`},
+		{dialect: "mysql", want: q},
+		{dialect: "sqlite", want: q},
+	}
+	for _, tt := range tests {
+		if got := (sqlDialect{name: tt.dialect}).rebind(q); got != tt.want {
+			t.Errorf("rebind(%s) = %q, want %q", tt.dialect, got, tt.want)
+		}
+	}
+}
+
+func TestSQLStorage_CRUD(t *testing.T) {
+	s := openTestSQL(t, sqliteDSN(t), 0)
+	ctx := context.Background()
+
+	rec := &types.DNSRecord{Name: "a.com.", Type: types.RecordTypeTXT, TTL: 300, Value: []string{"v=spf1 -all", "second"}}
+	if err := s.Create(ctx, rec); err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+	if err := s.Create(ctx, rec); !errors.Is(err, types.ErrRecordExists) {
+		t.Errorf("Create() duplicate error = %v, want ErrRecordExists", err)
+	}
+	recs, err := s.Get(ctx, "a.com.", types.RecordTypeTXT)
+	if err != nil || len(recs) != 1 || len(recs[0].Value) != 2 || recs[0].Value[0] != "v=spf1 -all" {
+		t.Fatalf("Get() = %v, %v, want stored record", recs, err)
+	}
+
+	if err := s.Update(ctx, aRecord("b.com.", "1.1.1.1")); !errors.Is(err, types.ErrRecordNotFound) {
+		t.Errorf("Update() missing error = %v, want ErrRecordNotFound", err)
+	}
+	rec.TTL = 60
+	if err := s.Update(ctx, rec); err != nil {
+		t.Fatalf("Update() error = %v", err)
+	}
+	if recs, _ := s.Get(ctx, "a.com.", types.RecordTypeTXT); recs[0].TTL != 60 {
+		t.Errorf("TTL after Update() = %d, want 60", recs[0].TTL)
+	}
+
+	if err := s.Delete(ctx, "a.com.", types.RecordTypeTXT); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+	if err := s.Delete(ctx, "a.com.", types.RecordTypeTXT); !errors.Is(err, types.ErrRecordNotFound) {
+		t.Errorf("Delete() missing error = %v, want ErrRecordNotFound", err)
+	}
+	if v, _ := s.Version(ctx); v != 3 {
+		t.Errorf("Version() = %d, want 3", v)
+	}
+}
+
+// sqlSOA returns an SOA record for the zone apex.
+func sqlSOA(apex string) *types.DNSRecord {
+	return &types.DNSRecord{Name: apex, Type: types.RecordTypeSOA, TTL: 300,
+		Value: []string{"ns1." + apex + " admin." + apex + " 1 3600 900 604800 86400"}}
+}
+
+// recordNames returns the names of recs.
+func recordNames(recs []*types.DNSRecord) []string {
+	var names []string
+	for _, r := range recs {
+		names = append(names, r.Name+"/"+string(r.Type))
+	}
+	return names
+}
+
+func TestSQLStorage_Zones(t *testing.T) {
+	s := openTestSQL(t, sqliteDSN(t), 0)
+	ctx := context.Background()
+
+	for _, r := range []*types.DNSRecord{
+		aRecord("www.example.com.", "1.1.1.1"),
+		aRecord("www.sub.example.com.", "2.2.2.2"),
+		aRecord("other.org.", "3.3.3.3"),
+		sqlSOA("example.com."),
+	} {
+		if err := s.Create(ctx, r); err != nil {
+			t.Fatalf("Create(%s) error = %v", r.Name, err)
+		}
+	}
+	if zones, err := s.Zones(ctx); err != nil || fmt.Sprint(zones) != "[example.com.]" {
+		t.Fatalf("Zones() = %v, %v, want [example.com.]", zones, err)
+	}
+	recs, err := s.ListZone(ctx, "Example.COM.")
+	if got := fmt.Sprint(recordNames(recs)); err != nil || got != "[example.com./SOA www.example.com./A www.sub.example.com./A]" {
+		t.Fatalf("ListZone(example.com.) = %v, %v", got, err)
+	}
+
+	// A delegated zone takes its records out of the parent.
+	if err := s.Create(ctx, sqlSOA("sub.example.com.")); err != nil {
+		t.Fatalf("Create(SOA) error = %v", err)
+	}
+	if zones, _ := s.Zones(ctx); fmt.Sprint(zones) != "[example.com. sub.example.com.]" {
+		t.Errorf("Zones() = %v, want both zones", zones)
+	}
+	if recs, _ := s.ListZone(ctx, "example.com."); fmt.Sprint(recordNames(recs)) != "[example.com./SOA www.example.com./A]" {
+		t.Errorf("ListZone(example.com.) = %v after delegation", recordNames(recs))
+	}
+	if recs, _ := s.ListZone(ctx, "sub.example.com."); fmt.Sprint(recordNames(recs)) != "[sub.example.com./SOA www.sub.example.com./A]" {
+		t.Errorf("ListZone(sub.example.com.) = %v", recordNames(recs))
+	}
+
+	// Removing the SOA returns the records to the parent zone.
+	if err := s.Delete(ctx, "sub.example.com.", types.RecordTypeSOA); err != nil {
+		t.Fatalf("Delete(SOA) error = %v", err)
+	}
+	if zones, _ := s.Zones(ctx); fmt.Sprint(zones) != "[example.com.]" {
+		t.Errorf("Zones() = %v after deleting the SOA", zones)
+	}
+	if recs, _ := s.ListZone(ctx, "example.com."); len(recs) != 3 {
+		t.Errorf("ListZone(example.com.) = %v, want 3 records", recordNames(recs))
+	}
+}
+
+func TestMigrateSQL_FillsZones(t *testing.T) {
+	dsn := sqliteDSN(t)
+	ctx := context.Background()
+
+	// Stop before the zones migration and store records the old way.
+	all := sqlMigrations
+	sqlMigrations = all[:2]
+	_, _, err := MigrateSQL(ctx, "sqlite", dsn)
+	sqlMigrations = all
+	if err != nil {
+		t.Fatalf("MigrateSQL() error = %v", err)
+	}
+	db, _, err := openSQLDB("sqlite", dsn)
+	if err != nil {
+		t.Fatalf("openSQLDB() error = %v", err)
+	}
+	for _, r := range []*types.DNSRecord{sqlSOA("example.com."), aRecord("www.example.com.", "1.1.1.1"), aRecord("other.org.", "3.3.3.3")} {
+		if _, err := db.ExecContext(ctx, `INSERT INTO jw238dns_records (name, type, ttl, value) VALUES (?, ?, ?, ?)`,
+			r.Name, string(r.Type), r.TTL, `["`+r.Value[0]+`"]`); err != nil {
+			t.Fatalf("insert %s: %v", r.Name, err)
+		}
+	}
+	db.Close()
+
+	if from, to, err := MigrateSQL(ctx, "sqlite", dsn); err != nil || from != 2 || to != len(sqlMigrations) {
+		t.Fatalf("MigrateSQL() = %d -> %d, %v", from, to, err)
+	}
+	s := openTestSQL(t, dsn, 0)
+	if zones, _ := s.Zones(ctx); fmt.Sprint(zones) != "[example.com.]" {
+		t.Errorf("Zones() = %v, want [example.com.]", zones)
+	}
+	if recs, _ := s.ListZone(ctx, "example.com."); fmt.Sprint(recordNames(recs)) != "[example.com./SOA www.example.com./A]" {
+		t.Errorf("ListZone(example.com.) = %v", recordNames(recs))
+	}
+}
+
+func TestSQLStorage_Metadata(t *testing.T) {
+	s := openTestSQL(t, sqliteDSN(t), 0)
+	ctx := context.Background()
+
+	meta := &types.RecordMeta{Owner: "external-dns", Labels: map[string]string{"env": "prod"}, CreatedAt: time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)}
+	if err := s.Create(ctx, &types.DNSRecord{Name: "m.com.", Type: types.RecordTypeA, TTL: 300, Value: []string{"192.0.2.1"}, Meta: meta}); err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+	if err := s.Create(ctx, aRecord("plain.com.", "192.0.2.2")); err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+	if recs, err := s.Get(ctx, "m.com.", types.RecordTypeA); err != nil || !recs[0].Meta.Equal(meta) {
+		t.Errorf("Get() = %v, %v, want the stored metadata", recs, err)
+	}
+	if recs, err := s.Get(ctx, "plain.com.", types.RecordTypeA); err != nil || recs[0].Meta != nil {
+		t.Errorf("Get() = %v, %v, want no metadata", recs, err)
+	}
+}
+
+func TestSQLStorage_GetWildcard(t *testing.T) {
+	s := openTestSQL(t, sqliteDSN(t), 0)
+	ctx := context.Background()
+	_ = s.Create(ctx, aRecord("*.example.com.", "10.0.0.1"))
+
+	recs, err := s.Get(ctx, "test.example.com.", types.RecordTypeA)
+	if err != nil || len(recs) != 1 || recs[0].Name != "test.example.com." {
+		t.Fatalf("Get() wildcard = %v, %v", recs, err)
+	}
+	if _, err := s.Get(ctx, "example.org.", types.RecordTypeA); !errors.Is(err, types.ErrRecordNotFound) {
+		t.Errorf("Get() unmatched error = %v, want ErrRecordNotFound", err)
+	}
+}
+
+func TestSQLStorage_HotReload(t *testing.T) {
+	s := openTestSQL(t, sqliteDSN(t), 0)
+	ctx := context.Background()
+	_ = s.Create(ctx, aRecord("keep.com.", "1.1.1.1"))
+	_ = s.Create(ctx, aRecord("drop.com.", "2.2.2.2"))
+
+	desired := []*types.DNSRecord{aRecord("keep.com.", "1.1.1.1"), aRecord("new.com.", "3.3.3.3")}
+	if err := s.HotReload(ctx, desired); err != nil {
+		t.Fatalf("HotReload() error = %v", err)
+	}
+	recs, _ := s.List(ctx)
+	if changes := DiffRecords(recs, desired); len(changes.Added)+len(changes.Updated)+len(changes.Deleted) != 0 {
+		t.Errorf("records after HotReload() differ: %+v", changes)
+	}
+
+	// An identical reload commits nothing.
+	if err := s.HotReload(ctx, desired); err != nil {
+		t.Fatalf("HotReload() again error = %v", err)
+	}
+	if v, _ := s.Version(ctx); v != 3 {
+		t.Errorf("Version() = %d, want 3", v)
+	}
+}
+
+func TestSQLStorage_WatchSeesOtherReplica(t *testing.T) {
+	dsn := sqliteDSN(t)
+	writer := openTestSQL(t, dsn, 0)
+	reader := openTestSQL(t, dsn, 0)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch, err := reader.Watch(ctx)
+	if err != nil {
+		t.Fatalf("Watch() error = %v", err)
+	}
+
+	_ = writer.Create(ctx, aRecord("a.com.", "1.1.1.1"))
+	_ = writer.Update(ctx, aRecord("a.com.", "2.2.2.2"))
+	_ = writer.Create(ctx, aRecord("b.com.", "3.3.3.3"))
+	_ = writer.Delete(ctx, "b.com.", types.RecordTypeA)
+
+	// Depending on how the polls fall, changes to one record may be
+	// collapsed; the last event for each record must reflect its state.
+	last := make(map[string]types.StorageEvent)
+	deadline := time.After(2 * time.Second)
+	for last["a.com."].Record == nil || last["a.com."].Record.Value[0] != "2.2.2.2" || last["b.com."].Type != types.EventDeleted {
+		select {
+		case ev := <-ch:
+			last[ev.Record.Name] = ev
+		case <-deadline:
+			t.Fatalf("events = %+v, want a.com. at 2.2.2.2 and b.com. deleted", last)
+		}
+	}
+}
+
+func TestSQLStorage_TransactionAcrossReplicas(t *testing.T) {
+	dsn := sqliteDSN(t)
+	replicas := []*SQLStorage{openTestSQL(t, dsn, 0), openTestSQL(t, dsn, 0)}
+	ctx := context.Background()
+	counter := &types.DNSRecord{Name: "counter.com.", Type: types.RecordTypeTXT, TTL: 300, Value: []string{"0"}}
+	if err := replicas[0].Create(ctx, counter); err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+
+	// Every increment reads the counter and writes it back; none may be lost.
+	const increments = 10
+	var wg sync.WaitGroup
+	errs := make(chan error, len(replicas)*increments)
+	for _, s := range replicas {
+		for range increments {
+			wg.Go(func() {
+				errs <- s.Transaction(ctx, func(tx *Tx) error {
+					rec, err := tx.Get("counter.com.", types.RecordTypeTXT)
+					if err != nil {
+						return err
+					}
+					n, _ := strconv.Atoi(rec.Value[0])
+					return tx.Update(&types.DNSRecord{Name: rec.Name, Type: rec.Type, TTL: rec.TTL, Value: []string{strconv.Itoa(n + 1)}})
+				})
+			})
+		}
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Errorf("Transaction() error = %v", err)
+		}
+	}
+
+	recs, err := replicas[1].Get(ctx, "counter.com.", types.RecordTypeTXT)
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	if want := strconv.Itoa(len(replicas) * increments); recs[0].Value[0] != want {
+		t.Errorf("counter = %s, want %s", recs[0].Value[0], want)
+	}
+}
+
+func TestSQLStorage_ConcurrentCreate(t *testing.T) {
+	dsn := sqliteDSN(t)
+	replicas := []*SQLStorage{openTestSQL(t, dsn, 0), openTestSQL(t, dsn, 0)}
+	ctx := context.Background()
+
+	// Of concurrent creates of one record, one succeeds and the rest
+	// find it exists.
+	const creates = 10
+	var wg sync.WaitGroup
+	errs := make(chan error, len(replicas)*creates)
+	for _, s := range replicas {
+		for range creates {
+			wg.Go(func() { errs <- s.Create(ctx, aRecord("a.com.", "192.0.2.1")) })
+		}
+	}
+	wg.Wait()
+	close(errs)
+	created := 0
+	for err := range errs {
+		switch {
+		case err == nil:
+			created++
+		case !errors.Is(err, types.ErrRecordExists):
+			t.Errorf("Create() error = %v, want ErrRecordExists", err)
+		}
+	}
+	if created != 1 {
+		t.Errorf("%d creates succeeded, want 1", created)
+	}
+}
+
+func TestSQLStorage_SyncTo(t *testing.T) {
+	dsn := sqliteDSN(t)
+	writer := openTestSQL(t, dsn, 0)
+	reader := openTestSQL(t, dsn, 2)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	_ = writer.Create(ctx, aRecord("before.com.", "1.1.1.1"))
+
+	store := NewMemoryStorage()
+	version, err := reader.LoadInto(ctx, store)
+	if err != nil {
+		t.Fatalf("LoadInto() error = %v", err)
+	}
+	if _, err := store.Get(ctx, "before.com.", types.RecordTypeA); err != nil {
+		t.Fatalf("record missing after LoadInto(): %v", err)
+	}
+	go reader.SyncTo(ctx, store, version)
+
+	// More changes than the journal keeps force a full reload.
+	for i := range 5 {
+		_ = writer.Create(ctx, aRecord(fmt.Sprintf("r%d.com.", i), "2.2.2.2"))
+	}
+	_ = writer.Delete(ctx, "before.com.", types.RecordTypeA)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		want, _ := writer.List(ctx)
+		got, _ := store.List(ctx)
+		if changes := DiffRecords(got, want); len(changes.Added)+len(changes.Updated)+len(changes.Deleted) == 0 {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Error("store did not converge to the database contents")
+}
@@ -0,0 +1,132 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+// sqlMigration is one schema change: statements run in order, then fill,
+// if set, to populate what the statements added.
+type sqlMigration struct {
+	statements []string
+	fill       func(ctx context.Context, tx *sql.Tx, d sqlDialect) error
+}
+
+// sqlMigrations are the schema changes of the SQL storage, applied in
+// order. The schema version is the number of migrations applied. Each
+// statement runs on its own because not every driver accepts several
+// statements per Exec. The DDL is kept to types PostgreSQL, MySQL and
+// SQLite all understand.
+var sqlMigrations = []sqlMigration{
+	{statements: []string{
+		`CREATE TABLE jw238dns_records (
+			name VARCHAR(255) NOT NULL,
+			type VARCHAR(16) NOT NULL,
+			ttl BIGINT NOT NULL,
+			value TEXT NOT NULL,
+			PRIMARY KEY (name, type)
+		)`,
+		`CREATE TABLE jw238dns_version (version BIGINT NOT NULL)`,
+		`INSERT INTO jw238dns_version (version) VALUES (0)`,
+		`CREATE TABLE jw238dns_changes (
+			version BIGINT NOT NULL,
+			name VARCHAR(255) NOT NULL,
+			type VARCHAR(16) NOT NULL,
+			op VARCHAR(16) NOT NULL
+		)`,
+		`CREATE INDEX jw238dns_changes_version ON jw238dns_changes (version)`,
+	}},
+	{statements: []string{
+		// Record metadata (types.RecordMeta) as JSON; NULL for none.
+		`ALTER TABLE jw238dns_records ADD COLUMN meta TEXT`,
+	}},
+	{
+		statements: []string{
+			// Zone apexes (lower-cased names with an SOA record), and the
+			// apex of the most specific zone holding each record; NULL
+			// outside every zone.
+			`CREATE TABLE jw238dns_zones (
+				name VARCHAR(255) NOT NULL,
+				PRIMARY KEY (name)
+			)`,
+			`ALTER TABLE jw238dns_records ADD COLUMN zone VARCHAR(255)`,
+			`CREATE INDEX jw238dns_records_zone ON jw238dns_records (zone)`,
+		},
+		fill: func(ctx context.Context, tx *sql.Tx, d sqlDialect) error {
+			return rebuildSQLZones(ctx, tx, d)
+		},
+	},
+}
+
+// MigrateSQL brings the schema of the database identified by driver and
+// dsn up to date. It returns the schema version before and after.
+func MigrateSQL(ctx context.Context, driver, dsn string) (from, to int, err error) {
+	db, d, err := openSQLDB(driver, dsn)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer db.Close()
+	return migrateSQL(ctx, db, d)
+}
+
+// migrateSQL applies the migrations db is missing, each in its own
+// transaction. MySQL commits DDL implicitly, so a failed migration there
+// may be partly applied.
+func migrateSQL(ctx context.Context, db *sql.DB, d sqlDialect) (from, to int, err error) {
+	if _, err := db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS jw238dns_schema (version INTEGER NOT NULL)`); err != nil {
+		return 0, 0, fmt.Errorf("create schema table: %w", err)
+	}
+	from, err = schemaVersion(ctx, db)
+	if errors.Is(err, sql.ErrNoRows) {
+		if _, err := db.ExecContext(ctx, `INSERT INTO jw238dns_schema (version) VALUES (0)`); err != nil {
+			return 0, 0, fmt.Errorf("initialise schema table: %w", err)
+		}
+		from, err = 0, nil
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	if from > len(sqlMigrations) {
+		return from, from, fmt.Errorf("database schema version %d is newer than this build (%d)", from, len(sqlMigrations))
+	}
+
+	for to = from; to < len(sqlMigrations); to++ {
+		tx, err := db.BeginTx(ctx, nil)
+		if err != nil {
+			return from, to, fmt.Errorf("begin migration %d: %w", to+1, err)
+		}
+		m := sqlMigrations[to]
+		for _, stmt := range m.statements {
+			if _, err := tx.ExecContext(ctx, stmt); err != nil {
+				tx.Rollback()
+				return from, to, fmt.Errorf("migration %d: %w", to+1, err)
+			}
+		}
+		if m.fill != nil {
+			if err := m.fill(ctx, tx, d); err != nil {
+				tx.Rollback()
+				return from, to, fmt.Errorf("migration %d: %w", to+1, err)
+			}
+		}
+		if _, err := tx.ExecContext(ctx, d.rebind(`UPDATE jw238dns_schema SET version = ?`), to+1); err != nil {
+			tx.Rollback()
+			return from, to, fmt.Errorf("record migration %d: %w", to+1, err)
+		}
+		if err := tx.Commit(); err != nil {
+			return from, to, fmt.Errorf("commit migration %d: %w", to+1, err)
+		}
+	}
+	return from, to, nil
+}
+
+// schemaVersion returns the schema version recorded in db.
+func schemaVersion(ctx context.Context, db *sql.DB) (int, error) {
+	var version int
+	err := db.QueryRowContext(ctx, `SELECT version FROM jw238dns_schema`).Scan(&version)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return 0, fmt.Errorf("read schema version: %w", err)
+	}
+	return version, err
+}
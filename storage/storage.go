@@ -32,6 +32,13 @@ type CoreStorage interface {
 	// PartialReload applies only the changed records atomically.
 	PartialReload(ctx context.Context, changes *types.RecordChanges) error
 
+	// Transaction calls fn with a Tx over the stored records and applies
+	// the changes fn makes through it at once, like PartialReload. If fn
+	// returns an error nothing is applied and the error is returned. fn
+	// must not call the storage, and may be called again if another
+	// writer changed the records it read.
+	Transaction(ctx context.Context, fn func(tx *Tx) error) error
+
 	// Watch returns a channel that receives storage change events.
 	Watch(ctx context.Context) (<-chan types.StorageEvent, error)
 }
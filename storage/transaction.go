@@ -0,0 +1,129 @@
+package storage
+
+import (
+	"jabberwocky238/jw238dns/types"
+)
+
+// Tx is the working copy of a transaction started by
+// CoreStorage.Transaction. A record is read from the storage the first
+// time the transaction uses it; writes only change the working copy until
+// the transaction is applied. Records returned by Get must not be
+// modified.
+type Tx struct {
+	read  func(types.RecordKey) (*types.DNSRecord, error)
+	orig  map[types.RecordKey]*types.DNSRecord // As stored; nil if absent
+	cur   map[types.RecordKey]*types.DNSRecord // As changed; nil if absent
+	order []types.RecordKey                    // Keys in the order first used
+}
+
+// newTx creates a Tx reading records with read, which returns nil for a
+// record that does not exist.
+func newTx(read func(types.RecordKey) (*types.DNSRecord, error)) *Tx {
+	return &Tx{
+		read: read,
+		orig: make(map[types.RecordKey]*types.DNSRecord),
+		cur:  make(map[types.RecordKey]*types.DNSRecord),
+	}
+}
+
+// Get returns the record stored under name and type as changed by the
+// transaction so far, or ErrRecordNotFound. Unlike CoreStorage.Get it
+// does not match wildcards.
+func (tx *Tx) Get(name string, recordType types.RecordType) (*types.DNSRecord, error) {
+	rec, err := tx.load(types.RecordKey{Name: name, Type: recordType})
+	if err != nil {
+		return nil, err
+	}
+	if rec == nil {
+		return nil, types.ErrRecordNotFound
+	}
+	return rec, nil
+}
+
+// Create adds record to the transaction. Returns ErrRecordExists if a
+// record with the same name and type exists.
+func (tx *Tx) Create(record *types.DNSRecord) error {
+	key := types.RecordKey{Name: record.Name, Type: record.Type}
+	rec, err := tx.load(key)
+	if err != nil {
+		return err
+	}
+	if rec != nil {
+		return types.ErrRecordExists
+	}
+	tx.cur[key] = record
+	return nil
+}
+
+// Update replaces a record in the transaction. Returns ErrRecordNotFound
+// if the record does not exist.
+func (tx *Tx) Update(record *types.DNSRecord) error {
+	key := types.RecordKey{Name: record.Name, Type: record.Type}
+	rec, err := tx.load(key)
+	if err != nil {
+		return err
+	}
+	if rec == nil {
+		return types.ErrRecordNotFound
+	}
+	tx.cur[key] = record
+	return nil
+}
+
+// Delete removes a record in the transaction. Returns ErrRecordNotFound
+// if the record does not exist.
+func (tx *Tx) Delete(name string, recordType types.RecordType) error {
+	key := types.RecordKey{Name: name, Type: recordType}
+	rec, err := tx.load(key)
+	if err != nil {
+		return err
+	}
+	if rec == nil {
+		return types.ErrRecordNotFound
+	}
+	tx.cur[key] = nil
+	return nil
+}
+
+// Changes returns the difference between the stored records and the
+// working copy: what applying the transaction would change. Records
+// changed and then changed back are left out.
+func (tx *Tx) Changes() *types.RecordChanges {
+	changes := &types.RecordChanges{
+		Added:   []*types.DNSRecord{},
+		Updated: []*types.DNSRecord{},
+		Deleted: []types.RecordKey{},
+	}
+	for _, key := range tx.order {
+		old, rec := tx.orig[key], tx.cur[key]
+		switch {
+		case old == nil && rec != nil:
+			changes.Added = append(changes.Added, rec)
+		case old != nil && rec == nil:
+			changes.Deleted = append(changes.Deleted, key)
+		case old != nil && !recordsEqual(old, rec):
+			changes.Updated = append(changes.Updated, rec)
+		}
+	}
+	return changes
+}
+
+// load returns the working copy of the record under key, reading it from
+// the storage on first use.
+func (tx *Tx) load(key types.RecordKey) (*types.DNSRecord, error) {
+	if rec, ok := tx.cur[key]; ok {
+		return rec, nil
+	}
+	rec, err := tx.read(key)
+	if err != nil {
+		return nil, err
+	}
+	tx.orig[key], tx.cur[key] = rec, rec
+	tx.order = append(tx.order, key)
+	return rec, nil
+}
+
+// emptyChanges reports whether changes changes nothing.
+func emptyChanges(changes *types.RecordChanges) bool {
+	return len(changes.Added) == 0 && len(changes.Updated) == 0 && len(changes.Deleted) == 0
+}
@@ -0,0 +1,148 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"jabberwocky238/jw238dns/types"
+)
+
+func TestTransaction(t *testing.T) {
+	backends := map[string]func(t *testing.T) CoreStorage{
+		"memory": func(t *testing.T) CoreStorage { return NewMemoryStorage() },
+		"bolt":   func(t *testing.T) CoreStorage { return openTestBolt(t, "", 100) },
+		"sql":    func(t *testing.T) CoreStorage { return openTestSQL(t, sqliteDSN(t), 100) },
+		"etcd": func(t *testing.T) CoreStorage {
+			s, _ := newTestEtcd(t, 0)
+			return s
+		},
+	}
+	for name, open := range backends {
+		t.Run(name, func(t *testing.T) {
+			s := open(t)
+			ctx := context.Background()
+			for _, r := range []*types.DNSRecord{aRecord("a.com.", "192.0.2.1"), aRecord("b.com.", "192.0.2.2")} {
+				if err := s.Create(ctx, r); err != nil {
+					t.Fatalf("Create() error = %v", err)
+				}
+			}
+
+			// A failing transaction applies nothing.
+			errAbort := errors.New("abort")
+			err := s.Transaction(ctx, func(tx *Tx) error {
+				if err := tx.Delete("a.com.", types.RecordTypeA); err != nil {
+					return err
+				}
+				if err := tx.Create(aRecord("b.com.", "192.0.2.9")); !errors.Is(err, types.ErrRecordExists) {
+					t.Errorf("Tx.Create() of an existing record = %v, want ErrRecordExists", err)
+				}
+				return errAbort
+			})
+			if !errors.Is(err, errAbort) {
+				t.Fatalf("Transaction() = %v, want the error of fn", err)
+			}
+			if _, err := s.Get(ctx, "a.com.", types.RecordTypeA); err != nil {
+				t.Errorf("a.com. deleted by an aborted transaction: %v", err)
+			}
+
+			err = s.Transaction(ctx, func(tx *Tx) error {
+				if err := tx.Delete("a.com.", types.RecordTypeA); err != nil {
+					return err
+				}
+				if _, err := tx.Get("a.com.", types.RecordTypeA); !errors.Is(err, types.ErrRecordNotFound) {
+					t.Errorf("Tx.Get() after Tx.Delete() = %v, want ErrRecordNotFound", err)
+				}
+				if err := tx.Update(aRecord("b.com.", "192.0.2.3")); err != nil {
+					return err
+				}
+				// Created and deleted again: no change.
+				if err := tx.Create(aRecord("c.com.", "192.0.2.4")); err != nil {
+					return err
+				}
+				if err := tx.Delete("c.com.", types.RecordTypeA); err != nil {
+					return err
+				}
+				if err := tx.Create(aRecord("d.com.", "192.0.2.5")); err != nil {
+					return err
+				}
+				changes := tx.Changes()
+				if len(changes.Added) != 1 || len(changes.Updated) != 1 || len(changes.Deleted) != 1 {
+					t.Errorf("Tx.Changes() = %d added, %d updated, %d deleted, want 1 each",
+						len(changes.Added), len(changes.Updated), len(changes.Deleted))
+				}
+				return nil
+			})
+			if err != nil {
+				t.Fatalf("Transaction() error = %v", err)
+			}
+
+			for name, want := range map[string]string{"a.com.": "", "b.com.": "192.0.2.3", "c.com.": "", "d.com.": "192.0.2.5"} {
+				recs, err := s.Get(ctx, name, types.RecordTypeA)
+				switch {
+				case want == "" && err == nil:
+					t.Errorf("%s still present", name)
+				case want != "" && (err != nil || recs[0].Value[0] != want):
+					t.Errorf("Get(%s) = %v, %v, want %s", name, recs, err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestMemoryStorage_TransactionEmitsOneEvent(t *testing.T) {
+	s := NewMemoryStorage()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events, _ := s.Watch(ctx)
+
+	err := s.Transaction(ctx, func(tx *Tx) error {
+		if err := tx.Create(aRecord("a.com.", "192.0.2.1")); err != nil {
+			return err
+		}
+		return tx.Create(aRecord("b.com.", "192.0.2.2"))
+	})
+	if err != nil {
+		t.Fatalf("Transaction() error = %v", err)
+	}
+	if ev := <-events; ev.Type != types.EventReloaded {
+		t.Errorf("event = %s, want %s", ev.Type, types.EventReloaded)
+	}
+	if len(events) != 0 {
+		t.Errorf("%d more events, want one per transaction", len(events))
+	}
+}
+
+func TestEtcdStorage_TransactionRetriesOnConflict(t *testing.T) {
+	s, _ := newTestEtcd(t, 0)
+	ctx := context.Background()
+	if err := s.Create(ctx, aRecord("a.com.", "192.0.2.1")); err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+
+	calls := 0
+	err := s.Transaction(ctx, func(tx *Tx) error {
+		calls++
+		rec, err := tx.Get("a.com.", types.RecordTypeA)
+		if err != nil {
+			return err
+		}
+		if calls == 1 {
+			// Another writer changes the record after it was read.
+			if err := s.Update(ctx, aRecord("a.com.", "192.0.2.2")); err != nil {
+				t.Fatalf("Update() error = %v", err)
+			}
+		}
+		return tx.Update(aRecord("a.com.", rec.Value[0]+"0"))
+	})
+	if err != nil {
+		t.Fatalf("Transaction() error = %v", err)
+	}
+	if calls != 2 {
+		t.Errorf("fn called %d times, want 2", calls)
+	}
+	recs, _ := s.Get(ctx, "a.com.", types.RecordTypeA)
+	if got := recs[0].Value[0]; got != "192.0.2.20" {
+		t.Errorf("value = %s, want the update of the concurrent write", got)
+	}
+}
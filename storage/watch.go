@@ -0,0 +1,223 @@
+package storage
+
+import (
+	"context"
+	"sync"
+
+	"jabberwocky238/jw238dns/metrics"
+	"jabberwocky238/jw238dns/types"
+)
+
+const (
+	// watchBufferSize is the capacity of a watcher's channel.
+	watchBufferSize = 64
+
+	// watchQueueSize is the number of events a watcher may fall behind
+	// beyond its channel before they are replaced by an EventResync.
+	watchQueueSize = 256
+
+	// eventLogSize is the least number of latest events kept for
+	// WatchFrom.
+	eventLogSize = 1024
+)
+
+// watcher is a subscriber of a MemoryStorage. emit sends events straight
+// to the channel while it has room; after that they are queued and
+// delivered by the watcher's pump, so a slow subscriber never blocks the
+// storage. If it falls watchQueueSize events further behind, the queue is
+// dropped and the subscriber gets an EventResync instead.
+type watcher struct {
+	ch   chan types.StorageEvent
+	wake chan struct{} // Signalled when the queue changes
+
+	mu      sync.Mutex
+	queue   []types.StorageEvent
+	missed  int  // Events dropped since the last delivery
+	sending bool // The pump is delivering an event taken from the queue
+}
+
+// push delivers or queues event, or drops the queue if it is full.
+func (w *watcher) push(event types.StorageEvent) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	// Events go straight to the channel unless older ones are pending.
+	if !w.sending && w.missed == 0 && len(w.queue) == 0 {
+		select {
+		case w.ch <- event:
+			return
+		default:
+		}
+	}
+	if len(w.queue) < watchQueueSize {
+		w.queue = append(w.queue, event)
+	} else {
+		dropped := len(w.queue) + 1
+		w.missed += dropped
+		w.queue = nil
+		metrics.WatchEventsDroppedTotal.Add(float64(dropped))
+	}
+
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Watch returns a channel that receives storage change events. The channel
+// is closed when the provided context is cancelled.
+//
+// Every event carries the storage version after the change. Events are
+// never silently dropped: a subscriber that falls behind gets a single
+// EventResync holding every record instead of the events it missed.
+func (s *MemoryStorage) Watch(ctx context.Context) (<-chan types.StorageEvent, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.subscribeLocked(ctx, nil), nil
+}
+
+// WatchFrom is like Watch, but first delivers the events after version,
+// so a subscriber can resume where it left off. If those events are no
+// longer kept, or version is ahead of the storage (which restarted), the
+// first event is an EventResync instead.
+func (s *MemoryStorage) WatchFrom(ctx context.Context, version uint64) (<-chan types.StorageEvent, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var backlog []types.StorageEvent
+	switch {
+	case version == s.version:
+	case version < s.version && len(s.events) > 0 && s.events[0].Version <= version+1:
+		for _, ev := range s.events {
+			if ev.Version > version {
+				backlog = append(backlog, ev)
+			}
+		}
+	default:
+		ev := s.resyncEventLocked()
+		if version < s.version {
+			ev.Missed = int(s.version - version)
+		}
+		backlog = []types.StorageEvent{ev}
+	}
+	return s.subscribeLocked(ctx, backlog), nil
+}
+
+// subscribeLocked registers a watcher with backlog queued and starts its
+// pump. Caller must hold s.mu, so no event is emitted in between.
+func (s *MemoryStorage) subscribeLocked(ctx context.Context, backlog []types.StorageEvent) <-chan types.StorageEvent {
+	w := &watcher{
+		ch:    make(chan types.StorageEvent, watchBufferSize),
+		wake:  make(chan struct{}, 1),
+		queue: backlog,
+	}
+	s.watchMu.Lock()
+	s.watchers = append(s.watchers, w)
+	s.watchMu.Unlock()
+
+	go s.pump(ctx, w)
+	return w.ch
+}
+
+// pump delivers the events queued for w until ctx is cancelled, then
+// unregisters w and closes its channel.
+func (s *MemoryStorage) pump(ctx context.Context, w *watcher) {
+	defer func() {
+		s.watchMu.Lock()
+		for i, other := range s.watchers {
+			if other == w {
+				s.watchers = append(s.watchers[:i], s.watchers[i+1:]...)
+				break
+			}
+		}
+		s.watchMu.Unlock()
+		close(w.ch)
+	}()
+
+	for {
+		ev, ok := s.next(w)
+		if !ok {
+			select {
+			case <-ctx.Done():
+				return
+			case <-w.wake:
+				continue
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case w.ch <- ev:
+		}
+		w.mu.Lock()
+		w.sending = false
+		w.mu.Unlock()
+	}
+}
+
+// next dequeues the next event for w: an EventResync if w missed events,
+// or else the oldest queued one. The caller clears w.sending once the
+// event is delivered.
+func (s *MemoryStorage) next(w *watcher) (types.StorageEvent, bool) {
+	w.mu.Lock()
+	if w.missed == 0 {
+		defer w.mu.Unlock()
+		if len(w.queue) == 0 {
+			return types.StorageEvent{}, false
+		}
+		ev := w.queue[0]
+		w.queue = w.queue[1:]
+		w.sending = true
+		return ev, true
+	}
+	w.mu.Unlock()
+
+	// Lock the storage before w, as emit does, so the snapshot and the
+	// queue agree: events queued up to the snapshot are covered by it.
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	ev := s.resyncEventLocked()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	ev.Missed = w.missed
+	w.missed = 0
+	var queue []types.StorageEvent
+	for _, queued := range w.queue {
+		if queued.Version > ev.Version {
+			queue = append(queue, queued)
+		}
+	}
+	w.queue = queue
+	w.sending = true
+	metrics.WatchResyncsTotal.Inc()
+	return ev, true
+}
+
+// resyncEventLocked returns an EventResync with every record. Caller must
+// hold s.mu.
+func (s *MemoryStorage) resyncEventLocked() types.StorageEvent {
+	var all []*types.DNSRecord
+	for _, byType := range s.records {
+		for _, recs := range byType {
+			all = append(all, recs...)
+		}
+	}
+	return types.StorageEvent{Type: types.EventResync, Version: s.version, Snapshot: all}
+}
+
+// emit stamps event with the storage version, keeps it for WatchFrom and
+// queues it for every watcher. Caller must hold s.mu for writing, having
+// just incremented the version.
+func (s *MemoryStorage) emit(event types.StorageEvent) {
+	event.Version = s.version
+	s.events = append(s.events, event)
+	if len(s.events) >= 2*eventLogSize {
+		s.events = append(s.events[:0:0], s.events[len(s.events)-eventLogSize:]...)
+	}
+
+	s.watchMu.Lock()
+	defer s.watchMu.Unlock()
+	for _, w := range s.watchers {
+		w.push(event)
+	}
+}
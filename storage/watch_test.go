@@ -0,0 +1,133 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"jabberwocky238/jw238dns/types"
+)
+
+// receive returns the next event on ch, failing the test after a second.
+func receive(t *testing.T, ch <-chan types.StorageEvent) types.StorageEvent {
+	t.Helper()
+	select {
+	case ev := <-ch:
+		return ev
+	case <-time.After(time.Second):
+		t.Fatal("no event")
+		return types.StorageEvent{}
+	}
+}
+
+func TestMemoryStorage_WatchEventsCarryChanges(t *testing.T) {
+	s := NewMemoryStorage()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch, _ := s.Watch(ctx)
+
+	_ = s.Create(ctx, aRecord("a.com.", "192.0.2.1"))
+	_ = s.PartialReload(ctx, &types.RecordChanges{Added: []*types.DNSRecord{aRecord("b.com.", "192.0.2.2")}})
+	_ = s.HotReload(ctx, []*types.DNSRecord{aRecord("a.com.", "192.0.2.3"), aRecord("c.com.", "192.0.2.4")})
+	_ = s.Delete(ctx, "c.com.", types.RecordTypeA)
+	s.ApplySource(ctx, "discovery", []*types.DNSRecord{aRecord("svc.com.", "192.0.2.9")})
+
+	tests := []struct {
+		typ                     types.EventType
+		added, updated, deleted int
+		source                  string
+	}{
+		{types.EventAdded, 1, 0, 0, ""},
+		{types.EventReloaded, 1, 0, 0, ""},
+		{types.EventReloaded, 1, 1, 1, ""}, // c.com. added, a.com. updated, b.com. deleted
+		{types.EventDeleted, 0, 0, 1, ""},
+		{types.EventReloaded, 1, 0, 0, "discovery"},
+	}
+	for i, tt := range tests {
+		ev := receive(t, ch)
+		if ev.Type != tt.typ || ev.Version != uint64(i+1) || ev.Source != tt.source {
+			t.Errorf("event %d = %s v%d source %q, want %s v%d source %q", i, ev.Type, ev.Version, ev.Source, tt.typ, i+1, tt.source)
+			continue
+		}
+		if ev.Changes == nil || len(ev.Changes.Added) != tt.added || len(ev.Changes.Updated) != tt.updated || len(ev.Changes.Deleted) != tt.deleted {
+			t.Errorf("event %d changes = %+v, want %d added, %d updated, %d deleted", i, ev.Changes, tt.added, tt.updated, tt.deleted)
+		}
+	}
+}
+
+func TestMemoryStorage_WatchResync(t *testing.T) {
+	s := NewMemoryStorage()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch, _ := s.Watch(ctx)
+
+	// Nobody reads until the watcher is far behind.
+	total := uint64(watchBufferSize + watchQueueSize + 10)
+	for i := range total {
+		_ = s.Create(ctx, aRecord(fmt.Sprintf("r%d.com.", i), "192.0.2.1"))
+	}
+
+	var last uint64
+	resyncs := 0
+	for last < total {
+		ev := receive(t, ch)
+		switch {
+		case ev.Type == types.EventResync:
+			resyncs++
+			if ev.Missed == 0 || ev.Version < last || len(ev.Snapshot) != int(ev.Version) {
+				t.Fatalf("resync = v%d, %d missed, %d records, after v%d", ev.Version, ev.Missed, len(ev.Snapshot), last)
+			}
+		case ev.Version != last+1:
+			t.Fatalf("event v%d after v%d", ev.Version, last)
+		}
+		last = ev.Version
+	}
+	if resyncs != 1 {
+		t.Errorf("%d resyncs, want 1", resyncs)
+	}
+
+	// Once caught up, events flow again.
+	_ = s.Delete(ctx, "r0.com.", types.RecordTypeA)
+	if ev := receive(t, ch); ev.Type != types.EventDeleted || ev.Version != total+1 {
+		t.Errorf("event after catching up = %s v%d, want deleted v%d", ev.Type, ev.Version, total+1)
+	}
+}
+
+func TestMemoryStorage_WatchFrom(t *testing.T) {
+	s := NewMemoryStorage()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for i := range 5 {
+		_ = s.Create(ctx, aRecord(fmt.Sprintf("r%d.com.", i), "192.0.2.1"))
+	}
+
+	ch, _ := s.WatchFrom(ctx, 2)
+	_ = s.Create(ctx, aRecord("live.com.", "192.0.2.1"))
+	for want := uint64(3); want <= 6; want++ {
+		if ev := receive(t, ch); ev.Type != types.EventAdded || ev.Version != want {
+			t.Errorf("event = %s v%d, want added v%d", ev.Type, ev.Version, want)
+		}
+	}
+
+	// A version the storage never reached, as after a restart.
+	ch, _ = s.WatchFrom(ctx, 100)
+	if ev := receive(t, ch); ev.Type != types.EventResync || ev.Version != 6 || len(ev.Snapshot) != 6 {
+		t.Errorf("event = %s v%d with %d records, want a resync at v6", ev.Type, ev.Version, len(ev.Snapshot))
+	}
+}
+
+func TestMemoryStorage_WatchFromTrimmedLog(t *testing.T) {
+	s := NewMemoryStorage()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for i := range 2 * eventLogSize {
+		_ = s.Create(ctx, aRecord(fmt.Sprintf("r%d.com.", i), "192.0.2.1"))
+	}
+
+	ch, _ := s.WatchFrom(ctx, 1)
+	ev := receive(t, ch)
+	if ev.Type != types.EventResync || ev.Missed != 2*eventLogSize-1 {
+		t.Errorf("event = %s with %d missed, want a resync replacing %d", ev.Type, ev.Missed, 2*eventLogSize-1)
+	}
+}
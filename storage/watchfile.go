@@ -0,0 +1,80 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// watchDebounce coalesces the burst of events a single save produces.
+const watchDebounce = 100 * time.Millisecond
+
+// WatchFiles uses fsnotify to watch the given files and calls onChange,
+// debounced, after any of them is written or (re)created. The parent
+// directories are watched so atomic rename-based writes are caught. It
+// blocks until ctx is cancelled.
+func WatchFiles(ctx context.Context, paths []string, onChange func()) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("create fsnotify watcher: %w", err)
+	}
+	defer watcher.Close()
+
+	watched := make(map[string]bool, len(paths))
+	dirs := make(map[string]bool)
+	for _, p := range paths {
+		abs, err := filepath.Abs(p)
+		if err != nil {
+			return fmt.Errorf("resolve %s: %w", p, err)
+		}
+		watched[abs] = true
+		dir := filepath.Dir(abs)
+		if dirs[dir] {
+			continue
+		}
+		if err := watcher.Add(dir); err != nil {
+			return fmt.Errorf("watch directory %s: %w", dir, err)
+		}
+		dirs[dir] = true
+	}
+
+	// Debounce timer to coalesce rapid writes.
+	var debounce *time.Timer
+
+	for {
+		select {
+		case <-ctx.Done():
+			if debounce != nil {
+				debounce.Stop()
+			}
+			return ctx.Err()
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			// Only react to writes/creates for our specific files.
+			absEvent, _ := filepath.Abs(event.Name)
+			if !watched[absEvent] {
+				continue
+			}
+			if event.Op&(fsnotify.Write|fsnotify.Create) == 0 {
+				continue
+			}
+
+			// Debounce: wait a short period before reloading.
+			if debounce != nil {
+				debounce.Stop()
+			}
+			debounce = time.AfterFunc(watchDebounce, onChange)
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			slog.Warn("fsnotify error", "err", err)
+		}
+	}
+}
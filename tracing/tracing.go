@@ -0,0 +1,113 @@
+// Package tracing configures the OpenTelemetry tracer provider used to
+// trace DNS resolution, storage calls and the HTTP management API. When
+// tracing is not configured the global no-op provider is left in place.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.37.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// InstrumentationName is the instrumentation scope of every jw238dns tracer.
+const InstrumentationName = "jabberwocky238/jw238dns"
+
+// Supported exporters for Config.Exporter.
+const (
+	ExporterNone     = "none"
+	ExporterOTLPGRPC = "otlp-grpc"
+	ExporterOTLPHTTP = "otlp-http"
+)
+
+// Config holds tracing settings.
+type Config struct {
+	Exporter    string  // "none" (default), "otlp-grpc" or "otlp-http"
+	Endpoint    string  // Collector endpoint (host:port); empty uses the OTEL_EXPORTER_OTLP_* env vars
+	Insecure    bool    // Disable TLS to the collector
+	SampleRatio float64 // Fraction of root spans sampled, in (0, 1]; 0 samples every span
+	ServiceName string  // Reported service.name; defaults to "jw238dns"
+}
+
+// Tracer returns the jw238dns tracer from the global provider.
+func Tracer() trace.Tracer {
+	return otel.Tracer(InstrumentationName)
+}
+
+// Setup installs a global tracer provider for the configured exporter and
+// returns a function that flushes and shuts it down. With the "none"
+// exporter it leaves the no-op provider in place and the returned
+// shutdown function does nothing.
+func Setup(ctx context.Context, cfg Config) (func(context.Context) error, error) {
+	noop := func(context.Context) error { return nil }
+
+	var (
+		exporter sdktrace.SpanExporter
+		err      error
+	)
+	switch cfg.Exporter {
+	case "", ExporterNone:
+		return noop, nil
+	case ExporterOTLPGRPC:
+		var opts []otlptracegrpc.Option
+		if cfg.Endpoint != "" {
+			opts = append(opts, otlptracegrpc.WithEndpoint(cfg.Endpoint))
+		}
+		if cfg.Insecure {
+			opts = append(opts, otlptracegrpc.WithInsecure())
+		}
+		exporter, err = otlptracegrpc.New(ctx, opts...)
+	case ExporterOTLPHTTP:
+		var opts []otlptracehttp.Option
+		if cfg.Endpoint != "" {
+			opts = append(opts, otlptracehttp.WithEndpoint(cfg.Endpoint))
+		}
+		if cfg.Insecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		exporter, err = otlptracehttp.New(ctx, opts...)
+	default:
+		return noop, fmt.Errorf("unknown tracing exporter %q", cfg.Exporter)
+	}
+	if err != nil {
+		return noop, fmt.Errorf("create %s exporter: %w", cfg.Exporter, err)
+	}
+
+	serviceName := cfg.ServiceName
+	if serviceName == "" {
+		serviceName = "jw238dns"
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(
+		semconv.ServiceName(serviceName),
+	))
+	if err != nil {
+		return noop, fmt.Errorf("build resource: %w", err)
+	}
+
+	sampler := sdktrace.ParentBased(sdktrace.AlwaysSample())
+	if cfg.SampleRatio > 0 && cfg.SampleRatio < 1 {
+		sampler = sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.SampleRatio))
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sampler),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	))
+
+	slog.Info("tracing enabled", "exporter", cfg.Exporter, "endpoint", cfg.Endpoint)
+	return provider.Shutdown, nil
+}
@@ -0,0 +1,41 @@
+package tracing
+
+import (
+	"context"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+)
+
+func TestSetup(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     Config
+		wantErr bool
+	}{
+		{name: "empty exporter is no-op", cfg: Config{}},
+		{name: "none exporter is no-op", cfg: Config{Exporter: ExporterNone}},
+		{name: "otlp-http", cfg: Config{Exporter: ExporterOTLPHTTP, Endpoint: "127.0.0.1:4318", Insecure: true}},
+		{name: "otlp-grpc", cfg: Config{Exporter: ExporterOTLPGRPC, Endpoint: "127.0.0.1:4317", Insecure: true, SampleRatio: 0.5}},
+		{name: "unknown exporter", cfg: Config{Exporter: "zipkin"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			prev := otel.GetTracerProvider()
+			defer otel.SetTracerProvider(prev)
+
+			shutdown, err := Setup(context.Background(), tt.cfg)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Setup() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if shutdown == nil {
+				t.Fatal("Setup() returned nil shutdown func")
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel() // don't wait on an unreachable collector
+			_ = shutdown(ctx)
+		})
+	}
+}
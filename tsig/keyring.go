@@ -0,0 +1,192 @@
+// Package tsig holds the TSIG keyring used to authenticate zone transfers,
+// NOTIFY, dynamic updates and upstream queries (RFC 8945). Keys come from
+// the configuration file, environment variables or a Kubernetes Secret.
+package tsig
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// DefaultFudge is the permitted clock skew, in seconds, written into the
+// TSIG records of outgoing messages.
+const DefaultFudge = 300
+
+// Key is a named TSIG shared secret.
+type Key struct {
+	Name      string `json:"name" yaml:"name"`           // Key name (e.g. "xfr.example.com.")
+	Algorithm string `json:"algorithm" yaml:"algorithm"` // "hmac-sha256" (default) or "hmac-sha512"
+	Secret    string `json:"secret" yaml:"secret"`       // Base64-encoded secret
+}
+
+// normalize validates k and returns it with a canonical name and
+// algorithm.
+func (k Key) normalize() (Key, error) {
+	if k.Name == "" {
+		return Key{}, fmt.Errorf("TSIG key has no name")
+	}
+	k.Name = dns.CanonicalName(k.Name)
+
+	switch dns.CanonicalName(k.Algorithm) {
+	case ".", dns.HmacSHA256:
+		k.Algorithm = dns.HmacSHA256
+	case dns.HmacSHA512:
+		k.Algorithm = dns.HmacSHA512
+	default:
+		return Key{}, fmt.Errorf("TSIG key %s: unsupported algorithm %q", k.Name, k.Algorithm)
+	}
+
+	secret, err := base64.StdEncoding.DecodeString(k.Secret)
+	if err != nil {
+		return Key{}, fmt.Errorf("TSIG key %s: invalid base64 secret: %w", k.Name, err)
+	}
+	if len(secret) == 0 {
+		return Key{}, fmt.Errorf("TSIG key %s: empty secret", k.Name)
+	}
+	return k, nil
+}
+
+// Keyring is a thread-safe set of TSIG keys. It implements
+// dns.TsigProvider, so it can be plugged into dns.Server, dns.Client and
+// dns.Transfer. Keys are grouped by source so that one source (e.g. a
+// Kubernetes Secret) can be replaced without touching the others.
+type Keyring struct {
+	fudge uint16
+
+	mu      sync.RWMutex
+	keys    map[string]Key      // canonical name -> key
+	sources map[string][]string // source -> names it provided
+}
+
+// NewKeyring creates an empty Keyring. fudge is the clock skew allowed in
+// outgoing signatures; 0 uses DefaultFudge.
+func NewKeyring(fudge uint16) *Keyring {
+	if fudge == 0 {
+		fudge = DefaultFudge
+	}
+	return &Keyring{
+		fudge:   fudge,
+		keys:    make(map[string]Key),
+		sources: make(map[string][]string),
+	}
+}
+
+// Set replaces every key previously provided by source with keys. Either
+// all keys are valid and applied, or the keyring is left unchanged.
+func (k *Keyring) Set(source string, keys []Key) error {
+	normalized := make([]Key, 0, len(keys))
+	for _, key := range keys {
+		n, err := key.normalize()
+		if err != nil {
+			return err
+		}
+		normalized = append(normalized, n)
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	for _, name := range k.sources[source] {
+		delete(k.keys, name)
+	}
+	names := make([]string, 0, len(normalized))
+	for _, key := range normalized {
+		k.keys[key.Name] = key
+		names = append(names, key.Name)
+	}
+	k.sources[source] = names
+	return nil
+}
+
+// Get returns the key with the given name.
+func (k *Keyring) Get(name string) (Key, bool) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	key, ok := k.keys[dns.CanonicalName(name)]
+	return key, ok
+}
+
+// Names returns the names of all keys, sorted.
+func (k *Keyring) Names() []string {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	names := make([]string, 0, len(k.keys))
+	for name := range k.keys {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Sign adds a TSIG record for the named key to m. The signature itself is
+// computed when m is written by a client or server using this keyring.
+func (k *Keyring) Sign(m *dns.Msg, name string) error {
+	key, ok := k.Get(name)
+	if !ok {
+		return fmt.Errorf("unknown TSIG key %q", name)
+	}
+	// Drop a TSIG left over from an earlier attempt; it must be last.
+	if m.IsTsig() != nil {
+		m.Extra = m.Extra[:len(m.Extra)-1]
+	}
+	m.SetTsig(key.Name, key.Algorithm, k.fudge, time.Now().Unix())
+	return nil
+}
+
+// Generate implements dns.TsigProvider. It fails with dns.ErrSecret for
+// unknown keys and dns.ErrKeyAlg when the algorithm does not match the
+// key's.
+func (k *Keyring) Generate(msg []byte, t *dns.TSIG) ([]byte, error) {
+	h, err := k.hash(t)
+	if err != nil {
+		return nil, err
+	}
+	h.Write(msg)
+	return h.Sum(nil), nil
+}
+
+// Verify implements dns.TsigProvider. In addition to the Generate errors
+// it returns dns.ErrSig when the MAC does not match.
+func (k *Keyring) Verify(msg []byte, t *dns.TSIG) error {
+	expected, err := k.Generate(msg, t)
+	if err != nil {
+		return err
+	}
+	mac, err := hex.DecodeString(t.MAC)
+	if err != nil || !hmac.Equal(expected, mac) {
+		return dns.ErrSig
+	}
+	return nil
+}
+
+// hash returns a keyed HMAC for the key and algorithm named in t.
+func (k *Keyring) hash(t *dns.TSIG) (hash.Hash, error) {
+	key, ok := k.Get(t.Hdr.Name)
+	if !ok {
+		return nil, dns.ErrSecret
+	}
+	if !strings.EqualFold(dns.CanonicalName(t.Algorithm), key.Algorithm) {
+		return nil, dns.ErrKeyAlg
+	}
+	secret, err := base64.StdEncoding.DecodeString(key.Secret)
+	if err != nil {
+		return nil, dns.ErrSecret
+	}
+	switch key.Algorithm {
+	case dns.HmacSHA512:
+		return hmac.New(sha512.New, secret), nil
+	default:
+		return hmac.New(sha256.New, secret), nil
+	}
+}
@@ -0,0 +1,156 @@
+package tsig
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	testSecret    = "c2VjcmV0LXNlY3JldC1zZWNyZXQ="
+	otherSecret   = "b3RoZXItb3RoZXItb3RoZXI="
+	testKeyName   = "xfr.example.com."
+	sha512KeyName = "update.example.com."
+)
+
+func TestKeyring_Set(t *testing.T) {
+	tests := []struct {
+		name    string
+		key     Key
+		wantAlg string
+		wantErr bool
+	}{
+		{name: "default algorithm", key: Key{Name: "XFR.example.com", Secret: testSecret}, wantAlg: dns.HmacSHA256},
+		{name: "sha256", key: Key{Name: testKeyName, Algorithm: "hmac-sha256", Secret: testSecret}, wantAlg: dns.HmacSHA256},
+		{name: "sha512", key: Key{Name: testKeyName, Algorithm: "HMAC-SHA512.", Secret: testSecret}, wantAlg: dns.HmacSHA512},
+		{name: "unsupported algorithm", key: Key{Name: testKeyName, Algorithm: "hmac-md5", Secret: testSecret}, wantErr: true},
+		{name: "bad base64", key: Key{Name: testKeyName, Secret: "not base64!"}, wantErr: true},
+		{name: "empty secret", key: Key{Name: testKeyName}, wantErr: true},
+		{name: "no name", key: Key{Secret: testSecret}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			k := NewKeyring(0)
+			err := k.Set("config", []Key{tt.key})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Set() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				if len(k.Names()) != 0 {
+					t.Errorf("keyring changed on error: %v", k.Names())
+				}
+				return
+			}
+			got, ok := k.Get(testKeyName)
+			if !ok {
+				t.Fatalf("Get(%q) not found", testKeyName)
+			}
+			if got.Algorithm != tt.wantAlg {
+				t.Errorf("Algorithm = %q, want %q", got.Algorithm, tt.wantAlg)
+			}
+		})
+	}
+}
+
+func TestKeyring_SetReplacesSource(t *testing.T) {
+	k := NewKeyring(0)
+	if err := k.Set("config", []Key{{Name: "a.", Secret: testSecret}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := k.Set("secret", []Key{{Name: "b.", Secret: testSecret}, {Name: "c.", Secret: testSecret}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := k.Set("secret", []Key{{Name: "d.", Secret: testSecret}}); err != nil {
+		t.Fatal(err)
+	}
+
+	got := k.Names()
+	want := []string{"a.", "d."}
+	if len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("Names() = %v, want %v", got, want)
+	}
+}
+
+// signedMsg packs a query signed with the given key and secret using the
+// library's own secret-map provider.
+func signedMsg(t *testing.T, name, alg, secret string, signed time.Time) []byte {
+	t.Helper()
+	m := new(dns.Msg)
+	m.SetQuestion("example.com.", dns.TypeSOA)
+	m.SetTsig(name, alg, 300, signed.Unix())
+	buf, _, err := dns.TsigGenerate(m, secret, "", false)
+	if err != nil {
+		t.Fatalf("TsigGenerate() error = %v", err)
+	}
+	return buf
+}
+
+func TestKeyring_Verify(t *testing.T) {
+	k := NewKeyring(0)
+	if err := k.Set("config", []Key{
+		{Name: testKeyName, Secret: testSecret},
+		{Name: sha512KeyName, Algorithm: "hmac-sha512", Secret: testSecret},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	tests := []struct {
+		name    string
+		msg     []byte
+		wantErr error
+	}{
+		{name: "valid sha256", msg: signedMsg(t, testKeyName, dns.HmacSHA256, testSecret, now)},
+		{name: "valid sha512", msg: signedMsg(t, sha512KeyName, dns.HmacSHA512, testSecret, now)},
+		{name: "unknown key", msg: signedMsg(t, "nope.example.com.", dns.HmacSHA256, testSecret, now), wantErr: dns.ErrSecret},
+		{name: "wrong algorithm", msg: signedMsg(t, testKeyName, dns.HmacSHA512, testSecret, now), wantErr: dns.ErrKeyAlg},
+		{name: "wrong secret", msg: signedMsg(t, testKeyName, dns.HmacSHA256, otherSecret, now), wantErr: dns.ErrSig},
+		{name: "clock skew", msg: signedMsg(t, testKeyName, dns.HmacSHA256, testSecret, now.Add(-time.Hour)), wantErr: dns.ErrTime},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := dns.TsigVerifyWithProvider(tt.msg, k, "", false)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("TsigVerifyWithProvider() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestKeyring_Sign(t *testing.T) {
+	k := NewKeyring(60)
+	if err := k.Set("config", []Key{{Name: sha512KeyName, Algorithm: "hmac-sha512", Secret: testSecret}}); err != nil {
+		t.Fatal(err)
+	}
+
+	m := new(dns.Msg)
+	m.SetQuestion("example.com.", dns.TypeSOA)
+	if err := k.Sign(m, "Update.Example.Com"); err != nil {
+		t.Fatalf("Sign() error = %v", err)
+	}
+	// Signing again replaces the TSIG instead of adding a second one.
+	if err := k.Sign(m, sha512KeyName); err != nil {
+		t.Fatalf("Sign() error = %v", err)
+	}
+	if len(m.Extra) != 1 {
+		t.Fatalf("len(Extra) = %d, want 1", len(m.Extra))
+	}
+	rr := m.IsTsig()
+	if rr == nil || rr.Algorithm != dns.HmacSHA512 || rr.Fudge != 60 {
+		t.Fatalf("TSIG = %v, want hmac-sha512 with fudge 60", rr)
+	}
+
+	buf, _, err := dns.TsigGenerateWithProvider(m, k, "", false)
+	if err != nil {
+		t.Fatalf("TsigGenerateWithProvider() error = %v", err)
+	}
+	if err := dns.TsigVerifyWithProvider(buf, k, "", false); err != nil {
+		t.Errorf("signed message does not verify: %v", err)
+	}
+
+	if err := k.Sign(new(dns.Msg), "missing."); err == nil {
+		t.Error("Sign() with unknown key succeeded")
+	}
+}
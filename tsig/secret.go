@@ -0,0 +1,142 @@
+package tsig
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"gopkg.in/yaml.v3"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+)
+
+// DefaultSecretDataKey is the Secret data key holding the keys when none
+// is configured.
+const DefaultSecretDataKey = "keys.yaml"
+
+// secretYAML is the structure stored under the Secret's data key.
+type secretYAML struct {
+	Keys []Key `yaml:"keys"`
+}
+
+// SecretWatcher loads TSIG keys from a Kubernetes Secret into a Keyring
+// and keeps them in sync, so keys can be rotated without a restart. The
+// Secret's data key holds YAML of the form:
+//
+//	keys:
+//	  - name: xfr.example.com.
+//	    algorithm: hmac-sha256
+//	    secret: <base64>
+type SecretWatcher struct {
+	client    kubernetes.Interface
+	namespace string
+	name      string
+	dataKey   string
+	keyring   *Keyring
+}
+
+// NewSecretWatcher creates a SecretWatcher for the named Secret. An empty
+// dataKey uses DefaultSecretDataKey.
+func NewSecretWatcher(client kubernetes.Interface, namespace, name, dataKey string, keyring *Keyring) *SecretWatcher {
+	if dataKey == "" {
+		dataKey = DefaultSecretDataKey
+	}
+	return &SecretWatcher{
+		client:    client,
+		namespace: namespace,
+		name:      name,
+		dataKey:   dataKey,
+		keyring:   keyring,
+	}
+}
+
+// source identifies the watcher's keys in the keyring.
+func (w *SecretWatcher) source() string {
+	return fmt.Sprintf("secret/%s/%s", w.namespace, w.name)
+}
+
+// Load reads the Secret once and replaces the keys it provides.
+func (w *SecretWatcher) Load(ctx context.Context) error {
+	secret, err := w.client.CoreV1().Secrets(w.namespace).Get(ctx, w.name, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("get secret: %w", err)
+	}
+	return w.apply(secret)
+}
+
+// Watch keeps the keyring in sync with the Secret until ctx is cancelled.
+// Watch errors are retried after a short delay.
+func (w *SecretWatcher) Watch(ctx context.Context) error {
+	for {
+		if err := w.watchOnce(ctx); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			slog.Warn("TSIG secret watch error, retrying", "err", err)
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(5 * time.Second):
+			}
+			continue
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+}
+
+// watchOnce runs a single watch session.
+func (w *SecretWatcher) watchOnce(ctx context.Context) error {
+	watcher, err := w.client.CoreV1().Secrets(w.namespace).Watch(ctx, metav1.ListOptions{
+		FieldSelector: fmt.Sprintf("metadata.name=%s", w.name),
+	})
+	if err != nil {
+		return fmt.Errorf("watch secret: %w", err)
+	}
+	defer watcher.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case event, ok := <-watcher.ResultChan():
+			if !ok {
+				return nil
+			}
+			secret, ok := event.Object.(*corev1.Secret)
+			if !ok {
+				continue
+			}
+			switch event.Type {
+			case watch.Added, watch.Modified:
+				if err := w.apply(secret); err != nil {
+					slog.Error("load TSIG keys from secret", "err", err)
+				}
+			case watch.Deleted:
+				_ = w.keyring.Set(w.source(), nil)
+				slog.Warn("TSIG secret deleted, keys removed", "secret", w.source())
+			}
+		}
+	}
+}
+
+// apply parses the Secret and replaces the watcher's keys.
+func (w *SecretWatcher) apply(secret *corev1.Secret) error {
+	data, ok := secret.Data[w.dataKey]
+	if !ok {
+		return fmt.Errorf("secret %s has no key %q", w.source(), w.dataKey)
+	}
+	var parsed secretYAML
+	if err := yaml.Unmarshal(data, &parsed); err != nil {
+		return fmt.Errorf("parse secret %s: %w", w.source(), err)
+	}
+	if err := w.keyring.Set(w.source(), parsed.Keys); err != nil {
+		return err
+	}
+	slog.Info("TSIG keys loaded from secret", "secret", w.source(), "keys", len(parsed.Keys))
+	return nil
+}
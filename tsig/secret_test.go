@@ -0,0 +1,115 @@
+package tsig
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func testSecretObject(keys string) *corev1.Secret {
+	return &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "jw238dns-tsig", Namespace: "default"},
+		Data:       map[string][]byte{DefaultSecretDataKey: []byte(keys)},
+	}
+}
+
+func TestSecretWatcher_Load(t *testing.T) {
+	tests := []struct {
+		name      string
+		secret    *corev1.Secret
+		wantErr   bool
+		wantNames []string
+	}{
+		{
+			name:      "valid keys",
+			secret:    testSecretObject("keys:\n  - name: a.example.com.\n    secret: " + testSecret + "\n  - name: b.example.com.\n    algorithm: hmac-sha512\n    secret: " + testSecret + "\n"),
+			wantNames: []string{"a.example.com.", "b.example.com."},
+		},
+		{
+			name:    "invalid key",
+			secret:  testSecretObject("keys:\n  - name: a.example.com.\n    secret: '!!'\n"),
+			wantErr: true,
+		},
+		{
+			name: "missing data key",
+			secret: &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Name: "jw238dns-tsig", Namespace: "default"},
+				Data:       map[string][]byte{"other": nil},
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := fake.NewSimpleClientset(tt.secret)
+			keyring := NewKeyring(0)
+			w := NewSecretWatcher(client, "default", "jw238dns-tsig", "", keyring)
+
+			err := w.Load(context.Background())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Load() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			got := keyring.Names()
+			if len(got) != len(tt.wantNames) {
+				t.Fatalf("Names() = %v, want %v", got, tt.wantNames)
+			}
+			for i := range got {
+				if got[i] != tt.wantNames[i] {
+					t.Errorf("Names()[%d] = %q, want %q", i, got[i], tt.wantNames[i])
+				}
+			}
+		})
+	}
+}
+
+func TestSecretWatcher_WatchRotatesKeys(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	keyring := NewKeyring(0)
+	if err := keyring.Set("config", []Key{{Name: "static.", Secret: testSecret}}); err != nil {
+		t.Fatal(err)
+	}
+	w := NewSecretWatcher(client, "default", "jw238dns-tsig", "", keyring)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { _ = w.Watch(ctx) }()
+	// Give the watcher goroutine time to register the K8s watch.
+	time.Sleep(100 * time.Millisecond)
+
+	secrets := client.CoreV1().Secrets("default")
+	if _, err := secrets.Create(ctx, testSecretObject("keys:\n  - name: old.\n    secret: "+testSecret+"\n"), metav1.CreateOptions{}); err != nil {
+		t.Fatalf("create secret: %v", err)
+	}
+	waitForKey(t, keyring, "old.", true)
+
+	if _, err := secrets.Update(ctx, testSecretObject("keys:\n  - name: new.\n    secret: "+testSecret+"\n"), metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("update secret: %v", err)
+	}
+	waitForKey(t, keyring, "new.", true)
+	waitForKey(t, keyring, "old.", false)
+
+	if err := secrets.Delete(ctx, "jw238dns-tsig", metav1.DeleteOptions{}); err != nil {
+		t.Fatalf("delete secret: %v", err)
+	}
+	waitForKey(t, keyring, "new.", false)
+
+	if _, ok := keyring.Get("static."); !ok {
+		t.Error("key from another source was removed")
+	}
+}
+
+func waitForKey(t *testing.T, keyring *Keyring, name string, want bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if _, ok := keyring.Get(name); ok == want {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("key %q present = %v, want %v", name, !want, want)
+}
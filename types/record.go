@@ -4,7 +4,9 @@ package types
 
 import (
 	"errors"
+	"maps"
 	"net"
+	"time"
 )
 
 // RecordType represents a DNS record type.
@@ -48,6 +50,73 @@ type DNSRecord struct {
 	Type  RecordType `json:"type" yaml:"type"`   // Record type (A, AAAA, CNAME, etc.)
 	TTL   uint32     `json:"ttl" yaml:"ttl"`     // Time to live in seconds
 	Value []string   `json:"value" yaml:"value"` // Record values (can be multiple)
+
+	// Meta is optional provenance metadata. It is stored with the record
+	// but never served in DNS answers.
+	Meta *RecordMeta `json:"meta,omitempty" yaml:"meta,omitempty"`
+}
+
+// Record sources, the writers that set RecordMeta.Source. Records written
+// by hand to a records file or ConfigMap carry no source.
+const (
+	SourceHTTP       = "http"       // The HTTP API, including ACME clients
+	SourceUpdate     = "rfc2136"    // RFC 2136 dynamic updates
+	SourceKubernetes = "kubernetes" // Kubernetes Service, Ingress and Gateway discovery
+)
+
+// RecordMeta records who manages a record and where it came from.
+type RecordMeta struct {
+	Owner     string            `json:"owner,omitempty" yaml:"owner,omitempty"`   // Controller or user managing the record
+	Source    string            `json:"source,omitempty" yaml:"source,omitempty"` // Writer that created the record, e.g. SourceHTTP
+	CreatedAt time.Time         `json:"created_at,omitzero" yaml:"created_at,omitempty"`
+	UpdatedAt time.Time         `json:"updated_at,omitzero" yaml:"updated_at,omitempty"`
+	Labels    map[string]string `json:"labels,omitempty" yaml:"labels,omitempty"`
+	Comment   string            `json:"comment,omitempty" yaml:"comment,omitempty"`
+
+	// ExpiresAt, if set, is when the record deletes itself.
+	ExpiresAt time.Time `json:"expires_at,omitzero" yaml:"expires_at,omitempty"`
+}
+
+// Owner returns the record's owner, or "" if it has none.
+func (r *DNSRecord) Owner() string {
+	if r.Meta == nil {
+		return ""
+	}
+	return r.Meta.Owner
+}
+
+// Clone returns a deep copy of m; nil stays nil.
+func (m *RecordMeta) Clone() *RecordMeta {
+	if m == nil {
+		return nil
+	}
+	c := *m
+	c.Labels = maps.Clone(m.Labels)
+	return &c
+}
+
+// Equal reports whether m and o hold the same metadata. A nil RecordMeta
+// equals an empty one.
+func (m *RecordMeta) Equal(o *RecordMeta) bool {
+	var zero RecordMeta
+	if m == nil {
+		m = &zero
+	}
+	if o == nil {
+		o = &zero
+	}
+	return m.Owner == o.Owner && m.Source == o.Source && m.Comment == o.Comment &&
+		m.CreatedAt.Equal(o.CreatedAt) && m.UpdatedAt.Equal(o.UpdatedAt) &&
+		m.ExpiresAt.Equal(o.ExpiresAt) && maps.Equal(m.Labels, o.Labels)
+}
+
+// Expires returns when the record expires, or the zero time if it does
+// not.
+func (r *DNSRecord) Expires() time.Time {
+	if r.Meta == nil {
+		return time.Time{}
+	}
+	return r.Meta.ExpiresAt
 }
 
 // QueryInfo holds parsed information from a DNS query.
@@ -79,12 +148,40 @@ const (
 	EventUpdated  EventType = "updated"
 	EventDeleted  EventType = "deleted"
 	EventReloaded EventType = "reloaded"
+
+	// EventResync replaces events a watcher missed: Snapshot holds every
+	// record as of Version, and Missed counts the events it replaces.
+	EventResync EventType = "resync"
 )
 
 // StorageEvent represents a change notification from storage.
 type StorageEvent struct {
 	Type   EventType
 	Record *DNSRecord
+
+	// Version is the storage version after the change, or that of
+	// Snapshot for EventResync. Zero if the storage does not version its
+	// events.
+	Version uint64
+
+	// Changes is the change set, for EventReloaded and, with one record,
+	// for single-record events. Nil for EventResync and from storages
+	// that do not report change sets.
+	Changes *RecordChanges
+
+	// Source names the source whose synthesized records changed, for
+	// changes made by MemoryStorage.ApplySource. Such changes are not
+	// persisted.
+	Source string
+
+	Missed   int          // Events replaced by an EventResync
+	Snapshot []*DNSRecord // Every record, for EventResync
+
+	// Origin identifies the storage call that produced the event, so
+	// subscribers can link their own work (e.g. persistence) to the
+	// originating request. It is opaque here; the storage package sets
+	// and reads it.
+	Origin any
 }
 
 // Sentinel errors for DNS operations.
@@ -96,4 +193,6 @@ var (
 	ErrInvalidName       = errors.New("invalid domain name")
 	ErrReloadFailed      = errors.New("hot reload failed")
 	ErrStorageLocked     = errors.New("storage is locked during update")
+	ErrNotLeader         = errors.New("not the leader replica")
+	ErrRecordOwned       = errors.New("record is owned by another owner")
 )
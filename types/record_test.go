@@ -2,6 +2,7 @@ package types
 
 import (
 	"testing"
+	"time"
 )
 
 func TestRecordType_IsValid(t *testing.T) {
@@ -80,6 +81,7 @@ func TestEventType_Constants(t *testing.T) {
 		{name: "updated", et: EventUpdated, expected: "updated"},
 		{name: "deleted", et: EventDeleted, expected: "deleted"},
 		{name: "reloaded", et: EventReloaded, expected: "reloaded"},
+		{name: "resync", et: EventResync, expected: "resync"},
 	}
 
 	for _, tt := range tests {
@@ -117,3 +119,38 @@ func TestSentinelErrors(t *testing.T) {
 		})
 	}
 }
+
+func TestRecordMeta_EqualAndClone(t *testing.T) {
+	created := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	m := &RecordMeta{Owner: "ops", CreatedAt: created, Labels: map[string]string{"env": "prod"}}
+
+	c := m.Clone()
+	if !m.Equal(c) {
+		t.Fatalf("Clone() = %+v, want equal to %+v", c, m)
+	}
+	c.Labels["env"] = "dev"
+	if m.Labels["env"] != "prod" {
+		t.Error("Clone() shares labels with the original")
+	}
+	if m.Equal(c) {
+		t.Error("Equal() ignores labels")
+	}
+	if !(*RecordMeta)(nil).Equal(&RecordMeta{}) {
+		t.Error("nil RecordMeta does not equal an empty one")
+	}
+	if (*RecordMeta)(nil).Clone() != nil {
+		t.Error("Clone() of nil is not nil")
+	}
+	if !m.Equal(&RecordMeta{Owner: "ops", CreatedAt: created.In(time.FixedZone("CET", 3600)), Labels: map[string]string{"env": "prod"}}) {
+		t.Error("Equal() compares time zones rather than instants")
+	}
+	if (&DNSRecord{}).Owner() != "" || (&DNSRecord{Meta: m}).Owner() != "ops" {
+		t.Error("Owner() mismatch")
+	}
+	if !(&DNSRecord{}).Expires().IsZero() || !(&DNSRecord{Meta: &RecordMeta{ExpiresAt: created}}).Expires().Equal(created) {
+		t.Error("Expires() mismatch")
+	}
+	if m.Equal(&RecordMeta{Owner: "ops", CreatedAt: created, Labels: map[string]string{"env": "prod"}, ExpiresAt: created}) {
+		t.Error("Equal() ignores the expiry")
+	}
+}